@@ -2,6 +2,7 @@ package accounts
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/ekiru/kanna/models"
 	"github.com/ekiru/kanna/routes"
@@ -23,7 +24,10 @@ func authGet(w http.ResponseWriter, r *http.Request) {
 		}
 		authLoggedInTemplate.Render(w, r, data{User: user})
 	} else {
-		authShowForm.ServeHTTP(w, r)
+		type data struct {
+			Next string
+		}
+		authShowForm.Render(w, r, data{Next: r.URL.Query().Get("next")})
 	}
 }
 
@@ -45,7 +49,17 @@ func authPost(w http.ResponseWriter, r *http.Request) {
 	sess := sessions.Get(r.Context())
 	sess.User = user
 	sess.Save()
-	http.Redirect(w, r, "/auth", http.StatusSeeOther)
+	http.Redirect(w, r, localRedirect(r.PostForm.Get("next"), "/auth"), http.StatusSeeOther)
+}
+
+// localRedirect returns next if it is a path on this server and
+// fallback otherwise, so that login forms can't be used to redirect
+// to other sites.
+func localRedirect(next, fallback string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return fallback
 }
 
 func authLogout(w http.ResponseWriter, r *http.Request) {
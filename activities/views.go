@@ -0,0 +1,36 @@
+// The activities package serves the activities that actors on this
+// server have performed.
+package activities
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the routes related to activities on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{"activity", routes.Param("activity")}, http.HandlerFunc(showActivity))
+}
+
+func showActivity(w http.ResponseWriter, r *http.Request) {
+	activityKey := r.Context().Value(routes.Param("activity")).(string)
+	activityId := config.Get(r.Context()).URL("activity", activityKey).String()
+	if activity, err := models.ActivityById(r.Context(), activityId); err == nil {
+		if visible, err := models.CanViewActivity(r.Context(), sessions.Get(r.Context()).Actor(), activity); err != nil {
+			panic(routes.Error(err))
+		} else if !visible {
+			panic(routes.NotFound)
+		}
+		views.ActivityStream(activity).ServeHTTP(w, r)
+	} else if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else {
+		panic(routes.Error(err))
+	}
+}
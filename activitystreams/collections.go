@@ -0,0 +1,82 @@
+package activitystreams
+
+import "net/url"
+
+// An OrderedCollection represents an OrderedCollection or an
+// OrderedCollectionPage as defined in the Activity Streams vocabulary
+// (https://www.w3.org/TR/activitystreams-vocabulary/#dfn-orderedcollection).
+type OrderedCollection struct {
+	id *url.URL
+	// PartOf is the collection that a page belongs to. It is nil
+	// for collections that are not pages.
+	PartOf *url.URL
+	// TotalItems is the number of items in the whole collection.
+	// It is only included for collections that are not pages.
+	TotalItems int
+	// First is the first page of the collection.
+	First *url.URL
+	// Next and Prev are the pages following and preceding a page.
+	Next, Prev *url.URL
+	// Items holds the items in the collection or page. It may be
+	// nil for a collection whose items are only available through
+	// its pages.
+	Items []interface{}
+}
+
+// NewOrderedCollection creates an OrderedCollection with an ID.
+func NewOrderedCollection(id *url.URL) *OrderedCollection {
+	return &OrderedCollection{id: id}
+}
+
+// NewOrderedCollectionPage creates a page of a collection.
+func NewOrderedCollectionPage(id *url.URL, partOf *url.URL) *OrderedCollection {
+	return &OrderedCollection{id: id, PartOf: partOf}
+}
+
+func (c *OrderedCollection) ID() *url.URL {
+	return c.id
+}
+
+func (c *OrderedCollection) Types() []string {
+	if c.PartOf != nil {
+		return []string{"OrderedCollectionPage"}
+	}
+	return []string{"OrderedCollection"}
+}
+
+func (c *OrderedCollection) HasType(t string) bool {
+	return t == c.Types()[0]
+}
+
+func (c *OrderedCollection) Props() []string {
+	if c.PartOf != nil {
+		return []string{"partOf", "next", "prev", "orderedItems"}
+	}
+	props := []string{"totalItems", "first"}
+	if c.Items != nil {
+		props = append(props, "orderedItems")
+	}
+	return props
+}
+
+func (c *OrderedCollection) GetProp(prop string) (interface{}, bool) {
+	switch prop {
+	case "partOf":
+		return c.PartOf, true
+	case "totalItems":
+		return c.TotalItems, true
+	case "first":
+		return c.First, true
+	case "next":
+		return c.Next, true
+	case "prev":
+		return c.Prev, true
+	case "orderedItems":
+		if c.Items == nil {
+			return []interface{}{}, true
+		}
+		return c.Items, true
+	default:
+		return nil, false
+	}
+}
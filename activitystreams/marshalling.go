@@ -3,6 +3,7 @@ package activitystreams
 import (
 	"encoding/json"
 	"net/url"
+	"reflect"
 )
 
 // ContentType is the defined MIME content-type for Activity Streams
@@ -24,19 +25,61 @@ func Marshal(obj Object) ([]byte, error) {
 		return nil, err
 	}
 	serMap := ser.(map[string]interface{})
-	serMap["@context"] = "https://www.w3.org/ns/activitystreams"
+	serMap["@context"] = jsonLDContext
 	return json.Marshal(serMap)
 }
 
+// jsonLDContext is the @context of serialized objects. Besides the
+// Activity Streams vocabulary, it defines the sensitive property,
+// an extension used by Mastodon and other servers to mark posts whose
+// attachments shouldn't be shown without warning.
+var jsonLDContext = []interface{}{
+	"https://www.w3.org/ns/activitystreams",
+	map[string]string{
+		"sensitive": "as:sensitive",
+	},
+}
+
+// hiddenProps lists properties that are never included when an
+// object is serialized. The bto and bcc properties address an object
+// to recipients without revealing them, so servers must remove them
+// before sharing the object.
+var hiddenProps = map[string]bool{
+	"bto": true,
+	"bcc": true,
+}
+
+// isNil reports whether a property value is nil or a nil pointer.
+// Properties with nil values are omitted when serializing an Object.
+func isNil(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	v := reflect.ValueOf(val)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 func serializeValue(val interface{}) (interface{}, error) {
 	switch val := val.(type) {
 	case string:
 		return val, nil
+	case *string:
+		return *val, nil
+	case int:
+		return val, nil
+	case bool:
+		return val, nil
 	case *url.URL:
 		return val.String(), nil
+	case []*url.URL:
+		vals := make([]interface{}, len(val))
+		for i, u := range val {
+			vals[i] = u.String()
+		}
+		return vals, nil
 	case []interface{}:
 		vals := make([]interface{}, 0, len(val))
-		for elem := range val {
+		for _, elem := range val {
 			ser, err := serializeValue(elem)
 			if err != nil {
 				return nil, err
@@ -54,7 +97,13 @@ func serializeValue(val interface{}) (interface{}, error) {
 			ser["type"] = types
 		}
 		for _, name := range val.Props() {
+			if hiddenProps[name] {
+				continue
+			}
 			propVal, _ := val.GetProp(name)
+			if isNil(propVal) {
+				continue
+			}
 			serVal, err := serializeValue(propVal)
 			if err != nil {
 				return nil, err
@@ -62,6 +111,10 @@ func serializeValue(val interface{}) (interface{}, error) {
 			ser[name] = serVal
 		}
 		return ser, nil
+	case json.Marshaler:
+		// Values that aren't Objects, such as the source of a
+		// post, can define their own serialization.
+		return val, nil
 	case *Link:
 		ser := map[string]interface{}{
 			"type": val.Type,
@@ -76,6 +129,19 @@ func serializeValue(val interface{}) (interface{}, error) {
 		}
 		return ser, nil
 	default:
+		// Other kinds of slices, such as the tags of a post, are
+		// serialized element by element.
+		if v := reflect.ValueOf(val); v.Kind() == reflect.Slice {
+			vals := make([]interface{}, v.Len())
+			for i := range vals {
+				ser, err := serializeValue(v.Index(i).Interface())
+				if err != nil {
+					return nil, err
+				}
+				vals[i] = ser
+			}
+			return vals, nil
+		}
 		panic("unrecognized value type")
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/models"
+)
+
+// actorRefresh fetches actors on other servers again, so that changes
+// to their names, inboxes or keys are picked up. The actors are given
+// by their IDs or handles, or with -all, are all of the actors on other
+// servers that are known.
+func actorRefresh(e *env, args []string) error {
+	flags := flag.NewFlagSet("actor refresh", flag.ContinueOnError)
+	all := flags.Bool("all", false, "refresh all actors on other servers")
+	if err := parseFlags(flags, args, 0, -1); err != nil {
+		return err
+	}
+	if *all == (flags.NArg() != 0) {
+		return errUsage
+	}
+	var ids []*url.URL
+	if *all {
+		known, err := models.ActorIds(e.ctx)
+		if err != nil {
+			return err
+		}
+		for _, id := range known {
+			if !e.cfg.IsLocal(id) {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		for _, arg := range flags.Args() {
+			id, err := actorId(e, arg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+	}
+	failed := 0
+	for _, id := range ids {
+		if _, err := federation.FetchActor(e.ctx, id); err != nil {
+			fmt.Fprintf(e.out, "%s: %v\n", id, err)
+			failed++
+		} else {
+			fmt.Fprintf(e.out, "%s: refreshed\n", id)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d actors couldn't be refreshed", failed, len(ids))
+	}
+	return nil
+}
+
+// actorId finds the ID of the actor on another server with an ID or a
+// handle.
+func actorId(e *env, arg string) (*url.URL, error) {
+	var id *url.URL
+	if strings.HasPrefix(arg, "https://") || strings.HasPrefix(arg, "http://") {
+		var err error
+		if id, err = url.Parse(arg); err != nil {
+			return nil, err
+		}
+	} else {
+		actor, err := federation.Lookup(e.ctx, strings.TrimPrefix(arg, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("looking up %s: %v", arg, err)
+		}
+		id = actor.ID()
+	}
+	if e.cfg.IsLocal(id) {
+		return nil, fmt.Errorf("%s is on this server", arg)
+	}
+	return id, nil
+}
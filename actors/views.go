@@ -3,23 +3,34 @@ package actors
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 
 	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/federation"
 	"github.com/ekiru/kanna/models"
 	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/timelines"
 	"github.com/ekiru/kanna/views"
 )
 
 // AddRoutes registers the routes related to actors on the Router.
 func AddRoutes(router *routes.Router) {
 	router.Route([]interface{}{"actor", routes.Param("actor")}, actorParam(http.HandlerFunc(showActor)))
+	router.Route([]interface{}{routes.Method{"POST"}, "actor", routes.Param("actor"), "inbox"}, actorParam(http.HandlerFunc(postInbox)))
+	router.Route([]interface{}{"actor", routes.Param("actor"), "outbox"}, actorParam(http.HandlerFunc(showOutbox)))
+	router.Route([]interface{}{"actor", routes.Param("actor"), "followers"}, actorParam(http.HandlerFunc(showFollowers)))
 }
 
 func actorParam(handler http.Handler) http.Handler {
 	return views.MapParam(handler, "actor", func(ctx context.Context, actorKey interface{}) interface{} {
-		actorId := fmt.Sprintf("https://faew.ink/actor/%s", actorKey.(string))
+		actorId := config.Get(ctx).URL("actor", actorKey.(string)).String()
 		if actor, err := models.ActorById(ctx, actorId); err == nil {
 			return actor
 		} else if err == sql.ErrNoRows {
@@ -30,22 +41,129 @@ func actorParam(handler http.Handler) http.Handler {
 	})
 }
 
+// profilePageSize is the number of posts in each page of an actor's
+// profile.
+const profilePageSize = 20
+
 var showActorTemplate = views.HtmlTemplate("actors/show.html")
 
 func showActor(w http.ResponseWriter, r *http.Request) {
 	type data struct {
-		Actor *models.Actor
-		Posts []*models.Post
+		Actor        *models.Actor
+		Entries      []*models.TimelineEntry
+		Older, Newer string
 	}
 	actor := r.Context().Value(routes.Param("actor")).(*models.Actor)
 	switch r.Header.Get("Accept") {
 	case activitystreams.ContentType:
 		views.ActivityStream(actor).ServeHTTP(w, r)
 	default:
-		if posts, err := models.PostsByActor(r.Context(), actor); err == nil {
-			showActorTemplate.Render(w, r, data{Actor: actor, Posts: posts})
+		viewer := sessions.Get(r.Context()).Actor()
+		query := r.URL.Query()
+		page := models.Page{MaxID: query.Get("max_id"), MinID: query.Get("min_id"), Limit: profilePageSize}
+		if entries, err := models.ProfileTimeline(r.Context(), actor, viewer, page); err == nil {
+			d := data{Actor: actor, Entries: entries}
+			d.Older, d.Newer = timelines.PageLinks(entries, profilePageSize, page.MaxID != "" || page.MinID != "")
+			showActorTemplate.Render(w, r, d)
 		} else {
 			panic(routes.Error(err))
 		}
 	}
 }
+
+// outboxPageSize is the number of activities in each page of an
+// outbox.
+const outboxPageSize = 20
+
+func showOutbox(w http.ResponseWriter, r *http.Request) {
+	actor := r.Context().Value(routes.Param("actor")).(*models.Actor)
+	viewer := sessions.Get(r.Context()).Actor()
+	query := r.URL.Query()
+	pageURL := func(param, id string) *url.URL {
+		u := *actor.Outbox
+		q := url.Values{"page": {"true"}}
+		if param != "" {
+			q.Set(param, id)
+		}
+		u.RawQuery = q.Encode()
+		return &u
+	}
+	if query.Get("page") == "" {
+		outbox := activitystreams.NewOrderedCollection(actor.Outbox)
+		count, err := models.CountOutboxActivities(r.Context(), actor, viewer)
+		if err != nil {
+			panic(routes.Error(err))
+		}
+		outbox.TotalItems = count
+		outbox.First = pageURL("", "")
+		views.ActivityStream(outbox).ServeHTTP(w, r)
+		return
+	}
+	activities, err := models.OutboxActivities(r.Context(), actor, viewer, models.Page{
+		MaxID: query.Get("max_id"),
+		MinID: query.Get("min_id"),
+		Limit: outboxPageSize,
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	self := *actor.Outbox
+	self.RawQuery = r.URL.RawQuery
+	page := activitystreams.NewOrderedCollectionPage(&self, actor.Outbox)
+	page.Items = make([]interface{}, len(activities))
+	for i, activity := range activities {
+		page.Items[i] = activity
+	}
+	if len(activities) > 0 {
+		page.Prev = pageURL("min_id", activities[0].ID().String())
+		if len(activities) == outboxPageSize {
+			page.Next = pageURL("max_id", activities[len(activities)-1].ID().String())
+		}
+	}
+	views.ActivityStream(page).ServeHTTP(w, r)
+}
+
+// postInbox receives an activity delivered to an actor's inbox by
+// another server.
+func postInbox(w http.ResponseWriter, r *http.Request) {
+	var activity federation.Object
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, federation.MaxObjectSize))
+	if err == nil {
+		err = json.Unmarshal(body, &activity)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid activity"))
+		return
+	}
+	signer, err := federation.VerifyRequest(r.Context(), r, body)
+	if err != nil && err != federation.ErrUnsigned {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("the signature could not be verified"))
+		return
+	}
+	if err := federation.Receive(r.Context(), activity, signer); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the activity could not be processed"))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func showFollowers(w http.ResponseWriter, r *http.Request) {
+	actor := r.Context().Value(routes.Param("actor")).(*models.Actor)
+	if actor.Followers == nil {
+		panic(routes.NotFound)
+	}
+	count, err := models.CountFollowers(r.Context(), actor)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	// Who follows whom isn't shared, only how many followers there
+	// are.
+	followers := activitystreams.NewOrderedCollection(actor.Followers)
+	followers.TotalItems = count
+	views.ActivityStream(followers).ServeHTTP(w, r)
+}
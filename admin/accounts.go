@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+var accountsTemplate = views.HtmlTemplate("admin/accounts.html")
+
+// A managedAccount is an account as it is listed for moderators.
+type managedAccount struct {
+	*models.Account
+	Suspended, Silenced bool
+	// Manageable is true if the user may act on the account.
+	Manageable bool
+}
+
+type accountsData struct {
+	Accounts []*managedAccount
+	Roles    []string
+	// Admin is true if the user is an administrator, who may reset
+	// passwords, log accounts out and change their roles.
+	Admin bool
+	// Message tells the user the result of the last action, such as
+	// a new password, or why it couldn't be taken.
+	Message   string
+	CSRFToken string
+}
+
+func renderAccounts(w http.ResponseWriter, r *http.Request, status int, message string) {
+	ctx := r.Context()
+	accounts, err := models.Accounts(ctx)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	user := currentUser(r)
+	d := accountsData{
+		Roles:     models.Roles,
+		Admin:     user.HasRole(models.AdminRole),
+		Message:   message,
+		CSRFToken: sessions.CSRFToken(ctx),
+	}
+	for _, account := range accounts {
+		managed := &managedAccount{Account: account, Manageable: canManage(user, account)}
+		if managed.Suspended, err = models.IsActorSuspended(ctx, account.Actor.ID()); err != nil {
+			panic(routes.Error(err))
+		}
+		if managed.Silenced, err = models.IsActorSilenced(ctx, account.Actor.ID()); err != nil {
+			panic(routes.Error(err))
+		}
+		d.Accounts = append(d.Accounts, managed)
+	}
+	accountsTemplate.RenderStatus(w, r, status, d)
+}
+
+func showAccounts(w http.ResponseWriter, r *http.Request) {
+	renderAccounts(w, r, http.StatusOK, "")
+}
+
+// canManage reports whether a user may act on an account. Nobody may
+// act on their own account, and only administrators may act on the
+// accounts of moderators and administrators.
+func canManage(user, account *models.Account) bool {
+	return user.Username != account.Username &&
+		(user.HasRole(models.AdminRole) || !account.HasRole(models.ModeratorRole))
+}
+
+// accountParam retrieves the account whose username is in the route,
+// after checking the form that was submitted to act on it. If the user
+// may not act on the account, the request is refused and accountParam
+// returns nil.
+func accountParam(w http.ResponseWriter, r *http.Request) *models.Account {
+	if !checkForm(w, r) {
+		return nil
+	}
+	username := r.Context().Value(routes.Param("username")).(string)
+	account, err := models.ManagedAccount(r.Context(), username)
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	if !canManage(currentUser(r), account) {
+		renderAccounts(w, r, http.StatusForbidden, "You can't do that to "+account.Username+".")
+		return nil
+	}
+	return account
+}
+
+// accountAction returns a handler that acts on an account and records
+// the action in the moderation log.
+func accountAction(action string, act func(ctx context.Context, account *models.Account) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := accountParam(w, r)
+		if account == nil {
+			return
+		}
+		if err := act(r.Context(), account); err != nil {
+			panic(routes.Error(err))
+		}
+		logModeration(r, action, account.Actor.ID(), nil)
+		http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+	}
+}
+
+// logout logs an account out of all of its sessions and revokes the
+// access tokens of the applications acting as it.
+func logout(ctx context.Context, account *models.Account) error {
+	sessions.CloseUser(ctx, account.Username)
+	return models.RevokeTokens(ctx, account)
+}
+
+var (
+	suspendAccount = accountAction(models.SuspendActorAction, func(ctx context.Context, account *models.Account) error {
+		if err := models.SuspendActor(ctx, account.Actor); err != nil {
+			return err
+		}
+		return logout(ctx, account)
+	})
+	unsuspendAccount = accountAction(models.UnsuspendActorAction, func(ctx context.Context, account *models.Account) error {
+		return models.UnsuspendActor(ctx, account.Actor)
+	})
+	silenceAccount = accountAction(models.SilenceActorAction, func(ctx context.Context, account *models.Account) error {
+		return models.SilenceActor(ctx, account.Actor)
+	})
+	unsilenceAccount = accountAction(models.UnsilenceActorAction, func(ctx context.Context, account *models.Account) error {
+		return models.UnsilenceActor(ctx, account.Actor)
+	})
+	logoutAccount = accountAction(models.LogoutAction, logout)
+)
+
+// resetPassword gives an account a new random password, which is shown
+// to the administrator to pass on, and logs the account out.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	account := accountParam(w, r)
+	if account == nil {
+		return
+	}
+	key := make([]byte, 12)
+	if _, err := rand.Read(key); err != nil {
+		panic(routes.Error(err))
+	}
+	password := base64.RawURLEncoding.EncodeToString(key)
+	if err := models.SetPassword(r.Context(), account, password); err != nil {
+		panic(routes.Error(err))
+	}
+	if err := logout(r.Context(), account); err != nil {
+		panic(routes.Error(err))
+	}
+	logModeration(r, models.ResetPasswordAction, account.Actor.ID(), nil)
+	renderAccounts(w, r, http.StatusOK, "The new password of "+account.Username+" is "+password)
+}
+
+func changeRole(w http.ResponseWriter, r *http.Request) {
+	account := accountParam(w, r)
+	if account == nil {
+		return
+	}
+	role := r.PostForm.Get("role")
+	valid := false
+	for _, name := range models.Roles {
+		valid = valid || name == role
+	}
+	if !valid {
+		renderAccounts(w, r, http.StatusBadRequest, "That isn't a role.")
+		return
+	}
+	if err := models.SetRole(r.Context(), account, role); err != nil {
+		panic(routes.Error(err))
+	}
+	logModeration(r, models.ChangeRoleAction, account.Actor.ID(), nil)
+	http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+}
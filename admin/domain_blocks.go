@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+var domainBlocksTemplate = views.HtmlTemplate("admin/domain_blocks.html")
+
+type domainBlocksData struct {
+	Blocks     []*models.DomainBlock
+	Severities []string
+	// Error explains why the last change couldn't be made.
+	Error     string
+	CSRFToken string
+}
+
+func renderDomainBlocks(w http.ResponseWriter, r *http.Request, status int, message string) {
+	blocks, err := models.DomainBlocks(r.Context())
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	domainBlocksTemplate.RenderStatus(w, r, status, domainBlocksData{
+		Blocks:     blocks,
+		Severities: models.DomainBlockSeverities,
+		Error:      message,
+		CSRFToken:  sessions.CSRFToken(r.Context()),
+	})
+}
+
+func showDomainBlocks(w http.ResponseWriter, r *http.Request) {
+	renderDomainBlocks(w, r, http.StatusOK, "")
+}
+
+// createDomainBlock blocks a domain, or changes how it is blocked if it
+// already is. Blocking this server's own domain isn't allowed.
+func createDomainBlock(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	block := &models.DomainBlock{
+		Domain:         r.PostForm.Get("domain"),
+		Severity:       r.PostForm.Get("severity"),
+		RejectMedia:    r.PostForm.Get("reject_media") == "true",
+		PublicComment:  strings.TrimSpace(r.PostForm.Get("public_comment")),
+		PrivateComment: strings.TrimSpace(r.PostForm.Get("private_comment")),
+	}
+	domain, err := models.NormalizeDomain(block.Domain)
+	if err != nil {
+		renderDomainBlocks(w, r, http.StatusBadRequest, "That isn't a valid domain.")
+		return
+	}
+	if ownDomain(r, domain) {
+		renderDomainBlocks(w, r, http.StatusBadRequest, "This server's own domain can't be blocked.")
+		return
+	}
+	if err = models.SaveDomainBlock(r.Context(), block); err != nil {
+		panic(routes.Error(err))
+	}
+	http.Redirect(w, r, "/admin/domain_blocks", http.StatusSeeOther)
+}
+
+// ownDomain reports whether blocking a domain would block this server.
+func ownDomain(r *http.Request, domain string) bool {
+	return config.Get(r.Context()).InDomain(domain)
+}
+
+func deleteDomainBlock(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	domain := r.Context().Value(routes.Param("domain")).(string)
+	if err := models.DeleteDomainBlock(r.Context(), domain); err != nil {
+		panic(routes.Error(err))
+	}
+	http.Redirect(w, r, "/admin/domain_blocks", http.StatusSeeOther)
+}
+
+// exportDomainBlocks serves the domain blocklist as a CSV file that
+// can be imported by this server or by Mastodon.
+func exportDomainBlocks(w http.ResponseWriter, r *http.Request) {
+	blocks, err := models.DomainBlocks(r.Context())
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="domain_blocks.csv"`)
+	models.WriteDomainBlocksCSV(w, blocks)
+}
+
+// importDomainBlocks blocks the domains in an uploaded blocklist,
+// replacing the blocks of any that are already blocked. Nothing is
+// blocked if the blocklist is invalid or includes this server's own
+// domain.
+func importDomainBlocks(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		renderDomainBlocks(w, r, http.StatusBadRequest, "Choose a blocklist to import.")
+		return
+	}
+	defer file.Close()
+	blocks, err := models.ReadDomainBlocksCSV(file)
+	if err != nil {
+		renderDomainBlocks(w, r, http.StatusBadRequest, "The blocklist is invalid: "+err.Error())
+		return
+	}
+	for _, block := range blocks {
+		if ownDomain(r, block.Domain) {
+			renderDomainBlocks(w, r, http.StatusBadRequest, "The blocklist includes this server's own domain.")
+			return
+		}
+	}
+	for _, block := range blocks {
+		if err = models.SaveDomainBlock(r.Context(), block); err != nil {
+			panic(routes.Error(err))
+		}
+	}
+	http.Redirect(w, r, "/admin/domain_blocks", http.StatusSeeOther)
+}
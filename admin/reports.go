@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/media"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// logPageSize is the number of entries of the moderation log that are
+// shown.
+const logPageSize = 100
+
+var reportsTemplate = views.HtmlTemplate("admin/reports.html")
+
+type reportsData struct {
+	Reports []*models.Report
+	// Resolved is true if the resolved reports are listed rather
+	// than the open ones.
+	Resolved bool
+	// Error explains why the last action couldn't be taken.
+	Error     string
+	CSRFToken string
+}
+
+func renderReports(w http.ResponseWriter, r *http.Request, status int, resolved bool, message string) {
+	reports, err := models.Reports(r.Context(), resolved)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	reportsTemplate.RenderStatus(w, r, status, reportsData{
+		Reports:   reports,
+		Resolved:  resolved,
+		Error:     message,
+		CSRFToken: sessions.CSRFToken(r.Context()),
+	})
+}
+
+// showReports shows the moderation queue: the reports that are waiting
+// for a moderator or, if the resolved parameter is true, those that
+// have been dealt with.
+func showReports(w http.ResponseWriter, r *http.Request) {
+	resolved, _ := strconv.ParseBool(r.URL.Query().Get("resolved"))
+	renderReports(w, r, http.StatusOK, resolved, "")
+}
+
+// reportParam retrieves the report whose ID is in the route.
+func reportParam(r *http.Request) *models.Report {
+	id, err := strconv.ParseInt(r.Context().Value(routes.Param("report")).(string), 10, 64)
+	if err != nil {
+		panic(routes.NotFound)
+	}
+	report, err := models.ReportById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	return report
+}
+
+func resolveReport(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	report := reportParam(r)
+	if err := models.ResolveReport(r.Context(), report); err != nil {
+		panic(routes.Error(err))
+	}
+	logModeration(r, models.ResolveReportAction, report.Target.ID(), report)
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// suspendReported suspends the target of a report, which resolves it.
+// Moderators can't suspend themselves.
+func suspendReported(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	report := reportParam(r)
+	if report.Target.ID().String() == currentUser(r).Actor.ID().String() {
+		renderReports(w, r, http.StatusBadRequest, false, "You can't suspend yourself.")
+		return
+	}
+	if err := models.SuspendActor(r.Context(), report.Target); err != nil {
+		panic(routes.Error(err))
+	}
+	if err := models.ResolveReport(r.Context(), report); err != nil {
+		panic(routes.Error(err))
+	}
+	logModeration(r, models.SuspendActorAction, report.Target.ID(), report)
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// deleteReportedPost deletes one of the posts of a report, leaving the
+// report open in case there is more to be done.
+func deleteReportedPost(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+	report := reportParam(r)
+	var post *models.Post
+	for _, p := range report.Posts {
+		if p.ID().String() == r.PostForm.Get("post") {
+			post = p
+		}
+	}
+	if post == nil {
+		renderReports(w, r, http.StatusBadRequest, report.Resolved, "That post isn't part of the report.")
+		return
+	}
+	activity, err := models.DeletePost(r.Context(), post)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	federation.Deliver(r.Context(), activity)
+	media.DeleteFiles(r.Context(), post.Attachment)
+	logModeration(r, models.DeletePostAction, post.ID(), report)
+	target := "/admin/reports"
+	if report.Resolved {
+		target += "?resolved=true"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+var logTemplate = views.HtmlTemplate("admin/log.html")
+
+// showLog shows the most recent actions taken by moderators.
+func showLog(w http.ResponseWriter, r *http.Request) {
+	type data struct {
+		Entries []*models.ModerationAction
+	}
+	entries, err := models.ModerationLog(r.Context(), logPageSize)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	logTemplate.Render(w, r, data{entries})
+}
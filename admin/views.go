@@ -0,0 +1,145 @@
+// The admin package serves the pages on which the server's moderators
+// and administrators manage it.
+package admin
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/middleware"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the administration routes on the Router. The
+// pages for handling reports and moderating accounts are served to
+// moderators, and the rest only to administrators.
+func AddRoutes(router *routes.Router) {
+	get, post := routes.Method{"GET"}, routes.Method{"POST"}
+	moderator := func(handler http.HandlerFunc) http.Handler {
+		return middleware.RequireRole(models.ModeratorRole, handler)
+	}
+	admin := func(handler http.HandlerFunc) http.Handler {
+		return middleware.RequireRole(models.AdminRole, handler)
+	}
+
+	router.Route([]interface{}{get, "admin"}, moderator(showDashboard))
+	router.Route([]interface{}{get, "admin", "instances"}, admin(showInstances))
+
+	router.Route([]interface{}{get, "admin", "accounts"}, moderator(showAccounts))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "suspend"}, moderator(suspendAccount))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "unsuspend"}, moderator(unsuspendAccount))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "silence"}, moderator(silenceAccount))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "unsilence"}, moderator(unsilenceAccount))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "reset_password"}, admin(resetPassword))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "logout"}, admin(logoutAccount))
+	router.Route([]interface{}{post, "admin", "accounts", routes.Param("username"), "role"}, admin(changeRole))
+
+	router.Route([]interface{}{get, "admin", "domain_blocks"}, admin(showDomainBlocks))
+	router.Route([]interface{}{post, "admin", "domain_blocks"}, admin(createDomainBlock))
+	router.Route([]interface{}{get, "admin", "domain_blocks", "export"}, admin(exportDomainBlocks))
+	router.Route([]interface{}{post, "admin", "domain_blocks", "import"}, admin(importDomainBlocks))
+	router.Route([]interface{}{post, "admin", "domain_blocks", routes.Param("domain"), "delete"}, admin(deleteDomainBlock))
+
+	router.Route([]interface{}{get, "admin", "reports"}, moderator(showReports))
+	router.Route([]interface{}{post, "admin", "reports", routes.Param("report"), "resolve"}, moderator(resolveReport))
+	router.Route([]interface{}{post, "admin", "reports", routes.Param("report"), "suspend"}, moderator(suspendReported))
+	router.Route([]interface{}{post, "admin", "reports", routes.Param("report"), "delete_post"}, moderator(deleteReportedPost))
+	router.Route([]interface{}{get, "admin", "log"}, moderator(showLog))
+}
+
+// maxImportSize is the size in bytes of the largest domain blocklist
+// that can be imported.
+const maxImportSize = 1 << 20
+
+// currentUser returns the account of the logged-in moderator, whom
+// middleware.RequireRole has already checked for.
+func currentUser(r *http.Request) *models.Account {
+	return sessions.Get(r.Context()).User
+}
+
+// checkForm parses a submitted form and checks its CSRF token,
+// failing the request if it is invalid.
+func checkForm(w http.ResponseWriter, r *http.Request) bool {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		err = r.ParseMultipartForm(maxImportSize)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil || !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid form submission"))
+		return false
+	}
+	return true
+}
+
+// logModeration records an action taken by the logged-in moderator in
+// the moderation log, failing the request if it can't be.
+func logModeration(r *http.Request, action string, targetId *url.URL, report *models.Report) {
+	if err := models.LogModeration(r.Context(), currentUser(r).Actor, action, targetId, report); err != nil {
+		panic(routes.Error(err))
+	}
+}
+
+var dashboardTemplate = views.HtmlTemplate("admin/dashboard.html")
+
+// showDashboard shows statistics about the server and links to the
+// pages that the user may manage it from.
+func showDashboard(w http.ResponseWriter, r *http.Request) {
+	type data struct {
+		Accounts, LocalPosts, Posts int
+		QueueDepth, Instances       int
+		OpenReports                 int
+		// Admin is true if the user is an administrator, who may
+		// see the pages only they may use.
+		Admin bool
+	}
+	ctx := r.Context()
+	d := data{QueueDepth: federation.QueueDepth(), Admin: currentUser(r).HasRole(models.AdminRole)}
+	var err error
+	if d.Accounts, err = models.CountAccounts(ctx); err != nil {
+		panic(routes.Error(err))
+	}
+	if d.LocalPosts, err = models.CountPostsByAccounts(ctx); err != nil {
+		panic(routes.Error(err))
+	}
+	if d.Posts, err = models.CountPosts(ctx); err != nil {
+		panic(routes.Error(err))
+	}
+	if d.OpenReports, err = models.CountOpenReports(ctx); err != nil {
+		panic(routes.Error(err))
+	}
+	hosts, err := models.ActorHosts(ctx)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	for _, host := range hosts {
+		if host != config.Get(ctx).Host() {
+			d.Instances++
+		}
+	}
+	dashboardTemplate.Render(w, r, d)
+}
+
+var instancesTemplate = views.HtmlTemplate("admin/instances.html")
+
+// showInstances shows the other servers that this server knows of,
+// with how well delivering activities to them has gone.
+func showInstances(w http.ResponseWriter, r *http.Request) {
+	type data struct {
+		Instances []*models.Instance
+	}
+	instances, err := models.Instances(r.Context(), config.Get(r.Context()).Host())
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	instancesTemplate.Render(w, r, data{instances})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/models"
+)
+
+func verifyCredentials(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:accounts")
+	entity := accountEntity(r.Context(), account.Actor)
+	entity.Source = &Source{
+		Privacy: "public",
+		Fields:  []interface{}{},
+	}
+	writeJSON(w, entity)
+}
+
+func showAccount(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, accountEntity(r.Context(), actorParam(r)))
+}
+
+func showRelationships(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:follows")
+	query := r.URL.Query()
+	ids := append(query["id[]"], query["id"]...)
+	rels := make([]*Relationship, 0, len(ids))
+	for _, id := range ids {
+		actor, err := models.ActorById(r.Context(), decodeID(id))
+		check(err)
+		rels = append(rels, relationshipEntity(r.Context(), account.Actor, actor))
+	}
+	writeJSON(w, rels)
+}
+
+func followAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:follows")
+	actor := actorParam(r)
+	activity, err := models.Follow(r.Context(), account.Actor, actor)
+	if err == models.ErrBlocked {
+		panic(failure{http.StatusForbidden, "This action is not allowed"})
+	}
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+func unfollowAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:follows")
+	actor := actorParam(r)
+	activity, err := models.Unfollow(r.Context(), account.Actor, actor)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+func blockAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:blocks")
+	actor := actorParam(r)
+	activity, err := models.Block(r.Context(), account.Actor, actor)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+func unblockAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:blocks")
+	actor := actorParam(r)
+	activity, err := models.Unblock(r.Context(), account.Actor, actor)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+// muteAccount mutes an account, along with its notifications unless
+// the notifications parameter is false.
+func muteAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:mutes")
+	actor := actorParam(r)
+	notifications := true
+	if param := params(r).Get("notifications"); param != "" {
+		var err error
+		if notifications, err = strconv.ParseBool(param); err != nil {
+			panic(failure{http.StatusUnprocessableEntity, "Validation failed: Notifications is invalid"})
+		}
+	}
+	check(models.Mute(r.Context(), account.Actor, actor, notifications))
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+func unmuteAccount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:mutes")
+	actor := actorParam(r)
+	check(models.Unmute(r.Context(), account.Actor, actor))
+	writeJSON(w, relationshipEntity(r.Context(), account.Actor, actor))
+}
+
+func listBlocks(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:blocks")
+	actors, err := models.BlockedActors(r.Context(), account.Actor)
+	check(err)
+	writeAccounts(w, r, actors)
+}
+
+func listMutes(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:mutes")
+	actors, err := models.MutedActors(r.Context(), account.Actor)
+	check(err)
+	writeAccounts(w, r, actors)
+}
+
+func writeAccounts(w http.ResponseWriter, r *http.Request, actors []*models.Actor) {
+	accounts := make([]*Account, len(actors))
+	for i, actor := range actors {
+		accounts[i] = accountEntity(r.Context(), actor)
+	}
+	writeJSON(w, accounts)
+}
@@ -0,0 +1,280 @@
+// The api package implements the parts of the Mastodon client API
+// (https://docs.joinmastodon.org/api/) that Kanna supports, so that
+// existing Mastodon clients can be used with Kanna.
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// AddRoutes registers the routes for the client API on the Router.
+func AddRoutes(router *routes.Router) {
+	get, post, put, del := routes.Method{"GET"}, routes.Method{"POST"}, routes.Method{"PUT"}, routes.Method{"DELETE"}
+
+	router.Route([]interface{}{post, "api", "v1", "apps"}, http.HandlerFunc(createApp))
+	router.Route([]interface{}{get, "oauth", "authorize"}, http.HandlerFunc(authorizeGet))
+	router.Route([]interface{}{post, "oauth", "authorize"}, http.HandlerFunc(authorizePost))
+	router.Route([]interface{}{post, "oauth", "token"}, http.HandlerFunc(issueToken))
+	router.Route([]interface{}{post, "oauth", "revoke"}, http.HandlerFunc(revokeToken))
+
+	router.Route([]interface{}{get, "api", "v1", "instance"}, http.HandlerFunc(showInstance))
+
+	router.Route([]interface{}{get, "api", "v1", "accounts", "verify_credentials"}, http.HandlerFunc(verifyCredentials))
+	router.Route([]interface{}{get, "api", "v1", "accounts", "relationships"}, http.HandlerFunc(showRelationships))
+	router.Route([]interface{}{get, "api", "v1", "accounts", routes.Param("id")}, http.HandlerFunc(showAccount))
+	router.Route([]interface{}{get, "api", "v1", "accounts", routes.Param("id"), "statuses"}, http.HandlerFunc(accountStatuses))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "follow"}, http.HandlerFunc(followAccount))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "unfollow"}, http.HandlerFunc(unfollowAccount))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "block"}, http.HandlerFunc(blockAccount))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "unblock"}, http.HandlerFunc(unblockAccount))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "mute"}, http.HandlerFunc(muteAccount))
+	router.Route([]interface{}{post, "api", "v1", "accounts", routes.Param("id"), "unmute"}, http.HandlerFunc(unmuteAccount))
+	router.Route([]interface{}{get, "api", "v1", "blocks"}, http.HandlerFunc(listBlocks))
+	router.Route([]interface{}{get, "api", "v1", "mutes"}, http.HandlerFunc(listMutes))
+
+	router.Route([]interface{}{post, "api", "v1", "statuses"}, http.HandlerFunc(createStatus))
+	router.Route([]interface{}{get, "api", "v1", "statuses", routes.Param("id")}, http.HandlerFunc(showStatus))
+	router.Route([]interface{}{del, "api", "v1", "statuses", routes.Param("id")}, http.HandlerFunc(deleteStatus))
+	router.Route([]interface{}{get, "api", "v1", "statuses", routes.Param("id"), "context"}, http.HandlerFunc(statusContext))
+	router.Route([]interface{}{post, "api", "v1", "statuses", routes.Param("id"), "favourite"}, http.HandlerFunc(favouriteStatus))
+	router.Route([]interface{}{post, "api", "v1", "statuses", routes.Param("id"), "unfavourite"}, http.HandlerFunc(unfavouriteStatus))
+	router.Route([]interface{}{post, "api", "v1", "statuses", routes.Param("id"), "reblog"}, http.HandlerFunc(reblogStatus))
+	router.Route([]interface{}{post, "api", "v1", "statuses", routes.Param("id"), "unreblog"}, http.HandlerFunc(unreblogStatus))
+	router.Route([]interface{}{get, "api", "v1", "favourites"}, http.HandlerFunc(favourites))
+
+	router.Route([]interface{}{post, "api", "v1", "media"}, http.HandlerFunc(uploadMedia))
+	router.Route([]interface{}{post, "api", "v2", "media"}, http.HandlerFunc(uploadMedia))
+	router.Route([]interface{}{get, "api", "v1", "media", routes.Param("id")}, http.HandlerFunc(showMedia))
+	router.Route([]interface{}{put, "api", "v1", "media", routes.Param("id")}, http.HandlerFunc(updateMedia))
+
+	router.Route([]interface{}{get, "api", "v1", "notifications"}, http.HandlerFunc(listNotifications))
+	router.Route([]interface{}{get, "api", "v1", "notifications", "unread_count"}, http.HandlerFunc(unreadNotificationCount))
+	router.Route([]interface{}{post, "api", "v1", "notifications", "clear"}, http.HandlerFunc(clearNotifications))
+	router.Route([]interface{}{get, "api", "v1", "notifications", routes.Param("id")}, http.HandlerFunc(showNotification))
+	router.Route([]interface{}{post, "api", "v1", "notifications", routes.Param("id"), "dismiss"}, http.HandlerFunc(dismissNotification))
+	router.Route([]interface{}{get, "api", "v1", "markers"}, http.HandlerFunc(showMarkers))
+	router.Route([]interface{}{post, "api", "v1", "markers"}, http.HandlerFunc(updateMarkers))
+
+	router.Route([]interface{}{post, "api", "v1", "reports"}, http.HandlerFunc(createReport))
+
+	router.Route([]interface{}{get, "api", "v1", "streaming"}, http.HandlerFunc(streamWebSocket))
+	router.Route([]interface{}{get, "api", "v1", "streaming", "health"}, http.HandlerFunc(streamingHealth))
+	router.Route([]interface{}{get, "api", "v1", "streaming", routes.Rest("stream")}, http.HandlerFunc(streamEvents))
+
+	router.Route([]interface{}{get, "api", "v1", "timelines", "home"}, http.HandlerFunc(homeTimeline))
+	router.Route([]interface{}{get, "api", "v1", "timelines", "public"}, http.HandlerFunc(publicTimeline))
+}
+
+// A failure is a routes.Failure that reports an error to the client
+// as a Mastodon API error entity rather than an HTML page.
+type failure struct {
+	status  int
+	message string
+}
+
+func (f failure) HandleFailure(_ *routes.Router, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.status)
+	json.NewEncoder(w).Encode(map[string]string{"error": f.message})
+}
+
+var (
+	notFound     = failure{http.StatusNotFound, "Record not found"}
+	unauthorized = failure{http.StatusUnauthorized, "The access token is invalid"}
+	forbidden    = failure{http.StatusForbidden, "This action is outside the authorized scopes"}
+)
+
+// check panics with an appropriate failure if err is non-nil.
+func check(err error) {
+	if err == nil {
+		return
+	} else if err == sql.ErrNoRows {
+		panic(notFound)
+	}
+	log.Println(err)
+	panic(failure{http.StatusInternalServerError, "Internal server error"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// params returns the parameters of a request, whether they were
+// supplied in the query string, as a form, or as a JSON object.
+func params(r *http.Request) url.Values {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			panic(failure{http.StatusBadRequest, err.Error()})
+		}
+		return r.Form
+	}
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			panic(failure{http.StatusBadRequest, err.Error()})
+		}
+		return r.Form
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		panic(failure{http.StatusBadRequest, err.Error()})
+	}
+	vals := r.URL.Query()
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			vals.Add(k, v)
+		case bool:
+			if v {
+				vals.Add(k, "true")
+			} else {
+				vals.Add(k, "false")
+			}
+		case float64:
+			buf, _ := json.Marshal(v)
+			vals.Add(k, string(buf))
+		case []interface{}:
+			for _, elem := range v {
+				if s, ok := elem.(string); ok {
+					vals.Add(k+"[]", s)
+				}
+			}
+		case map[string]interface{}:
+			// Nested objects are flattened into the same
+			// parameters that a form would use.
+			for sub, elem := range v {
+				if s, ok := elem.(string); ok {
+					vals.Add(k+"["+sub+"]", s)
+				}
+			}
+		}
+	}
+	return vals
+}
+
+// Mastodon entities are identified by opaque strings, so Kanna uses
+// the URL-safe base64 encoding of the ActivityPub ID of the object.
+func encodeID(u *url.URL) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(u.String()))
+}
+
+func decodeID(id string) string {
+	buf, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		panic(notFound)
+	}
+	return string(buf)
+}
+
+func actorParam(r *http.Request) *models.Actor {
+	id := decodeID(r.Context().Value(routes.Param("id")).(string))
+	actor, err := models.ActorById(r.Context(), id)
+	check(err)
+	return actor
+}
+
+// postParam retrieves the post identified in the request path, failing
+// the request if the viewer may not see it.
+func postParam(r *http.Request, viewer *models.Account) *models.Post {
+	return visiblePost(r, r.Context().Value(routes.Param("id")).(string), viewer)
+}
+
+// visiblePost retrieves the post with an API ID, failing the request if
+// the viewer may not see it.
+func visiblePost(r *http.Request, apiID string, viewer *models.Account) *models.Post {
+	post, err := models.PostById(r.Context(), decodeID(apiID))
+	check(err)
+	visible, err := models.CanView(r.Context(), actorOf(viewer), post)
+	check(err)
+	if !visible {
+		panic(notFound)
+	}
+	return post
+}
+
+// actorOf returns the main Actor of an account, or nil if the account
+// is nil.
+func actorOf(account *models.Account) *models.Actor {
+	if account == nil {
+		return nil
+	}
+	return account.Actor
+}
+
+// authenticate returns the account whose access token was supplied
+// with the request, or nil if no token was supplied. If the token is
+// invalid or was not granted the scope, authenticate fails the
+// request.
+func authenticate(r *http.Request, scope string) *models.Account {
+	account, _ := authenticateScopes(r, scope)
+	return account
+}
+
+// authenticateScopes is like authenticate but also returns the scopes
+// granted to the token.
+func authenticateScopes(r *http.Request, scope string) (*models.Account, string) {
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil, ""
+	}
+	account, scopes, err := models.AccountByToken(r.Context(), token)
+	if err == sql.ErrNoRows {
+		panic(unauthorized)
+	}
+	check(err)
+	if !hasScope(scopes, scope) {
+		panic(forbidden)
+	}
+	return account, scopes
+}
+
+// requireAuth is like authenticate but also fails the request if no
+// token was supplied.
+func requireAuth(r *http.Request, scope string) *models.Account {
+	account := authenticate(r, scope)
+	if account == nil {
+		panic(unauthorized)
+	}
+	return account
+}
+
+// followScopes are the scopes that the deprecated follow scope grants.
+var followScopes = map[string]bool{
+	"read:follows":  true,
+	"write:follows": true,
+	"read:blocks":   true,
+	"write:blocks":  true,
+	"read:mutes":    true,
+	"write:mutes":   true,
+}
+
+// hasScope reports whether the space-separated granted scopes include
+// the needed scope, either directly or through a broader scope such as
+// "read" for "read:statuses".
+func hasScope(granted, needed string) bool {
+	for _, scope := range strings.Fields(granted) {
+		if scope == needed || strings.HasPrefix(needed, scope+":") {
+			return true
+		}
+		if scope == "follow" && followScopes[needed] {
+			return true
+		}
+	}
+	return false
+}
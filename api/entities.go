@@ -0,0 +1,433 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// An Account is the Mastodon API's representation of an actor.
+type Account struct {
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	Acct           string        `json:"acct"`
+	DisplayName    string        `json:"display_name"`
+	Locked         bool          `json:"locked"`
+	Bot            bool          `json:"bot"`
+	CreatedAt      string        `json:"created_at"`
+	Note           string        `json:"note"`
+	URL            string        `json:"url"`
+	Avatar         string        `json:"avatar"`
+	AvatarStatic   string        `json:"avatar_static"`
+	Header         string        `json:"header"`
+	HeaderStatic   string        `json:"header_static"`
+	FollowersCount int           `json:"followers_count"`
+	FollowingCount int           `json:"following_count"`
+	StatusesCount  int           `json:"statuses_count"`
+	Emojis         []interface{} `json:"emojis"`
+	Fields         []interface{} `json:"fields"`
+	Source         *Source       `json:"source,omitempty"`
+}
+
+// A Source holds the account's own settings and is only included in
+// the response to verify_credentials.
+type Source struct {
+	Privacy   string        `json:"privacy"`
+	Sensitive bool          `json:"sensitive"`
+	Note      string        `json:"note"`
+	Fields    []interface{} `json:"fields"`
+}
+
+// A Status is the Mastodon API's representation of a post.
+type Status struct {
+	ID                 string             `json:"id"`
+	URI                string             `json:"uri"`
+	URL                string             `json:"url"`
+	Account            *Account           `json:"account"`
+	InReplyToID        *string            `json:"in_reply_to_id"`
+	InReplyToAccountID *string            `json:"in_reply_to_account_id"`
+	Reblog             *Status            `json:"reblog"`
+	Content            string             `json:"content"`
+	CreatedAt          string             `json:"created_at"`
+	Emojis             []interface{}      `json:"emojis"`
+	RepliesCount       int                `json:"replies_count"`
+	ReblogsCount       int                `json:"reblogs_count"`
+	FavouritesCount    int                `json:"favourites_count"`
+	Favourited         bool               `json:"favourited"`
+	Reblogged          bool               `json:"reblogged"`
+	Muted              bool               `json:"muted"`
+	Sensitive          bool               `json:"sensitive"`
+	SpoilerText        string             `json:"spoiler_text"`
+	Visibility         string             `json:"visibility"`
+	MediaAttachments   []*MediaAttachment `json:"media_attachments"`
+	Mentions           []Mention          `json:"mentions"`
+	Tags               []Tag              `json:"tags"`
+	Application        interface{}        `json:"application"`
+	Language           *string            `json:"language"`
+	Pinned             bool               `json:"pinned"`
+	Text               *string            `json:"text,omitempty"`
+}
+
+// A MediaAttachment is a file attached to a Status.
+type MediaAttachment struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	URL         string     `json:"url"`
+	PreviewURL  *string    `json:"preview_url"`
+	RemoteURL   *string    `json:"remote_url"`
+	TextURL     *string    `json:"text_url"`
+	Meta        *MediaMeta `json:"meta"`
+	Description *string    `json:"description"`
+	Blurhash    *string    `json:"blurhash"`
+}
+
+// MediaMeta holds the dimensions of a MediaAttachment, if they are
+// known.
+type MediaMeta struct {
+	Original *MediaSize `json:"original,omitempty"`
+}
+
+// A MediaSize describes the dimensions of an image.
+type MediaSize struct {
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Size   string  `json:"size"`
+	Aspect float64 `json:"aspect"`
+}
+
+// A Mention is an account mentioned in a Status.
+type Mention struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	URL      string `json:"url"`
+	Acct     string `json:"acct"`
+}
+
+// A Tag is a hashtag used in a Status.
+type Tag struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// A Relationship describes how the authenticated account relates to
+// another account.
+type Relationship struct {
+	ID                  string `json:"id"`
+	Following           bool   `json:"following"`
+	ShowingReblogs      bool   `json:"showing_reblogs"`
+	Notifying           bool   `json:"notifying"`
+	FollowedBy          bool   `json:"followed_by"`
+	Blocking            bool   `json:"blocking"`
+	BlockedBy           bool   `json:"blocked_by"`
+	Muting              bool   `json:"muting"`
+	MutingNotifications bool   `json:"muting_notifications"`
+	Requested           bool   `json:"requested"`
+	DomainBlocking      bool   `json:"domain_blocking"`
+	Endorsed            bool   `json:"endorsed"`
+	Note                string `json:"note"`
+}
+
+// A Notification is the Mastodon API's representation of a
+// notification.
+type Notification struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	CreatedAt string   `json:"created_at"`
+	GroupKey  string   `json:"group_key"`
+	Account   *Account `json:"account"`
+	Status    *Status  `json:"status,omitempty"`
+}
+
+// A Report is the Mastodon API's representation of a report made by
+// the user.
+type Report struct {
+	ID            string   `json:"id"`
+	ActionTaken   bool     `json:"action_taken"`
+	Category      string   `json:"category"`
+	Comment       string   `json:"comment"`
+	Forwarded     bool     `json:"forwarded"`
+	CreatedAt     string   `json:"created_at"`
+	StatusIDs     []string `json:"status_ids"`
+	RuleIDs       []string `json:"rule_ids"`
+	TargetAccount *Account `json:"target_account"`
+}
+
+// A Marker records the position in a timeline that the user has read
+// up to.
+type Marker struct {
+	LastReadID string `json:"last_read_id"`
+	Version    int    `json:"version"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+// An Instance describes the server.
+type Instance struct {
+	URI              string            `json:"uri"`
+	Title            string            `json:"title"`
+	ShortDescription string            `json:"short_description"`
+	Description      string            `json:"description"`
+	Email            string            `json:"email"`
+	Version          string            `json:"version"`
+	URLs             map[string]string `json:"urls"`
+	Stats            InstanceStats     `json:"stats"`
+	Thumbnail        *string           `json:"thumbnail"`
+	Languages        []string          `json:"languages"`
+	Registrations    bool              `json:"registrations"`
+	ApprovalRequired bool              `json:"approval_required"`
+	InvitesEnabled   bool              `json:"invites_enabled"`
+	ContactAccount   *Account          `json:"contact_account"`
+}
+
+// InstanceStats holds the statistics included in an Instance.
+type InstanceStats struct {
+	UserCount   int `json:"user_count"`
+	StatusCount int `json:"status_count"`
+	DomainCount int `json:"domain_count"`
+}
+
+// Version is the Mastodon API version that Kanna reports. Clients use
+// it to decide which features are available.
+const Version = "3.0.0 (compatible; Kanna)"
+
+func accountEntity(ctx context.Context, actor *models.Actor) *Account {
+	cfg := config.Get(ctx)
+	acct := actor.Name
+	if !cfg.IsLocal(actor.ID()) {
+		acct += "@" + actor.ID().Host
+	}
+	// Kanna doesn't support avatars or headers yet, but clients
+	// expect the URLs to be present.
+	missing := cfg.URL("avatars", "missing.png").String()
+	account := &Account{
+		ID:          encodeID(actor.ID()),
+		Username:    actor.Name,
+		Acct:        acct,
+		DisplayName: actor.Name,
+		Bot:         actor.HasType("Service") || actor.HasType("Application"),
+		// Actors don't record when they were created yet.
+		CreatedAt:    "1970-01-01T00:00:00Z",
+		URL:          actor.ID().String(),
+		Avatar:       missing,
+		AvatarStatic: missing,
+		Header:       missing,
+		HeaderStatic: missing,
+		Emojis:       []interface{}{},
+		Fields:       []interface{}{},
+	}
+	var err error
+	account.FollowersCount, err = models.CountFollowers(ctx, actor)
+	check(err)
+	account.FollowingCount, err = models.CountFollowing(ctx, actor)
+	check(err)
+	account.StatusesCount, err = models.CountPostsByActor(ctx, actor)
+	check(err)
+	return account
+}
+
+func relationshipEntity(ctx context.Context, viewer, actor *models.Actor) *Relationship {
+	rel := &Relationship{
+		ID:             encodeID(actor.ID()),
+		ShowingReblogs: true,
+	}
+	var err error
+	rel.Following, err = models.IsFollowing(ctx, viewer, actor)
+	check(err)
+	rel.Requested, err = models.IsFollowRequested(ctx, viewer, actor)
+	check(err)
+	rel.FollowedBy, err = models.IsFollowing(ctx, actor, viewer)
+	check(err)
+	rel.Blocking, err = models.IsBlocking(ctx, viewer, actor)
+	check(err)
+	rel.BlockedBy, err = models.IsBlocking(ctx, actor, viewer)
+	check(err)
+	rel.Muting, rel.MutingNotifications, err = models.IsMuting(ctx, viewer, actor)
+	check(err)
+	return rel
+}
+
+// statusEntity converts a post to a Status. If viewer is non-nil, the
+// Status describes the viewer's interactions with the post.
+func statusEntity(ctx context.Context, post *models.Post, viewer *models.Account) *Status {
+	status := &Status{
+		ID:               encodeID(post.ID()),
+		URI:              post.ID().String(),
+		URL:              post.ID().String(),
+		Account:          accountEntity(ctx, post.Author),
+		Content:          string(post.HTML()),
+		CreatedAt:        post.Published,
+		Emojis:           []interface{}{},
+		Visibility:       string(post.Visibility()),
+		MediaAttachments: []*MediaAttachment{},
+		Mentions:         []Mention{},
+		Tags:             []Tag{},
+		Sensitive:        post.Sensitive,
+	}
+	if post.Summary != nil {
+		status.SpoilerText = *post.Summary
+	}
+	for _, a := range post.Attachment {
+		status.MediaAttachments = append(status.MediaAttachments, mediaEntity(a))
+	}
+	cfg := config.Get(ctx)
+	for _, tag := range post.Tag {
+		name := strings.TrimLeft(tag.Name, "@#")
+		switch tag.Type {
+		case models.MentionType:
+			acct := name
+			username, host := splitAcct(name)
+			if host == cfg.Host() {
+				acct = username
+			}
+			status.Mentions = append(status.Mentions, Mention{
+				ID:       encodeID(tag.Href),
+				Username: username,
+				URL:      tag.Href.String(),
+				Acct:     acct,
+			})
+		case models.HashtagType:
+			status.Tags = append(status.Tags, Tag{
+				Name: strings.ToLower(name),
+				URL:  tag.Href.String(),
+			})
+		}
+	}
+	if post.InReplyTo != nil {
+		id := encodeID(post.InReplyTo)
+		status.InReplyToID = &id
+		if parent, err := models.PostById(ctx, post.InReplyTo.String()); err == nil {
+			accountID := encodeID(parent.Author.ID())
+			status.InReplyToAccountID = &accountID
+		} else if err != sql.ErrNoRows {
+			check(err)
+		}
+	}
+	var err error
+	status.RepliesCount, err = models.CountReplies(ctx, post, actorOf(viewer))
+	check(err)
+	status.FavouritesCount, err = models.CountLikes(ctx, post)
+	check(err)
+	status.ReblogsCount, err = models.CountAnnounces(ctx, post)
+	check(err)
+	if viewer != nil {
+		status.Favourited, err = models.HasLiked(ctx, viewer.Actor, post)
+		check(err)
+		status.Reblogged, err = models.HasAnnounced(ctx, viewer.Actor, post)
+		check(err)
+	}
+	return status
+}
+
+// timelineEntity converts an entry in a timeline to a Status, which
+// is a reblog if the entry is a boost.
+func timelineEntity(ctx context.Context, entry *models.TimelineEntry, viewer *models.Account) *Status {
+	status := statusEntity(ctx, entry.Post, viewer)
+	if entry.BoostedBy == nil {
+		return status
+	}
+	return reblogEntity(ctx, entry.BoostID, entry.BoostedBy, entry.Published, status)
+}
+
+// reblogEntity builds the Status representing a boost of another
+// Status.
+func reblogEntity(ctx context.Context, id *url.URL, booster *models.Actor, published string, status *Status) *Status {
+	return &Status{
+		ID:               encodeID(id),
+		URI:              id.String(),
+		URL:              status.URL,
+		Account:          accountEntity(ctx, booster),
+		Reblog:           status,
+		CreatedAt:        published,
+		Emojis:           []interface{}{},
+		Visibility:       status.Visibility,
+		MediaAttachments: []*MediaAttachment{},
+		Mentions:         []Mention{},
+		Tags:             []Tag{},
+		Favourited:       status.Favourited,
+		Reblogged:        status.Reblogged,
+	}
+}
+
+// mediaEntity converts an attachment to a MediaAttachment. Images are
+// served by this server, while other files are linked to on the server
+// they came from.
+func mediaEntity(a *models.Attachment) *MediaAttachment {
+	media := &MediaAttachment{
+		ID:   encodeID(a.ID),
+		Type: "unknown",
+		URL:  a.URL().String(),
+	}
+	if a.IsImage() {
+		preview := a.PreviewURL().String()
+		media.Type, media.URL, media.PreviewURL = "image", a.ID.String(), &preview
+	}
+	if a.RemoteURL != nil {
+		remote := a.RemoteURL.String()
+		media.RemoteURL = &remote
+	}
+	if a.Name != "" {
+		media.Description = &a.Name
+	}
+	if a.Width > 0 && a.Height > 0 {
+		media.Meta = &MediaMeta{Original: &MediaSize{
+			Width:  a.Width,
+			Height: a.Height,
+			Size:   fmt.Sprintf("%dx%d", a.Width, a.Height),
+			Aspect: float64(a.Width) / float64(a.Height),
+		}}
+	}
+	return media
+}
+
+func notificationEntity(ctx context.Context, n *models.Notification, viewer *models.Account) *Notification {
+	notification := &Notification{
+		ID:        strconv.FormatInt(n.ID, 10),
+		Type:      n.Type,
+		CreatedAt: n.Created,
+		GroupKey:  n.GroupKey(),
+		Account:   accountEntity(ctx, n.Actor),
+	}
+	if n.Post != nil {
+		notification.Status = statusEntity(ctx, n.Post, viewer)
+	}
+	return notification
+}
+
+func reportEntity(ctx context.Context, report *models.Report) *Report {
+	entity := &Report{
+		ID:            strconv.FormatInt(report.ID, 10),
+		ActionTaken:   report.Resolved,
+		Category:      "other",
+		Comment:       report.Comment,
+		Forwarded:     report.Forwarded,
+		CreatedAt:     report.Created,
+		StatusIDs:     []string{},
+		RuleIDs:       []string{},
+		TargetAccount: accountEntity(ctx, report.Target),
+	}
+	for _, post := range report.Posts {
+		entity.StatusIDs = append(entity.StatusIDs, encodeID(post.ID()))
+	}
+	return entity
+}
+
+func statusEntities(ctx context.Context, posts []*models.Post, viewer *models.Account) []*Status {
+	statuses := make([]*Status, len(posts))
+	for i, post := range posts {
+		statuses[i] = statusEntity(ctx, post, viewer)
+	}
+	return statuses
+}
+
+// splitAcct splits an acct of the form user@host into its parts.
+func splitAcct(acct string) (username, host string) {
+	parts := strings.SplitN(acct, "@", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+)
+
+func showInstance(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Get(r.Context())
+	instance := Instance{
+		URI:              cfg.Host(),
+		Title:            cfg.Instance.Title,
+		ShortDescription: cfg.Instance.Description,
+		Description:      cfg.Instance.Description,
+		Email:            cfg.Instance.Email,
+		Version:          Version,
+		URLs:             map[string]string{},
+		Languages:        []string{},
+	}
+	var err error
+	instance.Stats.UserCount, err = models.CountAccounts(r.Context())
+	check(err)
+	instance.Stats.StatusCount, err = models.CountPostsByAccounts(r.Context())
+	check(err)
+	hosts, err := models.ActorHosts(r.Context())
+	check(err)
+	for _, host := range hosts {
+		if host != cfg.Host() {
+			instance.Stats.DomainCount++
+		}
+	}
+	writeJSON(w, instance)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/media"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// multipartMemory is how much of an uploaded file is kept in memory
+// while the request is parsed. The rest is stored in a temporary file.
+const multipartMemory = 1 << 20
+
+// uploadMedia stores an uploaded image, which can then be attached to
+// a status by passing its ID in media_ids.
+func uploadMedia(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:media")
+	r.Body = http.MaxBytesReader(w, r.Body, config.Get(r.Context()).Media.MaxUploadSize+multipartMemory)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			panic(failure{http.StatusRequestEntityTooLarge, "File is too large"})
+		}
+		panic(failure{http.StatusBadRequest, err.Error()})
+	}
+	file, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: File can't be blank"})
+	}
+	check(err)
+	defer file.Close()
+	a, err := media.Upload(r.Context(), account.Actor, file, r.PostForm.Get("description"))
+	switch err {
+	case media.ErrUnsupported:
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: File content type is invalid"})
+	case media.ErrTooLarge:
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: File is too large"})
+	}
+	check(err)
+	writeJSON(w, mediaEntity(a))
+}
+
+func showMedia(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:media")
+	writeJSON(w, mediaEntity(ownMedia(r, account, r.Context().Value(routes.Param("id")).(string))))
+}
+
+// updateMedia changes the description of an uploaded image.
+func updateMedia(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:media")
+	a := ownMedia(r, account, r.Context().Value(routes.Param("id")).(string))
+	ps := params(r)
+	if _, ok := ps["description"]; ok {
+		check(models.SetAttachmentDescription(r.Context(), a, ps.Get("description")))
+	}
+	writeJSON(w, mediaEntity(a))
+}
+
+// ownMedia retrieves the attachment with an API ID, failing the request
+// unless the account uploaded it.
+func ownMedia(r *http.Request, account *models.Account, apiID string) *models.Attachment {
+	a, err := models.AttachmentById(r.Context(), decodeID(apiID))
+	check(err)
+	if a.Owner.String() != account.Actor.ID().String() || a.RemoteURL != nil {
+		panic(notFound)
+	}
+	return a
+}
+
+// mediaParam retrieves the attachments named by the media_ids[]
+// parameter, which must have been uploaded by the account and not yet
+// attached to a status.
+func mediaParam(r *http.Request, account *models.Account, ps url.Values) []*models.Attachment {
+	ids := ps["media_ids[]"]
+	if len(ids) > models.MaxAttachments {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Too many attachments"})
+	}
+	var attachments []*models.Attachment
+	for _, id := range ids {
+		a := ownMedia(r, account, id)
+		if a.PostID != nil {
+			panic(failure{http.StatusUnprocessableEntity, "Validation failed: Media is already attached to a status"})
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
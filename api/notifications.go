@@ -0,0 +1,152 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// Notification IDs are integers, which are used as API IDs as they
+// are.
+func decodeNotificationID(id string) string {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		panic(notFound)
+	}
+	return id
+}
+
+// notificationTypes reads the types[] and exclude_types[] parameters,
+// returning the types of notifications to list.
+func notificationTypes(r *http.Request) []string {
+	query := r.URL.Query()
+	included := append(query["types[]"], query["types"]...)
+	excluded := make(map[string]bool)
+	for _, typ := range append(query["exclude_types[]"], query["exclude_types"]...) {
+		excluded[typ] = true
+	}
+	if len(included) == 0 && len(excluded) == 0 {
+		return nil
+	}
+	types := []string{}
+	for _, typ := range models.NotificationTypes {
+		if excluded[typ] {
+			continue
+		}
+		if len(included) == 0 || contains(included, typ) {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+func listNotifications(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:notifications")
+	types := notificationTypes(r)
+	if types != nil && len(types) == 0 {
+		writeJSON(w, []*Notification{})
+		return
+	}
+	list, err := models.Notifications(r.Context(), account.Actor, types, pageParamIDs(r, decodeNotificationID))
+	check(err)
+	notifications := make([]*Notification, len(list))
+	for i, n := range list {
+		notifications[i] = notificationEntity(r.Context(), n, account)
+	}
+	if len(notifications) > 0 {
+		writeLinkIDs(w, r, notifications[0].ID, notifications[len(notifications)-1].ID)
+	}
+	writeJSON(w, notifications)
+}
+
+func showNotification(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:notifications")
+	id := decodeNotificationID(r.Context().Value(routes.Param("id")).(string))
+	n, err := models.NotificationById(r.Context(), account.Actor, id)
+	check(err)
+	writeJSON(w, notificationEntity(r.Context(), n, account))
+}
+
+func unreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:notifications")
+	count, err := models.CountUnreadNotifications(r.Context(), account.Actor)
+	check(err)
+	writeJSON(w, map[string]int{"count": count})
+}
+
+func dismissNotification(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:notifications")
+	id, _ := strconv.ParseInt(decodeNotificationID(r.Context().Value(routes.Param("id")).(string)), 10, 64)
+	check(models.DismissNotification(r.Context(), account.Actor, id))
+	writeJSON(w, map[string]interface{}{})
+}
+
+func clearNotifications(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:notifications")
+	check(models.ClearNotifications(r.Context(), account.Actor))
+	writeJSON(w, map[string]interface{}{})
+}
+
+// showMarkers reports the position that the user has read their
+// notifications up to. Kanna only keeps track of which notifications
+// have been read, so the home timeline has no marker, and the
+// marker's updated_at is when the notification it points to was
+// created.
+func showMarkers(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:statuses")
+	markers := map[string]*Marker{}
+	query := r.URL.Query()
+	if timelines := append(query["timeline[]"], query["timeline"]...); len(timelines) == 0 || contains(timelines, "notifications") {
+		if marker := notificationsMarker(r, account); marker != nil {
+			markers["notifications"] = marker
+		}
+	}
+	writeJSON(w, markers)
+}
+
+// notificationsMarker returns the marker of the most recent
+// notification that the user has read, or nil if they haven't read
+// any.
+func notificationsMarker(r *http.Request, account *models.Account) *Marker {
+	last, err := models.LastReadNotification(r.Context(), account.Actor)
+	check(err)
+	if last == 0 {
+		return nil
+	}
+	n, err := models.NotificationById(r.Context(), account.Actor, strconv.FormatInt(last, 10))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err)
+	return &Marker{LastReadID: strconv.FormatInt(n.ID, 10), UpdatedAt: n.Created}
+}
+
+// updateMarkers marks the user's notifications up to
+// notifications[last_read_id] as read.
+func updateMarkers(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:statuses")
+	ps := params(r)
+	markers := map[string]*Marker{}
+	if id := ps.Get("notifications[last_read_id]"); id != "" {
+		last, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			panic(failure{http.StatusUnprocessableEntity, "Validation failed: Last read ID is invalid"})
+		}
+		check(models.MarkNotificationsRead(r.Context(), account.Actor, last))
+		if marker := notificationsMarker(r, account); marker != nil {
+			markers["notifications"] = marker
+		}
+	}
+	writeJSON(w, markers)
+}
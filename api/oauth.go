@@ -0,0 +1,188 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// outOfBand is the redirect URI that asks for the authorization code
+// to be displayed to the user instead of passed to a redirect URI.
+const outOfBand = "urn:ietf:wg:oauth:2.0:oob"
+
+func createApp(w http.ResponseWriter, r *http.Request) {
+	ps := params(r)
+	name, redirectURIs := ps.Get("client_name"), ps.Get("redirect_uris")
+	if name == "" || redirectURIs == "" {
+		panic(failure{http.StatusUnprocessableEntity, "client_name and redirect_uris are required"})
+	}
+	scopes := ps.Get("scopes")
+	if scopes == "" {
+		scopes = "read"
+	}
+	app, err := models.CreateApp(r.Context(), name, redirectURIs, scopes, ps.Get("website"))
+	check(err)
+	writeJSON(w, map[string]interface{}{
+		"id":            app.ClientID,
+		"name":          app.Name,
+		"website":       app.Website,
+		"redirect_uri":  app.RedirectURIs,
+		"client_id":     app.ClientID,
+		"client_secret": app.ClientSecret,
+	})
+}
+
+// authorizationRequest holds the parameters of a request for the user
+// to authorize an application.
+type authorizationRequest struct {
+	App         *models.App
+	RedirectURI string
+	Scopes      string
+	CSRFToken   string
+}
+
+func parseAuthorizationRequest(r *http.Request, ps url.Values) *authorizationRequest {
+	app, err := models.AppByClientID(r.Context(), ps.Get("client_id"))
+	if err == sql.ErrNoRows {
+		panic(failure{http.StatusBadRequest, "unknown client_id"})
+	}
+	check(err)
+	req := &authorizationRequest{
+		App:         app,
+		RedirectURI: ps.Get("redirect_uri"),
+		Scopes:      ps.Get("scope"),
+		CSRFToken:   sessions.CSRFToken(r.Context()),
+	}
+	if !allowedRedirect(app, req.RedirectURI) {
+		panic(failure{http.StatusBadRequest, "redirect_uri is not registered for this application"})
+	}
+	if req.Scopes == "" {
+		req.Scopes = "read"
+	}
+	for _, scope := range strings.Fields(req.Scopes) {
+		if !hasScope(app.Scopes, scope) {
+			panic(failure{http.StatusBadRequest, "scope " + scope + " is not registered for this application"})
+		}
+	}
+	return req
+}
+
+func allowedRedirect(app *models.App, redirectURI string) bool {
+	for _, allowed := range strings.Fields(app.RedirectURIs) {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	authorizeTemplate = views.HtmlTemplate("oauth/authorize.html")
+	showCodeTemplate  = views.HtmlTemplate("oauth/code.html")
+)
+
+func authorizeGet(w http.ResponseWriter, r *http.Request) {
+	if sessions.Get(r.Context()).User == nil {
+		http.Redirect(w, r, "/auth?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	if r.URL.Query().Get("response_type") != "code" {
+		panic(failure{http.StatusBadRequest, "response_type must be code"})
+	}
+	authorizeTemplate.Render(w, r, parseAuthorizationRequest(r, r.URL.Query()))
+}
+
+func authorizePost(w http.ResponseWriter, r *http.Request) {
+	user := sessions.Get(r.Context()).User
+	if user == nil {
+		panic(unauthorized)
+	}
+	if err := r.ParseForm(); err != nil {
+		panic(failure{http.StatusBadRequest, err.Error()})
+	}
+	if !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+		panic(forbidden)
+	}
+	req := parseAuthorizationRequest(r, r.PostForm)
+	code, err := models.CreateAuthorizationCode(r.Context(), req.App, user, req.RedirectURI, req.Scopes)
+	check(err)
+	if req.RedirectURI == outOfBand {
+		type data struct {
+			App  *models.App
+			Code string
+		}
+		showCodeTemplate.Render(w, r, data{App: req.App, Code: code})
+		return
+	}
+	target, err := url.Parse(req.RedirectURI)
+	check(err)
+	query := target.Query()
+	query.Set("code", code)
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func authenticateApp(r *http.Request, ps url.Values) *models.App {
+	app, err := models.AppByClientID(r.Context(), ps.Get("client_id"))
+	if err == sql.ErrNoRows || (err == nil && app.ClientSecret != ps.Get("client_secret")) {
+		panic(failure{http.StatusUnauthorized, "invalid_client"})
+	}
+	check(err)
+	return app
+}
+
+func issueToken(w http.ResponseWriter, r *http.Request) {
+	ps := params(r)
+	app := authenticateApp(r, ps)
+	var account *models.Account
+	var scopes string
+	var err error
+	switch ps.Get("grant_type") {
+	case "authorization_code":
+		account, scopes, err = models.RedeemAuthorizationCode(r.Context(), app, ps.Get("code"), ps.Get("redirect_uri"))
+		if err == sql.ErrNoRows {
+			panic(failure{http.StatusBadRequest, "invalid_grant"})
+		}
+		check(err)
+	case "password":
+		account, err = models.Authenticate(r.Context(), ps.Get("username"), ps.Get("password"))
+		if err == sql.ErrNoRows {
+			panic(failure{http.StatusBadRequest, "invalid_grant"})
+		}
+		check(err)
+		scopes = ps.Get("scope")
+		if scopes == "" {
+			scopes = "read"
+		}
+		for _, scope := range strings.Fields(scopes) {
+			if !hasScope(app.Scopes, scope) {
+				panic(failure{http.StatusBadRequest, "invalid_scope"})
+			}
+		}
+	default:
+		panic(failure{http.StatusBadRequest, "unsupported_grant_type"})
+	}
+	token, err := models.CreateToken(r.Context(), app, account, scopes)
+	check(err)
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"scope":        scopes,
+		"created_at":   time.Now().Unix(),
+	})
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	ps := params(r)
+	app := authenticateApp(r, ps)
+	if err := models.RevokeToken(r.Context(), app, ps.Get("token")); err != sql.ErrNoRows {
+		check(err)
+	}
+	writeJSON(w, map[string]interface{}{})
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/models"
+)
+
+// createReport reports an account, and some of their statuses, to the
+// moderators of this server and, if forward is true and the account is
+// on another server, to the moderators of that server.
+func createReport(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:reports")
+	ps := params(r)
+	id := ps.Get("account_id")
+	if id == "" {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Target account can't be blank"})
+	}
+	target, err := models.ActorById(r.Context(), decodeID(id))
+	check(err)
+	comment := ps.Get("comment")
+	if utf8.RuneCountInString(comment) > models.MaxReportComment {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Comment is too long"})
+	}
+	var posts []*models.Post
+	for _, id := range ps["status_ids[]"] {
+		post := visiblePost(r, id, account)
+		if post.Author.ID().String() != target.ID().String() {
+			panic(failure{http.StatusUnprocessableEntity, "Validation failed: Statuses must be by the reported account"})
+		}
+		posts = append(posts, post)
+	}
+	forward, _ := strconv.ParseBool(ps.Get("forward"))
+	report, err := models.CreateReport(r.Context(), account.Actor, target, posts, comment, forward)
+	check(err)
+	if report.Forwarded {
+		federation.Deliver(r.Context(), report.Flag())
+	}
+	writeJSON(w, reportEntity(r.Context(), report))
+}
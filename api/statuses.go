@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/media"
+	"github.com/ekiru/kanna/models"
+)
+
+func createStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:statuses")
+	ps := params(r)
+	text := ps.Get("status")
+	attachments := mediaParam(r, account, ps)
+	if strings.TrimSpace(text) == "" && len(attachments) == 0 {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Text can't be blank"})
+	}
+	source := models.Source{Content: text, MediaType: markup.Markdown}
+	switch contentType := ps.Get("content_type"); contentType {
+	case "", markup.Markdown:
+	case markup.PlainText:
+		source.MediaType = contentType
+	default:
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Content type is not supported"})
+	}
+	visibility := models.VisibilityPublic
+	if name := ps.Get("visibility"); name != "" {
+		var ok bool
+		if visibility, ok = models.ParseVisibility(name); !ok {
+			panic(failure{http.StatusUnprocessableEntity, "Validation failed: Visibility is not included in the list"})
+		}
+	}
+	sensitive, _ := strconv.ParseBool(ps.Get("sensitive"))
+	cw := models.ContentWarning{Summary: ps.Get("spoiler_text"), Sensitive: sensitive}
+	var parent *models.Post
+	if id := ps.Get("in_reply_to_id"); id != "" {
+		parent = visiblePost(r, id, account)
+	}
+	post, activity, err := models.CreatePost(r.Context(), account.Actor, source, cw, visibility,
+		federation.ResolveMentions(r.Context(), source), parent, attachments)
+	if err == models.ErrAttachmentUnavailable {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Media is already attached to a status"})
+	}
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, statusEntity(r.Context(), post, account))
+}
+
+func showStatus(w http.ResponseWriter, r *http.Request) {
+	viewer := authenticate(r, "read:statuses")
+	writeJSON(w, statusEntity(r.Context(), postParam(r, viewer), viewer))
+}
+
+// statusContext returns the posts above and below a status in its
+// thread.
+func statusContext(w http.ResponseWriter, r *http.Request) {
+	type context struct {
+		Ancestors   []*Status `json:"ancestors"`
+		Descendants []*Status `json:"descendants"`
+	}
+	viewer := authenticate(r, "read:statuses")
+	post := postParam(r, viewer)
+	ancestors, err := models.Ancestors(r.Context(), post, actorOf(viewer))
+	check(err)
+	descendants, err := models.Descendants(r.Context(), post, actorOf(viewer))
+	check(err)
+	writeJSON(w, context{
+		Ancestors:   statusEntities(r.Context(), ancestors, viewer),
+		Descendants: statusEntities(r.Context(), descendants, viewer),
+	})
+}
+
+func deleteStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:statuses")
+	post := postParam(r, account)
+	if post.Author.ID().String() != account.Actor.ID().String() {
+		panic(notFound)
+	}
+	status := statusEntity(r.Context(), post, account)
+	text := post.SourceText()
+	status.Text = &text
+	activity, err := models.DeletePost(r.Context(), post)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	media.DeleteFiles(r.Context(), post.Attachment)
+	writeJSON(w, status)
+}
+
+func favouriteStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:favourites")
+	post := postParam(r, account)
+	activity, err := models.Like(r.Context(), account.Actor, post)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, statusEntity(r.Context(), post, account))
+}
+
+func unfavouriteStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:favourites")
+	post := postParam(r, account)
+	activity, err := models.Unlike(r.Context(), account.Actor, post)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, statusEntity(r.Context(), post, account))
+}
+
+// reblogStatus boosts a status, responding with a status representing
+// the boost.
+func reblogStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:statuses")
+	post := postParam(r, account)
+	activity, err := models.Announce(r.Context(), account.Actor, post)
+	if err == models.ErrCannotAnnounce {
+		panic(failure{http.StatusUnprocessableEntity, "Validation failed: Reblog of private toot is not allowed"})
+	}
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	status := statusEntity(r.Context(), post, account)
+	if activity == nil {
+		// The post was already boosted, so there's no new
+		// boost to describe.
+		writeJSON(w, status)
+		return
+	}
+	writeJSON(w, reblogEntity(r.Context(), activity.ID(), account.Actor, activity.Published, status))
+}
+
+func unreblogStatus(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "write:statuses")
+	post := postParam(r, account)
+	activity, err := models.Unannounce(r.Context(), account.Actor, post)
+	check(err)
+	federation.Deliver(r.Context(), activity)
+	writeJSON(w, statusEntity(r.Context(), post, account))
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/streaming"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// heartbeatInterval is how often streaming connections are sent
+	// something, so that clients and proxies can tell that they
+	// are still open.
+	heartbeatInterval = 15 * time.Second
+	// writeTimeout is how long writing an event to a client may take
+	// before the client is disconnected.
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	errUnknownStream = errors.New("Unknown stream type")
+	errNoTag         = errors.New("No tag for stream provided")
+	errNoToken       = errors.New("Missing access token")
+	errNoScope       = errors.New("Access token does not have the required scopes")
+)
+
+// A stream is one of the streams of events that clients can subscribe
+// to in the streaming API.
+type stream struct {
+	// name is the name of the stream, such as "user" or
+	// "public:local".
+	name string
+	// tag is the hashtag of hashtag streams.
+	tag string
+}
+
+// streamScopes are the scopes needed to subscribe to each stream.
+var streamScopes = map[string]string{
+	"user":              "read:statuses",
+	"user:notification": "read:notifications",
+	"public":            "read:statuses",
+	"public:local":      "read:statuses",
+	"public:remote":     "read:statuses",
+	"hashtag":           "read:statuses",
+	"hashtag:local":     "read:statuses",
+}
+
+// parseStream checks that a stream exists and that the viewer, whose
+// access token was granted scopes, may subscribe to it. The user
+// streams need an access token, while the others can be streamed by
+// anyone.
+func parseStream(name, tag string, viewer *models.Account, scopes string) (stream, error) {
+	scope, ok := streamScopes[name]
+	if !ok {
+		return stream{}, errUnknownStream
+	}
+	if strings.HasPrefix(name, "user") && viewer == nil {
+		return stream{}, errNoToken
+	}
+	if viewer != nil && !hasScope(scopes, scope) {
+		return stream{}, errNoScope
+	}
+	tag = strings.TrimPrefix(tag, "#")
+	if strings.HasPrefix(name, "hashtag") && tag == "" {
+		return stream{}, errNoTag
+	}
+	return stream{name, tag}, nil
+}
+
+// streamFailure converts an error from parseStream to a failure.
+func streamFailure(err error) failure {
+	switch err {
+	case errNoToken:
+		return unauthorized
+	case errNoScope:
+		return forbidden
+	default:
+		return failure{http.StatusBadRequest, err.Error()}
+	}
+}
+
+// names returns the stream's name as it is given in the messages sent
+// over WebSockets.
+func (s stream) names() []string {
+	if s.tag != "" {
+		return []string{s.name, s.tag}
+	}
+	return []string{s.name}
+}
+
+// render returns the payload of an event to send to the stream's
+// client, or false if the event doesn't belong in the stream or the
+// client may not see it.
+func (s stream) render(ctx context.Context, event streaming.Event, viewer *models.Account) (payload string, ok bool) {
+	// Events are rendered after they happened, so what they refer
+	// to may have changed since. Such events are left out rather
+	// than ending the stream.
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("streaming %s event: %v", event.Type, err)
+			payload, ok = "", false
+		}
+	}()
+	switch object := event.Object.(type) {
+	case *models.TimelineEntry:
+		if !s.includes(ctx, object, viewer) {
+			return "", false
+		}
+		var status *Status
+		switch event.Type {
+		case streaming.Delete:
+			return encodeID(object.ID()), true
+		case streaming.StatusUpdate:
+			status = statusEntity(ctx, object.Post, viewer)
+		default:
+			status = timelineEntity(ctx, object, viewer)
+		}
+		return marshal(status), true
+	case *models.Notification:
+		if !strings.HasPrefix(s.name, "user") || object.Recipient.ID().String() != viewer.Actor.ID().String() {
+			return "", false
+		}
+		return marshal(notificationEntity(ctx, object, viewer)), true
+	}
+	return "", false
+}
+
+// includes reports whether a timeline entry belongs in the stream and
+// may be seen by the viewer, as it would be in the timeline that the
+// stream follows.
+func (s stream) includes(ctx context.Context, entry *models.TimelineEntry, viewer *models.Account) bool {
+	var ok bool
+	var err error
+	switch s.name {
+	case "user":
+		ok, err = models.InHomeTimeline(ctx, viewer.Actor, entry)
+	case "public", "public:remote":
+		ok, err = models.InFederatedTimeline(ctx, actorOf(viewer), entry)
+		ok = ok && (s.name == "public" || !config.Get(ctx).IsLocal(entry.Post.Author.ID()))
+	case "public:local":
+		ok, err = models.InLocalTimeline(ctx, actorOf(viewer), entry)
+	case "hashtag", "hashtag:local":
+		if entry.BoostedBy != nil {
+			return false
+		}
+		if s.name == "hashtag:local" && !config.Get(ctx).IsLocal(entry.Post.Author.ID()) {
+			return false
+		}
+		ok, err = models.InHashtagTimeline(ctx, s.tag, actorOf(viewer), entry)
+	}
+	check(err)
+	return ok
+}
+
+func marshal(v interface{}) string {
+	buf, err := json.Marshal(v)
+	check(err)
+	return string(buf)
+}
+
+func streamingHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// streamEvents streams the events of the stream named in the path,
+// such as /api/v1/streaming/public/local, as Server-Sent Events.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	name := strings.Join(r.Context().Value(routes.Rest("stream")).([]string), ":")
+	scope, ok := streamScopes[name]
+	if !ok {
+		panic(failure{http.StatusNotFound, errUnknownStream.Error()})
+	}
+	viewer, scopes := authenticateScopes(r, scope)
+	s, err := parseStream(name, r.URL.Query().Get("tag"), viewer, scopes)
+	if err != nil {
+		panic(streamFailure(err))
+	}
+	hub := streaming.Get(r.Context())
+	if hub == nil {
+		panic(failure{http.StatusServiceUnavailable, "Streaming is not available"})
+	}
+	sub := hub.Subscribe()
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(format string, args ...interface{}) error {
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if send(":)\n\n") != nil {
+		return
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			err = send(":thump\n\n")
+		case event, ok := <-sub.C:
+			if !ok {
+				// The client fell behind, or the server is
+				// shutting down.
+				return
+			}
+			if payload, ok := s.render(r.Context(), event, viewer); ok {
+				err = send("event: %s\ndata: %s\n\n", event.Type, payload)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// A streamingMessage is sent to clients over a WebSocket.
+type streamingMessage struct {
+	Stream  []string `json:"stream,omitempty"`
+	Event   string   `json:"event,omitempty"`
+	Payload string   `json:"payload,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Status  int      `json:"status,omitempty"`
+}
+
+// A streamingCommand is received from clients over a WebSocket to
+// subscribe to or unsubscribe from a stream.
+type streamingCommand struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	Tag    string `json:"tag"`
+}
+
+// streamWebSocket streams events over a WebSocket, to which clients
+// can subscribe to several streams. A first stream can be given in the
+// stream and tag parameters. The access token can be passed as the
+// WebSocket protocol, since browsers can't set the Authorization
+// header of WebSockets.
+func streamWebSocket(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" && query.Get("access_token") == "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+protocol)
+	}
+	viewer, scopes := authenticateScopes(r, "read:statuses")
+	streams := make(map[string]stream)
+	if name := query.Get("stream"); name != "" {
+		s, err := parseStream(name, query.Get("tag"), viewer, scopes)
+		if err != nil {
+			panic(streamFailure(err))
+		}
+		streams[strings.Join(s.names(), ":")] = s
+	}
+	hub := streaming.Get(r.Context())
+	if hub == nil {
+		panic(failure{http.StatusServiceUnavailable, "Streaming is not available"})
+	}
+	ctx := r.Context()
+	server := websocket.Server{
+		// Clients authenticate with access tokens rather than
+		// cookies, so WebSockets are accepted from any origin.
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			if len(cfg.Protocol) > 1 {
+				cfg.Protocol = cfg.Protocol[:1]
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			serveWebSocket(ctx, ws, hub.Subscribe(), streams, viewer, scopes)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func serveWebSocket(ctx context.Context, ws *websocket.Conn, sub *streaming.Subscription, streams map[string]stream, viewer *models.Account, scopes string) {
+	defer ws.Close()
+	defer sub.Close()
+	// Commands are read in the background, so that events can be
+	// sent while waiting for them.
+	commands := make(chan streamingCommand)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var cmd streamingCommand
+			if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+				if _, ok := err.(*json.SyntaxError); ok {
+					continue
+				}
+				return
+			}
+			select {
+			case commands <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	send := func(msg streamingMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return websocket.JSON.Send(ws, msg)
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	var err error
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			ws.PayloadType = websocket.PingFrame
+			_, err = ws.Write(nil)
+		case cmd := <-commands:
+			err = handleCommand(cmd, streams, viewer, scopes, send)
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			for _, s := range streams {
+				if payload, ok := s.render(ctx, event, viewer); ok {
+					if err = send(streamingMessage{Stream: s.names(), Event: event.Type, Payload: payload}); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleCommand subscribes to or unsubscribes from a stream, reporting
+// errors to the client.
+func handleCommand(cmd streamingCommand, streams map[string]stream, viewer *models.Account, scopes string, send func(streamingMessage) error) error {
+	s, err := parseStream(cmd.Stream, cmd.Tag, viewer, scopes)
+	if err != nil {
+		f := streamFailure(err)
+		return send(streamingMessage{Error: f.message, Status: f.status})
+	}
+	switch cmd.Type {
+	case "subscribe":
+		streams[strings.Join(s.names(), ":")] = s
+	case "unsubscribe":
+		delete(streams, strings.Join(s.names(), ":"))
+	default:
+		return send(streamingMessage{Error: "Unknown command type", Status: http.StatusBadRequest})
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 40
+)
+
+// pageParam reads the Mastodon pagination parameters from a request.
+func pageParam(r *http.Request) models.Page {
+	return pageParamIDs(r, decodeID)
+}
+
+// pageParamIDs is like pageParam for entities whose IDs aren't encoded
+// with encodeID, using decode to convert their IDs to model IDs.
+func pageParamIDs(r *http.Request, decode func(string) string) models.Page {
+	query := r.URL.Query()
+	page := models.Page{Limit: defaultLimit}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		page.Limit = limit
+	}
+	if page.Limit > maxLimit {
+		page.Limit = maxLimit
+	}
+	if id := query.Get("max_id"); id != "" {
+		page.MaxID = decode(id)
+	}
+	if id := query.Get("since_id"); id != "" {
+		page.SinceID = decode(id)
+	}
+	if id := query.Get("min_id"); id != "" {
+		page.MinID = decode(id)
+	}
+	return page
+}
+
+// writePage sends a page of statuses along with a Link header pointing
+// to the next (older) and previous (newer) pages.
+func writePage(w http.ResponseWriter, r *http.Request, posts []*models.Post, viewer *models.Account) {
+	if len(posts) > 0 {
+		writeLinks(w, r, posts[0].ID(), posts[len(posts)-1].ID())
+	}
+	writeJSON(w, statusEntities(r.Context(), posts, viewer))
+}
+
+// writeTimeline sends a page of a timeline like writePage, with boosts
+// represented as reblogs.
+func writeTimeline(w http.ResponseWriter, r *http.Request, timeline []*models.TimelineEntry, viewer *models.Account) {
+	if len(timeline) > 0 {
+		writeLinks(w, r, timeline[0].ID(), timeline[len(timeline)-1].ID())
+	}
+	statuses := make([]*Status, len(timeline))
+	for i, entry := range timeline {
+		statuses[i] = timelineEntity(r.Context(), entry, viewer)
+	}
+	writeJSON(w, statuses)
+}
+
+// writeLinks sets the Link header pointing to the pages before and
+// after the page whose first and last items have the IDs supplied.
+func writeLinks(w http.ResponseWriter, r *http.Request, first, last *url.URL) {
+	writeLinkIDs(w, r, encodeID(first), encodeID(last))
+}
+
+// writeLinkIDs is like writeLinks for API IDs that have already been
+// encoded.
+func writeLinkIDs(w http.ResponseWriter, r *http.Request, first, last string) {
+	link := func(param string, id string) string {
+		u := config.Get(r.Context()).URL()
+		u.Path = r.URL.Path
+		query := r.URL.Query()
+		for _, p := range []string{"max_id", "since_id", "min_id"} {
+			query.Del(p)
+		}
+		query.Set(param, id)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="prev"`,
+		link("max_id", last), link("min_id", first)))
+}
+
+func homeTimeline(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:statuses")
+	timeline, err := models.HomeTimeline(r.Context(), account.Actor, pageParam(r))
+	check(err)
+	writeTimeline(w, r, timeline, account)
+}
+
+// publicTimeline lists the public posts known to the server, or only
+// those from this server if the local parameter is true.
+func publicTimeline(w http.ResponseWriter, r *http.Request) {
+	viewer := authenticate(r, "read:statuses")
+	timeline := models.FederatedTimeline
+	if local, _ := strconv.ParseBool(params(r).Get("local")); local {
+		timeline = models.LocalTimeline
+	}
+	entries, err := timeline(r.Context(), actorOf(viewer), pageParam(r))
+	check(err)
+	writeTimeline(w, r, entries, viewer)
+}
+
+func accountStatuses(w http.ResponseWriter, r *http.Request) {
+	viewer := authenticate(r, "read:statuses")
+	timeline, err := models.ProfileTimeline(r.Context(), actorParam(r), actorOf(viewer), pageParam(r))
+	check(err)
+	writeTimeline(w, r, timeline, viewer)
+}
+
+func favourites(w http.ResponseWriter, r *http.Request) {
+	account := requireAuth(r, "read:favourites")
+	posts, err := models.LikedPosts(r.Context(), account.Actor, pageParam(r))
+	check(err)
+	writePage(w, r, posts, account)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "fmt"
+
+// configCheck reports the mistakes in the configuration, failing if
+// there are any.
+func configCheck(e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	errs := e.cfg.Check()
+	for _, err := range errs {
+		fmt.Fprintln(e.out, err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("the configuration has %d mistakes", len(errs))
+	}
+	fmt.Fprintln(e.out, "The configuration is valid.")
+	return nil
+}
@@ -0,0 +1,211 @@
+// The config package defines the settings used to configure a Kanna
+// server and loads them from a JSON file.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ekiru/kanna/routes"
+)
+
+// A Config holds the settings for a Kanna server.
+type Config struct {
+	// BaseURL is the URL at which the server is reachable, without
+	// a trailing slash. The IDs of local objects are built from it.
+	BaseURL string `json:"baseUrl"`
+	// Listen is the address on which the HTTP server listens.
+	Listen string `json:"listen"`
+	// Database is the path of the SQLite database file, or the
+	// postgres:// URL of a PostgreSQL database.
+	Database string `json:"database"`
+	// Instance describes the server to clients.
+	Instance Instance `json:"instance"`
+	// Media configures how the files of media attachments are
+	// stored.
+	Media Media `json:"media"`
+}
+
+// An Instance describes the server to clients and other servers.
+type Instance struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Email       string `json:"email"`
+}
+
+// Media configures the storage of media attachments.
+type Media struct {
+	// Storage is "file" to store files in Dir, or "s3" to store
+	// them in an S3-compatible bucket.
+	Storage string `json:"storage"`
+	// Dir is the directory in which files are stored when Storage
+	// is "file".
+	Dir string `json:"dir"`
+	// S3 configures the bucket used when Storage is "s3".
+	S3 S3 `json:"s3"`
+	// MaxUploadSize is the size in bytes of the largest file that
+	// can be uploaded.
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// MaxRemoteSize is the size in bytes of the largest attachment
+	// of a post from another server that will be cached.
+	MaxRemoteSize int64 `json:"maxRemoteSize"`
+	// MaxPixels is the largest number of pixels an image may have,
+	// so that small files can't decode to huge images.
+	MaxPixels int `json:"maxPixels"`
+}
+
+// S3 identifies a bucket in an S3-compatible object store, such as
+// Amazon S3 or MinIO, and the credentials with which to access it.
+type S3 struct {
+	// Endpoint is the URL of the store, such as
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// PathStyle, if true, addresses the bucket as a path under the
+	// endpoint rather than as a subdomain of it, as most stores
+	// other than Amazon S3 require.
+	PathStyle bool `json:"pathStyle"`
+}
+
+// Default returns the configuration used when no configuration file
+// is present.
+func Default() *Config {
+	return &Config{
+		BaseURL:  "https://faew.ink",
+		Listen:   "localhost:9123",
+		Database: "db.sqlite3",
+		Instance: Instance{
+			Title: "Kanna",
+		},
+		Media: Media{
+			Storage:       "file",
+			Dir:           "uploads",
+			MaxUploadSize: 8 << 20,
+			MaxRemoteSize: 8 << 20,
+			MaxPixels:     40000000,
+		},
+	}
+}
+
+// Load reads a configuration file, using the defaults for any settings
+// the file does not specify. If the file does not exist, Load returns
+// the default configuration.
+func Load(filename string) (*Config, error) {
+	cfg := Default()
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	return cfg, nil
+}
+
+// InitParams configures a Router to pass the configuration to request
+// handlers via the context.
+func InitParams(router *routes.Router, cfg *Config) {
+	router.BaseParam(configKey{}, cfg)
+}
+
+// WithConfig returns a copy of the context carrying the configuration,
+// for use outside of request handlers.
+func WithConfig(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, cfg)
+}
+
+type configKey struct{}
+
+// Get retrieves the configuration from the request context.
+func Get(ctx context.Context) *Config {
+	return ctx.Value(configKey{}).(*Config)
+}
+
+// Host returns the host name (and port, if any) of the BaseURL.
+func (cfg *Config) Host() string {
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// URL builds the URL of a local resource from the path components
+// supplied, escaping each of them.
+func (cfg *Config) URL(components ...string) *url.URL {
+	escaped := make([]string, len(components))
+	for i, component := range components {
+		escaped[i] = url.PathEscape(component)
+	}
+	u, err := url.Parse(cfg.BaseURL + "/" + strings.Join(escaped, "/"))
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// InDomain reports whether the server's host is a domain or one of its
+// subdomains.
+func (cfg *Config) InDomain(domain string) bool {
+	host := strings.ToLower(cfg.Host())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// IsLocal reports whether a URL identifies a resource on this server.
+func (cfg *Config) IsLocal(u *url.URL) bool {
+	return u != nil && strings.HasPrefix(u.String(), cfg.BaseURL+"/")
+}
+
+// Check looks for mistakes in the configuration, returning an error
+// for each setting that is invalid.
+func (cfg *Config) Check() []error {
+	var errs []error
+	if u, err := url.Parse(cfg.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("baseUrl: %v", err))
+	} else if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("baseUrl: %q isn't an http or https URL", cfg.BaseURL))
+	}
+	if cfg.Listen == "" {
+		errs = append(errs, errors.New("listen: missing"))
+	}
+	if cfg.Database == "" {
+		errs = append(errs, errors.New("database: missing"))
+	}
+	switch cfg.Media.Storage {
+	case "file":
+		if cfg.Media.Dir == "" {
+			errs = append(errs, errors.New("media.dir: missing"))
+		}
+	case "s3":
+		if u, err := url.Parse(cfg.Media.S3.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("media.s3.endpoint: %q isn't a URL", cfg.Media.S3.Endpoint))
+		}
+		if cfg.Media.S3.Bucket == "" {
+			errs = append(errs, errors.New("media.s3.bucket: missing"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("media.storage: %q isn't file or s3", cfg.Media.Storage))
+	}
+	if cfg.Media.MaxUploadSize <= 0 {
+		errs = append(errs, errors.New("media.maxUploadSize: must be positive"))
+	}
+	if cfg.Media.MaxRemoteSize <= 0 {
+		errs = append(errs, errors.New("media.maxRemoteSize: must be positive"))
+	}
+	if cfg.Media.MaxPixels <= 0 {
+		errs = append(errs, errors.New("media.maxPixels: must be positive"))
+	}
+	return errs
+}
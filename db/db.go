@@ -5,35 +5,252 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/ekiru/kanna/routes"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// Open opens a connection to Kanna's database. This should only be
-// called directly when running database migrations. In the normal
+// A Database is a pool of connections to Kanna's database, which
+// speaks a Dialect. Its methods that take queries accept them with ?
+// placeholders and rewrite those for the dialect, so that the same
+// queries can be used with every database.
+type Database struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Open opens a connection to Kanna's database. The source is either the
+// path or file: URI of an SQLite database or the postgres:// URL of a
+// PostgreSQL database, which requires kanna to be built with the
+// postgres tag. SQLite databases are always opened with foreign keys
+// enforced and so that transactions take the database's write lock as
+// soon as they begin, whatever the source's options say, since the
+// deletions that cascade and the lock that stops two processes from
+// migrating the database at once rely on them. This should only be
+// called directly when starting the kanna program. In the normal
 // operation of the application, the database will be passed through to
 // request handlers via the context and can be accessed using the DB
 // function.
-func Open() (*sql.DB, error) {
-	return sql.Open("sqlite3", "db.sqlite3")
+func Open(source string) (*Database, error) {
+	if strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://") {
+		return open(PostgreSQL, source)
+	}
+	return open(SQLite, sqliteSource(source))
+}
+
+// sqliteOptions are the options that SQLite databases are opened with,
+// along with the other names that the driver accepts for them.
+var sqliteOptions = []struct {
+	names []string
+	value string
+}{
+	{[]string{"_foreign_keys", "_fk"}, "on"},
+	{[]string{"_txlock"}, "immediate"},
+}
+
+// sqliteSource sets the options in sqliteOptions in the query string of
+// the source of an SQLite database, replacing any values that the
+// source gives them and keeping its other options.
+func sqliteSource(source string) string {
+	var params []string
+	if i := strings.IndexByte(source, '?'); i >= 0 {
+		for _, param := range strings.Split(source[i+1:], "&") {
+			if param != "" && !isSqliteOption(param) {
+				params = append(params, param)
+			}
+		}
+		source = source[:i]
+	}
+	for _, opt := range sqliteOptions {
+		params = append(params, opt.names[0]+"="+opt.value)
+	}
+	return source + "?" + strings.Join(params, "&")
 }
 
-// InitParams connects to the database and configures a Router to pass
-// the database to request handlers via the context.
-func InitParams(router *routes.Router) error {
-	db, err := Open()
+// isSqliteOption reports whether a parameter of a query string sets one
+// of the options in sqliteOptions.
+func isSqliteOption(param string) bool {
+	name := param
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		name = param[:i]
+	}
+	// A name that can't be unescaped is left for the driver to
+	// complain about.
+	name, err := url.QueryUnescape(name)
+	if err != nil {
+		return false
+	}
+	for _, opt := range sqliteOptions {
+		for _, optName := range opt.names {
+			if name == optName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func open(d Dialect, source string) (*Database, error) {
+	found := false
+	for _, name := range sql.Drivers() {
+		found = found || name == d.Name()
+	}
+	if !found {
+		return nil, fmt.Errorf("kanna was built without the %s driver; build it with -tags postgres", d.Name())
+	}
+	conn, err := sql.Open(d.Name(), source)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &Database{conn, d}, nil
+}
+
+// Exec executes a query without returning any rows.
+func (db *Database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(rebind(db.Dialect, query), args...)
+}
+
+// ExecContext executes a query without returning any rows.
+func (db *Database) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, rebind(db.Dialect, query), args...)
+}
+
+// Query executes a query that returns rows.
+func (db *Database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(rebind(db.Dialect, query), args...)
+}
+
+// QueryContext executes a query that returns rows.
+func (db *Database) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, rebind(db.Dialect, query), args...)
+}
+
+// QueryRow executes a query that returns at most one row.
+func (db *Database) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(rebind(db.Dialect, query), args...)
+}
+
+// QueryRowContext executes a query that returns at most one row.
+func (db *Database) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(ctx, rebind(db.Dialect, query), args...)
+}
+
+// InitParams configures a Router to pass the database to request
+// handlers via the context.
+func InitParams(router *routes.Router, db *Database) {
 	router.BaseParam(dbKey{}, db)
-	return nil
+}
+
+// WithDB returns a copy of the context carrying the database, for use
+// outside of request handlers.
+func WithDB(ctx context.Context, db *Database) context.Context {
+	return context.WithValue(ctx, dbKey{}, db)
 }
 
 type dbKey struct{}
 
-// DB retrieves the database object from the request context.
-func DB(ctx context.Context) *sql.DB {
-	// TODO: maybe check this
-	return ctx.Value(dbKey{}).(*sql.DB)
+// ErrNoDatabase is returned when the database is needed and the
+// context doesn't carry it.
+var ErrNoDatabase = errors.New("the context doesn't carry the database")
+
+// Pool retrieves the database from the request context, ignoring any
+// transaction that it carries, for work that should outlive the
+// transaction, such as that done in the background.
+func Pool(ctx context.Context) (*Database, error) {
+	db, ok := ctx.Value(dbKey{}).(*Database)
+	if !ok {
+		return nil, ErrNoDatabase
+	}
+	return db, nil
+}
+
+// A Conn makes queries in the transaction begun by WithTx, or on the
+// database if there is none. Like a Database, it accepts queries with
+// ? placeholders.
+type Conn struct {
+	// Dialect is the dialect of the database.
+	Dialect Dialect
+	q       interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+}
+
+// DB retrieves the database from the request context, making queries
+// in the transaction that the context carries, if any.
+func DB(ctx context.Context) (*Conn, error) {
+	if t, ok := ctx.Value(txKey{}).(*tx); ok {
+		return &Conn{t.dialect, t.Tx}, nil
+	}
+	db, err := Pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{db.Dialect, db.DB}, nil
+}
+
+// ExecContext executes a query without returning any rows.
+func (c *Conn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(ctx, rebind(c.Dialect, query), args...)
+}
+
+// QueryContext executes a query that returns rows.
+func (c *Conn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, rebind(c.Dialect, query), args...)
+}
+
+// QueryRowContext executes a query that returns at most one row.
+func (c *Conn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(ctx, rebind(c.Dialect, query), args...)
+}
+
+// Exec executes a query without returning any rows, on the Conn that
+// DB returns for the context.
+func Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	conn, err := DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.ExecContext(ctx, query, args...)
+}
+
+// Query executes a query that returns rows, on the Conn that DB
+// returns for the context.
+func Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	conn, err := DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.QueryContext(ctx, query, args...)
+}
+
+// A Row is the result of QueryRow, which reports any error in finding
+// the database when it is scanned.
+type Row struct {
+	row *sql.Row
+	err error
+}
+
+// QueryRow executes a query that returns at most one row, on the Conn
+// that DB returns for the context.
+func QueryRow(ctx context.Context, query string, args ...interface{}) *Row {
+	conn, err := DB(ctx)
+	if err != nil {
+		return &Row{err: err}
+	}
+	return &Row{row: conn.QueryRowContext(ctx, query, args...)}
+}
+
+// Scan copies the columns of the row into the values pointed at by
+// dest, as sql.Row's Scan does.
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Scan(dest...)
 }
@@ -0,0 +1,38 @@
+package db
+
+import "testing"
+
+func TestSqliteSource(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"kanna.db", "kanna.db?_foreign_keys=on&_txlock=immediate"},
+		{"file:kanna.db?cache=shared", "file:kanna.db?cache=shared&_foreign_keys=on&_txlock=immediate"},
+		{"file::memory:?mode=memory", "file::memory:?mode=memory&_foreign_keys=on&_txlock=immediate"},
+		{"kanna.db?", "kanna.db?_foreign_keys=on&_txlock=immediate"},
+		{"kanna.db?_fk=off", "kanna.db?_foreign_keys=on&_txlock=immediate"},
+		{"kanna.db?_foreign_keys=off&_txlock=deferred", "kanna.db?_foreign_keys=on&_txlock=immediate"},
+		{"kanna.db?_txlock=exclusive&_busy_timeout=100&", "kanna.db?_busy_timeout=100&_foreign_keys=on&_txlock=immediate"},
+		{"file:kanna.db?%5Ftxlock=deferred&mode=rw", "file:kanna.db?mode=rw&_foreign_keys=on&_txlock=immediate"},
+	}
+	for _, test := range tests {
+		if got := sqliteSource(test.source); got != test.want {
+			t.Errorf("sqliteSource(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestOpenSqliteWithQuery(t *testing.T) {
+	db, err := Open("file:" + t.TempDir() + "/kanna.db?cache=shared&_foreign_keys=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var fk int
+	if err = db.QueryRow("pragma foreign_keys").Scan(&fk); err != nil {
+		t.Fatal(err)
+	}
+	if fk != 1 {
+		t.Errorf("foreign_keys = %d, want 1", fk)
+	}
+}
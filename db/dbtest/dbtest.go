@@ -0,0 +1,114 @@
+// The dbtest package opens databases for tests, so that the same tests
+// can be run against each of the dialects that Kanna supports.
+//
+// SQLite databases are created in temporary directories. PostgreSQL
+// needs a server, so tests are only run against it if the
+// KANNA_TEST_POSTGRES environment variable holds the postgres:// URL of
+// a database, in which each test gets a schema of its own, and if the
+// tests are built with the postgres tag:
+//
+//	KANNA_TEST_POSTGRES=postgres://localhost/kanna_test?sslmode=disable \
+//		go test -tags sqlite_fts5,postgres ./...
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/migrations"
+)
+
+// PostgresEnv is the environment variable holding the URL of the
+// PostgreSQL database to test against.
+const PostgresEnv = "KANNA_TEST_POSTGRES"
+
+// Run runs f as a subtest named after each dialect, with a new empty
+// database of that dialect. The subtest for PostgreSQL is skipped if
+// PostgresEnv isn't set.
+func Run(t *testing.T, f func(t *testing.T, database *db.Database)) {
+	for _, d := range []db.Dialect{db.SQLite, db.PostgreSQL} {
+		t.Run(d.Name(), func(t *testing.T) {
+			f(t, Open(t, d))
+		})
+	}
+}
+
+// Open opens a new empty database of a dialect, which is closed and
+// removed when the test finishes. The test is skipped if the dialect is
+// PostgreSQL and PostgresEnv isn't set.
+func Open(t *testing.T, d db.Dialect) *db.Database {
+	t.Helper()
+	if d != db.PostgreSQL {
+		return open(t, filepath.Join(t.TempDir(), "kanna.db"))
+	}
+	source := os.Getenv(PostgresEnv)
+	if source == "" {
+		t.Skip(PostgresEnv + " isn't set")
+	}
+	admin := open(t, source)
+	schema := "kanna_test_" + randomHex(t)
+	if _, err := admin.Exec("create schema " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("drop schema " + schema + " cascade"); err != nil {
+			t.Error(err)
+		}
+	})
+	u, err := url.Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Parameters that the driver doesn't know are set on each of
+	// the connections that it opens.
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return open(t, u.String())
+}
+
+func open(t *testing.T, source string) *db.Database {
+	t.Helper()
+	database, err := db.Open(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run in reverse, so the database is closed before any
+	// schema it was opened in is dropped.
+	t.Cleanup(func() {
+		database.Close()
+	})
+	return database
+}
+
+func randomHex(t *testing.T) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Migrate applies all of the migrations to a database.
+func Migrate(t *testing.T, database *db.Database) {
+	t.Helper()
+	run, err := db.StartMigrations(context.Background(), database, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations.All() {
+		if _, err = run.Apply(migration); err != nil {
+			run.Close()
+			t.Fatalf("applying %s: %v", migration.ID(), err)
+		}
+	}
+	if err = run.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
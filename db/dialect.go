@@ -0,0 +1,385 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Dialect is the variant of SQL spoken by a kind of database that
+// Kanna can store its data in. Queries are written with ? placeholders
+// and in the SQL that SQLite and PostgreSQL share, and the Dialect
+// supplies what they don't.
+type Dialect interface {
+	// Name is the name of the database/sql driver for the
+	// database.
+	Name() string
+	// Placeholder returns the placeholder for the nth argument of
+	// a query, counting from 1.
+	Placeholder(n int) string
+	// TypeName returns the name of a column type.
+	TypeName(t ColumnType) string
+	// AutoIncrement returns the definition of an integer primary
+	// key whose values the database supplies, never reusing those
+	// of deleted rows.
+	AutoIncrement() string
+	// Upsert returns the clause that ends an insert so that a row
+	// which conflicts with an existing one on the conflict columns
+	// updates the update columns of it instead, or is left out if
+	// no update columns are given. Without conflict columns, rows
+	// that conflict with existing ones on any unique columns are
+	// left out.
+	Upsert(conflict []string, update ...string) string
+	// CaseInsensitive returns an expression comparing as the text
+	// expr does, but ignoring case.
+	CaseInsensitive(expr string) string
+	// Literal writes a value as an SQL literal.
+	Literal(v interface{}) string
+
+	// RowID returns the definition of a column named rowid that
+	// numbers the rows of a table in the order in which they were
+	// inserted, which tables created by the migration helpers are
+	// given if the database doesn't add it itself, or "".
+	RowID() string
+
+	// foreignKeys turns the enforcement of foreign keys on a
+	// connection on or off outside of transactions, if the
+	// database allows it.
+	foreignKeys(conn *sql.Conn, on bool) error
+	// checkForeignKeys fails if any rows of the database refer to
+	// rows of other tables that don't exist, if the database
+	// doesn't check them itself.
+	checkForeignKeys(tx *sql.Tx) error
+	// lockMigrations waits until no other transaction is migrating
+	// the database and stops any other from doing so until the
+	// transaction ends, if beginning a transaction doesn't. It
+	// gives up when the context is done.
+	lockMigrations(ctx context.Context, tx *sql.Tx) error
+	// migrationLock describes the lock that is held while the
+	// database is migrated, for the errors of those waiting for it.
+	migrationLock() string
+	// hasColumn reports whether a table has a column.
+	hasColumn(db querier, table, column string) (bool, error)
+	// schema returns the statements that create the database's
+	// tables and indexes, as Schema does.
+	schema(db querier) ([]string, error)
+}
+
+// The dialects of the databases that Kanna supports.
+var (
+	SQLite     Dialect = sqliteDialect{}
+	PostgreSQL Dialect = postgresDialect{}
+)
+
+// Dialects are the dialects of the databases that Kanna supports, by
+// their names.
+var Dialects = map[string]Dialect{
+	SQLite.Name():     SQLite,
+	PostgreSQL.Name(): PostgreSQL,
+}
+
+// A ColumnType identifies a column type when creating tables or adding
+// or modifying columns.
+type ColumnType int
+
+const (
+	String ColumnType = iota
+	Text
+	Int
+	Float
+	Bool
+	Timestamp
+	Blob
+)
+
+// rebind rewrites the ? placeholders of a query outside of quotes with
+// those of a dialect.
+func rebind(d Dialect, q string) string {
+	if d == SQLite || !strings.Contains(q, "?") {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	forEachPlaceholder(q, &b, func() {
+		n++
+		b.WriteString(d.Placeholder(n))
+	})
+	return b.String()
+}
+
+// forEachPlaceholder copies a query to b, calling f in place of each ?
+// placeholder outside of quotes.
+func forEachPlaceholder(q string, b *strings.Builder, f func()) {
+	var quote rune
+	for _, c := range q {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			f()
+			continue
+		}
+		b.WriteRune(c)
+	}
+}
+
+// upsert writes the on conflict clause that both SQLite and PostgreSQL
+// understand.
+func upsert(conflict []string, update []string) string {
+	var b strings.Builder
+	b.WriteString(" on conflict")
+	if len(conflict) != 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(conflict, ", "))
+	}
+	if len(update) == 0 {
+		b.WriteString(" do nothing")
+		return b.String()
+	}
+	b.WriteString(" do update set ")
+	for i, col := range update {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = excluded.%s", col, col)
+	}
+	return b.String()
+}
+
+// literal writes a value as an SQL literal, using a function for the
+// kinds of values that the dialects write differently.
+func literal(arg interface{}, special func(v driver.Value) (string, bool)) string {
+	v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+	if err != nil {
+		v = fmt.Sprint(arg)
+	}
+	if s, ok := special(v); ok {
+		return s
+	}
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case int64, float64:
+		return fmt.Sprint(v)
+	case time.Time:
+		return literal(v.UTC().Format(timeFormat), special)
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+	}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (sqliteDialect) TypeName(t ColumnType) string {
+	switch t {
+	case String, Text:
+		return "text"
+	case Int, Timestamp:
+		return "int"
+	case Float:
+		return "real"
+	case Bool:
+		return "boolean"
+	case Blob:
+		return "blob"
+	default:
+		panic(fmt.Sprintf("unknown column type %d", t))
+	}
+}
+
+func (sqliteDialect) AutoIncrement() string {
+	return "integer primary key autoincrement"
+}
+
+func (sqliteDialect) Upsert(conflict []string, update ...string) string {
+	return upsert(conflict, update)
+}
+
+func (sqliteDialect) CaseInsensitive(expr string) string {
+	return expr + " collate nocase"
+}
+
+func (sqliteDialect) Literal(v interface{}) string {
+	return literal(v, func(v driver.Value) (string, bool) {
+		switch v := v.(type) {
+		case bool:
+			if v {
+				return "1", true
+			}
+			return "0", true
+		case []byte:
+			return "x'" + hex.EncodeToString(v) + "'", true
+		}
+		return "", false
+	})
+}
+
+// RowID returns "", since every SQLite table that isn't created
+// without one has a rowid.
+func (sqliteDialect) RowID() string {
+	return ""
+}
+
+func (sqliteDialect) foreignKeys(conn *sql.Conn, on bool) error {
+	pragma := "pragma foreign_keys = off"
+	if on {
+		pragma = "pragma foreign_keys = on"
+	}
+	_, err := conn.ExecContext(context.Background(), pragma)
+	return err
+}
+
+func (sqliteDialect) checkForeignKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("pragma foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fk int
+		if err = rows.Scan(&table, &rowid, &parent, &fk); err != nil {
+			return err
+		}
+		return fmt.Errorf("a row of %s refers to a row of %s that doesn't exist", table, parent)
+	}
+	return rows.Err()
+}
+
+// lockMigrations does nothing, since the database is opened so that
+// transactions take its write lock as soon as they begin.
+func (sqliteDialect) lockMigrations(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+
+func (sqliteDialect) migrationLock() string {
+	return "the database's write lock"
+}
+
+func (sqliteDialect) hasColumn(db querier, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from pragma_table_info(?) where name = ?", table, column).Scan(&count)
+	return count != 0, err
+}
+
+func (sqliteDialect) schema(db querier) ([]string, error) {
+	return queryStrings(db, `select m.sql from sqlite_master m
+	left join pragma_table_list l on l.schema = 'main' and l.name = m.name
+	where m.sql is not null and m.name not like 'sqlite\_%' escape '\'
+		and coalesce(l.type, '') != 'shadow'
+	order by m.rowid`)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresDialect) TypeName(t ColumnType) string {
+	switch t {
+	case String, Text:
+		return "text"
+	case Int, Timestamp:
+		return "bigint"
+	case Float:
+		return "double precision"
+	case Bool:
+		return "boolean"
+	case Blob:
+		return "bytea"
+	default:
+		panic(fmt.Sprintf("unknown column type %d", t))
+	}
+}
+
+func (postgresDialect) AutoIncrement() string {
+	return "bigint generated by default as identity primary key"
+}
+
+func (postgresDialect) Upsert(conflict []string, update ...string) string {
+	return upsert(conflict, update)
+}
+
+// CaseInsensitive lowercases the expression, so indexes that ignore
+// case must be on lower(column) too.
+func (postgresDialect) CaseInsensitive(expr string) string {
+	return "lower(" + expr + ")"
+}
+
+func (postgresDialect) Literal(v interface{}) string {
+	return literal(v, func(v driver.Value) (string, bool) {
+		switch v := v.(type) {
+		case bool:
+			return strconv.FormatBool(v), true
+		case []byte:
+			return `'\x` + hex.EncodeToString(v) + "'::bytea", true
+		}
+		return "", false
+	})
+}
+
+// RowID returns an identity column, which stands in for SQLite's rowid
+// so that rows can be ordered as they were inserted.
+func (postgresDialect) RowID() string {
+	return "rowid bigint generated always as identity"
+}
+
+// foreignKeys does nothing, since PostgreSQL always enforces foreign
+// keys.
+func (postgresDialect) foreignKeys(conn *sql.Conn, on bool) error {
+	return nil
+}
+
+func (postgresDialect) checkForeignKeys(tx *sql.Tx) error {
+	return nil
+}
+
+// migrationLockKey is the key of the advisory lock that is held while
+// the database is migrated.
+const migrationLockKey = 0x6b616e6e61
+
+func (postgresDialect) lockMigrations(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock($1)", migrationLockKey)
+	return err
+}
+
+func (postgresDialect) migrationLock() string {
+	return fmt.Sprintf("the advisory lock %d", migrationLockKey)
+}
+
+func (postgresDialect) hasColumn(db querier, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from information_schema.columns "+
+		"where table_schema = current_schema() and table_name = lower($1) and column_name = lower($2)",
+		table, column).Scan(&count)
+	return count != 0, err
+}
+
+// schema fails, since PostgreSQL doesn't keep the statements that
+// created its tables; pg_dump --schema-only writes equivalent ones.
+func (postgresDialect) schema(db querier) ([]string, error) {
+	return nil, errors.New("the schema of a PostgreSQL database can't be dumped; use pg_dump --schema-only")
+}
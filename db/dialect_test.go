@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		q, want string
+	}{
+		{"select 1", "select 1"},
+		{"select * from Posts where id = ?", "select * from Posts where id = $1"},
+		{"insert into Tags (objectId, type, href, name) values (?, ?, ?, ?)",
+			"insert into Tags (objectId, type, href, name) values ($1, $2, $3, $4)"},
+		{"select ? from Posts where content = '?' and id = ?",
+			"select $1 from Posts where content = '?' and id = $2"},
+		{`select "a?b" from Posts where id = ?`, `select "a?b" from Posts where id = $1`},
+		{"select 'it''s ?' where id = ? and name = 'what?'",
+			"select 'it''s ?' where id = $1 and name = 'what?'"},
+		{`select '"?' where id = ? and x = "'?"`, `select '"?' where id = $1 and x = "'?"`},
+		{"select 'héllo ?', ? where ü = ?", "select 'héllo ?', $1 where ü = $2"},
+	}
+	for _, test := range tests {
+		if got := rebind(PostgreSQL, test.q); got != test.want {
+			t.Errorf("rebind(PostgreSQL, %q) = %q, want %q", test.q, got, test.want)
+		}
+		if got := rebind(SQLite, test.q); got != test.q {
+			t.Errorf("rebind(SQLite, %q) = %q, want it unchanged", test.q, got)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	tests := []struct {
+		conflict []string
+		update   []string
+		want     string
+	}{
+		{nil, nil, " on conflict do nothing"},
+		{[]string{"id"}, nil, " on conflict (id) do nothing"},
+		{[]string{"id"}, []string{"name"}, " on conflict (id) do update set name = excluded.name"},
+		{[]string{"actorId", "objectId"}, []string{"type", "published"},
+			" on conflict (actorId, objectId) do update set type = excluded.type, published = excluded.published"},
+	}
+	for _, d := range []Dialect{SQLite, PostgreSQL} {
+		for _, test := range tests {
+			if got := d.Upsert(test.conflict, test.update...); got != test.want {
+				t.Errorf("%s: Upsert(%q, %q) = %q, want %q", d.Name(), test.conflict, test.update, got, test.want)
+			}
+		}
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	tests := []struct {
+		v                interface{}
+		sqlite, postgres string
+	}{
+		{nil, "null", "null"},
+		{42, "42", "42"},
+		{1.5, "1.5", "1.5"},
+		{"it's", "'it''s'", "'it''s'"},
+		{true, "1", "true"},
+		{false, "0", "false"},
+		{[]byte{0xca, 0xfe}, "x'cafe'", `'\xcafe'::bytea`},
+		{when, "'" + when.UTC().Format(timeFormat) + "'", "'" + when.UTC().Format(timeFormat) + "'"},
+	}
+	for _, test := range tests {
+		if got := SQLite.Literal(test.v); got != test.sqlite {
+			t.Errorf("SQLite.Literal(%#v) = %s, want %s", test.v, got, test.sqlite)
+		}
+		if got := PostgreSQL.Literal(test.v); got != test.postgres {
+			t.Errorf("PostgreSQL.Literal(%#v) = %s, want %s", test.v, got, test.postgres)
+		}
+	}
+}
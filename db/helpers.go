@@ -1,47 +1,206 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-// FromRow scans a row returned from a SQL query into destinations
-// chosen based on column names. The sql.Rows object must have already
-// had its Next method called. The cols map maps column names to the
-// pointer into which the column should be scanned. FromRow returns an
-// error if either the Columns or Scan methods on the sql.Rows object
-// returns an error, if a column name appear twice in the columns
-// returned by the query, if a column name that is not present in cols
-// was returned by the query, or if a column name present in cols was
-// not returned by the query.
-func FromRow(row *sql.Rows, cols map[string]interface{}) error {
-	found := make(map[string]bool, len(cols))
-	dsts := make([]interface{}, 0, len(cols))
-	rowCols, err := row.Columns()
-	if err != nil {
-		return err
+// A Mapping maps the columns of rows returned by queries, by name, to
+// the fields of values of type T that they are scanned into. Names are
+// compared ignoring case, since PostgreSQL folds the names of columns
+// that aren't quoted to lower case. The columns of models joined to T
+// are included under a prefix with Nest, and are selected with aliases
+// such as "author.name".
+//
+// The columns returned by a query are checked against the Mapping the
+// first time its rows are mapped, and the order in which they are
+// scanned is remembered, so that each query is only checked once.
+type Mapping[T any] struct {
+	cols map[string]func(v *T) interface{}
+	// names are the names of the columns by their lower case
+	// forms.
+	names map[string]string
+
+	mu sync.RWMutex
+	// plans are the destinations of the columns returned by the
+	// queries that have been checked, in order, by the columns'
+	// names.
+	plans map[string][]func(v *T) interface{}
+}
+
+// NewMapping creates a Mapping from a map of column names to functions
+// returning the destinations in a value of type T into which the
+// columns are scanned.
+func NewMapping[T any](cols map[string]func(v *T) interface{}) *Mapping[T] {
+	m := &Mapping[T]{
+		cols:  cols,
+		names: make(map[string]string, len(cols)),
+		plans: make(map[string][]func(v *T) interface{}),
+	}
+	for name := range cols {
+		m.names[strings.ToLower(name)] = name
 	}
-	for _, col := range rowCols {
-		if found[col] {
-			return fmt.Errorf("duplicate column %q", col)
+	return m
+}
+
+// Nest returns a Mapping with the columns of outer and those of inner,
+// which maps a model joined to T, named with a prefix and a dot. field
+// returns the joined model of a value of type T, creating it if it is
+// nil.
+func Nest[T, U any](outer *Mapping[T], prefix string, field func(v *T) *U, inner *Mapping[U]) *Mapping[T] {
+	cols := make(map[string]func(v *T) interface{}, len(outer.cols)+len(inner.cols))
+	for name, dst := range outer.cols {
+		cols[name] = dst
+	}
+	for name, dst := range inner.cols {
+		dst := dst
+		cols[prefix+"."+name] = func(v *T) interface{} {
+			return dst(field(v))
 		}
-		if dst, ok := cols[col]; ok {
-			dsts = append(dsts, dst)
-			found[col] = true
-		} else {
-			return fmt.Errorf("unexpected column %q", col)
+	}
+	return NewMapping(cols)
+}
+
+// Columns returns the columns of the Mapping, other than those of the
+// models nested in it, as a list for a select clause on a table with
+// an alias. If the prefix isn't empty, the columns are named with it
+// and a dot, as they are when the Mapping is nested under the prefix.
+func (m *Mapping[T]) Columns(alias, prefix string) string {
+	var names []string
+	for name := range m.cols {
+		if !strings.Contains(name, ".") {
+			names = append(names, name)
 		}
 	}
-	if len(dsts) != len(cols) {
+	sort.Strings(names)
+	cols := make([]string, len(names))
+	for i, name := range names {
+		cols[i] = alias + "." + name
+		if prefix != "" {
+			cols[i] += ` as "` + prefix + "." + name + `"`
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// plan returns the destinations of the columns returned by a query, in
+// order, checking them against the Mapping if they haven't been
+// before. It returns an error if a column name appears twice in the
+// columns, if a column isn't in the Mapping, or if a column in the
+// Mapping isn't returned by the query.
+func (m *Mapping[T]) plan(cols []string) ([]func(v *T) interface{}, error) {
+	key := strings.Join(cols, "\x00")
+	m.mu.RLock()
+	plan, ok := m.plans[key]
+	m.mu.RUnlock()
+	if ok {
+		return plan, nil
+	}
+	found := make(map[string]bool, len(cols))
+	plan = make([]func(v *T) interface{}, 0, len(cols))
+	for _, col := range cols {
+		name, ok := m.names[strings.ToLower(col)]
+		if !ok {
+			return nil, fmt.Errorf("unexpected column %q", col)
+		} else if found[name] {
+			return nil, fmt.Errorf("duplicate column %q", col)
+		}
+		plan = append(plan, m.cols[name])
+		found[name] = true
+	}
+	if len(plan) != len(m.cols) {
 		var missing []string
-		for col, _ := range cols {
-			if !found[col] {
-				missing = append(missing, strconv.Quote(col))
+		for name := range m.cols {
+			if !found[name] {
+				missing = append(missing, strconv.Quote(name))
 			}
 		}
-		return fmt.Errorf("missing columns %s", strings.Join(missing, ", "))
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing columns %s", strings.Join(missing, ", "))
+	}
+	m.mu.Lock()
+	m.plans[key] = plan
+	m.mu.Unlock()
+	return plan, nil
+}
+
+// scan scans the row that rows is on into v.
+func scan[T any](rows *sql.Rows, plan []func(v *T) interface{}, v *T) error {
+	dsts := make([]interface{}, len(plan))
+	for i, dst := range plan {
+		dsts[i] = dst(v)
+	}
+	return rows.Scan(dsts...)
+}
+
+// FromRow scans a row returned from a SQL query into v, with the
+// destinations chosen by a Mapping based on the names of the columns.
+// The sql.Rows object must have already had its Next method called.
+// FromRow returns an error if either the Columns or Scan methods on the
+// sql.Rows object returns an error, or if the columns don't match
+// those of the Mapping.
+func FromRow[T any](rows *sql.Rows, m *Mapping[T], v *T) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	plan, err := m.plan(cols)
+	if err != nil {
+		return err
+	}
+	return scan(rows, plan, v)
+}
+
+// All executes a query with the database that the context carries,
+// mapping each of the rows that it returns to a new value of type T.
+func All[T any](ctx context.Context, m *Mapping[T], query string, args ...interface{}) ([]*T, error) {
+	rows, err := Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	plan, err := m.plan(cols)
+	if err != nil {
+		return nil, err
+	}
+	var vs []*T
+	for rows.Next() {
+		v := new(T)
+		if err = scan(rows, plan, v); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, rows.Err()
+}
+
+// One executes a query with the database that the context carries,
+// mapping the first row that it returns to a new value of type T. If
+// there are no rows, it returns sql.ErrNoRows.
+func One[T any](ctx context.Context, m *Mapping[T], query string, args ...interface{}) (*T, error) {
+	rows, err := Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	v := new(T)
+	if err = FromRow(rows, m, v); err != nil {
+		return nil, err
 	}
-	return row.Scan(dsts...)
+	return v, rows.Close()
 }
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A MigrationRun applies and undoes migrations in a single transaction,
+// which holds the database's write lock from start to finish so that
+// only one process migrates the database at a time. Each migration is
+// applied or undone in a savepoint, so that one that fails is rolled
+// back without those before it, and each sees the changes made by
+// those before it.
+type MigrationRun struct {
+	conn    *sql.Conn
+	tx      *sql.Tx
+	dialect Dialect
+	dryRun  bool
+}
+
+// StartMigrations begins a MigrationRun, which must be finished by
+// calling Close, first waiting for any other process that is migrating
+// the database to finish. It gives up waiting when the context is
+// done; the context doesn't bound the run itself. If dryRun is true,
+// Close rolls back all of the changes, so that the statements that the
+// migrations execute can be reviewed without changing the database.
+// The Migrations table is created if it doesn't exist, as
+// CreateMigrationsTable would.
+func StartMigrations(ctx context.Context, db *Database, dryRun bool) (*MigrationRun, error) {
+	for waiting := false; ; waiting = true {
+		conn, tx, err := beginMigrationTx(ctx, db)
+		if err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("gave up waiting for another process to finish migrating the database, which holds %s: %v",
+				db.Dialect.migrationLock(), ctx.Err())
+		} else if isBusy(err) {
+			// Beginning the transaction has already waited for
+			// the lock for the busy timeout, so it can be tried
+			// again straight away.
+			if !waiting {
+				log.Printf("Waiting for another process to finish migrating the database, which holds %s",
+					db.Dialect.migrationLock())
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		run := &MigrationRun{conn: conn, tx: tx, dialect: db.Dialect, dryRun: dryRun}
+		if err = createMigrationsTable(tx, db.Dialect); err != nil {
+			run.dryRun = true
+			run.Close()
+			return nil, err
+		}
+		return run, nil
+	}
+}
+
+// isBusy reports whether an error is SQLite's because another
+// connection holds a lock that was needed.
+func isBusy(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.Code == sqlite3.ErrBusy
+}
+
+// AppliedMigrations returns the records of the migrations that have
+// been applied, including those applied during the MigrationRun.
+func (run *MigrationRun) AppliedMigrations() (map[string]*AppliedMigration, error) {
+	return appliedMigrations(run.tx)
+}
+
+// Apply applies a migration as ApplyMigration would, returning the
+// statements that it executed. If it fails, the statements include the
+// one that failed.
+func (run *MigrationRun) Apply(mi Migration) ([]Statement, error) {
+	var statements []Statement
+	err := run.savepoint(func(tx *sql.Tx) error {
+		return applyMigration(tx, run.dialect, mi, &statements)
+	})
+	return statements, err
+}
+
+// Undo undoes a migration as UndoMigration would, returning the
+// statements that it executed.
+func (run *MigrationRun) Undo(mi Migration) ([]Statement, error) {
+	var statements []Statement
+	err := run.savepoint(func(tx *sql.Tx) error {
+		return undoMigration(tx, run.dialect, mi, &statements)
+	})
+	return statements, err
+}
+
+// savepoint runs a function in the transaction in a savepoint, rolling
+// back its changes if it fails.
+func (run *MigrationRun) savepoint(f func(tx *sql.Tx) error) error {
+	if _, err := run.tx.Exec("savepoint migration"); err != nil {
+		return err
+	}
+	if err := runMigrationTx(run.tx, run.dialect, f); err != nil {
+		run.tx.Exec("rollback to migration")
+		run.tx.Exec("release migration")
+		return err
+	}
+	_, err := run.tx.Exec("release migration")
+	return err
+}
+
+// Close finishes the MigrationRun, committing the changes of the
+// migrations that succeeded unless it is a dry run, and releases the
+// lock.
+func (run *MigrationRun) Close() error {
+	var err error
+	if run.dryRun {
+		err = run.tx.Rollback()
+	} else {
+		err = run.tx.Commit()
+	}
+	if endErr := endMigrationTx(run.conn, run.dialect); err == nil {
+		err = endErr
+	}
+	return err
+}
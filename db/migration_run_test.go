@@ -0,0 +1,73 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/db/dbtest"
+)
+
+func TestStartMigrationsGivesUp(t *testing.T) {
+	tests := []struct {
+		dialect db.Dialect
+		open    func(t *testing.T) *db.Database
+		lock    string
+	}{
+		{db.SQLite, func(t *testing.T) *db.Database {
+			// Beginning a transaction waits for the lock for the
+			// busy timeout before trying again, so it is made
+			// shorter than the default five seconds. Asking for
+			// deferred transactions mustn't stop them from
+			// taking the lock.
+			database, err := db.Open(filepath.Join(t.TempDir(), "kanna.db") + "?_busy_timeout=50&_txlock=deferred")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { database.Close() })
+			return database
+		}, "the database's write lock"},
+		{db.PostgreSQL, func(t *testing.T) *db.Database {
+			return dbtest.Open(t, db.PostgreSQL)
+		}, "the advisory lock"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.dialect.Name(), func(t *testing.T) {
+			database := test.open(t)
+			holder, err := db.StartMigrations(context.Background(), database, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			run, err := db.StartMigrations(ctx, database, false)
+			if err == nil {
+				run.Close()
+				t.Fatal("started migrating while another run held the lock")
+			}
+			if !strings.Contains(err.Error(), test.lock) || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+				t.Errorf("got the error %q, want it to name %s and the deadline", err, test.lock)
+			}
+			if waited := time.Since(start); waited > 2*time.Second {
+				t.Errorf("gave up after %v", waited)
+			}
+
+			if err = holder.Close(); err != nil {
+				t.Fatal(err)
+			}
+			run, err = db.StartMigrations(context.Background(), database, false)
+			if err != nil {
+				t.Fatalf("after the lock was released: %v", err)
+			}
+			if err = run.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -1,22 +1,72 @@
 package db
 
-import "database/sql"
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // MigrationTx wraps the database/sql package's Tx type to provide a
 // more restricted interface when running migrations.
 type MigrationTx struct {
-	tx *sql.Tx
+	tx      *sql.Tx
+	dialect Dialect
+	// statements, if non-nil, records the statements that are
+	// executed. If tx is nil, they are only recorded.
+	statements *[]Statement
 }
 
 // Exec executes a query without returning any rows by calling the
 // underlying Tx object's Exec method.
 func (tx MigrationTx) Exec(q string, vs ...interface{}) {
-	_, err := tx.tx.Exec(q, vs...)
+	if tx.statements != nil {
+		*tx.statements = append(*tx.statements, Statement{Query: q, Args: vs, dialect: tx.dialect})
+	}
+	if tx.tx == nil {
+		return
+	}
+	_, err := tx.tx.Exec(rebind(tx.dialect, q), vs...)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// Dialect returns the dialect of the database that the migration is
+// applied to or undone in, for the migrations that must execute
+// different statements in each.
+func (tx MigrationTx) Dialect() Dialect {
+	return tx.dialect
+}
+
+// A Statement is a query executed by a migration, with its arguments.
+type Statement struct {
+	Query string
+	Args  []interface{}
+	// dialect is that of the database that the statement was
+	// executed in.
+	dialect Dialect
+}
+
+// String returns the query with its arguments written as SQL literals
+// in place of its placeholders, so that it can be run on its own.
+func (stmt Statement) String() string {
+	var b strings.Builder
+	args := stmt.Args
+	forEachPlaceholder(stmt.Query, &b, func() {
+		if len(args) == 0 {
+			b.WriteRune('?')
+			return
+		}
+		b.WriteString(stmt.dialect.Literal(args[0]))
+		args = args[1:]
+	})
+	return b.String()
+}
+
 // A Migration performs some reversible change to the database.
 type Migration interface {
 	// The ID identifies a particular migration and distinguishes it
@@ -33,79 +83,271 @@ type Migration interface {
 	Down(MigrationTx)
 }
 
+// A RevisedMigration is a migration whose definition was changed on
+// purpose after it had been applied to databases. A database to which
+// one of its earlier definitions was applied hasn't drifted from it.
+type RevisedMigration interface {
+	Migration
+	// EarlierChecksums returns the Checksums of the earlier
+	// definitions.
+	EarlierChecksums() []string
+}
+
 // ApplyMigration performs a migration and marks it as having been
 // performed in the Migrations table. All changes are performed in a
 // transaction: any error will cause all changes to be rolled back and
 // all changes should occur atomically. If the Migration has already
 // been performed, then ApplyMigration does nothing and returns a nil
 // error.
-func ApplyMigration(db *sql.DB, mi Migration) (err error) {
-	var tx *sql.Tx
-	tx, err = db.Begin()
+func ApplyMigration(db *Database, mi Migration) error {
+	return migrationTx(db, func(tx *sql.Tx) error {
+		return applyMigration(tx, db.Dialect, mi, nil)
+	})
+}
+
+// applyMigration applies a migration in a transaction if it hasn't
+// been applied, recording the statements that it executes if
+// statements is non-nil.
+func applyMigration(tx *sql.Tx, d Dialect, mi Migration, statements *[]Statement) error {
+	checksum, err := Checksum(d, mi)
 	if err != nil {
-		return
-	}
-	defer func() {
-		if recovered := recover(); recovered != nil {
-			err = recovered.(error) // TODO check this
-		}
-		if err != nil {
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-		}
-	}()
-	if alreadyApplied, err := wasMigrationApplied(tx, mi); err != nil {
 		return err
-	} else if alreadyApplied {
-		return nil
 	}
-	mi.Up(MigrationTx{tx})
-	_, err = tx.Exec("insert into Migrations (id) values (?)", mi.ID())
-	if err != nil {
-		return nil
+	if alreadyApplied, err := wasMigrationApplied(tx, d, mi); err != nil || alreadyApplied {
+		return err
 	}
-	return
+	mi.Up(MigrationTx{tx: tx, dialect: d, statements: statements})
+	_, err = tx.Exec(rebind(d, "insert into Migrations (id, appliedAt, checksum) values (?, ?, ?)"),
+		mi.ID(), time.Now().UTC().Format(timeFormat), checksum)
+	return err
 }
 
 // UndoMigration undoes a migration and marks it as not having been
 // applied. Similarly to ApplyMigration, all changes are performed in a
 // transaction. The changes will only be performed if the migration has
 // previously been applied.
-func UndoMigration(db *sql.DB, mi Migration) (err error) {
-	var tx *sql.Tx
-	tx, err = db.Begin()
+func UndoMigration(db *Database, mi Migration) error {
+	return migrationTx(db, func(tx *sql.Tx) error {
+		return undoMigration(tx, db.Dialect, mi, nil)
+	})
+}
+
+// undoMigration undoes a migration in a transaction if it has been
+// applied, recording the statements that it executes if statements is
+// non-nil.
+func undoMigration(tx *sql.Tx, d Dialect, mi Migration, statements *[]Statement) error {
+	if alreadyApplied, err := wasMigrationApplied(tx, d, mi); err != nil || !alreadyApplied {
+		return err
+	}
+	mi.Down(MigrationTx{tx: tx, dialect: d, statements: statements})
+	_, err := tx.Exec(rebind(d, "delete from Migrations where id = ?"), mi.ID())
+	return err
+}
+
+// migrationTx runs a function in a transaction, committing it if the
+// function succeeds and rolling it back if it fails or panics.
+func migrationTx(db *Database, f func(tx *sql.Tx) error) (err error) {
+	conn, tx, err := beginMigrationTx(context.Background(), db)
 	if err != nil {
-		return
+		return err
 	}
 	defer func() {
-		if recovered := recover(); recovered != nil {
-			err = recovered.(error) // TODO check
-		}
 		if err != nil {
 			tx.Rollback()
 		} else {
 			err = tx.Commit()
 		}
+		if fkErr := endMigrationTx(conn, db.Dialect); err == nil {
+			err = fkErr
+		}
 	}()
-	if alreadyApplied, err := wasMigrationApplied(tx, mi); err != nil {
-		return err
-	} else if !alreadyApplied {
-		return nil
+	return runMigrationTx(tx, db.Dialect, f)
+}
+
+// beginMigrationTx begins a transaction in which to apply or undo
+// migrations, which holds the lock that stops other processes from
+// migrating the database at the same time. Where the database allows
+// it, foreign keys aren't enforced during the transaction, so that
+// tables can be rebuilt without the rows that refer to them being
+// deleted; runMigrationTx checks them instead. Once the transaction is
+// finished, the connection must be passed to endMigrationTx. The
+// context bounds the wait for the lock, but not the transaction.
+func beginMigrationTx(ctx context.Context, db *Database) (*sql.Conn, *sql.Tx, error) {
+	// Foreign keys can only be turned off outside of a transaction,
+	// and only for one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	mi.Down(MigrationTx{tx})
-	_, err = tx.Exec("delete from Migrations where id = ?", mi.ID())
+	if err = db.Dialect.foreignKeys(conn, false); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tx, err := conn.BeginTx(context.Background(), nil)
 	if err != nil {
-		return nil
+		endMigrationTx(conn, db.Dialect)
+		return nil, nil, err
+	}
+	if err = db.Dialect.lockMigrations(ctx, tx); err != nil {
+		tx.Rollback()
+		endMigrationTx(conn, db.Dialect)
+		return nil, nil, err
+	}
+	return conn, tx, nil
+}
+
+// endMigrationTx enforces foreign keys again on the connection of a
+// finished migration transaction and returns it to the pool.
+func endMigrationTx(conn *sql.Conn, d Dialect) error {
+	err := d.foreignKeys(conn, true)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
 	}
-	return
+	return err
 }
 
-func wasMigrationApplied(tx *sql.Tx, mi Migration) (bool, error) {
-	row := tx.QueryRow("select count(*) from Migrations where id = ?", mi.ID())
+// runMigrationTx runs a function in a migration transaction, turning
+// a panic into an error, and fails if any rows violate foreign keys
+// afterwards.
+func runMigrationTx(tx *sql.Tx, d Dialect, f func(tx *sql.Tx) error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(recovered)
+		}
+	}()
+	if err = f(tx); err != nil {
+		return err
+	}
+	return d.checkForeignKeys(tx)
+}
+
+func wasMigrationApplied(tx *sql.Tx, d Dialect, mi Migration) (bool, error) {
+	row := tx.QueryRow(rebind(d, "select count(*) from Migrations where id = ?"), mi.ID())
 	var alreadyApplied int64
 	if err := row.Scan(&alreadyApplied); err != nil {
 		return false, err
 	}
 	return alreadyApplied != 0, nil
 }
+
+// recoveredError converts a value recovered from a panic during a
+// migration to an error.
+func recoveredError(recovered interface{}) error {
+	if err, ok := recovered.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", recovered)
+}
+
+// timeFormat is the format of the times at which migrations were
+// applied, which is the one used for times throughout the database.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Checksum summarizes the definition of a migration, so that changes
+// to migrations that have already been applied can be noticed. It
+// covers the statements that the migration executes in each direction,
+// but not their arguments, which may be generated, such as password
+// hashes. Migrations may execute different statements in different
+// dialects, so their checksums depend on the dialect.
+func Checksum(d Dialect, mi Migration) (string, error) {
+	up, down, err := Statements(d, mi)
+	if err != nil {
+		return "", err
+	}
+	queries := func(statements []Statement) string {
+		qs := make([]string, len(statements))
+		for i, stmt := range statements {
+			qs[i] = stmt.Query
+		}
+		return strings.Join(qs, "\n;\n")
+	}
+	sum := sha256.Sum256([]byte(queries(up) + "\n--\n" + queries(down)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Statements returns the statements that a migration executes when it
+// is applied and when it is undone in a database of a dialect, without
+// executing them.
+func Statements(d Dialect, mi Migration) (up, down []Statement, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(recovered)
+		}
+	}()
+	mi.Up(MigrationTx{dialect: d, statements: &up})
+	mi.Down(MigrationTx{dialect: d, statements: &down})
+	return up, down, nil
+}
+
+// CreateMigrationsTable creates the Migrations table, which records
+// the migrations that have been applied, if it doesn't already exist.
+// The table of a database created before the times and checksums of
+// migrations were recorded gains the columns for them.
+func CreateMigrationsTable(db *Database) error {
+	return createMigrationsTable(db.DB, db.Dialect)
+}
+
+// A querier is a database or a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func createMigrationsTable(db querier, d Dialect) error {
+	_, err := db.Exec(`create table if not exists Migrations (
+	id text primary key not null,
+	appliedAt text,
+	checksum text
+)`)
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"appliedAt", "checksum"} {
+		found, err := d.hasColumn(db, "Migrations", column)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if _, err = db.Exec("alter table Migrations add column " + column + " text"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// An AppliedMigration is the record of a migration that has been
+// applied.
+type AppliedMigration struct {
+	ID string
+	// AppliedAt is when the migration was applied, and Checksum
+	// is the Checksum of its definition at the time. Both are ""
+	// for migrations that were applied before they were recorded.
+	AppliedAt, Checksum string
+}
+
+// AppliedMigrations returns the records of the migrations that have
+// been applied, by their IDs.
+func AppliedMigrations(db *Database) (map[string]*AppliedMigration, error) {
+	return appliedMigrations(db.DB)
+}
+
+func appliedMigrations(db querier) (map[string]*AppliedMigration, error) {
+	rows, err := db.Query("select id, appliedAt, checksum from Migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]*AppliedMigration)
+	for rows.Next() {
+		var mi AppliedMigration
+		var appliedAt, checksum sql.NullString
+		if err = rows.Scan(&mi.ID, &appliedAt, &checksum); err != nil {
+			return nil, err
+		}
+		mi.AppliedAt, mi.Checksum = appliedAt.String, checksum.String
+		applied[mi.ID] = &mi
+	}
+	return applied, rows.Err()
+}
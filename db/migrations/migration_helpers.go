@@ -5,6 +5,7 @@ package migrations
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/ekiru/kanna/db"
 )
@@ -18,36 +19,20 @@ func (id idHelper) ID() string {
 }
 
 // A ColumnType identifies a column type when creating tables or adding
-// or modifying columns.
-type ColumnType int
+// or modifying columns. Its name depends on the dialect of the
+// database.
+type ColumnType = db.ColumnType
 
 const (
-	String ColumnType = iota
-	Text
-	Int
-	Float
-	Bool
-	Timestamp
+	String    = db.String
+	Text      = db.Text
+	Int       = db.Int
+	Float     = db.Float
+	Bool      = db.Bool
+	Timestamp = db.Timestamp
+	Blob      = db.Blob
 )
 
-// String converts a ColumnType to a string.
-func (t ColumnType) String() string {
-	switch t {
-	case String, Text:
-		return "text"
-	case Int:
-		return "int"
-	case Float:
-		return "real"
-	case Bool:
-		return "boolean"
-	case Timestamp:
-		return "int"
-	default:
-		return "" // TODO maybe panic or something
-	}
-}
-
 // A Column represents a database column.
 type Column struct {
 	// Name is the name of the column.
@@ -66,65 +51,366 @@ type Column struct {
 	PrimaryKey bool
 	// AutoIncrement, if true, requests that the database
 	// automatically supply incrementing values for a primary key
-	// column.
+	// column. The column's Type is ignored, since it must be an
+	// integer of the kind that the database increments.
 	AutoIncrement bool
 	// Unique, if true, specifies that no two rows in the table can
 	// hold the same value.
 	Unique bool
 }
 
-type createTable struct {
-	idHelper
-	name    string
-	columns []Column
+// A CompositeKey option of CreateTable makes several columns together
+// the primary key of a table.
+type CompositeKey []string
+
+// The actions that can be taken on the rows that refer to a row through
+// a ForeignKey when the row is deleted.
+const (
+	// NoAction refuses to delete the row.
+	NoAction = "no action"
+	// Cascade deletes the rows that refer to it.
+	Cascade = "cascade"
+	// SetNull sets the columns that refer to it to null.
+	SetNull = "set null"
+	// SetDefault sets the columns that refer to it to their
+	// default values.
+	SetDefault = "set default"
+)
+
+// A ForeignKey option of CreateTable requires the values of some of a
+// table's columns to be those of a row of another table.
+type ForeignKey struct {
+	// Columns are the columns of the table that refer to the row.
+	Columns []string
+	// Table is the other table, and References are the columns of
+	// it that Columns hold the values of, usually its primary key.
+	Table      string
+	References []string
+	// OnDelete is what happens to the table's rows when the row
+	// they refer to is deleted, such as Cascade. It is NoAction if
+	// it is "".
+	OnDelete string
 }
 
-// CreateTable defines a migration that creates a table.
-func CreateTable(id string, name string, cols_and_options ...interface{}) db.Migration {
-	var mi createTable
-	mi.idHelper.id = id
-	mi.name = name
-	for _, col := range cols_and_options {
-		mi.columns = append(mi.columns, col.(Column))
+// An Index speeds up looking up the rows of a table by some of its
+// columns, and may require their values to be unique. Indexes can be
+// created by CreateIndex, or by CreateTable and RebuildTable when they
+// are given as options.
+type Index struct {
+	// Name names the index, which must be unique in the database.
+	Name string
+	// Table is the table that the index is on. It is filled in
+	// when the Index is an option of CreateTable or RebuildTable.
+	Table   string
+	Columns []string
+	// Unique, if true, stops two rows having the same values in
+	// the index's columns.
+	Unique bool
+	// Where, if not "", is a SQL expression limiting the index to
+	// the rows for which it is true, making it a partial index.
+	Where string
+}
+
+func (index Index) create() string {
+	var stmt bytes.Buffer
+	stmt.WriteString("create ")
+	if index.Unique {
+		stmt.WriteString("unique ")
 	}
-	return &mi
+	fmt.Fprintf(&stmt, "index %s on %s (%s)", index.Name, index.Table, strings.Join(index.Columns, ", "))
+	if index.Where != "" {
+		stmt.WriteString(" where ")
+		stmt.WriteString(index.Where)
+	}
+	return stmt.String()
 }
 
-func (mi *createTable) Up(tx db.MigrationTx) {
+// definition returns the SQL defining a column in a table in a
+// dialect.
+func (col Column) definition(d db.Dialect) string {
+	var def bytes.Buffer
+	def.WriteString(col.Name)
+	def.WriteString(" ")
+	if col.AutoIncrement {
+		def.WriteString(d.AutoIncrement())
+	} else {
+		def.WriteString(d.TypeName(col.Type))
+	}
+	if col.PrimaryKey && !col.AutoIncrement {
+		def.WriteString(" primary key")
+	}
+	if col.Unique {
+		def.WriteString(" unique")
+	}
+	if col.NotNull {
+		def.WriteString(" not null")
+	}
+	if col.Default != nil {
+		def.WriteString(" default ")
+		def.WriteString(*col.Default)
+	}
+	return def.String()
+}
+
+// A table is the definition of a table given to CreateTable or
+// RebuildTable.
+type table struct {
+	name         string
+	columns      []Column
+	compositeKey CompositeKey
+	foreignKeys  []ForeignKey
+	indexes      []Index
+}
+
+func newTable(name string, colsAndOptions []interface{}) *table {
+	t := &table{name: name}
+	for _, opt := range colsAndOptions {
+		switch opt := opt.(type) {
+		case Column:
+			t.columns = append(t.columns, opt)
+		case CompositeKey:
+			t.compositeKey = opt
+		case ForeignKey:
+			t.foreignKeys = append(t.foreignKeys, opt)
+		case Index:
+			opt.Table = name
+			t.indexes = append(t.indexes, opt)
+		default:
+			panic(fmt.Sprintf("%T isn't a column or an option of a table", opt))
+		}
+	}
+	return t
+}
+
+// create returns the statements creating the table in a dialect, under
+// another name if as isn't "", and its indexes. If the dialect doesn't
+// give tables a rowid, the table is given a column for it.
+func (t *table) create(d db.Dialect, as string) []string {
+	name := t.name
+	if as != "" {
+		name = as
+	}
 	var stmt bytes.Buffer
 	stmt.WriteString("create table ")
-	stmt.WriteString(mi.name)
+	stmt.WriteString(name)
 	stmt.WriteString(" (")
 	sep := ""
-	for _, col := range mi.columns {
+	for _, col := range t.columns {
+		stmt.WriteString(sep)
+		stmt.WriteString(col.definition(d))
+		sep = ", "
+	}
+	if rowid := d.RowID(); rowid != "" {
 		stmt.WriteString(sep)
-		stmt.WriteString(col.Name)
-		stmt.WriteString(" ")
-		stmt.WriteString(col.Type.String())
-		if col.Default != nil {
-			stmt.WriteString(" default ")
-			stmt.WriteString(*col.Default)
+		stmt.WriteString(rowid)
+	}
+	if len(t.compositeKey) != 0 {
+		fmt.Fprintf(&stmt, ", primary key (%s)", strings.Join(t.compositeKey, ", "))
+	}
+	for _, fk := range t.foreignKeys {
+		fmt.Fprintf(&stmt, ", foreign key (%s) references %s (%s)",
+			strings.Join(fk.Columns, ", "), fk.Table, strings.Join(fk.References, ", "))
+		if fk.OnDelete != "" {
+			stmt.WriteString(" on delete ")
+			stmt.WriteString(fk.OnDelete)
 		}
-		if col.PrimaryKey {
-			stmt.WriteString(" primary key")
-			if col.AutoIncrement {
-				stmt.WriteString(" autoincrement")
-			}
+	}
+	stmt.WriteString(")")
+	stmts := []string{stmt.String()}
+	if as == "" {
+		stmts = append(stmts, t.createIndexes()...)
+	}
+	return stmts
+}
+
+func (t *table) createIndexes() []string {
+	var stmts []string
+	for _, index := range t.indexes {
+		stmts = append(stmts, index.create())
+	}
+	return stmts
+}
+
+func (t *table) hasColumn(name string) bool {
+	for _, col := range t.columns {
+		if col.Name == name {
+			return true
 		}
-		if col.Unique {
-			stmt.WriteString(" unique")
+	}
+	return false
+}
+
+// rebuildTo returns the statements that rebuild the table with
+// another definition in a dialect, keeping the values of the columns
+// that they share and the order of the rows. Null values of columns
+// that become not null with a default are replaced by the default.
+func (t *table) rebuildTo(d db.Dialect, to *table) []string {
+	var columns, values []string
+	for _, col := range to.columns {
+		if !t.hasColumn(col.Name) {
+			continue
 		}
-		if col.NotNull {
-			stmt.WriteString(" not null")
+		columns = append(columns, col.Name)
+		if col.NotNull && col.Default != nil {
+			values = append(values, fmt.Sprintf("coalesce(%s, %s)", col.Name, *col.Default))
+		} else {
+			values = append(values, col.Name)
 		}
-		sep = ", "
 	}
-	stmt.WriteString(")")
-	tx.Exec(stmt.String())
+	temp := to.name + "_rebuilt"
+	stmts := to.create(d, temp)
+	order := ""
+	if d.RowID() != "" {
+		order = " order by rowid"
+	}
+	stmts = append(stmts,
+		fmt.Sprintf("insert into %s (%s) select %s from %s%s",
+			temp, strings.Join(columns, ", "), strings.Join(values, ", "), t.name, order),
+		fmt.Sprintf("drop table %s", t.name),
+		fmt.Sprintf("alter table %s rename to %s", temp, to.name),
+	)
+	return append(stmts, to.createIndexes()...)
+}
+
+func execAll(tx db.MigrationTx, stmts []string) {
+	for _, stmt := range stmts {
+		tx.Exec(stmt)
+	}
+}
+
+type createTable struct {
+	idHelper
+	table *table
+}
+
+// CreateTable defines a migration that creates a table. Its columns
+// are given as Columns, and can be followed by a CompositeKey,
+// ForeignKeys and Indexes.
+func CreateTable(id string, name string, cols_and_options ...interface{}) db.Migration {
+	return &createTable{idHelper{id}, newTable(name, cols_and_options)}
+}
+
+func (mi *createTable) Up(tx db.MigrationTx) {
+	execAll(tx, mi.table.create(tx.Dialect(), ""))
 }
 
 func (mi *createTable) Down(tx db.MigrationTx) {
-	tx.Exec(fmt.Sprintf("drop table %s", mi.name))
+	tx.Exec(fmt.Sprintf("drop table %s", mi.table.name))
+}
+
+type addColumn struct {
+	idHelper
+	table  string
+	column Column
+}
+
+// AddColumn defines a migration that adds a column to a table. SQLite
+// can't add columns that are primary keys or unique, or that are not
+// null without a default; RebuildTable can.
+func AddColumn(id string, table string, column Column) db.Migration {
+	return &addColumn{idHelper{id}, table, column}
+}
+
+func (mi *addColumn) Up(tx db.MigrationTx) {
+	tx.Exec(fmt.Sprintf("alter table %s add column %s", mi.table, mi.column.definition(tx.Dialect())))
+}
+
+func (mi *addColumn) Down(tx db.MigrationTx) {
+	tx.Exec(fmt.Sprintf("alter table %s drop column %s", mi.table, mi.column.Name))
+}
+
+// DropColumn defines a migration that drops a column from a table. The
+// column is given as it is defined, so that undoing the migration can
+// add it back, although its values are lost. SQLite can't drop columns
+// that are primary keys, unique or indexed; RebuildTable can.
+func DropColumn(id string, table string, column Column) db.Migration {
+	return reversed{&addColumn{idHelper{id}, table, column}}
+}
+
+type renameColumn struct {
+	idHelper
+	table    string
+	from, to string
+}
+
+// RenameColumn defines a migration that renames a column of a table.
+func RenameColumn(id string, table string, from, to string) db.Migration {
+	return &renameColumn{idHelper{id}, table, from, to}
+}
+
+func (mi *renameColumn) Up(tx db.MigrationTx) {
+	tx.Exec(fmt.Sprintf("alter table %s rename column %s to %s", mi.table, mi.from, mi.to))
+}
+
+func (mi *renameColumn) Down(tx db.MigrationTx) {
+	tx.Exec(fmt.Sprintf("alter table %s rename column %s to %s", mi.table, mi.to, mi.from))
+}
+
+type createIndex struct {
+	idHelper
+	indexes []Index
+}
+
+// CreateIndex defines a migration that creates one or more indexes, in
+// order. Undoing it drops them in the reverse order.
+func CreateIndex(id string, indexes ...Index) db.Migration {
+	return &createIndex{idHelper{id}, indexes}
+}
+
+func (mi *createIndex) Up(tx db.MigrationTx) {
+	for _, index := range mi.indexes {
+		tx.Exec(index.create())
+	}
+}
+
+func (mi *createIndex) Down(tx db.MigrationTx) {
+	for i := len(mi.indexes) - 1; i >= 0; i-- {
+		tx.Exec(fmt.Sprintf("drop index %s", mi.indexes[i].Name))
+	}
+}
+
+type rebuildTable struct {
+	idHelper
+	from, to *table
+}
+
+// RebuildTable defines a migration that changes the definition of a
+// table in ways that SQLite can't alter in place, such as changing the
+// types or constraints of columns or adding foreign keys. The table is
+// given as it is defined before and after the migration, in the same
+// form as to CreateTable. It is rebuilt by creating a table with the
+// new definition, copying the values of the columns that both
+// definitions have into it and replacing the old table with it.
+//
+// The indexes of the old table are dropped along with it, and those of
+// the new definition are created, so both definitions must include all
+// of the table's indexes. Triggers on the table are dropped too, and
+// must be created again by another migration. PostgreSQL refuses to
+// drop a table that the foreign keys of other tables refer to, so such
+// tables can only be rebuilt in SQLite.
+func RebuildTable(id string, name string, from, to []interface{}) db.Migration {
+	return &rebuildTable{idHelper{id}, newTable(name, from), newTable(name, to)}
+}
+
+func (mi *rebuildTable) Up(tx db.MigrationTx) {
+	execAll(tx, mi.from.rebuildTo(tx.Dialect(), mi.to))
+}
+
+func (mi *rebuildTable) Down(tx db.MigrationTx) {
+	execAll(tx, mi.to.rebuildTo(tx.Dialect(), mi.from))
+}
+
+// reversed swaps the directions of a migration.
+type reversed struct {
+	db.Migration
+}
+
+func (mi reversed) Up(tx db.MigrationTx) {
+	mi.Migration.Down(tx)
+}
+
+func (mi reversed) Down(tx db.MigrationTx) {
+	mi.Migration.Up(tx)
 }
 
 // A FreeForm Migration allows specifying arbitrary SQL queries for the
@@ -148,3 +434,30 @@ func (mi FreeForm) Up(tx db.MigrationTx) {
 func (mi FreeForm) Down(tx db.MigrationTx) {
 	mi.Downward(tx)
 }
+
+// Retired returns a migration that does nothing, to take the place of
+// one whose changes are no longer wanted, such as one that inserted
+// data that doesn't belong in every database. Its ID is kept so that
+// the migrations after it keep their order, and the checksums of its
+// earlier definitions are given so that the databases to which it was
+// applied aren't reported as having changed.
+func Retired(id string, checksums ...string) db.RevisedMigration {
+	return retired{id, checksums}
+}
+
+type retired struct {
+	id        string
+	checksums []string
+}
+
+func (mi retired) ID() string {
+	return mi.id
+}
+
+func (mi retired) Up(tx db.MigrationTx) {}
+
+func (mi retired) Down(tx db.MigrationTx) {}
+
+func (mi retired) EarlierChecksums() []string {
+	return mi.checksums
+}
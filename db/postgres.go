@@ -0,0 +1,7 @@
+//go:build postgres
+
+package db
+
+// The PostgreSQL driver is only built into kanna with the postgres tag,
+// so that servers using SQLite don't need it.
+import _ "github.com/lib/pq"
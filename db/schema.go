@@ -0,0 +1,27 @@
+package db
+
+// Schema returns the statements that create the tables, indexes,
+// triggers and views of a database, in the order in which they were
+// created. The tables that SQLite creates for itself or for virtual
+// tables are left out, since they are created along with those.
+func Schema(db *Database) ([]string, error) {
+	return db.Dialect.schema(db.DB)
+}
+
+// queryStrings returns the column of strings selected by a query.
+func queryStrings(db querier, q string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var strings []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		strings = append(strings, s)
+	}
+	return strings, rows.Err()
+}
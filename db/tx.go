@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// busyRetries is how many more times WithTx tries to begin a
+// transaction while another connection holds the database's write
+// lock.
+const busyRetries = 3
+
+// A tx is the transaction that a context carries.
+type tx struct {
+	*sql.Tx
+	dialect Dialect
+	// savepoints counts the savepoints that have been made, so that
+	// each has its own name.
+	savepoints int
+	// afterCommit are the functions to call once the transaction is
+	// committed.
+	afterCommit []func()
+}
+
+type txKey struct{}
+
+// WithTx calls f with a copy of the context that carries a transaction,
+// which the queries made through DB with it, or with contexts derived
+// from it, are made in. The transaction is committed if f returns nil
+// and rolled back if it returns an error or panics. If the context
+// already carries a transaction, f is run in a savepoint of it
+// instead, so that only its own changes are rolled back if it fails.
+//
+// Beginning a transaction waits for any other connection that is
+// writing to an SQLite database, and if that takes longer than the
+// busy timeout, WithTx tries again a few times before giving up. Only
+// beginning the transaction is tried again: SQLite transactions take
+// the database's write lock as soon as they begin, so the queries made
+// in them aren't held up by other writers, and f is only called once.
+// Effects outside the database that should only happen once its
+// changes are committed can be deferred with AfterCommit.
+func WithTx(ctx context.Context, f func(ctx context.Context) error) error {
+	if t, ok := ctx.Value(txKey{}).(*tx); ok {
+		return t.savepoint(ctx, f)
+	}
+	db, err := Pool(ctx)
+	if err != nil {
+		return err
+	}
+	for retries := 0; ; retries++ {
+		sqlTx, err := db.BeginTx(ctx, nil)
+		if isBusy(err) && retries < busyRetries {
+			// Beginning the transaction has already waited for
+			// the lock for the busy timeout, so it can be tried
+			// again straight away.
+			continue
+		} else if err != nil {
+			return err
+		}
+		t := &tx{Tx: sqlTx, dialect: db.Dialect}
+		if err = t.run(ctx, f); err != nil {
+			t.Rollback()
+			return err
+		}
+		if err = t.Commit(); err != nil {
+			return err
+		}
+		for _, f := range t.afterCommit {
+			f()
+		}
+		return nil
+	}
+}
+
+// run calls f with a copy of the context that carries the
+// transaction, rolling it back if f panics.
+func (t *tx) run(ctx context.Context, f func(ctx context.Context) error) error {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.Rollback()
+			panic(recovered)
+		}
+	}()
+	return f(context.WithValue(ctx, txKey{}, t))
+}
+
+// savepoint calls f in a savepoint of the transaction, rolling back
+// its changes and forgetting the functions it deferred with
+// AfterCommit if it fails.
+func (t *tx) savepoint(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	t.savepoints++
+	name := "tx" + strconv.Itoa(t.savepoints)
+	if _, err = t.ExecContext(ctx, "savepoint "+name); err != nil {
+		return err
+	}
+	deferred := len(t.afterCommit)
+	rollback := func() {
+		t.afterCommit = t.afterCommit[:deferred]
+		t.ExecContext(ctx, "rollback to "+name)
+		t.ExecContext(ctx, "release "+name)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			rollback()
+			panic(recovered)
+		}
+	}()
+	if err = f(ctx); err != nil {
+		rollback()
+		return err
+	}
+	_, err = t.ExecContext(ctx, "release "+name)
+	return err
+}
+
+// AfterCommit calls f once the transaction that the context carries
+// has been committed, or straight away if it carries none. If the
+// transaction, or the savepoint that AfterCommit was called in, is
+// rolled back instead, f isn't called.
+func AfterCommit(ctx context.Context, f func()) {
+	if t, ok := ctx.Value(txKey{}).(*tx); ok {
+		t.afterCommit = append(t.afterCommit, f)
+		return
+	}
+	f()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"github.com/ekiru/kanna/models"
+)
+
+// domainBlock blocks a domain, or changes how it is blocked if it
+// already is, as the administration pages do.
+func domainBlock(e *env, args []string) error {
+	flags := flag.NewFlagSet("domain block", flag.ContinueOnError)
+	block := &models.DomainBlock{}
+	flags.StringVar(&block.Severity, "severity", models.SuspendSeverity,
+		"how the domain is blocked: "+strings.Join(models.DomainBlockSeverities, ", "))
+	flags.BoolVar(&block.RejectMedia, "reject-media", false, "stop fetching the attachments of the domain's posts")
+	flags.StringVar(&block.PublicComment, "public-comment", "", "a comment for everyone")
+	flags.StringVar(&block.PrivateComment, "private-comment", "", "a comment for administrators")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	domain, err := models.NormalizeDomain(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if e.cfg.InDomain(domain) {
+		return errors.New("this server's own domain can't be blocked")
+	}
+	block.Domain = domain
+	return models.SaveDomainBlock(e.ctx, block)
+}
@@ -0,0 +1,217 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/models"
+)
+
+// deliveryDelays are how long to wait before each attempt to deliver
+// an activity to an inbox. Delivery is abandoned after the last
+// attempt fails.
+var deliveryDelays = []time.Duration{0, time.Minute, 10 * time.Minute, time.Hour}
+
+// pending counts the deliveries to inboxes that haven't yet succeeded
+// or been abandoned.
+var pending int64
+
+// QueueDepth returns the number of deliveries to inboxes that are
+// waiting to be attempted or retried.
+func QueueDepth() int {
+	return int(atomic.LoadInt64(&pending))
+}
+
+// Deliver sends an activity to the inboxes of its recipients on other
+// servers. The recipients are the actors that the activity is
+// addressed to and the followers of the actor, if the activity is
+// addressed to their followers collection. Delivery happens in the
+// background, and is retried if it fails, once the transaction that
+// the context carries, if any, is committed. A nil activity is
+// ignored, so that the results of operations that may do nothing can
+// be passed directly.
+func Deliver(ctx context.Context, activity *models.Activity) {
+	if activity == nil {
+		return
+	}
+	body, err := activitystreams.Marshal(activity)
+	if err != nil {
+		log.Printf("delivering %s: %v", activity.ID(), err)
+		return
+	}
+	pool, err := db.Pool(ctx)
+	if err != nil {
+		log.Printf("delivering %s: %v", activity.ID(), err)
+		return
+	}
+	// The request's context is cancelled once the response has been
+	// sent, so delivery gets a context of its own.
+	bg := config.WithConfig(db.WithDB(context.Background(), pool), config.Get(ctx))
+	db.AfterCommit(ctx, func() { go queueDeliveries(bg, activity, body) })
+}
+
+// queueDeliveries queues the deliveries of an activity to the inboxes
+// of its recipients and begins attempting them.
+func queueDeliveries(ctx context.Context, activity *models.Activity, body []byte) {
+	inboxes, err := recipientInboxes(ctx, activity)
+	if err != nil {
+		log.Printf("delivering %s: %v", activity.ID(), err)
+		return
+	}
+	for _, inbox := range inboxes {
+		delivery, err := models.QueueDelivery(ctx, activity.ID(), activity.Actor, inbox, body)
+		if err != nil {
+			log.Printf("delivering %s to %s: %v", activity.ID(), inbox, err)
+			continue
+		}
+		atomic.AddInt64(&pending, 1)
+		go deliverWithRetries(ctx, delivery)
+	}
+}
+
+// recipientInboxes finds the distinct inboxes on other servers of the
+// recipients of an activity. Recipients who block the activity's actor,
+// who are suspended or who are on suspended servers are left out.
+func recipientInboxes(ctx context.Context, activity *models.Activity) ([]*url.URL, error) {
+	cfg := config.Get(ctx)
+	var recipients []*models.Actor
+	for _, field := range []string{"to", "cc"} {
+		targets, _ := activity.GetProp(field)
+		urls, _ := targets.([]*url.URL)
+		for _, target := range urls {
+			switch {
+			case target.String() == models.PublicCollection:
+			case activity.Actor.Followers != nil && target.String() == activity.Actor.Followers.String():
+				followers, err := models.Followers(ctx, activity.Actor)
+				if err != nil {
+					return nil, err
+				}
+				recipients = append(recipients, followers...)
+			case !cfg.IsLocal(target):
+				actor, err := ResolveActor(ctx, target)
+				if err != nil {
+					log.Printf("delivering %s to %s: %v", activity.ID(), target, err)
+					continue
+				}
+				recipients = append(recipients, actor)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	var inboxes []*url.URL
+	for _, actor := range recipients {
+		if actor.Inbox == nil || cfg.IsLocal(actor.Inbox) || seen[actor.Inbox.String()] {
+			continue
+		}
+		if blocked, err := models.IsBlocking(ctx, actor, activity.Actor); err != nil {
+			return nil, err
+		} else if blocked {
+			continue
+		}
+		if suspended, err := models.IsSuspended(ctx, actor.Inbox); err != nil {
+			return nil, err
+		} else if suspended {
+			continue
+		}
+		if suspended, err := models.IsActorSuspended(ctx, actor.ID()); err != nil {
+			return nil, err
+		} else if suspended {
+			continue
+		}
+		seen[actor.Inbox.String()] = true
+		inboxes = append(inboxes, actor.Inbox)
+	}
+	return inboxes, nil
+}
+
+// ResumeDeliveries restarts the deliveries that were unfinished when
+// the server last stopped. They are delivered in the background like
+// those started by Deliver.
+func ResumeDeliveries(ctx context.Context) error {
+	deliveries, err := models.PendingDeliveries(ctx)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&pending, int64(len(deliveries)))
+	for _, delivery := range deliveries {
+		go deliverWithRetries(ctx, delivery)
+	}
+	return nil
+}
+
+// deliverWithRetries delivers an activity to an inbox, retrying if it
+// fails, and gives up on the delivery after the last attempt.
+func deliverWithRetries(ctx context.Context, delivery *models.Delivery) {
+	defer atomic.AddInt64(&pending, -1)
+	var err error
+	for _, delay := range deliveryDelays {
+		time.Sleep(delay)
+		var retry bool
+		if retry, err = attempt(ctx, delivery); err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("delivering %s to %s: %v", delivery.ActivityID, delivery.Inbox, err)
+		if err = models.FailDelivery(ctx, delivery); err != nil {
+			log.Printf("giving up on delivery %d: %v", delivery.ID, err)
+		}
+	}
+}
+
+// Retry makes one more attempt at a delivery, such as one that has been
+// given up on, waiting for it to finish.
+func Retry(ctx context.Context, delivery *models.Delivery) error {
+	_, err := attempt(ctx, delivery)
+	return err
+}
+
+// attempt makes an attempt at a delivery and records how it went, both
+// for the delivery and for the health of the inbox's server. It reports
+// whether the delivery should be retried if it failed.
+func attempt(ctx context.Context, delivery *models.Delivery) (retry bool, err error) {
+	retry, err = post(ctx, delivery.Actor, delivery.Inbox, delivery.Body)
+	if recordErr := models.RecordDelivery(ctx, delivery.Inbox.Host, err); recordErr != nil {
+		log.Printf("recording delivery to %s: %v", delivery.Inbox.Host, recordErr)
+	}
+	if recordErr := models.RecordDeliveryAttempt(ctx, delivery, err); recordErr != nil {
+		log.Printf("recording delivery %d: %v", delivery.ID, recordErr)
+	}
+	return retry, err
+}
+
+// post sends a signed POST request with an activity to an inbox,
+// reporting whether the request should be retried if it fails.
+func post(ctx context.Context, actor *models.Actor, inbox *url.URL, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", inbox.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", activitystreams.ContentType)
+	if err = signRequest(ctx, req, actor, body); err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
@@ -0,0 +1,245 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/db/dbtest"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/models"
+)
+
+// A received is an activity delivered to an inbox of an inboxes
+// server, along with who signed it.
+type received struct {
+	inbox    string
+	activity Object
+	signer   string
+}
+
+// inboxes is a server whose inboxes accept every activity, verifying
+// its signature with the keys of the actors stored in the database
+// that ctx carries, as elsewhere.example would.
+func inboxes(t *testing.T, ctx context.Context) (*httptest.Server, chan received) {
+	elsewhere := *config.Get(ctx)
+	elsewhere.BaseURL = "https://elsewhere.example"
+	ctx = config.WithConfig(ctx, &elsewhere)
+	deliveries := make(chan received, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d := received{inbox: r.URL.Path}
+		if err = json.Unmarshal(body, &d.activity); err != nil {
+			t.Errorf("delivered to %s: %v", r.URL.Path, err)
+		}
+		if signer, err := VerifyRequest(ctx, r, body); err != nil {
+			t.Errorf("delivered to %s: %v", r.URL.Path, err)
+		} else {
+			d.signer = signer.ID().String()
+		}
+		w.WriteHeader(http.StatusAccepted)
+		deliveries <- d
+	}))
+	t.Cleanup(srv.Close)
+	return srv, deliveries
+}
+
+// remoteActor stores an actor from elsewhere.example whose inbox is on
+// the inboxes server.
+func remoteActor(t *testing.T, ctx context.Context, srv *httptest.Server, name string) *models.Actor {
+	t.Helper()
+	id, _ := url.Parse("https://elsewhere.example/users/" + name)
+	actor := models.NewActor(id, "Person")
+	actor.Name = name
+	actor.Inbox, _ = url.Parse(srv.URL + "/" + name + "/inbox")
+	actor.Outbox, _ = url.Parse("https://elsewhere.example/users/" + name + "/outbox")
+	if err := models.SaveActor(ctx, actor); err != nil {
+		t.Fatal(err)
+	}
+	return actor
+}
+
+// expectDeliveries waits for an activity to be delivered to each of
+// the inboxes, failing the test if it is delivered anywhere else.
+func expectDeliveries(t *testing.T, deliveries chan received, activity *models.Activity, signer *models.Actor, inboxes ...string) {
+	t.Helper()
+	want := make(map[string]bool)
+	for _, inbox := range inboxes {
+		want[inbox] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case d := <-deliveries:
+			if !want[d.inbox] {
+				t.Errorf("%s was delivered to %s", d.activity.String("type"), d.inbox)
+				continue
+			}
+			delete(want, d.inbox)
+			if id := d.activity.ID(); id == nil || id.String() != activity.ID().String() {
+				t.Errorf("%s received %v, want %s", d.inbox, id, activity.ID())
+			}
+			if d.signer != signer.ID().String() {
+				t.Errorf("%s received an activity signed by %q, want %s", d.inbox, d.signer, signer.ID())
+			}
+		case <-timeout:
+			t.Fatalf("%s %s wasn't delivered to %v", activity.Types()[0], activity.ID(), want)
+		}
+	}
+}
+
+func TestDeliverPosts(t *testing.T) {
+	database := dbtest.Open(t, db.SQLite)
+	dbtest.Migrate(t, database)
+	cfg := config.Default()
+	cfg.BaseURL = "https://kanna.example"
+	ctx := config.WithConfig(db.WithDB(context.Background(), database), cfg)
+	srv, deliveries := inboxes(t, ctx)
+
+	alice, err := models.CreateAccount(ctx, "alice", "password", models.UserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dan, eve := remoteActor(t, ctx, srv, "dan"), remoteActor(t, ctx, srv, "eve")
+	remoteActor(t, ctx, srv, "frank")
+	if _, err = models.Follow(ctx, dan, alice.Actor); err != nil {
+		t.Fatal(err)
+	}
+
+	// A post for followers that mentions eve goes to dan, who
+	// follows alice, and to eve, but not to frank.
+	source := models.Source{Content: "hello @eve@elsewhere.example", MediaType: markup.PlainText}
+	mentions := map[string]*models.Actor{"eve@elsewhere.example": eve}
+	post, activity, err := models.CreatePost(ctx, alice.Actor, source, models.ContentWarning{},
+		models.VisibilityFollowers, mentions, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Deliver(ctx, activity)
+	expectDeliveries(t, deliveries, activity, alice.Actor, "/dan/inbox", "/eve/inbox")
+
+	source.Content = "hello again @eve@elsewhere.example"
+	if activity, err = models.UpdatePost(ctx, post, source, models.ContentWarning{}, mentions); err != nil {
+		t.Fatal(err)
+	}
+	Deliver(ctx, activity)
+	expectDeliveries(t, deliveries, activity, alice.Actor, "/dan/inbox", "/eve/inbox")
+
+	if activity, err = models.DeletePost(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+	Deliver(ctx, activity)
+	expectDeliveries(t, deliveries, activity, alice.Actor, "/dan/inbox", "/eve/inbox")
+
+	select {
+	case d := <-deliveries:
+		t.Errorf("%s was also delivered to %s", d.activity.String("type"), d.inbox)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The deliveries are recorded after the responses are received,
+	// which must happen before the database is closed.
+	for deadline := time.Now().Add(5 * time.Second); QueueDepth() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollowRemoteActors(t *testing.T) {
+	database := dbtest.Open(t, db.SQLite)
+	dbtest.Migrate(t, database)
+	cfg := config.Default()
+	cfg.BaseURL = "https://kanna.example"
+	ctx := config.WithConfig(db.WithDB(context.Background(), database), cfg)
+	srv, deliveries := inboxes(t, ctx)
+
+	alice, err := models.CreateAccount(ctx, "alice", "password", models.UserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dan, eve := remoteActor(t, ctx, srv, "dan"), remoteActor(t, ctx, srv, "eve")
+	following := func(followee *models.Actor, wantRequested, wantFollowing bool) {
+		t.Helper()
+		if requested, err := models.IsFollowRequested(ctx, alice.Actor, followee); err != nil || requested != wantRequested {
+			t.Errorf("alice has asked to follow %s: %v, %v, want %v", followee.Name, requested, err, wantRequested)
+		}
+		if following, err := models.IsFollowing(ctx, alice.Actor, followee); err != nil || following != wantFollowing {
+			t.Errorf("alice follows %s: %v, %v, want %v", followee.Name, following, err, wantFollowing)
+		}
+	}
+
+	// Following dan asks dan to accept, and the follow is pending
+	// until the Accept arrives.
+	follow, err := models.Follow(ctx, alice.Actor, dan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follow == nil {
+		t.Fatal("following a remote actor returned no Follow activity")
+	}
+	Deliver(ctx, follow)
+	expectDeliveries(t, deliveries, follow, alice.Actor, "/dan/inbox")
+	following(dan, true, false)
+	if again, err := models.Follow(ctx, alice.Actor, dan); err != nil || again != nil {
+		t.Errorf("following dan again returned %v, %v", again, err)
+	}
+
+	accept := Object{
+		"id":     "https://elsewhere.example/users/dan#accepts/1",
+		"type":   "Accept",
+		"actor":  dan.ID().String(),
+		"object": follow.ID().String(),
+	}
+	if err = Receive(ctx, accept, eve); err == nil {
+		t.Error("received an Accept signed by someone else")
+	}
+	following(dan, true, false)
+	if err = Receive(ctx, accept, dan); err != nil {
+		t.Fatal(err)
+	}
+	following(dan, false, true)
+
+	undo, err := models.Unfollow(ctx, alice.Actor, dan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undo == nil || !undo.HasType("Undo") {
+		t.Fatalf("unfollowing dan returned %v", undo)
+	}
+	Deliver(ctx, undo)
+	expectDeliveries(t, deliveries, undo, alice.Actor, "/dan/inbox")
+	following(dan, false, false)
+
+	// A Reject that embeds the Follow without its ID refuses it.
+	if follow, err = models.Follow(ctx, alice.Actor, eve); err != nil {
+		t.Fatal(err)
+	}
+	Deliver(ctx, follow)
+	expectDeliveries(t, deliveries, follow, alice.Actor, "/eve/inbox")
+	reject := Object{
+		"id":     "https://elsewhere.example/users/eve#rejects/1",
+		"type":   "Reject",
+		"actor":  eve.ID().String(),
+		"object": map[string]interface{}{"type": "Follow", "actor": alice.Actor.ID().String(), "object": eve.ID().String()},
+	}
+	if err = Receive(ctx, reject, eve); err != nil {
+		t.Fatal(err)
+	}
+	following(eve, false, false)
+	if undo, err = models.Unfollow(ctx, alice.Actor, eve); err != nil || undo != nil {
+		t.Errorf("unfollowing eve after the Reject returned %v, %v", undo, err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); QueueDepth() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,174 @@
+// The federation package handles communication with other ActivityPub
+// servers: finding actors with WebFinger, fetching objects, delivering
+// signed activities, and receiving activities delivered to the inboxes
+// of local actors.
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// AddRoutes registers the routes used by other servers to discover
+// actors on this server.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{routes.Method{"GET"}, ".well-known", "webfinger"}, http.HandlerFunc(webfinger))
+}
+
+// MaxObjectSize is the largest ActivityStreams document that Kanna
+// will read from another server.
+const MaxObjectSize = 1 << 20
+
+// client is used for all requests to other servers.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// ErrGone is returned when fetching an object that doesn't exist or
+// has been deleted.
+var ErrGone = errors.New("object does not exist")
+
+// ErrSuspended is returned when fetching an object from a server that
+// is suspended.
+var ErrSuspended = errors.New("the server is suspended")
+
+// An Object is an ActivityStreams object as decoded from JSON.
+type Object map[string]interface{}
+
+// get performs a GET request for a document from another server,
+// decoding the JSON response into v. Nothing is fetched from suspended
+// servers.
+func get(ctx context.Context, u *url.URL, accept string, v interface{}) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("can't fetch %s: unsupported scheme", u)
+	}
+	if suspended, err := models.IsSuspended(ctx, u); err != nil {
+		return err
+	} else if suspended {
+		return ErrSuspended
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrGone
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, MaxObjectSize)).Decode(v); err != nil {
+		return fmt.Errorf("fetching %s: %v", u, err)
+	}
+	return nil
+}
+
+// FetchObject retrieves an object from the server it belongs to. The
+// object must have the ID it was requested by, so that a server can't
+// supply objects that belong to another server.
+func FetchObject(ctx context.Context, id *url.URL) (Object, error) {
+	var obj Object
+	if err := get(ctx, id, activitystreams.ContentType, &obj); err != nil {
+		return nil, err
+	}
+	if got := obj.ID(); got == nil || got.String() != id.String() {
+		return nil, fmt.Errorf("fetching %s: got object with a different id", id)
+	}
+	return obj, nil
+}
+
+// ID returns the id of the object, or nil if it doesn't have a valid
+// one.
+func (obj Object) ID() *url.URL {
+	return obj.URL("id")
+}
+
+// String returns the value of a property with a string value, or "" if
+// the property is missing or isn't a string.
+func (obj Object) String(prop string) string {
+	s, _ := obj[prop].(string)
+	return s
+}
+
+// Int returns the value of a property with an integer value, or 0 if
+// the property is missing or isn't a number.
+func (obj Object) Int(prop string) int {
+	n, _ := obj[prop].(float64)
+	return int(n)
+}
+
+// URL returns the ID of the object or link that is the value of a
+// property, which may be given either as a URL or embedded.
+func (obj Object) URL(prop string) *url.URL {
+	return refURL(obj[prop])
+}
+
+// URLs is like URL for properties whose values may be an array.
+func (obj Object) URLs(prop string) []*url.URL {
+	var urls []*url.URL
+	vals, ok := obj[prop].([]interface{})
+	if !ok {
+		vals = []interface{}{obj[prop]}
+	}
+	for _, val := range vals {
+		if u := refURL(val); u != nil {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// Objects returns the embedded objects that are the value of a
+// property, which may be a single object or an array.
+func (obj Object) Objects(prop string) []Object {
+	var objs []Object
+	vals, ok := obj[prop].([]interface{})
+	if !ok {
+		vals = []interface{}{obj[prop]}
+	}
+	for _, val := range vals {
+		if m, ok := val.(map[string]interface{}); ok {
+			objs = append(objs, Object(m))
+		}
+	}
+	return objs
+}
+
+// refURL converts a reference to an object or link to its URL. The
+// reference may be the URL itself, an embedded object with an id or a
+// Link with an href.
+func refURL(val interface{}) *url.URL {
+	var s string
+	switch val := val.(type) {
+	case string:
+		s = val
+	case map[string]interface{}:
+		s, _ = val["id"].(string)
+		if s == "" {
+			s, _ = val["href"].(string)
+		}
+	}
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() {
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,582 @@
+package federation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/media"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/streaming"
+)
+
+// actorTypes are the types of actors that Kanna stores.
+var actorTypes = map[string]bool{
+	"Application":  true,
+	"Group":        true,
+	"Organization": true,
+	"Person":       true,
+	"Service":      true,
+}
+
+// postTypes are the types of objects that Kanna stores as posts.
+var postTypes = map[string]bool{
+	"Article": true,
+	"Note":    true,
+	"Page":    true,
+}
+
+// ResolveActor returns the actor with an ID, fetching it from the
+// server it belongs to and storing it if it isn't already known.
+func ResolveActor(ctx context.Context, id *url.URL) (*models.Actor, error) {
+	actor, err := models.ActorById(ctx, id.String())
+	if err != sql.ErrNoRows || config.Get(ctx).IsLocal(id) {
+		return actor, err
+	}
+	return FetchActor(ctx, id)
+}
+
+// FetchActor retrieves an actor from the server it belongs to and
+// stores it, replacing any copy that was stored before.
+func FetchActor(ctx context.Context, id *url.URL) (*models.Actor, error) {
+	obj, err := FetchObject(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return saveActor(ctx, id, obj)
+}
+
+// saveActor stores an actor fetched from the server it belongs to.
+func saveActor(ctx context.Context, id *url.URL, obj Object) (*models.Actor, error) {
+	typ := obj.String("type")
+	if !actorTypes[typ] {
+		return nil, fmt.Errorf("%s is a %s, not an actor", id, typ)
+	}
+	actor := models.NewActor(id, typ)
+	actor.Name = obj.String("preferredUsername")
+	actor.Inbox = obj.URL("inbox")
+	actor.Outbox = obj.URL("outbox")
+	actor.Followers = obj.URL("followers")
+	if actor.Name == "" || actor.Inbox == nil || actor.Outbox == nil {
+		return nil, fmt.Errorf("%s is missing required properties", id)
+	}
+	if err := models.SaveActor(ctx, actor); err != nil {
+		return nil, err
+	}
+	for _, key := range obj.Objects("publicKey") {
+		keyId, owner, pem := key.ID(), key.URL("owner"), key.String("publicKeyPem")
+		if keyId == nil || keyId.Host != id.Host || owner == nil || owner.String() != id.String() || pem == "" {
+			continue
+		}
+		actor.PublicKey = &models.PublicKey{ID: keyId, Owner: owner, PublicKeyPem: pem}
+		if err := models.SavePublicKey(ctx, actor.PublicKey); err != nil {
+			return nil, err
+		}
+		break
+	}
+	return actor, nil
+}
+
+// FetchPost retrieves a post from the server it belongs to and stores
+// it along with its author, replacing any copy that was stored before.
+// The post's content is sanitized before it is stored. If the post is
+// a reply, any of the posts above it in its thread that aren't already
+// stored are fetched too, up to models.MaxThreadDepth posts.
+func FetchPost(ctx context.Context, id *url.URL) (*models.Post, error) {
+	post, err := fetchPost(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	fetchAncestors(ctx, post)
+	return post, nil
+}
+
+// ResolveURL returns the actor or post with a URL, fetching it from the
+// server it belongs to and storing it if it isn't already known. Only
+// one of the results is non-nil. The URL may also be that of a page
+// about the object, like the profile and post pages on Mastodon, if the
+// server responds to requests for Activity Streams at that URL with the
+// object. If there is no such actor or post, ResolveURL returns
+// sql.ErrNoRows.
+func ResolveURL(ctx context.Context, u *url.URL) (*models.Actor, *models.Post, error) {
+	if actor, err := models.ActorById(ctx, u.String()); err != sql.ErrNoRows {
+		return actor, nil, err
+	}
+	if post, err := models.PostById(ctx, u.String()); err != sql.ErrNoRows {
+		return nil, post, err
+	}
+	if config.Get(ctx).IsLocal(u) {
+		return nil, nil, sql.ErrNoRows
+	}
+	var obj Object
+	if err := get(ctx, u, activitystreams.ContentType, &obj); err == ErrGone {
+		return nil, nil, sql.ErrNoRows
+	} else if err != nil {
+		return nil, nil, err
+	}
+	id := obj.ID()
+	if id == nil {
+		return nil, nil, fmt.Errorf("fetching %s: got object without an id", u)
+	}
+	if id.String() != u.String() {
+		// The object is fetched again from its ID, so that a
+		// server can't supply objects that belong to another
+		// server.
+		if actor, err := models.ActorById(ctx, id.String()); err != sql.ErrNoRows {
+			return actor, nil, err
+		}
+		if post, err := models.PostById(ctx, id.String()); err != sql.ErrNoRows {
+			return nil, post, err
+		}
+		var err error
+		if obj, err = FetchObject(ctx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	typ := obj.String("type")
+	switch {
+	case actorTypes[typ]:
+		actor, err := saveActor(ctx, id, obj)
+		return actor, nil, err
+	case postTypes[typ]:
+		post, err := savePost(ctx, id, obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		fetchAncestors(ctx, post)
+		return nil, post, nil
+	default:
+		return nil, nil, fmt.Errorf("%s is a %s, not an actor or a post", id, typ)
+	}
+}
+
+// fetchAncestors fetches the posts above a post in its thread until it
+// reaches one that is already stored. Failing to fetch an ancestor
+// only ends the walk, since the post itself was stored successfully.
+func fetchAncestors(ctx context.Context, post *models.Post) {
+	seen := map[string]bool{post.ID().String(): true}
+	for depth := 0; post.InReplyTo != nil && depth < models.MaxThreadDepth; depth++ {
+		parentId := post.InReplyTo
+		if seen[parentId.String()] {
+			log.Printf("thread of %s contains a cycle", post.ID())
+			return
+		}
+		seen[parentId.String()] = true
+		if _, err := models.PostById(ctx, parentId.String()); err != sql.ErrNoRows {
+			return
+		}
+		parent, err := fetchPost(ctx, parentId)
+		if err != nil {
+			log.Printf("fetching ancestor %s of %s: %v", parentId, post.ID(), err)
+			return
+		}
+		post = parent
+	}
+}
+
+func fetchPost(ctx context.Context, id *url.URL) (*models.Post, error) {
+	if config.Get(ctx).IsLocal(id) {
+		return models.PostById(ctx, id.String())
+	}
+	obj, err := FetchObject(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return savePost(ctx, id, obj)
+}
+
+// savePost stores a post fetched from the server it belongs to, along
+// with its author.
+func savePost(ctx context.Context, id *url.URL, obj Object) (*models.Post, error) {
+	typ := obj.String("type")
+	if !postTypes[typ] {
+		return nil, fmt.Errorf("%s is a %s, not a post", id, typ)
+	}
+	// A server may only publish posts by its own actors.
+	authorId := obj.URL("attributedTo")
+	if authorId == nil || authorId.Host != id.Host {
+		return nil, fmt.Errorf("%s is not attributed to an actor on its server", id)
+	}
+	author, err := ResolveActor(ctx, authorId)
+	if err != nil {
+		return nil, err
+	}
+
+	post := models.NewPost(id, typ)
+	post.Author = author
+	post.Content = markup.Sanitize(obj.String("content"))
+	// The summary and sensitive flag are kept as they were sent,
+	// since servers differ in whether a summary implies the other.
+	if summary := obj.String("summary"); summary != "" {
+		post.Summary = &summary
+	}
+	post.Sensitive, _ = obj["sensitive"].(bool)
+	if source := obj.Objects("source"); len(source) > 0 {
+		post.Source = &models.Source{
+			Content:   source[0].String("content"),
+			MediaType: source[0].String("mediaType"),
+		}
+	}
+	post.InReplyTo = obj.URL("inReplyTo")
+	post.Context = obj.URL("context")
+	post.Published = timestamp(obj.String("published"))
+	if updated := obj.String("updated"); updated != "" {
+		updated = timestamp(updated)
+		post.Updated = &updated
+	}
+	post.To, post.Cc = obj.URLs("to"), obj.URLs("cc")
+	post.Bto, post.Bcc = obj.URLs("bto"), obj.URLs("bcc")
+	for _, tag := range obj.Objects("tag") {
+		typ, href, name := tag.String("type"), tag.URL("href"), tag.String("name")
+		if (typ == models.MentionType || typ == models.HashtagType) && href != nil && name != "" {
+			post.Tag = append(post.Tag, &models.Tag{Type: typ, Href: href, Name: name})
+		}
+	}
+	post.Attachment = attachments(obj)
+	removed, err := models.SavePost(ctx, post)
+	if err != nil {
+		return nil, err
+	}
+	media.DeleteFiles(ctx, removed)
+	return post, nil
+}
+
+// attachments reads the attachments of a post from another server. Their
+// files aren't fetched until they are requested.
+func attachments(obj Object) []*models.Attachment {
+	var attachments []*models.Attachment
+	for _, attachment := range obj.Objects("attachment") {
+		typ := attachment.String("type")
+		if typ != models.ImageType && typ != models.DocumentType {
+			continue
+		}
+		urls := attachment.URLs("url")
+		if len(urls) == 0 || urls[0].Scheme != "https" && urls[0].Scheme != "http" {
+			continue
+		}
+		a := &models.Attachment{
+			Type:      typ,
+			MediaType: attachment.String("mediaType"),
+			Name:      attachment.String("name"),
+			RemoteURL: urls[0],
+		}
+		if width, height := attachment.Int("width"), attachment.Int("height"); width > 0 && height > 0 {
+			a.Width, a.Height = width, height
+		}
+		attachments = append(attachments, a)
+		if len(attachments) == models.MaxAttachments {
+			break
+		}
+	}
+	return attachments
+}
+
+// timestamp converts a time received from another server to the format
+// Kanna stores times in, so that posts from different servers can be
+// ordered. Missing or invalid times are replaced with the current time.
+func timestamp(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.UTC().Format(models.TimeFormat)
+}
+
+// ResolveMentions finds the actors mentioned in the source of a post,
+// returning a map from the handles used in the source to the actors.
+// Mentions that can't be resolved are left out, so that they are
+// rendered as text.
+func ResolveMentions(ctx context.Context, source models.Source) map[string]*models.Actor {
+	mentions := make(map[string]*models.Actor)
+	handles, _ := markup.Tags(source.MediaType, source.Content)
+	for _, handle := range handles {
+		actor, err := Lookup(ctx, handle)
+		if err == nil {
+			mentions[handle] = actor
+		} else if err != sql.ErrNoRows {
+			log.Printf("resolving mention of %s: %v", handle, err)
+		}
+	}
+	return mentions
+}
+
+// Receive handles an activity delivered to an inbox. The activity
+// itself isn't trusted unless it was signed by its actor, so the object
+// of a Create or Update is fetched from the server it belongs to, and
+// the local actors mentioned in a new post are notified. New and edited
+// posts and boosts are published to the streaming hub. Follows, blocks,
+// reports, likes, boosts and deletes, the undoing of them and the
+// acceptance or rejection of follows are only accepted from their
+// signer, which is nil if the delivery wasn't signed, and a delete only
+// deletes a post that the signer wrote. Activities from suspended
+// actors or servers and other activities are ignored.
+func Receive(ctx context.Context, activity Object, signer *models.Actor) error {
+	typ := activity.String("type")
+	ids := []*url.URL{activity.ID(), activity.URL("actor")}
+	if signer != nil {
+		ids = append(ids, signer.ID())
+	}
+	for _, id := range ids {
+		if id == nil {
+			continue
+		}
+		if suspended, err := models.IsSuspended(ctx, id); err != nil || suspended {
+			return err
+		}
+	}
+	if actorId := activity.URL("actor"); actorId != nil {
+		if suspended, err := models.IsActorSuspended(ctx, actorId); err != nil || suspended {
+			return err
+		}
+	}
+	switch typ {
+	case "Create", "Update":
+		id := activity.URL("object")
+		if id == nil {
+			return fmt.Errorf("%s activity has no object", typ)
+		}
+		post, err := FetchPost(ctx, id)
+		if err != nil {
+			return err
+		}
+		entry := &models.TimelineEntry{Post: post, Published: post.Published}
+		if typ == "Update" {
+			streaming.Publish(ctx, streaming.Event{Type: streaming.StatusUpdate, Object: entry})
+			return nil
+		}
+		streaming.Publish(ctx, streaming.Event{Type: streaming.Update, Object: entry})
+		return models.NotifyMentions(ctx, post)
+	case "Follow":
+		id, actorId, objectId := activity.ID(), activity.URL("actor"), activity.URL("object")
+		if id == nil || actorId == nil || objectId == nil {
+			return fmt.Errorf("%s activity is missing required properties", typ)
+		}
+		if signer == nil || signer.ID().String() != actorId.String() || id.Host != actorId.Host {
+			return fmt.Errorf("%s activity was not signed by its actor", typ)
+		}
+		return receiveFollow(ctx, id, signer, objectId)
+	case "Accept", "Reject":
+		id, actorId := activity.ID(), activity.URL("actor")
+		if id == nil || actorId == nil {
+			return fmt.Errorf("%s activity is missing required properties", typ)
+		}
+		if signer == nil || signer.ID().String() != actorId.String() || id.Host != actorId.Host {
+			return fmt.Errorf("%s activity was not signed by its actor", typ)
+		}
+		for _, follow := range activity.Objects("object") {
+			if follow.String("type") == "Follow" {
+				return receiveFollowResponse(ctx, typ, signer, follow.ID(), follow.URL("actor"))
+			}
+		}
+		if followId := activity.URL("object"); followId != nil {
+			return receiveFollowResponse(ctx, typ, signer, followId, nil)
+		}
+		return nil
+	case models.FlagType:
+		id, actorId := activity.ID(), activity.URL("actor")
+		if id == nil || actorId == nil {
+			return fmt.Errorf("%s activity is missing required properties", typ)
+		}
+		if signer == nil || signer.ID().String() != actorId.String() || id.Host != actorId.Host {
+			return fmt.Errorf("%s activity was not signed by its actor", typ)
+		}
+		return receiveFlag(ctx, id, signer, activity.URLs("object"), activity.String("content"))
+	case "Delete":
+		id, actorId, objectId := activity.ID(), activity.URL("actor"), activity.URL("object")
+		if id == nil || actorId == nil || objectId == nil {
+			return fmt.Errorf("%s activity is missing required properties", typ)
+		}
+		if signer == nil || signer.ID().String() != actorId.String() || id.Host != actorId.Host {
+			return fmt.Errorf("%s activity was not signed by its actor", typ)
+		}
+		return receiveDelete(ctx, signer, objectId)
+	case models.LikeType, models.AnnounceType, models.BlockType, "Undo":
+		id, actorId, objectId := activity.ID(), activity.URL("actor"), activity.URL("object")
+		if id == nil || actorId == nil || objectId == nil {
+			return fmt.Errorf("%s activity is missing required properties", typ)
+		}
+		if signer == nil || signer.ID().String() != actorId.String() || id.Host != actorId.Host {
+			return fmt.Errorf("%s activity was not signed by its actor", typ)
+		}
+		if typ == "Undo" {
+			for _, undone := range activity.Objects("object") {
+				switch undone.String("type") {
+				case "Follow":
+					return receiveUnfollow(ctx, signer, undone.URL("object"))
+				case models.BlockType:
+					return models.DeleteBlock(ctx, objectId, signer)
+				}
+			}
+			return models.DeleteReaction(ctx, objectId, signer)
+		}
+		if typ == models.BlockType {
+			return receiveBlock(ctx, id, signer, objectId)
+		}
+		return receiveReaction(ctx, activity, typ, signer, objectId)
+	default:
+		return nil
+	}
+}
+
+// receiveFollow records that an actor follows an actor on this server
+// and accepts the Follow activity, or rejects it if either of them
+// blocks the other. Follows of actors on other servers are ignored.
+func receiveFollow(ctx context.Context, id *url.URL, follower *models.Actor, followeeId *url.URL) error {
+	if !config.Get(ctx).IsLocal(followeeId) {
+		return nil
+	}
+	followee, err := models.ActorById(ctx, followeeId.String())
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err = models.Follow(ctx, follower, followee); err == models.ErrBlocked {
+		Deliver(ctx, models.RejectFollow(ctx, followee, follower, id))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	Deliver(ctx, models.AcceptFollow(ctx, followee, follower, id))
+	return nil
+}
+
+// receiveUnfollow removes the record that an actor follows an actor on
+// this server.
+func receiveUnfollow(ctx context.Context, follower *models.Actor, followeeId *url.URL) error {
+	if followeeId == nil {
+		return nil
+	}
+	followee, err := models.ActorById(ctx, followeeId.String())
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = models.Unfollow(ctx, follower, followee)
+	return err
+}
+
+// receiveFollowResponse records the Accept or Reject by an actor on
+// another server of the Follow activity with an ID, by which an actor
+// on this server asked to follow them. The follower, if the response
+// gives them, identifies the Follow when its ID isn't known.
+func receiveFollowResponse(ctx context.Context, typ string, followee *models.Actor, followId, followerId *url.URL) error {
+	if typ == "Accept" {
+		return models.FollowAccepted(ctx, followee, followId, followerId)
+	}
+	return models.FollowRejected(ctx, followee, followId, followerId)
+}
+
+// receiveBlock records that an actor blocks an actor on this server.
+// Blocks of actors on other servers are ignored.
+func receiveBlock(ctx context.Context, id *url.URL, actor *models.Actor, targetId *url.URL) error {
+	if !config.Get(ctx).IsLocal(targetId) {
+		return nil
+	}
+	if _, err := models.ActorById(ctx, targetId.String()); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return models.SaveBlock(ctx, id, actor, targetId)
+}
+
+// receiveDelete deletes a post at the request of its author, leaving a
+// Tombstone in its place as deleting a post on this server does.
+// Deletes of posts that aren't stored are ignored, while those of posts
+// by other actors fail.
+func receiveDelete(ctx context.Context, actor *models.Actor, postId *url.URL) error {
+	post, err := models.PostById(ctx, postId.String())
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if post.Author.ID().String() != actor.ID().String() {
+		return fmt.Errorf("Delete activity for %s was not signed by its author", postId)
+	}
+	if _, err = models.DeletePost(ctx, post); err != nil {
+		return err
+	}
+	media.DeleteFiles(ctx, post.Attachment)
+	return nil
+}
+
+// receiveFlag stores a report of an actor on this server and some of
+// their posts. The reported actor is the first of the objects that is
+// an actor on this server, or else the author of the first reported
+// post on this server. Objects that aren't on this server, and posts
+// by other actors, are left out, and reports of no actor on this
+// server are ignored.
+func receiveFlag(ctx context.Context, id *url.URL, reporter *models.Actor, objects []*url.URL, comment string) error {
+	cfg := config.Get(ctx)
+	var target *models.Actor
+	var posts []*models.Post
+	for _, objectId := range objects {
+		if !cfg.IsLocal(objectId) {
+			continue
+		}
+		if actor, err := models.ActorById(ctx, objectId.String()); err == nil {
+			if target == nil {
+				target = actor
+			}
+		} else if err != sql.ErrNoRows {
+			return err
+		} else if post, err := models.PostById(ctx, objectId.String()); err == nil {
+			posts = append(posts, post)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if target == nil && len(posts) > 0 {
+		target = posts[0].Author
+	}
+	if target == nil {
+		return nil
+	}
+	var reported []*models.Post
+	for _, post := range posts {
+		if post.Author.ID().String() == target.ID().String() {
+			reported = append(reported, post)
+		}
+	}
+	return models.SaveReport(ctx, id, reporter, target, reported, comment)
+}
+
+// receiveReaction stores a Like or Announce of a post. Likes are only
+// stored for posts that are already known, while the posts that are
+// boosted are fetched if necessary, so that they can be shown with the
+// boost. Reactions to the posts of actors who block the reacting actor
+// are ignored.
+func receiveReaction(ctx context.Context, activity Object, typ string, actor *models.Actor, objectId *url.URL) error {
+	post, err := models.PostById(ctx, objectId.String())
+	if err == sql.ErrNoRows && typ == models.AnnounceType && !config.Get(ctx).IsLocal(objectId) {
+		post, err = FetchPost(ctx, objectId)
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if v := post.Visibility(); typ == models.AnnounceType && v != models.VisibilityPublic && v != models.VisibilityUnlisted {
+		return models.ErrCannotAnnounce
+	}
+	if blocked, err := models.IsBlocking(ctx, post.Author, actor); err != nil || blocked {
+		return err
+	}
+	published := timestamp(activity.String("published"))
+	if err = models.SaveReaction(ctx, activity.ID(), typ, actor, post.ID(), published); err != nil {
+		return err
+	}
+	if typ == models.AnnounceType {
+		models.PublishBoost(ctx, activity.ID(), actor, post, published)
+	}
+	return nil
+}
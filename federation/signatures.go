@@ -0,0 +1,190 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+)
+
+// Requests are signed as described in the draft HTTP Signatures
+// specification (draft-cavage-http-signatures), which is what other
+// ActivityPub servers expect.
+
+// signedHeaders are the headers covered by the signatures on requests
+// sent by this server.
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// maxClockSkew is how far the Date of a signed request may be from the
+// current time.
+const maxClockSkew = 12 * time.Hour
+
+// ErrUnsigned is returned by VerifyRequest for requests that don't
+// have a signature.
+var ErrUnsigned = errors.New("request is not signed")
+
+// signRequest signs a request on behalf of an actor on this server,
+// adding the Date, Digest and Signature headers.
+func signRequest(ctx context.Context, req *http.Request, actor *models.Actor, body []byte) error {
+	keyId, key, err := models.SigningKey(ctx, actor)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", digest(body))
+	hash := sha256.Sum256([]byte(signingString(req, signedHeaders)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// digest computes the value of the Digest header for a body.
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString builds the string that is signed for a request from
+// the values of the signed headers.
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, header := range headers {
+		var value string
+		switch header {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		default:
+			value = strings.Join(req.Header.Values(header), ", ")
+		}
+		lines[i] = header + ": " + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseSignature splits the Signature header of a request into its
+// parameters.
+func parseSignature(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// VerifyRequest checks the signature on a request received from
+// another server, returning the actor that signed it. The signature
+// must cover the request target, the Host and Date headers and, if the
+// request has a body, the Digest header, which must match the body.
+// If the request isn't signed, VerifyRequest returns ErrUnsigned.
+func VerifyRequest(ctx context.Context, r *http.Request, body []byte) (*models.Actor, error) {
+	header := r.Header.Get("Signature")
+	if header == "" {
+		return nil, ErrUnsigned
+	}
+	params := parseSignature(header)
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if len(body) > 0 {
+		required = append(required, "digest")
+		if r.Header.Get("Digest") != digest(body) {
+			return nil, errors.New("digest does not match the body")
+		}
+	}
+	for _, name := range required {
+		if !contains(headers, name) {
+			return nil, fmt.Errorf("signature does not cover %s", name)
+		}
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, err
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errors.New("request is too old or too far in the future")
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, err
+	}
+	keyId, err := url.Parse(params["keyId"])
+	if err != nil || !keyId.IsAbs() || config.Get(ctx).IsLocal(keyId) {
+		return nil, errors.New("invalid keyId")
+	}
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	key, err := models.PublicKeyById(ctx, keyId.String())
+	if err == nil {
+		err = checkSignature(key, hash[:], sig)
+	}
+	if err != nil {
+		// The key may be unknown or have changed since it was
+		// stored, so the actor is fetched again.
+		if key, err = fetchKey(ctx, keyId); err != nil {
+			return nil, err
+		}
+		if err = checkSignature(key, hash[:], sig); err != nil {
+			return nil, err
+		}
+	}
+	return models.ActorById(ctx, key.Owner.String())
+}
+
+// checkSignature verifies an rsa-sha256 signature with a public key.
+func checkSignature(key *models.PublicKey, hash, sig []byte) error {
+	rsaKey, err := key.RSA()
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash, sig)
+}
+
+// fetchKey fetches the actor that a key belongs to, along with the
+// key. The key's ID is the actor's ID with a fragment, as on most
+// servers.
+func fetchKey(ctx context.Context, keyId *url.URL) (*models.PublicKey, error) {
+	actorId := *keyId
+	actorId.Fragment = ""
+	actor, err := FetchActor(ctx, &actorId)
+	if err != nil {
+		return nil, err
+	}
+	if actor.PublicKey == nil || actor.PublicKey.ID.String() != keyId.String() {
+		return nil, sql.ErrNoRows
+	}
+	return actor.PublicKey, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package federation
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// A jrd is a JSON Resource Descriptor, the document returned by
+// WebFinger (RFC 7033).
+type jrd struct {
+	Subject string    `json:"subject"`
+	Aliases []string  `json:"aliases,omitempty"`
+	Links   []jrdLink `json:"links"`
+}
+
+type jrdLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+// activityJSON is the media type that WebFinger links to ActivityPub
+// actors use.
+const activityJSON = "application/activity+json"
+
+// webfinger describes a local account, identified either by an
+// acct: URI or by the ID of its actor.
+func webfinger(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Get(r.Context())
+	resource := r.URL.Query().Get("resource")
+	var actor *models.Actor
+	var err error
+	if strings.HasPrefix(resource, "acct:") {
+		user, host := splitHandle(strings.TrimPrefix(resource, "acct:"))
+		if host != cfg.Host() {
+			panic(routes.NotFound)
+		}
+		var account *models.Account
+		if account, err = models.AccountByUsername(r.Context(), user); err == nil {
+			actor = account.Actor
+		}
+	} else if u, perr := url.Parse(resource); perr == nil && cfg.IsLocal(u) {
+		actor, err = models.ActorById(r.Context(), u.String())
+	} else {
+		panic(routes.NotFound)
+	}
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	id := actor.ID().String()
+	buf, err := json.Marshal(jrd{
+		Subject: "acct:" + actor.Handle(),
+		Aliases: []string{id},
+		Links: []jrdLink{
+			{Rel: "self", Type: activityJSON, Href: id},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: id},
+		},
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.Write(buf)
+}
+
+// splitHandle splits a handle of the form user@host, or just user, into
+// its parts.
+func splitHandle(handle string) (user, host string) {
+	parts := strings.SplitN(strings.TrimPrefix(handle, "@"), "@", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Lookup finds the actor with a handle, of the form user@host or just
+// user for an account on this server. Actors on other servers that
+// aren't already known are found using WebFinger. If there is no such
+// actor, Lookup returns sql.ErrNoRows.
+func Lookup(ctx context.Context, handle string) (*models.Actor, error) {
+	cfg := config.Get(ctx)
+	user, host := splitHandle(handle)
+	if host == "" || host == cfg.Host() {
+		account, err := models.AccountByUsername(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		return account.Actor, nil
+	}
+	if actor, err := models.ActorByHandle(ctx, user, host); err != sql.ErrNoRows {
+		return actor, err
+	}
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     "/.well-known/webfinger",
+		RawQuery: url.Values{"resource": {"acct:" + user + "@" + host}}.Encode(),
+	}
+	var desc jrd
+	if err := get(ctx, u, "application/jrd+json", &desc); err == ErrGone {
+		return nil, sql.ErrNoRows
+	} else if err != nil {
+		return nil, err
+	}
+	for _, link := range desc.Links {
+		if link.Rel == "self" && (link.Type == activityJSON || strings.HasPrefix(link.Type, "application/ld+json")) {
+			id, err := url.Parse(link.Href)
+			if err != nil {
+				return nil, fmt.Errorf("looking up %s: %v", handle, err)
+			}
+			return ResolveActor(ctx, id)
+		}
+	}
+	return nil, errors.New("looking up " + handle + ": no ActivityPub actor")
+}
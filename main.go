@@ -1,42 +1,167 @@
+// The kanna program runs a Kanna server and manages its database,
+// accounts and federation from the command line. Run it without
+// arguments to list its commands.
 package main
 
 import (
-	"log"
-	"net/http"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 
-	"github.com/ekiru/kanna/accounts"
-	"github.com/ekiru/kanna/actors"
+	"github.com/ekiru/kanna/config"
 	"github.com/ekiru/kanna/db"
-	"github.com/ekiru/kanna/middleware"
-	"github.com/ekiru/kanna/pages"
-	"github.com/ekiru/kanna/posts"
-	"github.com/ekiru/kanna/routes"
-	"github.com/ekiru/kanna/sessions"
 )
 
-func main() {
-	routes := buildRoutes()
-	log.Fatal(http.ListenAndServe("localhost:9123", routes))
+// An env holds what the commands share: the configuration, the
+// database, a context carrying both for the models, and the streams
+// that the commands read from and write to.
+type env struct {
+	cfg *config.Config
+	db  *db.Database
+	ctx context.Context
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// A command is one of the subcommands of the kanna program.
+type command struct {
+	// name is the words that select the command, such as
+	// "migrate up".
+	name string
+	// args describes the flags and arguments the command takes.
+	args    string
+	summary string
+	run     func(e *env, args []string) error
 }
 
-func buildRoutes() http.Handler {
-	var router routes.Router
+var commands = []command{
+	{"serve", "[-migrate]", "run the server, applying the migrations that haven't been applied if -migrate is given", serve},
+	{"migrate up", "[-dry-run]", "apply the migrations that haven't been applied", migrateUp},
+	{"migrate down", "[-dry-run] [n]", "undo the last n migrations that were applied, or the last one", migrateDown},
+	{"migrate to", "[-dry-run] id", "apply or undo migrations so that the last one applied is the one with the id", migrateTo},
+	{"migrate redo", "[-dry-run]", "undo the last migration that was applied and apply it again", migrateRedo},
+	{"migrate status", "", "list the migrations, when they were applied and whether they have changed since", migrateStatus},
+	{"migrate export", "[-dialect sqlite3|postgres] file", "write the statements that the migrations execute to a file, or to standard output if it is -", migrateExport},
+	{"seed load", "set", "load a set of example data, such as dev, test or demo, or a .json file of it", seedLoad},
+	{"schema dump", "", "print the statements that create the database's tables and indexes", schemaDump},
+	{"user create", "[-role role] username", "create an account, reading its password from standard input", userCreate},
+	{"user passwd", "username", "change the password of an account, reading it from standard input", userPasswd},
+	{"user delete", "username", "delete an account and suspend its actor", userDelete},
+	{"user promote", "username [role]", "change the role of an account, to admin by default", userPromote},
+	{"actor refresh", "[-all] id-or-handle...", "fetch actors on other servers again", actorRefresh},
+	{"queue inspect", "", "list the deliveries that haven't succeeded", queueInspect},
+	{"queue retry", "[id...]", "retry deliveries, or all of those that were given up on", queueRetry},
+	{"domain block", "[-severity severity] [-reject-media] [-public-comment text] [-private-comment text] domain", "block a domain or change how it is blocked", domainBlock},
+	{"config check", "", "check the configuration file for mistakes", configCheck},
+}
 
-	router.Middleware(sessions.Middleware())
-	router.Middleware(middleware.ContentTypeOverride())
+// errUsage is returned by commands given the wrong arguments.
+var errUsage = errors.New("wrong arguments")
+
+// A usageError explains how to run the program or one of its commands.
+type usageError string
+
+func (err usageError) Error() string {
+	return string(err)
+}
 
-	if err := db.InitParams(&router); err != nil {
-		log.Fatal(err)
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if usage, ok := err.(usageError); ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "kanna:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the kanna program with the arguments that follow its name.
+func run(args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("kanna", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configFile := flags.String("config", "kanna.json", "the configuration file to load")
+	if err := flags.Parse(args); err != nil {
+		return usage()
+	}
+	cmd, args := findCommand(flags.Args())
+	if cmd == nil {
+		return usage()
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
 	}
+	conn, err := db.Open(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	e := &env{
+		cfg: cfg,
+		db:  conn,
+		ctx: config.WithConfig(db.WithDB(context.Background(), conn), cfg),
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+	if err = cmd.run(e, args); err == errUsage {
+		return usageError(fmt.Sprintf("usage: kanna %s %s\n", cmd.name, cmd.args))
+	}
+	return err
+}
 
-	router.Route([]interface{}{}, pages.Home)
+// findCommand finds the command named by the first words of args,
+// returning it with the arguments that follow its name.
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		name := strings.Fields(commands[i].name)
+		if len(args) >= len(name) && strings.Join(args[:len(name)], " ") == commands[i].name {
+			return &commands[i], args[len(name):]
+		}
+	}
+	return nil, nil
+}
 
-	accounts.AddRoutes(&router)
-	actors.AddRoutes(&router)
-	posts.AddRoutes(&router)
+// usage returns an error listing the commands.
+func usage() error {
+	var b strings.Builder
+	b.WriteString("usage: kanna [-config file] command [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "  %-15s %s\n", cmd.name, cmd.summary)
+	}
+	return usageError(b.String())
+}
 
-	router.NotFound(pages.NotFound)
-	router.Error(pages.Error)
+// parseFlags parses the flags of a command, returning errUsage if they
+// are invalid or if the number of remaining arguments is outside of
+// [min, max]. A negative max allows any number of arguments.
+func parseFlags(flags *flag.FlagSet, args []string, min, max int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if n := flags.NArg(); n < min || (max >= 0 && n > max) {
+		return errUsage
+	}
+	return nil
+}
 
-	return &router
+// readPassword prompts for a password and reads it from a line of the
+// standard input.
+func readPassword(e *env) (string, error) {
+	fmt.Fprint(e.out, "Password: ")
+	line, err := e.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("no password was given")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("the password can't be empty")
+	}
+	return password, nil
 }
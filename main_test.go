@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/models"
+)
+
+// A server is a configuration file and a SQLite database in a
+// temporary directory, for running the kanna program against.
+type server struct {
+	t      *testing.T
+	config string
+	cfg    *config.Config
+}
+
+// newServer writes a configuration file for a database in a temporary
+// directory, changing the default configuration with edit if it isn't
+// nil.
+func newServer(t *testing.T, edit func(cfg *config.Config)) *server {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.BaseURL = "https://kanna.example"
+	cfg.Database = filepath.Join(dir, "kanna.db")
+	cfg.Media.Dir = filepath.Join(dir, "uploads")
+	if edit != nil {
+		edit(cfg)
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{t: t, config: filepath.Join(dir, "kanna.json"), cfg: cfg}
+	if err = os.WriteFile(s.config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// kanna runs the kanna program with the arguments and standard input,
+// returning what it wrote to its standard output.
+func (s *server) kanna(input string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(append([]string{"-config", s.config}, args...), strings.NewReader(input), &out)
+	return out.String(), err
+}
+
+// mustKanna runs the kanna program, failing the test if it fails.
+func (s *server) mustKanna(input string, args ...string) string {
+	s.t.Helper()
+	out, err := s.kanna(input, args...)
+	if err != nil {
+		s.t.Fatalf("kanna %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// context opens the server's database, returning a context for the
+// models.
+func (s *server) context() context.Context {
+	conn, err := db.Open(s.cfg.Database)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { conn.Close() })
+	return config.WithConfig(db.WithDB(context.Background(), conn), s.cfg)
+}
+
+// wantError fails the test unless err is an error containing want.
+func wantError(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("got no error, want one containing %q", want)
+	} else if !strings.Contains(err.Error(), want) {
+		t.Errorf("got the error %q, want one containing %q", err, want)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	s := newServer(t, nil)
+	s.mustKanna("", "migrate", "up")
+	ctx := s.context()
+
+	out := s.mustKanna("first password\n", "user", "create", "-role", "moderator", "ann")
+	if want := "Created ann with the actor https://kanna.example/actor/ann"; !strings.Contains(out, want) {
+		t.Errorf("user create wrote %q, want it to contain %q", out, want)
+	}
+	account, err := models.Authenticate(ctx, "ann", "first password")
+	if err != nil {
+		t.Fatalf("authenticating as the new account: %v", err)
+	}
+	if account.Role != models.ModeratorRole {
+		t.Errorf("the new account has the role %q, want %q", account.Role, models.ModeratorRole)
+	}
+
+	_, err = s.kanna("password\n", "user", "create", "-role", "wizard", "bob")
+	wantError(t, err, `invalid role "wizard"`)
+	_, err = s.kanna("\n", "user", "create", "bob")
+	wantError(t, err, "the password can't be empty")
+	_, err = s.kanna("", "user", "create", "bob")
+	wantError(t, err, "no password was given")
+	if _, err = models.ManagedAccount(ctx, "bob"); err != sql.ErrNoRows {
+		t.Errorf("after failing to create bob, looking it up gave %v, want %v", err, sql.ErrNoRows)
+	}
+	_, err = s.kanna("", "user", "create")
+	if _, ok := err.(usageError); !ok {
+		t.Errorf("user create without a username gave %v, want a usage error", err)
+	}
+
+	s.mustKanna("second password\n", "user", "passwd", "ann")
+	if _, err = models.Authenticate(ctx, "ann", "second password"); err != nil {
+		t.Errorf("authenticating with the new password: %v", err)
+	}
+	if _, err = models.Authenticate(ctx, "ann", "first password"); err == nil {
+		t.Error("the old password still works")
+	}
+	_, err = s.kanna("\r\n", "user", "passwd", "ann")
+	wantError(t, err, "the password can't be empty")
+	if _, err = models.Authenticate(ctx, "ann", "second password"); err != nil {
+		t.Errorf("an empty password replaced the password: %v", err)
+	}
+	_, err = s.kanna("password\n", "user", "passwd", "nobody")
+	wantError(t, err, "there is no account named nobody")
+
+	roles := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ann"}, models.AdminRole},
+		{[]string{"ann", models.UserRole}, models.UserRole},
+		{[]string{"ann", models.ModeratorRole}, models.ModeratorRole},
+	}
+	for _, r := range roles {
+		s.mustKanna("", append([]string{"user", "promote"}, r.args...)...)
+		if account, err = models.ManagedAccount(ctx, "ann"); err != nil {
+			t.Fatal(err)
+		}
+		if account.Role != r.want {
+			t.Errorf("user promote %s left the role %q, want %q", strings.Join(r.args, " "), account.Role, r.want)
+		}
+	}
+	_, err = s.kanna("", "user", "promote", "ann", "wizard")
+	wantError(t, err, `invalid role "wizard"`)
+	if account, err = models.ManagedAccount(ctx, "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if account.Role != models.ModeratorRole {
+		t.Errorf("an invalid role changed the role to %q", account.Role)
+	}
+	_, err = s.kanna("", "user", "promote", "nobody")
+	wantError(t, err, "there is no account named nobody")
+
+	s.mustKanna("", "user", "delete", "ann")
+	if _, err = models.ManagedAccount(ctx, "ann"); err != sql.ErrNoRows {
+		t.Errorf("after deleting ann, looking it up gave %v, want %v", err, sql.ErrNoRows)
+	}
+	if suspended, err := models.IsActorSuspended(ctx, account.Actor.ID()); err != nil || !suspended {
+		t.Errorf("the deleted account's actor isn't suspended: %v", err)
+	}
+	_, err = s.kanna("", "user", "delete", "ann")
+	wantError(t, err, "there is no account named ann")
+}
+
+func TestDomainBlock(t *testing.T) {
+	s := newServer(t, nil)
+	s.mustKanna("", "migrate", "up")
+	ctx := s.context()
+
+	s.mustKanna("", "domain", "block", "-severity", "silence", "-reject-media",
+		"-public-comment", "spam", "-private-comment", "reported twice", "https://Bad.Example/")
+	block, err := models.DomainBlockFor(ctx, "www.bad.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.DomainBlock{
+		Domain:         "bad.example",
+		Severity:       models.SilenceSeverity,
+		RejectMedia:    true,
+		PublicComment:  "spam",
+		PrivateComment: "reported twice",
+	}
+	if block.Domain != want.Domain || block.Severity != want.Severity || block.RejectMedia != want.RejectMedia ||
+		block.PublicComment != want.PublicComment || block.PrivateComment != want.PrivateComment {
+		t.Errorf("the block is %+v, want %+v", block, want)
+	}
+
+	// Blocking the domain again changes the block.
+	s.mustKanna("", "domain", "block", "bad.example")
+	if block, err = models.DomainBlockFor(ctx, "bad.example"); err != nil {
+		t.Fatal(err)
+	}
+	if block.Severity != models.SuspendSeverity || block.RejectMedia {
+		t.Errorf("after blocking the domain again, the block is %+v", block)
+	}
+
+	for _, domain := range []string{"kanna.example", "example"} {
+		_, err = s.kanna("", "domain", "block", domain)
+		wantError(t, err, "this server's own domain can't be blocked")
+	}
+	_, err = s.kanna("", "domain", "block", "-severity", "banish", "worse.example")
+	wantError(t, err, `invalid severity "banish"`)
+	_, err = s.kanna("", "domain", "block", "user@worse.example")
+	wantError(t, err, models.ErrInvalidDomain.Error())
+	if block, err = models.DomainBlockFor(ctx, "worse.example"); err != nil || block != nil {
+		t.Errorf("after failing to block worse.example, its block is %+v, %v", block, err)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	out, err := newServer(t, nil).kanna("", "config", "check")
+	if err != nil {
+		t.Fatalf("checking a valid configuration: %v", err)
+	}
+	if out != "The configuration is valid.\n" {
+		t.Errorf("checking a valid configuration wrote %q", out)
+	}
+
+	s := newServer(t, func(cfg *config.Config) {
+		cfg.BaseURL = "kanna.example"
+		cfg.Media.Storage = "s3"
+		cfg.Media.MaxPixels = 0
+	})
+	out, err = s.kanna("", "config", "check")
+	wantError(t, err, "the configuration has 4 mistakes")
+	for _, want := range []string{
+		`baseUrl: "kanna.example" isn't an http or https URL`,
+		`media.s3.endpoint: "" isn't a URL`,
+		"media.s3.bucket: missing",
+		"media.maxPixels: must be positive",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("checking an invalid configuration wrote %q, want it to contain %q", out, want)
+		}
+	}
+}
+
+func TestMigrateStatus(t *testing.T) {
+	s := newServer(t, nil)
+	status := func() ([][]string, error) {
+		out, err := s.kanna("", "migrate", "status")
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		if len(lines) == 0 || strings.Join(strings.Fields(lines[0]), " ") != "STATUS MIGRATION APPLIED AT" {
+			t.Fatalf("migrate status wrote %q", out)
+		}
+		var rows [][]string
+		for _, line := range lines[1:] {
+			rows = append(rows, strings.Fields(line))
+		}
+		return rows, err
+	}
+
+	rows, err := status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Fatal("migrate status listed no migrations")
+	}
+	for _, row := range rows {
+		if len(row) != 2 || row[0] != "pending" {
+			t.Errorf("before migrating, migrate status listed %q", row)
+		}
+	}
+
+	s.mustKanna("", "migrate", "up")
+	ctx := s.context()
+	applied, err := status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(rows) {
+		t.Fatalf("migrate status listed %d migrations, then %d", len(rows), len(applied))
+	}
+	for i, row := range applied {
+		if len(row) != 3 || row[0] != "applied" || row[1] != rows[i][1] {
+			t.Errorf("after migrating, migrate status listed %q", row)
+		}
+	}
+
+	first := rows[0][1]
+	if _, err = db.Exec(ctx, "update Migrations set checksum = 'edited' where id = ?", first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(ctx, "insert into Migrations (id, appliedAt, checksum) values ('9999-from-the-future', '2030-01-01T00:00:00Z', '')"); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := status()
+	wantError(t, err, "1 migrations have changed since they were applied")
+	if len(changed) != len(rows)+1 {
+		t.Fatalf("migrate status listed %d migrations, want %d", len(changed), len(rows)+1)
+	}
+	if row := changed[0]; row[0] != "changed" || row[1] != first {
+		t.Errorf("after editing %s's checksum, migrate status listed %q", first, row)
+	}
+	if row := changed[len(changed)-1]; len(row) != 3 || row[0] != "unknown" || row[1] != "9999-from-the-future" {
+		t.Errorf("migrate status listed %q for the unknown migration", row)
+	}
+}
@@ -0,0 +1,161 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Links supplies the targets of the mentions and hashtags in a post
+// while it is rendered.
+type Links struct {
+	// Mention returns the URL of the actor with a handle, which is
+	// either a username on this server or user@host, without the
+	// initial @. If ok is false, the mention is left as text.
+	Mention func(handle string) (href string, ok bool)
+	// Hashtag returns the URL of the page for a hashtag, without the
+	// initial #.
+	Hashtag func(name string) string
+}
+
+// A renderer renders the source of a post, using links for its
+// mentions and hashtags. links may be nil.
+type renderer struct {
+	links *Links
+}
+
+// Tags returns the handles of the actors mentioned in a source text
+// and the hashtags used in it, without the initial @ or #, in the
+// order in which they first appear. Mentions and hashtags inside code
+// and links are ignored, as they are when rendering.
+func Tags(mediaType, source string) (mentions, hashtags []string) {
+	seen := make(map[string]bool)
+	Render(mediaType, source, &Links{
+		Mention: func(handle string) (string, bool) {
+			if !seen["@"+handle] {
+				seen["@"+handle] = true
+				mentions = append(mentions, handle)
+			}
+			return "", false
+		},
+		Hashtag: func(name string) string {
+			if !seen["#"+strings.ToLower(name)] {
+				seen["#"+strings.ToLower(name)] = true
+				hashtags = append(hashtags, name)
+			}
+			return ""
+		},
+	})
+	return mentions, hashtags
+}
+
+// renderText escapes plain text for inclusion in HTML, keeping its
+// line breaks and linking its mentions and hashtags.
+func (r renderer) renderText(text string) string {
+	var buf bytes.Buffer
+	start := 0
+	for i := 0; i < len(text); {
+		var out string
+		var n int
+		switch text[i] {
+		case '\n':
+			out, n = "<br />", 1
+		case '@', '#':
+			out, n = r.tag(text, i)
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		buf.WriteString(html.EscapeString(text[start:i]))
+		buf.WriteString(out)
+		i += n
+		start = i
+	}
+	buf.WriteString(html.EscapeString(text[start:]))
+	return buf.String()
+}
+
+// tag renders the mention or hashtag starting at text[i], in the
+// markup that Mastodon uses. Mentions and hashtags must start at the
+// beginning of a word.
+func (r renderer) tag(text string, i int) (string, int) {
+	if r.links == nil {
+		return "", 0
+	}
+	if before, _ := utf8.DecodeLastRuneInString(text[:i]); i > 0 && !unicode.IsSpace(before) && before != '(' {
+		return "", 0
+	}
+	if text[i] == '@' {
+		handle := mentionAt(text[i+1:])
+		if handle == "" {
+			return "", 0
+		}
+		href, ok := r.links.Mention(handle)
+		if !ok {
+			return "", 0
+		}
+		user := strings.SplitN(handle, "@", 2)[0]
+		return "<span class=\"h-card\"><a href=\"" + html.EscapeString(href) + "\" class=\"u-url mention\">@<span>" +
+			html.EscapeString(user) + "</span></a></span>", 1 + len(handle)
+	}
+	name := hashtagAt(text[i+1:])
+	if name == "" {
+		return "", 0
+	}
+	href := r.links.Hashtag(name)
+	return "<a href=\"" + html.EscapeString(href) + "\" class=\"mention hashtag\">#<span>" +
+		html.EscapeString(name) + "</span></a>", 1 + len(name)
+}
+
+func isUsernameChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+func isHostChar(c byte) bool {
+	return isUsernameChar(c) && c != '_' || c == '.' || c == '-'
+}
+
+// mentionAt returns the handle at the start of s, which is either a
+// username or user@host, or "" if there isn't one.
+func mentionAt(s string) string {
+	i := 0
+	for i < len(s) && (isUsernameChar(s[i]) || (s[i] == '.' || s[i] == '-') && i+1 < len(s) && isUsernameChar(s[i+1])) {
+		i++
+	}
+	if i == 0 {
+		return ""
+	}
+	if i+1 < len(s) && s[i] == '@' && isHostChar(s[i+1]) {
+		j := i + 1
+		for j < len(s) && isHostChar(s[j]) {
+			j++
+		}
+		host := strings.TrimRight(s[i+1:j], ".-")
+		if strings.Contains(host, ".") {
+			return s[:i+1+len(host)]
+		}
+	}
+	return s[:i]
+}
+
+// hashtagAt returns the name of the hashtag at the start of s, or "" if
+// there isn't one. Hashtags are made of letters, digits and
+// underscores, and can't be entirely numeric.
+func hashtagAt(s string) string {
+	end, letters := 0, false
+	for end < len(s) {
+		c, size := utf8.DecodeRuneInString(s[end:])
+		if !isAlphanumeric(c) && c != '_' {
+			break
+		}
+		letters = letters || !unicode.IsDigit(c)
+		end += size
+	}
+	if !letters {
+		return ""
+	}
+	return s[:end]
+}
@@ -0,0 +1,524 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// RenderMarkdown converts Markdown to HTML. It supports the subset of
+// CommonMark that is useful in posts:
+//
+//   - paragraphs, in which every line break is kept
+//   - block quotes, starting with >
+//   - bulleted lists, using -, * or +, and numbered lists
+//   - fenced code blocks, delimited by ``` or ~~~
+//   - *emphasis*, **strong emphasis** and `code spans`
+//   - [links](https://example.com) and <https://example.com>
+//   - backslash escapes
+//
+// Bare http and https URLs are also turned into links, as are
+// mentions and hashtags if links is non-nil. Raw HTML is escaped
+// rather than passed through, but the output should still be
+// sanitized before it is displayed.
+func RenderMarkdown(source string, links *Links) string {
+	source = strings.Replace(source, "\r\n", "\n", -1)
+	source = strings.Replace(source, "\r", "\n", -1)
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+	var buf bytes.Buffer
+	renderer{links}.renderBlocks(&buf, lines, false)
+	return buf.String()
+}
+
+// expandTabs replaces the tabs in a line's indentation with four
+// spaces so that indentation can be measured by counting spaces.
+func expandTabs(line string) string {
+	trimmed := strings.TrimLeft(line, " \t")
+	indent := line[:len(line)-len(trimmed)]
+	return strings.Replace(indent, "\t", "    ", -1) + trimmed
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// renderBlocks renders a sequence of lines as block-level elements.
+// In a tight list, paragraphs aren't wrapped in <p> elements.
+func (r renderer) renderBlocks(buf *bytes.Buffer, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case openingFence(line) != "":
+			i = renderCodeBlock(buf, lines, i)
+		case isBlockQuote(line):
+			i = r.renderBlockQuote(buf, lines, i)
+		case isListItem(line):
+			i = r.renderList(buf, lines, i)
+		default:
+			i = r.renderParagraph(buf, lines, i, tight)
+		}
+	}
+}
+
+// openingFence returns the fence that opens a fenced code block on the
+// line, or "" if the line doesn't open one.
+func openingFence(line string) string {
+	if indentation(line) > 3 {
+		return ""
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+		return ""
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+	if trimmed[0] == '`' && strings.Contains(trimmed[n:], "`") {
+		return ""
+	}
+	return trimmed[:n]
+}
+
+func closesFence(line, fence string) bool {
+	if indentation(line) > 3 {
+		return false
+	}
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == ""
+}
+
+func renderCodeBlock(buf *bytes.Buffer, lines []string, i int) int {
+	fence := openingFence(lines[i])
+	indent := indentation(lines[i])
+	buf.WriteString("<pre><code>")
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if closesFence(line, fence) {
+			i++
+			break
+		}
+		if n := indentation(line); n < indent {
+			line = line[n:]
+		} else {
+			line = line[indent:]
+		}
+		buf.WriteString(html.EscapeString(line))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</code></pre>\n")
+	return i
+}
+
+func isBlockQuote(line string) bool {
+	return indentation(line) <= 3 && strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+func (r renderer) renderBlockQuote(buf *bytes.Buffer, lines []string, i int) int {
+	var quoted []string
+	for ; i < len(lines) && isBlockQuote(lines[i]); i++ {
+		line := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+		quoted = append(quoted, strings.TrimPrefix(line, " "))
+	}
+	buf.WriteString("<blockquote>\n")
+	r.renderBlocks(buf, quoted, false)
+	buf.WriteString("</blockquote>\n")
+	return i
+}
+
+// A listMarker is the marker at the start of a list item.
+type listMarker struct {
+	ordered bool
+	// delim is the bullet character of a bulleted list, or the
+	// punctuation following the number in a numbered list.
+	delim byte
+	start int
+	// width is the indentation of the item's content.
+	width int
+	empty bool
+}
+
+func parseListMarker(line string) (listMarker, bool) {
+	var m listMarker
+	indent := indentation(line)
+	if indent > 3 {
+		return m, false
+	}
+	i := indent
+	if i < len(line) && strings.IndexByte("-*+", line[i]) >= 0 {
+		m.delim = line[i]
+		i++
+	} else {
+		for i < len(line) && i-indent < 9 && '0' <= line[i] && line[i] <= '9' {
+			i++
+		}
+		if i == indent || i == len(line) || (line[i] != '.' && line[i] != ')') {
+			return m, false
+		}
+		m.ordered = true
+		m.start, _ = strconv.Atoi(line[indent:i])
+		m.delim = line[i]
+		i++
+	}
+	if i < len(line) && line[i] != ' ' {
+		return m, false
+	}
+	if isBlank(line[i:]) {
+		m.empty = true
+		m.width = i + 1
+		return m, true
+	}
+	spaces := indentation(line[i:])
+	if spaces > 4 {
+		spaces = 1
+	}
+	m.width = i + spaces
+	return m, true
+}
+
+func isListItem(line string) bool {
+	_, ok := parseListMarker(line)
+	return ok
+}
+
+// interruptsParagraph reports whether a line starts a new block rather
+// than continuing a paragraph.
+func interruptsParagraph(line string) bool {
+	if openingFence(line) != "" || isBlockQuote(line) {
+		return true
+	}
+	m, ok := parseListMarker(line)
+	return ok && !m.empty && (!m.ordered || m.start == 1)
+}
+
+func (r renderer) renderList(buf *bytes.Buffer, lines []string, i int) int {
+	first, _ := parseListMarker(lines[i])
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m, ok := parseListMarker(lines[i])
+		if !ok || m.ordered != first.ordered || m.delim != first.delim {
+			break
+		}
+		if len(items) > 0 && isBlank(lines[i-1]) {
+			loose = true
+		}
+		item := []string{lines[i][min(m.width, len(lines[i])):]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				item = append(item, "")
+				continue
+			}
+			if indentation(line) >= m.width {
+				item = append(item, line[m.width:])
+				continue
+			}
+			if isListItem(line) || isBlank(item[len(item)-1]) || interruptsParagraph(line) {
+				break
+			}
+			// A lazy continuation line of a paragraph.
+			item = append(item, line)
+		}
+		for len(item) > 0 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		for _, line := range item {
+			if isBlank(line) {
+				loose = true
+			}
+		}
+		items = append(items, item)
+	}
+
+	if first.ordered {
+		if first.start == 1 {
+			buf.WriteString("<ol>\n")
+		} else {
+			buf.WriteString("<ol start=\"" + strconv.Itoa(first.start) + "\">\n")
+		}
+	} else {
+		buf.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		buf.WriteString("<li>")
+		r.renderBlocks(buf, item, !loose)
+		buf.WriteString("</li>\n")
+	}
+	if first.ordered {
+		buf.WriteString("</ol>\n")
+	} else {
+		buf.WriteString("</ul>\n")
+	}
+	return i
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (r renderer) renderParagraph(buf *bytes.Buffer, lines []string, i int, tight bool) int {
+	var para []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if isBlank(line) || (len(para) > 0 && interruptsParagraph(line)) {
+			break
+		}
+		para = append(para, strings.TrimSpace(line))
+	}
+	text := r.renderInline(strings.Join(para, "\n"), false)
+	if tight {
+		buf.WriteString(text)
+	} else {
+		buf.WriteString("<p>" + text + "</p>\n")
+	}
+	return i
+}
+
+const asciiPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// renderInline renders the inline elements in a paragraph. Inside the
+// text of a link, links aren't recognized, since they can't be nested.
+func (r renderer) renderInline(text string, inLink bool) string {
+	var buf bytes.Buffer
+	start := 0
+	for i := 0; i < len(text); {
+		var out string
+		var n int
+		switch c := text[i]; {
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			n = 1
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(asciiPunctuation, text[i+1]) >= 0:
+			out, n = html.EscapeString(text[i+1:i+2]), 2
+		case c == '\n':
+			out, n = "<br />\n", 1
+		case c == '`':
+			out, n = codeSpan(text[i:])
+		case c == '*' || c == '_':
+			out, n = r.emphasis(text, i, inLink)
+		case c == '[' && !inLink:
+			out, n = r.link(text[i:])
+		case c == '<' && !inLink:
+			out, n = autolink(text[i:])
+		case c == 'h' && !inLink && (i == 0 || strings.IndexByte(" \n(", text[i-1]) >= 0):
+			out, n = bareURL(text[i:])
+		case (c == '@' || c == '#') && !inLink:
+			out, n = r.tag(text, i)
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		buf.WriteString(html.EscapeString(text[start:i]))
+		buf.WriteString(out)
+		i += n
+		start = i
+	}
+	buf.WriteString(html.EscapeString(text[start:]))
+	return buf.String()
+}
+
+// runLength returns the number of times the byte at the start of s is
+// repeated.
+func runLength(s string) int {
+	n := 1
+	for n < len(s) && s[n] == s[0] {
+		n++
+	}
+	return n
+}
+
+func codeSpan(s string) (string, int) {
+	n := runLength(s)
+	for i := n; i < len(s); {
+		j := strings.IndexByte(s[i:], '`')
+		if j < 0 {
+			break
+		}
+		i += j
+		m := runLength(s[i:])
+		if m == n {
+			code := strings.Replace(s[n:i], "\n", " ", -1)
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+				code = code[1 : len(code)-1]
+			}
+			return "<code>" + html.EscapeString(code) + "</code>", i + n
+		}
+		i += m
+	}
+	// An unmatched run of backticks is literal text.
+	return s[:n], n
+}
+
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// emphasis renders emphasis delimited by a run of * or _ starting at
+// text[i]. As in CommonMark, an opening delimiter must be followed by
+// non-whitespace and a closing one preceded by it, and _ doesn't
+// delimit emphasis inside words, so that snake_case is left alone.
+func (r renderer) emphasis(text string, i int, inLink bool) (string, int) {
+	c := text[i]
+	n := runLength(text[i:])
+	literal := html.EscapeString(text[i : i+n])
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i+n:])
+	if n > 3 || i+n == len(text) || unicode.IsSpace(after) || (c == '_' && i > 0 && isAlphanumeric(before)) {
+		return literal, n
+	}
+	for j := i + n; j < len(text); {
+		k := strings.IndexByte(text[j:], c)
+		if k < 0 {
+			break
+		}
+		j += k
+		m := runLength(text[j:])
+		before, _ := utf8.DecodeLastRuneInString(text[:j])
+		after, _ := utf8.DecodeRuneInString(text[j+m:])
+		if m == n && !unicode.IsSpace(before) && !(c == '_' && j+m < len(text) && isAlphanumeric(after)) {
+			inner := r.renderInline(text[i+n:j], inLink)
+			switch n {
+			case 1:
+				return "<em>" + inner + "</em>", j + m - i
+			case 2:
+				return "<strong>" + inner + "</strong>", j + m - i
+			default:
+				return "<em><strong>" + inner + "</strong></em>", j + m - i
+			}
+		}
+		j += m
+	}
+	return literal, n
+}
+
+// link renders an inline link, [text](destination "title"). The title
+// is accepted but not used.
+func (r renderer) link(s string) (string, int) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return "", 0
+	}
+	rest := s[end+2:]
+	i := len(rest) - len(strings.TrimLeft(rest, " \n"))
+	var dest string
+	if i < len(rest) && rest[i] == '<' {
+		j := strings.IndexAny(rest[i:], ">\n")
+		if j < 0 || rest[i+j] != '>' {
+			return "", 0
+		}
+		dest = rest[i+1 : i+j]
+		i += j + 1
+	} else {
+		start, parens := i, 0
+	dest:
+		for ; i < len(rest); i++ {
+			switch rest[i] {
+			case ' ', '\n':
+				break dest
+			case '(':
+				parens++
+			case ')':
+				if parens == 0 {
+					break dest
+				}
+				parens--
+			}
+		}
+		dest = rest[start:i]
+	}
+	i += len(rest[i:]) - len(strings.TrimLeft(rest[i:], " \n"))
+	if i < len(rest) && strings.IndexByte("\"'(", rest[i]) >= 0 {
+		closer := rest[i]
+		if closer == '(' {
+			closer = ')'
+		}
+		j := strings.IndexByte(rest[i+1:], closer)
+		if j < 0 {
+			return "", 0
+		}
+		i += j + 2
+		i += len(rest[i:]) - len(strings.TrimLeft(rest[i:], " \n"))
+	}
+	if i >= len(rest) || rest[i] != ')' {
+		return "", 0
+	}
+	text := r.renderInline(s[1:end], true)
+	return "<a href=\"" + html.EscapeString(unescapeBackslashes(dest)) + "\">" + text + "</a>", end + 2 + i + 1
+}
+
+func unescapeBackslashes(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(asciiPunctuation, s[i+1]) >= 0 {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// autolink renders a URL or email address in angle brackets as a link.
+func autolink(s string) (string, int) {
+	end := strings.IndexAny(s[1:], "<> \n") + 1
+	if end == 0 || s[end] != '>' {
+		return "", 0
+	}
+	target := s[1:end]
+	href := target
+	if u, err := url.Parse(target); err != nil || u.Scheme == "" {
+		if !strings.Contains(target, "@") || strings.ContainsAny(target, "/:") {
+			return "", 0
+		}
+		href = "mailto:" + target
+	}
+	return "<a href=\"" + html.EscapeString(href) + "\">" + html.EscapeString(target) + "</a>", end + 1
+}
+
+// bareURL renders an http or https URL that isn't in angle brackets as
+// a link. Trailing punctuation is assumed to belong to the surrounding
+// sentence rather than the URL.
+func bareURL(s string) (string, int) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return "", 0
+	}
+	end := strings.IndexAny(s, " \n<")
+	if end < 0 {
+		end = len(s)
+	}
+	target := strings.TrimRight(s[:end], ".,:;!?'\"*_")
+	if strings.HasSuffix(target, ")") && strings.Count(target, "(") < strings.Count(target, ")") {
+		target = target[:len(target)-1]
+	}
+	if u, err := url.Parse(target); err != nil || u.Host == "" {
+		return "", 0
+	}
+	return "<a href=\"" + html.EscapeString(target) + "\">" + html.EscapeString(target) + "</a>", len(target)
+}
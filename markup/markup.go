@@ -0,0 +1,41 @@
+// The markup package converts the source of posts to HTML and
+// sanitizes HTML, whether it was rendered locally or received from
+// another server, so that it is safe to include in Kanna's pages.
+package markup
+
+import (
+	"strings"
+)
+
+// The media types of the source formats that Kanna understands.
+const (
+	Markdown  = "text/markdown"
+	PlainText = "text/plain"
+	HTML      = "text/html"
+)
+
+// Render converts source text of the given media type to sanitized
+// HTML, linking the mentions and hashtags in it if links is non-nil.
+// Sources of an unknown media type are treated as plain text.
+func Render(mediaType, source string, links *Links) string {
+	switch mediaType {
+	case Markdown:
+		return Sanitize(RenderMarkdown(source, links))
+	case HTML:
+		return Sanitize(source)
+	default:
+		return RenderPlainText(source, links)
+	}
+}
+
+// RenderPlainText converts plain text to HTML, with a paragraph for
+// each block of text separated by a blank line. If links is non-nil,
+// mentions and hashtags are linked.
+func RenderPlainText(text string, links *Links) string {
+	r := renderer{links}
+	var paragraphs []string
+	for _, para := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n\n") {
+		paragraphs = append(paragraphs, "<p>"+r.renderText(para)+"</p>")
+	}
+	return strings.Join(paragraphs, "")
+}
@@ -0,0 +1,200 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"strings"
+
+	htmlparser "golang.org/x/net/html"
+)
+
+// allowedElements maps the elements that may appear in sanitized HTML
+// to the attributes they may keep. It includes the elements produced
+// by RenderMarkdown and the ones Mastodon uses in the content of
+// posts.
+var allowedElements = map[string][]string{
+	"a":          {"href", "class"},
+	"b":          nil,
+	"blockquote": nil,
+	"br":         nil,
+	"code":       nil,
+	"del":        nil,
+	"em":         nil,
+	"i":          nil,
+	"li":         {"value"},
+	"ol":         {"start", "reversed"},
+	"p":          nil,
+	"pre":        nil,
+	"s":          nil,
+	"span":       {"class"},
+	"strong":     nil,
+	"u":          nil,
+	"ul":         nil,
+}
+
+// allowedClasses are the classes that may be used in class attributes.
+// Mastodon uses them to mark up mentions and hashtags and to shorten
+// long links.
+var allowedClasses = map[string]bool{
+	"ellipsis":  true,
+	"h-card":    true,
+	"hashtag":   true,
+	"invisible": true,
+	"mention":   true,
+	"u-url":     true,
+}
+
+// droppedElements are removed along with their content, which isn't
+// meant to be read as text.
+var droppedElements = map[string]bool{
+	"embed":    true,
+	"iframe":   true,
+	"math":     true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"select":   true,
+	"style":    true,
+	"svg":      true,
+	"template": true,
+	"textarea": true,
+	"title":    true,
+}
+
+// allowedSchemes are the URL schemes that links may use.
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// Sanitize removes everything from a fragment of HTML except for the
+// elements and attributes in a small allowlist. Disallowed elements are
+// replaced by their content, except for ones like script whose content
+// is dropped too. Links may only use http, https and mailto URLs and
+// are marked with rel="nofollow noopener noreferrer". The result is
+// well-formed, with every element closed.
+func Sanitize(fragment string) string {
+	var buf bytes.Buffer
+	var open []string
+	// While the content of a dropped element is being skipped, skip
+	// is its name and depth is the number of nested elements with
+	// that name.
+	skip, depth := "", 0
+	z := htmlparser.NewTokenizer(strings.NewReader(fragment))
+	for {
+		tt := z.Next()
+		switch tt {
+		case htmlparser.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				buf.WriteString("</" + open[i] + ">")
+			}
+			return buf.String()
+		case htmlparser.TextToken:
+			if skip == "" {
+				buf.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case htmlparser.StartTagToken, htmlparser.SelfClosingTagToken:
+			tok := z.Token()
+			if skip != "" {
+				if tok.Data == skip && tt == htmlparser.StartTagToken {
+					depth++
+				}
+				continue
+			}
+			if droppedElements[tok.Data] {
+				if tt == htmlparser.StartTagToken {
+					skip, depth = tok.Data, 1
+				}
+				continue
+			}
+			attrs, ok := allowedElements[tok.Data]
+			if !ok {
+				continue
+			}
+			buf.WriteString("<" + tok.Data)
+			for _, attr := range tok.Attr {
+				if !contains(attrs, attr.Key) || attr.Namespace != "" {
+					continue
+				}
+				if val, ok := sanitizeAttr(attr.Key, attr.Val); ok {
+					buf.WriteString(" " + attr.Key + "=\"" + html.EscapeString(val) + "\"")
+				}
+			}
+			if tok.Data == "a" {
+				buf.WriteString(" rel=\"nofollow noopener noreferrer\"")
+			}
+			if tok.Data == "br" {
+				buf.WriteString(" />")
+			} else {
+				buf.WriteString(">")
+				open = append(open, tok.Data)
+			}
+		case htmlparser.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if skip != "" {
+				if tag == skip {
+					if depth--; depth == 0 {
+						skip = ""
+					}
+				}
+				continue
+			}
+			// Close the element along with any elements left open
+			// inside it. End tags for elements that aren't open
+			// are ignored.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tag {
+					for j := len(open) - 1; j >= i; j-- {
+						buf.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeAttr checks the value of an allowed attribute, returning the
+// value to use and whether to keep the attribute at all.
+func sanitizeAttr(key, val string) (string, bool) {
+	switch key {
+	case "href":
+		u, err := url.Parse(strings.TrimSpace(val))
+		if err != nil || !allowedSchemes[strings.ToLower(u.Scheme)] {
+			return "", false
+		}
+		return u.String(), true
+	case "class":
+		var classes []string
+		for _, class := range strings.Fields(val) {
+			if allowedClasses[class] {
+				classes = append(classes, class)
+			}
+		}
+		return strings.Join(classes, " "), len(classes) > 0
+	case "start", "value":
+		for _, c := range val {
+			if c < '0' || c > '9' {
+				return "", false
+			}
+		}
+		return val, val != ""
+	case "reversed":
+		return "", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,101 @@
+package markup
+
+import "testing"
+
+// rel is the rel attribute that Sanitize adds to every link.
+const rel = ` rel="nofollow noopener noreferrer"`
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"script", `<script>alert(1)</script>hi`, `hi`},
+		{"script with src", `<SCRIPT SRC=x></SCRIPT>`, ``},
+		{"svg onload", `<svg onload=alert(1)><circle/></svg>ok`, `ok`},
+		{"script in svg", `<svg><script>alert(1)</script></svg>`, ``},
+		{"img onerror", `<img src=x onerror=alert(1)>`, ``},
+		{"onclick", `<p onclick="alert(1)">x</p>`, `<p>x</p>`},
+		{"onmouseover on link",
+			`<a href="https://example.com" onmouseover="alert(1)">x</a>`,
+			`<a href="https://example.com"` + rel + `>x</a>`},
+		{"style and onfocus",
+			`<span class="mention" style="x" onfocus=alert(1)>x</span>`,
+			`<span class="mention">x</span>`},
+		{"javascript URL", `<a href="javascript:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"mixed case javascript URL", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"decimal entity in javascript URL", `<a href="&#106;avascript:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"hex entities in javascript URL", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"tab in javascript URL", "<a href=\"java\tscript:alert(1)\">x</a>", `<a` + rel + `>x</a>`},
+		{"tab entity in javascript URL", `<a href="java&#9;script:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"named tab entity in javascript URL", `<a href="java&Tab;script:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"leading space in javascript URL", `<a href="  javascript:alert(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"vbscript URL", `<a href="vbscript:msgbox(1)">x</a>`, `<a` + rel + `>x</a>`},
+		{"data URL",
+			`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`,
+			`<a` + rel + `>x</a>`},
+		{"upper case data URL", `<a href="DATA:text/html,<script>alert(1)</script>">x</a>`, `<a` + rel + `>x</a>`},
+		{"quote entities in href",
+			`<a href="https://example.com/&quot; onclick=&quot;alert(1)">x</a>`,
+			`<a href="https://example.com/%22%20onclick=%22alert%281%29"` + rel + `>x</a>`},
+		{"double quotes in single-quoted href",
+			`<a href='https://example.com/" onclick="alert(1)'>x</a>`,
+			`<a href="https://example.com/%22%20onclick=%22alert%281%29"` + rel + `>x</a>`},
+		{"stray quote after attribute",
+			`<a href="https://example.com/" class="mention"">x</a>`,
+			`<a href="https://example.com/" class="mention"` + rel + `>x</a>`},
+		{"markup in single-quoted class",
+			`<span class='mention"><script>alert(1)</script>'>x</span>`,
+			`<span>x</span>`},
+		{"quote entities in start",
+			`<ol start="1&quot; onclick=&quot;alert(1)"><li>x</li></ol>`,
+			`<ol><li>x</li></ol>`},
+		{"ampersand in href",
+			`<a href="https://example.com/?q=a&b=c">x</a>`,
+			`<a href="https://example.com/?q=a&amp;b=c"` + rel + `>x</a>`},
+	}
+	for _, test := range tests {
+		if got := Sanitize(test.in); got != test.want {
+			t.Errorf("%s: Sanitize(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestRenderMarkdownUnsafe(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"raw script", `<script>alert(1)</script>`,
+			"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"raw img onerror", `hi <img src=x onerror=alert(1)>`,
+			"<p>hi &lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"raw link", `<a href="javascript:alert(1)">x</a>`,
+			"<p>&lt;a href=&#34;javascript:alert(1)&#34;&gt;x&lt;/a&gt;</p>\n"},
+		{"javascript link", `[x](javascript:alert(1))`, "<p><a" + rel + ">x</a></p>\n"},
+		{"mixed case javascript link", `[x](JaVaScRiPt:alert(1))`, "<p><a" + rel + ">x</a></p>\n"},
+		{"entity in javascript link", `[x](&#106;avascript:alert(1))`, "<p><a" + rel + ">x</a></p>\n"},
+		{"tab entity in javascript link", `[x](java&#9;script:alert(1))`, "<p><a" + rel + ">x</a></p>\n"},
+		{"javascript autolink", `<javascript:alert(1)>`,
+			"<p><a" + rel + ">javascript:alert(1)</a></p>\n"},
+		{"upper case javascript autolink", `<JAVASCRIPT:alert(1)>`,
+			"<p><a" + rel + ">JAVASCRIPT:alert(1)</a></p>\n"},
+		{"data link", `[x](data:text/html;base64,PHNjcmlwdD4=)`, "<p><a" + rel + ">x</a></p>\n"},
+		{"data autolink", `<data:text/html,<script>alert(1)</script>>`,
+			"<p>&lt;data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;&gt;</p>\n"},
+		{"quotes in link destination", `[x](https://example.com/"onmouseover="alert(1))`,
+			"<p><a href=\"https://example.com/%22onmouseover=%22alert%281%29\"" + rel + ">x</a></p>\n"},
+		{"markup in link text", `[x"><script>alert(1)</script>](https://example.com/)`,
+			"<p><a href=\"https://example.com/\"" + rel + ">x&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;</a></p>\n"},
+		{"markup after bare URL", `https://example.com/"><script>alert(1)</script>`,
+			"<p><a href=\"https://example.com/%22%3E\"" + rel + ">https://example.com/&#34;&gt;</a>" +
+				"&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"script in code block", "```\n<script>alert(1)</script>\n```",
+			"<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;\n</code></pre>\n"},
+		{"img in code span", "`<img src=x onerror=alert(1)>`",
+			"<p><code>&lt;img src=x onerror=alert(1)&gt;</code></p>\n"},
+	}
+	for _, test := range tests {
+		if got := Render(Markdown, test.in, nil); got != test.want {
+			t.Errorf("%s: Render(Markdown, %q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
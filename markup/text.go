@@ -0,0 +1,39 @@
+package markup
+
+import (
+	"strings"
+
+	htmlparser "golang.org/x/net/html"
+)
+
+// breakingElements are the elements that separate the text before them
+// from the text after them.
+var breakingElements = map[string]bool{
+	"blockquote": true,
+	"br":         true,
+	"li":         true,
+	"ol":         true,
+	"p":          true,
+	"pre":        true,
+	"ul":         true,
+}
+
+// Text returns the text of a fragment of sanitized HTML without its
+// markup, for uses such as indexing posts for searching. Paragraphs,
+// line breaks and other block elements become newlines.
+func Text(fragment string) string {
+	var buf strings.Builder
+	z := htmlparser.NewTokenizer(strings.NewReader(fragment))
+	for {
+		switch z.Next() {
+		case htmlparser.ErrorToken:
+			return strings.TrimSpace(buf.String())
+		case htmlparser.TextToken:
+			buf.Write(z.Text())
+		case htmlparser.StartTagToken, htmlparser.SelfClosingTagToken, htmlparser.EndTagToken:
+			if name, _ := z.TagName(); breakingElements[string(name)] {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+}
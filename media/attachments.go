@@ -0,0 +1,202 @@
+package media
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+)
+
+// client is used to fetch the attachments of posts from other servers.
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// Upload processes an image uploaded by an actor and stores it as a new
+// attachment that can be attached to a post by its owner. The
+// description is the alt text of the image.
+func Upload(ctx context.Context, owner *models.Actor, r io.Reader, description string) (*models.Attachment, error) {
+	cfg := config.Get(ctx).Media
+	buf, err := readLimited(r, cfg.MaxUploadSize)
+	if err != nil {
+		return nil, err
+	}
+	img, err := process(buf, cfg.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+	a, err := store(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	a.ID = models.NewAttachmentID(ctx)
+	a.Type = models.ImageType
+	a.Name = description
+	if err = models.CreateAttachment(ctx, a, owner); err != nil {
+		DeleteFiles(ctx, []*models.Attachment{a})
+		return nil, err
+	}
+	return a, nil
+}
+
+// readLimited reads all of r, failing with ErrTooLarge if it is longer
+// than max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		return nil, ErrTooLarge
+	}
+	return buf, nil
+}
+
+// store puts a processed image and its thumbnail in the media storage
+// under new keys, returning an Attachment describing the stored files.
+func store(ctx context.Context, img *processed) (*models.Attachment, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	name := hex.EncodeToString(key)
+	a := &models.Attachment{
+		MediaType:  img.mediaType,
+		Width:      img.width,
+		Height:     img.height,
+		FileKey:    name + extension(img.mediaType),
+		PreviewKey: name + "-preview" + extension(img.previewType),
+	}
+	storage := Get(ctx)
+	if err := storage.Put(ctx, a.FileKey, img.data); err != nil {
+		return nil, err
+	}
+	if err := storage.Put(ctx, a.PreviewKey, img.preview); err != nil {
+		storage.Delete(ctx, a.FileKey)
+		return nil, err
+	}
+	return a, nil
+}
+
+// extension returns the file name extension used in the keys of files
+// of a media type.
+func extension(mediaType string) string {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ""
+	}
+}
+
+// cache fetches the file of an attachment of a post from another
+// server and stores it, along with a thumbnail. Only images in the
+// formats that Kanna can process are cached, and only if they aren't
+// larger than the configured limit.
+func cache(ctx context.Context, a *models.Attachment) error {
+	cfg := config.Get(ctx).Media
+	buf, err := fetch(ctx, a, cfg.MaxRemoteSize)
+	if err != nil {
+		return err
+	}
+	img, err := process(buf, cfg.MaxPixels)
+	if err != nil {
+		return err
+	}
+	cached, err := store(ctx, img)
+	if err != nil {
+		return err
+	}
+	ok, err := models.CacheAttachment(ctx, a, cached)
+	if err != nil || !ok {
+		DeleteFiles(ctx, []*models.Attachment{cached})
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Another request cached the file first.
+		stored, err := models.AttachmentById(ctx, a.ID.String())
+		if err != nil {
+			return err
+		}
+		*a = *stored
+	}
+	return nil
+}
+
+// rejected reports whether the file of an attachment from another
+// server mustn't be fetched, because the server of the post it belongs
+// to or the one it is stored on is blocked.
+func rejected(ctx context.Context, a *models.Attachment) (bool, error) {
+	for _, u := range []*url.URL{a.Owner, a.RemoteURL} {
+		if u == nil {
+			continue
+		}
+		block, err := models.DomainBlockFor(ctx, u.Host)
+		if err != nil {
+			return false, err
+		} else if block.RejectsMedia() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetch retrieves the file of an attachment from another server.
+func fetch(ctx context.Context, a *models.Attachment, max int64) ([]byte, error) {
+	u := a.RemoteURL
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("can't fetch %s: unsupported scheme", u)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "image/*")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !models.ImageMediaTypes[mediaType] {
+		return nil, ErrUnsupported
+	}
+	if resp.ContentLength > max {
+		return nil, ErrTooLarge
+	}
+	return readLimited(resp.Body, max)
+}
+
+// DeleteFiles deletes the stored files of attachments that have been
+// deleted. Failures are only logged, since the attachments are gone
+// either way.
+func DeleteFiles(ctx context.Context, attachments []*models.Attachment) {
+	storage := Get(ctx)
+	for _, a := range attachments {
+		for _, key := range []string{a.FileKey, a.PreviewKey} {
+			if key == "" {
+				continue
+			}
+			if err := storage.Delete(ctx, key); err != nil {
+				log.Printf("deleting media file %s: %v", key, err)
+			}
+		}
+	}
+}
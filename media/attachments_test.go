@@ -0,0 +1,98 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+)
+
+// remoteFiles serves files of a given size, as another server would
+// serve attachments. Files under /chunked/ are sent without a
+// Content-Length, so that only reading them shows how large they are.
+func remoteFiles(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		data := bytes.Repeat([]byte{'x'}, size)
+		if r.URL.Path == "/chunked/" {
+			// Flushing before writing the body makes the
+			// response chunked.
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func remoteAttachment(t *testing.T, srv *httptest.Server, path string, size int, mediaType string) *models.Attachment {
+	u, err := url.Parse(srv.URL + path + "?size=" + strconv.Itoa(size) + "&type=" + url.QueryEscape(mediaType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.Attachment{RemoteURL: u}
+}
+
+func TestFetch(t *testing.T) {
+	srv := remoteFiles(t)
+	ctx := context.Background()
+	for _, test := range []struct {
+		path      string
+		size      int
+		mediaType string
+		err       error
+	}{
+		{"/", 16, "image/png", nil},
+		{"/chunked/", 16, "image/png", nil},
+		{"/", 17, "image/png", ErrTooLarge},
+		{"/chunked/", 17, "image/png", ErrTooLarge},
+		{"/chunked/", 1 << 20, "image/png", ErrTooLarge},
+		{"/", 16, "text/html", ErrUnsupported},
+		{"/", 16, "image/svg+xml", ErrUnsupported},
+	} {
+		a := remoteAttachment(t, srv, test.path, test.size, test.mediaType)
+		buf, err := fetch(ctx, a, 16)
+		if err != test.err {
+			t.Errorf("fetching %d bytes of %s from %s: %v, want %v", test.size, test.mediaType, test.path, err, test.err)
+		} else if err == nil && len(buf) != test.size {
+			t.Errorf("fetching %d bytes from %s read %d", test.size, test.path, len(buf))
+		}
+	}
+}
+
+// TestCacheTooLarge checks that remote attachments larger than the
+// configured limit aren't cached.
+func TestCacheTooLarge(t *testing.T) {
+	srv := remoteFiles(t)
+	cfg := config.Default()
+	cfg.Media.MaxRemoteSize = 1024
+	dir := t.TempDir()
+	ctx := context.WithValue(config.WithConfig(context.Background(), cfg), storageKey{}, FileStorage{Dir: dir})
+	for _, path := range []string{"/", "/chunked/"} {
+		a := remoteAttachment(t, srv, path, 1025, "image/jpeg")
+		if err := cache(ctx, a); err != ErrTooLarge {
+			t.Errorf("caching a file from %s larger than the limit: %v, want ErrTooLarge", path, err)
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("%d files were stored", len(files))
+	}
+}
@@ -0,0 +1,131 @@
+package media
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// orientationTag is the EXIF tag recording how an image must be
+// rotated or flipped to be displayed upright.
+const orientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, from 1
+// to 8, or 1 if the file doesn't record one.
+func jpegOrientation(buf []byte) int {
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(buf); {
+		if buf[i] != 0xFF {
+			return 1
+		}
+		marker := buf[i+1]
+		if marker == 0xFF {
+			// Markers may be preceded by any number of fill
+			// bytes.
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// The metadata comes before the start of the
+			// image data.
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if length < 2 || i+2+length > len(buf) {
+			return 1
+		}
+		segment := buf[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation finds the orientation in the first IFD of the TIFF
+// structure in which EXIF metadata is stored.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for j := 0; j < n; j++ {
+		entry := ifd + 2 + 12*j
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// The value of a SHORT tag is stored in the entry itself.
+		if order.Uint16(tiff[entry:]) == orientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient rotates and flips an image as an EXIF orientation requires
+// for it to be displayed upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flipped horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs rotating 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs rotating 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// toRGBA converts an image to an RGBA image with its origin at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
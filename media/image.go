@@ -0,0 +1,156 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// ErrUnsupported is returned for files that aren't images in one of
+// the formats Kanna can process.
+var ErrUnsupported = errors.New("file is not a supported image")
+
+// ErrTooLarge is returned for files or images that are larger than the
+// configured limits.
+var ErrTooLarge = errors.New("file is too large")
+
+// previewSize is the largest width and height of thumbnails.
+const previewSize = 400
+
+// jpegQuality is the quality with which JPEG files are re-encoded.
+const jpegQuality = 90
+
+// A processed image is an image that has been re-encoded without its
+// metadata, along with a thumbnail of it.
+type processed struct {
+	data, preview          []byte
+	mediaType, previewType string
+	width, height          int
+}
+
+// process decodes an image in JPEG, PNG or GIF format and re-encodes
+// it in the same format, which leaves out any metadata. JPEG images are
+// turned upright according to their EXIF orientation, since that is
+// lost with the metadata. Images with more than maxPixels pixels are
+// rejected before they are decoded.
+func process(buf []byte, maxPixels int) (*processed, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width > maxPixels/cfg.Height {
+		return nil, ErrTooLarge
+	}
+	p := &processed{}
+	var img image.Image
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		if img, err = jpeg.Decode(bytes.NewReader(buf)); err != nil {
+			return nil, ErrUnsupported
+		}
+		img = orient(img, jpegOrientation(buf))
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality})
+		p.mediaType = "image/jpeg"
+	case "png":
+		if img, err = png.Decode(bytes.NewReader(buf)); err != nil {
+			return nil, ErrUnsupported
+		}
+		err = png.Encode(&out, img)
+		p.mediaType = "image/png"
+	case "gif":
+		// Every frame of an animation is kept, but comments and
+		// other extensions are not.
+		var g *gif.GIF
+		if g, err = gif.DecodeAll(bytes.NewReader(buf)); err != nil || len(g.Image) == 0 {
+			return nil, ErrUnsupported
+		}
+		first := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		frame := g.Image[0]
+		draw.Draw(first, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		img = first
+		err = gif.EncodeAll(&out, g)
+		p.mediaType = "image/gif"
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.data = out.Bytes()
+	b := img.Bounds()
+	p.width, p.height = b.Dx(), b.Dy()
+
+	var preview bytes.Buffer
+	thumb := thumbnail(img, previewSize)
+	if format == "jpeg" {
+		err = jpeg.Encode(&preview, thumb, &jpeg.Options{Quality: jpegQuality})
+		p.previewType = "image/jpeg"
+	} else {
+		err = png.Encode(&preview, thumb)
+		p.previewType = "image/png"
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.preview = preview.Bytes()
+	return p, nil
+}
+
+// thumbnail scales an image down to fit within size by size pixels,
+// averaging the pixels covered by each pixel of the thumbnail. Images
+// that already fit are returned unchanged.
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	src := toRGBA(img)
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*h/th, (ty+1)*h/th
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*w/tw, (tx+1)*w/tw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[src.PixOffset(x0, y):src.PixOffset(x1, y)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			pix := dst.Pix[dst.PixOffset(tx, ty):]
+			for c := 0; c < 4; c++ {
+				pix[c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
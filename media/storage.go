@@ -0,0 +1,121 @@
+// The media package stores and serves the files of media attachments.
+// Uploaded images are processed before they are stored: their
+// metadata is stripped, they are turned upright according to their
+// EXIF orientation, and a thumbnail is generated. The attachments of
+// posts from other servers are fetched, processed and cached the first
+// time they are requested, so that clients never load them from the
+// other servers directly.
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/routes"
+)
+
+// A Storage stores files under keys. The keys are chosen by the media
+// package and are valid file names. Getting a file that doesn't exist
+// returns an error for which os.IsNotExist reports true.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Open returns the Storage selected by the configuration.
+func Open(cfg *config.Config) (Storage, error) {
+	switch cfg.Media.Storage {
+	case "", "file":
+		return FileStorage{Dir: cfg.Media.Dir}, nil
+	case "s3":
+		return NewS3Storage(cfg.Media.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage %q", cfg.Media.Storage)
+	}
+}
+
+// InitParams opens the media storage and configures a Router to pass
+// it to request handlers via the context.
+func InitParams(router *routes.Router, cfg *config.Config) error {
+	storage, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	router.BaseParam(storageKey{}, storage)
+	return nil
+}
+
+type storageKey struct{}
+
+// Get retrieves the media storage from the request context.
+func Get(ctx context.Context) Storage {
+	return ctx.Value(storageKey{}).(Storage)
+}
+
+// A FileStorage stores files in a directory of the local filesystem.
+type FileStorage struct {
+	Dir string
+}
+
+func (fs FileStorage) path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key || key[0] == '.' {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(fs.Dir, key), nil
+}
+
+// Put writes a file, replacing it atomically if it already exists.
+func (fs FileStorage) Put(ctx context.Context, key string, data []byte) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(fs.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(fs.Dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (fs FileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete removes a file. Deleting a file that doesn't exist isn't an
+// error.
+func (fs FileStorage) Delete(ctx context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package media
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+)
+
+// AddRoutes registers the routes that serve media files on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{"media", routes.Param("media")}, serveFile(false))
+	router.Route([]interface{}{"media", routes.Param("media"), "preview"}, serveFile(true))
+}
+
+// serveFile serves the file of the attachment in the request path, or
+// its thumbnail, caching the file first if it is from another server
+// whose media isn't rejected. The keys of attachments can't be guessed,
+// so anyone who knows the URL of a file may see it, as with other
+// servers.
+func serveFile(preview bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := ctx.Value(routes.Param("media")).(string)
+		a, err := models.AttachmentById(ctx, config.Get(ctx).URL("media", key).String())
+		if err == sql.ErrNoRows {
+			panic(routes.NotFound)
+		} else if err != nil {
+			panic(routes.Error(err))
+		}
+		if !a.IsCached() {
+			if a.RemoteURL == nil || !a.IsImage() {
+				panic(routes.NotFound)
+			}
+			if rejected, err := rejected(ctx, a); err != nil {
+				panic(routes.Error(err))
+			} else if rejected {
+				panic(routes.NotFound)
+			}
+			if err = cache(ctx, a); err != nil {
+				log.Printf("caching %s: %v", a.RemoteURL, err)
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte("the file could not be retrieved"))
+				return
+			}
+		}
+		fileKey := a.FileKey
+		if preview {
+			fileKey = a.PreviewKey
+		}
+		if fileKey == "" {
+			panic(routes.NotFound)
+		}
+		file, err := Get(ctx).Get(ctx, fileKey)
+		if os.IsNotExist(err) {
+			panic(routes.NotFound)
+		} else if err != nil {
+			panic(routes.Error(err))
+		}
+		defer file.Close()
+		// The files are never changed once they are stored, and
+		// browsers mustn't treat them as anything but images.
+		w.Header().Set("Content-Type", contentType(fileKey))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		io.Copy(w, file)
+	})
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/ekiru/kanna/sessions"
+)
+
+// RequireRole wraps a handler so that it is only served to logged-in
+// users whose accounts have a role or a more privileged one. Clients
+// that aren't logged-in are redirected to the login page, and other
+// users are refused.
+func RequireRole(role string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := sessions.Get(r.Context()).User
+		if user == nil {
+			http.Redirect(w, r, "/auth?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if !user.HasRole(role) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("you aren't allowed to do this"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
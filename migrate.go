@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/migrations"
+)
+
+// A migrationState is the migrations of this program along with the
+// records of those that have been applied to the database.
+type migrationState struct {
+	all     []db.Migration
+	applied map[string]*db.AppliedMigration
+	// checksums are the current checksums of the migrations, by
+	// their IDs.
+	checksums map[string]string
+	// run is the run in which migrations are applied and undone,
+	// which holds the database's lock until finish is called.
+	run *db.MigrationRun
+	// dryRun is true if the run is a dry run, which prints the
+	// statements of the migrations and rolls them back.
+	dryRun bool
+}
+
+// migrationLockTimeout is how long the commands wait for another
+// process to finish migrating the database before giving up.
+const migrationLockTimeout = 5 * time.Minute
+
+// loadMigrations starts a run of the migrations, waiting for any other
+// process that is migrating the database to finish, and finds which of
+// them have been applied to the database. The run must be finished by
+// calling finish.
+func loadMigrations(e *env, dryRun bool) (*migrationState, error) {
+	state := &migrationState{all: migrations.All(), checksums: make(map[string]string), dryRun: dryRun}
+	var err error
+	for _, migration := range state.all {
+		if state.checksums[migration.ID()], err = db.Checksum(e.db.Dialect, migration); err != nil {
+			return nil, fmt.Errorf("%s: %v", migration.ID(), err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, migrationLockTimeout)
+	defer cancel()
+	if state.run, err = db.StartMigrations(ctx, e.db, dryRun); err != nil {
+		return nil, err
+	}
+	if state.applied, err = state.run.AppliedMigrations(); err != nil {
+		state.finish()
+		return nil, err
+	}
+	return state, nil
+}
+
+// finish commits the changes of the migrations that were applied or
+// undone, or rolls them back in a dry run, and releases the lock.
+func (state *migrationState) finish() error {
+	return state.run.Close()
+}
+
+// say writes a line about what is being done. During a dry run, it is
+// written as an SQL comment, so that the output is a script.
+func (state *migrationState) say(e *env, format string, args ...interface{}) {
+	if state.dryRun {
+		format = "-- " + format
+	}
+	fmt.Fprintf(e.out, format+"\n", args...)
+}
+
+// warn warns about the migrations that have changed since they were
+// applied, before they are applied or undone.
+func (state *migrationState) warn(e *env) {
+	for _, migration := range state.all {
+		if state.changed(migration) {
+			state.say(e, "Warning: %s has changed since it was applied.", migration.ID())
+		}
+	}
+}
+
+// changed reports whether a migration was applied with a different
+// definition than it has now, other than one of its deliberate
+// revisions.
+func (state *migrationState) changed(migration db.Migration) bool {
+	record := state.applied[migration.ID()]
+	if record == nil || record.Checksum == "" || record.Checksum == state.checksums[migration.ID()] {
+		return false
+	}
+	if revised, ok := migration.(db.RevisedMigration); ok {
+		for _, checksum := range revised.EarlierChecksums() {
+			if record.Checksum == checksum {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// unknown returns the IDs of the migrations that have been applied but
+// that this program doesn't have, such as those of a newer version.
+func (state *migrationState) unknown() []string {
+	known := make(map[string]bool)
+	for _, migration := range state.all {
+		known[migration.ID()] = true
+	}
+	var ids []string
+	for id := range state.applied {
+		if !known[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// lastApplied returns the index in all of the last migration that has
+// been applied, or -1 if none has.
+func (state *migrationState) lastApplied() int {
+	for i := len(state.all) - 1; i >= 0; i-- {
+		if state.applied[state.all[i].ID()] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func (state *migrationState) apply(e *env, migration db.Migration) error {
+	if state.applied[migration.ID()] != nil {
+		return nil
+	}
+	state.say(e, "Applying %s", migration.ID())
+	statements, err := state.run.Apply(migration)
+	if state.dryRun {
+		writeStatements(e.out, statements)
+	}
+	if err != nil {
+		return fmt.Errorf("applying %s: %v", migration.ID(), err)
+	}
+	state.applied[migration.ID()] = &db.AppliedMigration{ID: migration.ID(), Checksum: state.checksums[migration.ID()]}
+	return nil
+}
+
+func (state *migrationState) undo(e *env, migration db.Migration) error {
+	if state.applied[migration.ID()] == nil {
+		return nil
+	}
+	state.say(e, "Undoing %s", migration.ID())
+	statements, err := state.run.Undo(migration)
+	if state.dryRun {
+		writeStatements(e.out, statements)
+	}
+	if err != nil {
+		return fmt.Errorf("undoing %s: %v", migration.ID(), err)
+	}
+	delete(state.applied, migration.ID())
+	return nil
+}
+
+// writeStatements writes statements with their arguments in place, each
+// ended by a semicolon.
+func writeStatements(w io.Writer, statements []db.Statement) {
+	for _, stmt := range statements {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+}
+
+// parseMigrateFlags parses the flags of the commands that apply or undo
+// migrations, which can all be run with -dry-run to print the
+// statements that would be executed without changing the database.
+func parseMigrateFlags(name string, args []string, min, max int) (flags *flag.FlagSet, dryRun bool, err error) {
+	flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", false, "print the statements without changing the database")
+	err = parseFlags(flags, args, min, max)
+	return flags, dryRun, err
+}
+
+// finishMigrations finishes the run of the migrations of a command,
+// setting the error that the command returns if that fails.
+func finishMigrations(state *migrationState, err *error) {
+	if finishErr := state.finish(); *err == nil {
+		*err = finishErr
+	}
+}
+
+// migrateUp applies the migrations that haven't been applied, in
+// order.
+func migrateUp(e *env, args []string) (err error) {
+	_, dryRun, err := parseMigrateFlags("migrate up", args, 0, 0)
+	if err != nil {
+		return err
+	}
+	state, err := loadMigrations(e, dryRun)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	state.warn(e)
+	for _, migration := range state.all {
+		if err = state.apply(e, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown undoes the last n of the migrations that have been
+// applied, or just the last one if n isn't given.
+func migrateDown(e *env, args []string) (err error) {
+	flags, dryRun, err := parseMigrateFlags("migrate down", args, 0, 1)
+	if err != nil {
+		return err
+	}
+	n := 1
+	if flags.NArg() == 1 {
+		if n, err = strconv.Atoi(flags.Arg(0)); err != nil || n < 1 {
+			return errUsage
+		}
+	}
+	state, err := loadMigrations(e, dryRun)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	state.warn(e)
+	for ; n > 0; n-- {
+		last := state.lastApplied()
+		if last < 0 {
+			state.say(e, "No migrations are left to undo.")
+			break
+		}
+		if err = state.undo(e, state.all[last]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTo applies or undoes migrations so that those up to and
+// including the one with an ID are applied, and those after it aren't.
+func migrateTo(e *env, args []string) (err error) {
+	flags, dryRun, err := parseMigrateFlags("migrate to", args, 1, 1)
+	if err != nil {
+		return err
+	}
+	state, err := loadMigrations(e, dryRun)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	state.warn(e)
+	target := -1
+	for i, migration := range state.all {
+		if migration.ID() == flags.Arg(0) {
+			target = i
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("there is no migration %s", flags.Arg(0))
+	}
+	for i := len(state.all) - 1; i > target; i-- {
+		if err = state.undo(e, state.all[i]); err != nil {
+			return err
+		}
+	}
+	for _, migration := range state.all[:target+1] {
+		if err = state.apply(e, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRedo undoes the last migration that was applied and applies
+// it again, such as to try out changes to it.
+func migrateRedo(e *env, args []string) (err error) {
+	_, dryRun, err := parseMigrateFlags("migrate redo", args, 0, 0)
+	if err != nil {
+		return err
+	}
+	state, err := loadMigrations(e, dryRun)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	state.warn(e)
+	last := state.lastApplied()
+	if last < 0 {
+		return errors.New("no migrations have been applied")
+	}
+	if err = state.undo(e, state.all[last]); err != nil {
+		return err
+	}
+	return state.apply(e, state.all[last])
+}
+
+// migrateStatus lists the migrations, whether each of them has been
+// applied and when, along with those that have been applied but that
+// this program doesn't know of. It fails if any of the migrations have
+// changed since they were applied.
+func migrateStatus(e *env, args []string) (err error) {
+	if len(args) != 0 {
+		return errUsage
+	}
+	state, err := loadMigrations(e, false)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	w := tabwriter.NewWriter(e.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tMIGRATION\tAPPLIED AT")
+	changed := 0
+	for _, migration := range state.all {
+		record := state.applied[migration.ID()]
+		switch {
+		case record == nil:
+			fmt.Fprintf(w, "pending\t%s\t\n", migration.ID())
+		case state.changed(migration):
+			changed++
+			fmt.Fprintf(w, "changed\t%s\t%s\n", migration.ID(), record.AppliedAt)
+		default:
+			fmt.Fprintf(w, "applied\t%s\t%s\n", migration.ID(), record.AppliedAt)
+		}
+	}
+	for _, id := range state.unknown() {
+		fmt.Fprintf(w, "unknown\t%s\t%s\n", id, state.applied[id].AppliedAt)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if changed != 0 {
+		return fmt.Errorf("%d migrations have changed since they were applied", changed)
+	}
+	return nil
+}
+
+// migrateExport writes the statements that all of the migrations
+// execute when they are applied to a file, or to the standard output
+// if the file is -, so that they can be reviewed or run by hand. They
+// are those for the database's dialect unless another is given with
+// -dialect. The database isn't used.
+func migrateExport(e *env, args []string) (err error) {
+	flags := flag.NewFlagSet("migrate export", flag.ContinueOnError)
+	dialectName := flags.String("dialect", e.db.Dialect.Name(), "the dialect of the statements")
+	if err = parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	dialect, ok := db.Dialects[*dialectName]
+	if !ok {
+		return fmt.Errorf("unknown dialect %s", *dialectName)
+	}
+	w := e.out
+	if file := flags.Arg(0); file != "-" {
+		f, createErr := os.Create(file)
+		if createErr != nil {
+			return createErr
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "-- The statements that the migrations of Kanna execute, in order.")
+	for _, migration := range migrations.All() {
+		up, _, err := db.Statements(dialect, migration)
+		if err != nil {
+			return fmt.Errorf("%s: %v", migration.ID(), err)
+		}
+		fmt.Fprintf(bw, "\n-- %s\n", migration.ID())
+		writeStatements(bw, up)
+	}
+	return bw.Flush()
+}
+
+// checkSchema makes sure that the database has the schema that this
+// program expects before the server starts, applying the migrations
+// that haven't been applied if apply is true and otherwise failing if
+// there are any. It also fails if the database has migrations that
+// this program doesn't know of, since a newer version of it must have
+// applied them. When several servers start at once, only one of them
+// applies the migrations, while the others wait for it to finish.
+func checkSchema(e *env, apply bool) (err error) {
+	state, err := loadMigrations(e, false)
+	if err != nil {
+		return err
+	}
+	defer finishMigrations(state, &err)
+	if unknown := state.unknown(); len(unknown) != 0 {
+		return fmt.Errorf("the database has migrations that this version of kanna doesn't know of: %s",
+			strings.Join(unknown, ", "))
+	}
+	pending := 0
+	for _, migration := range state.all {
+		if state.applied[migration.ID()] == nil {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	} else if !apply {
+		return fmt.Errorf("%d migrations haven't been applied; run kanna migrate up or kanna serve -migrate", pending)
+	}
+	state.warn(e)
+	for _, migration := range state.all {
+		if err = state.apply(e, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
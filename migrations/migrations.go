@@ -1,35 +1,18 @@
-package main
+// The migrations package defines the migrations that build Kanna's
+// database schema, which the kanna program applies.
+package migrations
 
 import (
-	"log"
-
 	"github.com/ekiru/kanna/db"
 	"github.com/ekiru/kanna/db/migrations"
-	"github.com/ekiru/kanna/models"
 )
 
-func main() {
-	conn, err := db.Open()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-	_, err = conn.Exec(`create table if not exists Migrations (
-	id text primary key not null
-)`)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, migration := range Migrations() {
-		log.Printf("Applying %s\n", migration.ID())
-		err := db.ApplyMigration(conn, migration)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-}
-
-func Migrations() []db.Migration {
+// All returns the migrations of Kanna's database, in the order in
+// which they are applied.
+func All() []db.Migration {
+	// Accounts are users unless they are made moderators or
+	// administrators.
+	defaultRole := "'user'"
 	return []db.Migration{
 		migrations.CreateTable("0001-create-actors",
 			"Actors",
@@ -60,18 +43,9 @@ func Migrations() []db.Migration {
 				NotNull: true,
 			},
 		),
-		migrations.FreeForm{
-			Identifier: "0002-create-example-actor",
-			Upward: func(tx db.MigrationTx) {
-				tx.Exec("insert into Actors (id, name, type, inbox, outbox) values (?, ?, ?, ?, ?)",
-					"https://faew.ink/actor/srn", "srn", "Person",
-					"https://faew.ink/actor/srn/inbox", "https://faew.ink/actor/srn/outbox",
-				)
-			},
-			Downward: func(tx db.MigrationTx) {
-				tx.Exec("delete Actors where name = ?", "srn")
-			},
-		},
+		// The example data is loaded with "kanna seed load dev" instead.
+		migrations.Retired("0002-create-example-actor",
+			"3dcc5c7d64e1cb001f596f6132f99f75626f8c0533a245d3ea27635c93eb5a6b"),
 		migrations.CreateTable(
 			"0003-create-accounts-table",
 			"Accounts",
@@ -98,18 +72,9 @@ func Migrations() []db.Migration {
 				Unique:  true,
 			},
 		),
-		migrations.FreeForm{
-			Identifier: "0004-create-example-account",
-			Upward: func(tx db.MigrationTx) {
-				tx.Exec("insert into Accounts (username, passwordHash, passwordHashVersion, actorId) values (?, ?, ?, ?)",
-					"srn", models.HashScrypt.Hash("examplePassword", nil), models.HashScrypt,
-					"https://faew.ink/actor/srn",
-				)
-			},
-			Downward: func(tx db.MigrationTx) {
-				tx.Exec("delete Accounts where username = ?", "srn")
-			},
-		},
+		// The example data is loaded with "kanna seed load dev" instead.
+		migrations.Retired("0004-create-example-account",
+			"87c4f9d92529b00e5ad75c7ae049fbb108ae859d265ba5f7ba00308199164211"),
 		migrations.CreateTable(
 			"0005-create-posts-table",
 			"Posts",
@@ -145,17 +110,1054 @@ func Migrations() []db.Migration {
 				NotNull: true,
 			},
 		),
+		// The example data is loaded with "kanna seed load dev" instead.
+		migrations.Retired("0006-create-example-post",
+			"599bed4e2b5d20fe94a5b7546e643d2cafdc371c63a55e5611b6099cf11c425f"),
+		migrations.CreateTable(
+			"0007-create-follows-table",
+			"Follows",
+			migrations.Column{
+				Name:    "followerId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "followeeId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "createdAt",
+				Type:    migrations.Timestamp,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0008-index-follows",
+			migrations.Index{
+				Name:    "FollowsByFollower",
+				Table:   "Follows",
+				Columns: []string{"followerId", "followeeId"},
+				Unique:  true,
+			},
+			migrations.Index{
+				Name:    "FollowsByFollowee",
+				Table:   "Follows",
+				Columns: []string{"followeeId"},
+			},
+		),
+		migrations.CreateTable(
+			"0009-create-favourites-table",
+			"Favourites",
+			migrations.Column{
+				Name:    "actorId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "postId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "createdAt",
+				Type:    migrations.Timestamp,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0010-index-favourites",
+			migrations.Index{
+				Name:    "FavouritesByActor",
+				Table:   "Favourites",
+				Columns: []string{"actorId", "postId"},
+				Unique:  true,
+			},
+			migrations.Index{
+				Name:    "FavouritesByPost",
+				Table:   "Favourites",
+				Columns: []string{"postId"},
+			},
+		),
+		migrations.CreateTable(
+			"0011-create-oauth-apps-table",
+			"OAuthApps",
+			migrations.Column{
+				Name:       "clientId",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "clientSecret",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "name",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "redirectUris",
+				Type:    migrations.Text,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "scopes",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "website",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateTable(
+			"0012-create-oauth-codes-table",
+			"OAuthCodes",
+			migrations.Column{
+				Name:       "code",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "clientId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "username",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "redirectUri",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "scopes",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "expiresAt",
+				Type:    migrations.Timestamp,
+				NotNull: true,
+			},
+		),
+		migrations.CreateTable(
+			"0013-create-oauth-tokens-table",
+			"OAuthTokens",
+			migrations.Column{
+				Name:       "token",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "clientId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "username",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "scopes",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "createdAt",
+				Type:    migrations.Timestamp,
+				NotNull: true,
+			},
+		),
+		migrations.AddColumn(
+			"0014-add-posts-updated",
+			"Posts",
+			migrations.Column{
+				Name: "updated",
+				Type: migrations.Text,
+			},
+		),
+		migrations.CreateTable(
+			"0015-create-activities-table",
+			"Activities",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "type",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "actorId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "objectId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "published",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0016-index-activities",
+			migrations.Index{
+				Name:    "ActivitiesByActor",
+				Table:   "Activities",
+				Columns: []string{"actorId", "published", "id"},
+			},
+		),
+		migrations.CreateTable(
+			"0017-create-tombstones-table",
+			"Tombstones",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "formerType",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "deleted",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.FreeForm{
+			Identifier: "0018-add-actors-followers",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Actors add column followers text")
+				tx.Exec("update Actors set followers = id || '/followers' where id in (select actorId from Accounts)")
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Actors drop column followers")
+			},
+		},
+		migrations.CreateTable(
+			"0019-create-addressing-table",
+			"Addressing",
+			migrations.Column{
+				Name:    "objectId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "field",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "targetId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0020-index-addressing",
+			migrations.Index{
+				Name:    "AddressingByObject",
+				Table:   "Addressing",
+				Columns: []string{"objectId"},
+			},
+			migrations.Index{
+				Name:    "AddressingByTarget",
+				Table:   "Addressing",
+				Columns: []string{"targetId", "field"},
+			},
+		),
+		migrations.FreeForm{
+			Identifier: "0021-move-posts-audience-to-addressing",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec("insert into Addressing (objectId, field, targetId) select id, 'to', audience from Posts")
+				tx.Exec("insert into Addressing (objectId, field, targetId) " +
+					"select post.id, 'cc', act.followers from Posts post join Actors act on post.authorId = act.id " +
+					"where act.followers is not null")
+				tx.Exec("alter table Posts drop column audience")
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Posts add column audience text not null default ''")
+				tx.Exec("update Posts set audience = coalesce((select targetId from Addressing " +
+					"where objectId = Posts.id and field = 'to' order by rowid limit 1), '')")
+				tx.Exec("delete from Addressing where objectId in (select id from Posts)")
+			},
+		},
+		migrations.FreeForm{
+			Identifier: "0022-add-posts-source",
+			Upward: func(tx db.MigrationTx) {
+				// Existing posts were written as plain text, so
+				// their content becomes their source and is
+				// escaped and split into paragraphs.
+				tx.Exec("alter table Posts add column source text")
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec("update Posts set source = json_build_object('content', content, 'mediaType', 'text/plain')::text")
+					tx.Exec("update Posts set content = '<p>' || " +
+						"replace(replace(replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), " +
+						"chr(10) || chr(10), '</p><p>'), chr(10), '<br />') || '</p>'")
+					return
+				}
+				tx.Exec("update Posts set source = json_object('content', content, 'mediaType', 'text/plain')")
+				tx.Exec("update Posts set content = '<p>' || " +
+					"replace(replace(replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), " +
+					"char(10) || char(10), '</p><p>'), char(10), '<br />') || '</p>'")
+			},
+			Downward: func(tx db.MigrationTx) {
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec("update Posts set content = source::json->>'content' where source is not null")
+				} else {
+					tx.Exec("update Posts set content = json_extract(source, '$.content') where source is not null")
+				}
+				tx.Exec("alter table Posts drop column source")
+			},
+		},
+		migrations.CreateTable(
+			"0023-create-tags-table",
+			"Tags",
+			migrations.Column{
+				Name:    "objectId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "type",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "href",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "name",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
 		migrations.FreeForm{
-			Identifier: "0006-create-example-post",
+			Identifier: "0024-index-tags",
 			Upward: func(tx db.MigrationTx) {
-				tx.Exec("insert into Posts (id, type, audience, authorId, content, published) values (?, ?, ?, ?, ?, ?)",
-					"https://faew.ink/post/1", "Note", "https://www.w3.org/ns/activitystreams#Public",
-					"https://faew.ink/actor/srn", "This is an example post!!!", "2017-10-21T15:49:45Z",
-				)
+				tx.Exec("create index TagsByObject on Tags (objectId)")
+				tx.Exec("create index TagsByName on Tags (" + tx.Dialect().CaseInsensitive("name") + ", type)")
 			},
 			Downward: func(tx db.MigrationTx) {
-				tx.Exec("delete Posts where id = ?", "https://faew.ink/post/1")
+				tx.Exec("drop index TagsByName")
+				tx.Exec("drop index TagsByObject")
 			},
 		},
+		migrations.FreeForm{
+			Identifier: "0025-add-posts-threading",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Posts add column inReplyTo text")
+				tx.Exec("alter table Posts add column context text")
+				tx.Exec("update Posts set context = id")
+				tx.Exec("create index PostsByInReplyTo on Posts (inReplyTo)")
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("drop index PostsByInReplyTo")
+				tx.Exec("alter table Posts drop column context")
+				tx.Exec("alter table Posts drop column inReplyTo")
+			},
+		},
+		migrations.CreateTable(
+			"0026-create-reactions-table",
+			"Reactions",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "type",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "actorId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "objectId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "published",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0027-index-reactions",
+			migrations.Index{
+				Name:    "ReactionsByActor",
+				Table:   "Reactions",
+				Columns: []string{"actorId", "objectId", "type"},
+				Unique:  true,
+			},
+			migrations.Index{
+				Name:    "ReactionsByObject",
+				Table:   "Reactions",
+				Columns: []string{"objectId", "type"},
+			},
+		),
+		migrations.FreeForm{
+			// Favourites become Likes. They were never
+			// published as activities, so they are given IDs in
+			// the manner of Mastodon's likes.
+			Identifier: "0028-move-favourites-to-reactions",
+			Upward: func(tx db.MigrationTx) {
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec("insert into Reactions (id, type, actorId, objectId, published) " +
+						"select actorId || '#likes/' || substr(md5(random()::text), 1, 24), 'Like', actorId, postId, " +
+						"to_char(to_timestamp(createdAt) at time zone 'UTC', 'YYYY-MM-DD\"T\"HH24:MI:SS.MS\"Z\"') from Favourites")
+				} else {
+					tx.Exec("insert into Reactions (id, type, actorId, objectId, published) " +
+						"select actorId || '#likes/' || lower(hex(randomblob(12))), 'Like', actorId, postId, " +
+						"strftime('%Y-%m-%dT%H:%M:%fZ', createdAt, 'unixepoch') from Favourites")
+				}
+				tx.Exec("drop index FavouritesByPost")
+				tx.Exec("drop index FavouritesByActor")
+				tx.Exec("drop table Favourites")
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("create table Favourites (actorId text not null, postId text not null, createdAt " +
+					tx.Dialect().TypeName(db.Timestamp) + " not null)")
+				tx.Exec("create unique index FavouritesByActor on Favourites (actorId, postId)")
+				tx.Exec("create index FavouritesByPost on Favourites (postId)")
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec("insert into Favourites (actorId, postId, createdAt) " +
+						"select actorId, objectId, cast(extract(epoch from published::timestamptz) as bigint) from Reactions where type = 'Like'")
+				} else {
+					tx.Exec("insert into Favourites (actorId, postId, createdAt) " +
+						"select actorId, objectId, cast(strftime('%s', published) as integer) from Reactions where type = 'Like'")
+				}
+				tx.Exec("delete from Reactions where type = 'Like'")
+			},
+		},
+		migrations.CreateTable(
+			"0029-create-keys-table",
+			"Keys",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "ownerId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "publicKeyPem",
+				Type:    migrations.Text,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name: "privateKeyPem",
+				Type: migrations.Text,
+			},
+		),
+		migrations.CreateIndex(
+			"0030-index-keys",
+			migrations.Index{
+				Name:    "KeysByOwner",
+				Table:   "Keys",
+				Columns: []string{"ownerId"},
+			},
+		),
+		migrations.CreateIndex(
+			"0031-index-timelines",
+			migrations.Index{
+				Name:    "PostsByPublished",
+				Table:   "Posts",
+				Columns: []string{"published", "id"},
+			},
+			migrations.Index{
+				Name:    "PostsByAuthor",
+				Table:   "Posts",
+				Columns: []string{"authorId", "published", "id"},
+			},
+			migrations.Index{
+				Name:    "ReactionsByPublished",
+				Table:   "Reactions",
+				Columns: []string{"type", "actorId", "published", "id"},
+			},
+		),
+		migrations.CreateTable(
+			"0032-create-attachments-table",
+			"Attachments",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "type",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "mediaType",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "name",
+				Type:    migrations.Text,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "width",
+				Type:    migrations.Int,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "height",
+				Type:    migrations.Int,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name: "remoteUrl",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name: "fileKey",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name: "previewKey",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name:    "ownerId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name: "postId",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name: "position",
+				Type: migrations.Int,
+			},
+			migrations.Column{
+				Name:    "created",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0033-index-attachments",
+			migrations.Index{
+				Name:    "AttachmentsByPost",
+				Table:   "Attachments",
+				Columns: []string{"postId", "position"},
+			},
+			migrations.Index{
+				Name:    "AttachmentsByOwner",
+				Table:   "Attachments",
+				Columns: []string{"ownerId"},
+			},
+		),
+		migrations.FreeForm{
+			Identifier: "0034-add-posts-content-warnings",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Posts add column summary text")
+				tx.Exec("alter table Posts add column sensitive boolean not null default " + tx.Dialect().Literal(false))
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("alter table Posts drop column sensitive")
+				tx.Exec("alter table Posts drop column summary")
+			},
+		},
+		migrations.AddColumn(
+			"0035-add-posts-plain-text",
+			"Posts",
+			migrations.Column{
+				Name: "plainText",
+				Type: migrations.Text,
+			},
+		),
+		migrations.FreeForm{
+			// The index is kept up to date by triggers. Posts and
+			// actors are stored with "insert or replace", which
+			// doesn't fire delete triggers, so the insert triggers
+			// remove any old entries first. Posts stored before
+			// the plainText column was added have their HTML
+			// content indexed instead until they are updated.
+			//
+			// PostgreSQL has no FTS5, so there the index is a
+			// table with a tsvector of each entry, kept up to
+			// date by a trigger function on each table.
+			Identifier: "0036-create-search-index",
+			Upward: func(tx db.MigrationTx) {
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec(`create table SearchIndex (
+	kind text not null,
+	objectId text not null,
+	name text not null,
+	content text not null,
+	document tsvector generated always as (to_tsvector('simple', name || ' ' || content)) stored)`)
+					tx.Exec("create index SearchIndexByObject on SearchIndex (objectId)")
+					tx.Exec("create index SearchIndexByDocument on SearchIndex using gin (document)")
+					tx.Exec(`create function PostsSearch() returns trigger language plpgsql as $$
+begin
+	if tg_op != 'INSERT' then
+		delete from SearchIndex where objectId = old.id;
+	end if;
+	if tg_op != 'DELETE' then
+		delete from SearchIndex where objectId = new.id;
+		insert into SearchIndex (kind, objectId, name, content)
+			values ('Post', new.id, coalesce(new.summary, ''), coalesce(new.plainText, new.content));
+	end if;
+	return null;
+end$$`)
+					tx.Exec("create trigger PostsSearch after insert or update or delete on Posts " +
+						"for each row execute function PostsSearch()")
+					tx.Exec(`create function ActorsSearch() returns trigger language plpgsql as $$
+begin
+	if tg_op != 'INSERT' then
+		delete from SearchIndex where objectId = old.id;
+	end if;
+	if tg_op != 'DELETE' then
+		delete from SearchIndex where objectId = new.id;
+		insert into SearchIndex (kind, objectId, name, content) values ('Actor', new.id, new.name, new.id);
+	end if;
+	return null;
+end$$`)
+					tx.Exec("create trigger ActorsSearch after insert or update or delete on Actors " +
+						"for each row execute function ActorsSearch()")
+					tx.Exec("insert into SearchIndex (kind, objectId, name, content) " +
+						"select 'Post', id, coalesce(summary, ''), coalesce(plainText, content) from Posts")
+					tx.Exec("insert into SearchIndex (kind, objectId, name, content) select 'Actor', id, name, id from Actors")
+					return
+				}
+				tx.Exec("create virtual table SearchIndex using fts5(kind unindexed, objectId unindexed, name, content)")
+				tx.Exec(`create trigger PostsSearchInsert after insert on Posts begin
+	delete from SearchIndex where objectId = new.id;
+	insert into SearchIndex (kind, objectId, name, content)
+		values ('Post', new.id, coalesce(new.summary, ''), coalesce(new.plainText, new.content));
+end`)
+				tx.Exec(`create trigger PostsSearchUpdate after update on Posts begin
+	delete from SearchIndex where objectId = old.id;
+	insert into SearchIndex (kind, objectId, name, content)
+		values ('Post', new.id, coalesce(new.summary, ''), coalesce(new.plainText, new.content));
+end`)
+				tx.Exec(`create trigger PostsSearchDelete after delete on Posts begin
+	delete from SearchIndex where objectId = old.id;
+end`)
+				tx.Exec(`create trigger ActorsSearchInsert after insert on Actors begin
+	delete from SearchIndex where objectId = new.id;
+	insert into SearchIndex (kind, objectId, name, content) values ('Actor', new.id, new.name, new.id);
+end`)
+				tx.Exec(`create trigger ActorsSearchUpdate after update on Actors begin
+	delete from SearchIndex where objectId = old.id;
+	insert into SearchIndex (kind, objectId, name, content) values ('Actor', new.id, new.name, new.id);
+end`)
+				tx.Exec(`create trigger ActorsSearchDelete after delete on Actors begin
+	delete from SearchIndex where objectId = old.id;
+end`)
+				tx.Exec("insert into SearchIndex (kind, objectId, name, content) " +
+					"select 'Post', id, coalesce(summary, ''), coalesce(plainText, content) from Posts")
+				tx.Exec("insert into SearchIndex (kind, objectId, name, content) select 'Actor', id, name, id from Actors")
+			},
+			Downward: func(tx db.MigrationTx) {
+				if tx.Dialect() == db.PostgreSQL {
+					tx.Exec("drop trigger ActorsSearch on Actors")
+					tx.Exec("drop function ActorsSearch")
+					tx.Exec("drop trigger PostsSearch on Posts")
+					tx.Exec("drop function PostsSearch")
+					tx.Exec("drop table SearchIndex")
+					return
+				}
+				tx.Exec("drop trigger ActorsSearchDelete")
+				tx.Exec("drop trigger ActorsSearchUpdate")
+				tx.Exec("drop trigger ActorsSearchInsert")
+				tx.Exec("drop trigger PostsSearchDelete")
+				tx.Exec("drop trigger PostsSearchUpdate")
+				tx.Exec("drop trigger PostsSearchInsert")
+				tx.Exec("drop table SearchIndex")
+			},
+		},
+		migrations.FreeForm{
+			// The id is an autoincrementing integer, which the
+			// table helper couldn't create when this was written,
+			// so that the IDs of dismissed notifications aren't
+			// reused.
+			Identifier: "0037-create-notifications-table",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec(`create table Notifications (
+	id ` + tx.Dialect().AutoIncrement() + `,
+	type text not null,
+	recipientId text not null,
+	actorId text not null,
+	objectId text,
+	activityId text,
+	created text not null,
+	read boolean not null default ` + tx.Dialect().Literal(false) + `)`)
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("drop table Notifications")
+			},
+		},
+		migrations.CreateIndex(
+			"0038-index-notifications",
+			migrations.Index{
+				Name:    "NotificationsByRecipient",
+				Table:   "Notifications",
+				Columns: []string{"recipientId", "id"},
+			},
+			migrations.Index{
+				Name:    "NotificationsByActivity",
+				Table:   "Notifications",
+				Columns: []string{"activityId", "recipientId"},
+				Unique:  true,
+			},
+		),
+		migrations.CreateTable(
+			"0039-create-blocks-table",
+			"Blocks",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "actorId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "targetId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "published",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0040-index-blocks",
+			migrations.Index{
+				Name:    "BlocksByActor",
+				Table:   "Blocks",
+				Columns: []string{"actorId", "targetId"},
+				Unique:  true,
+			},
+			migrations.Index{
+				Name:    "BlocksByTarget",
+				Table:   "Blocks",
+				Columns: []string{"targetId"},
+			},
+		),
+		migrations.CreateTable(
+			"0041-create-mutes-table",
+			"Mutes",
+			migrations.Column{
+				Name:    "actorId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "targetId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "notifications",
+				Type:    migrations.Bool,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "created",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0042-index-mutes",
+			migrations.Index{
+				Name:    "MutesByActor",
+				Table:   "Mutes",
+				Columns: []string{"actorId", "targetId"},
+				Unique:  true,
+			},
+		),
+		migrations.CreateTable(
+			"0043-create-domain-blocks-table",
+			"DomainBlocks",
+			migrations.Column{
+				Name:       "domain",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "severity",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "rejectMedia",
+				Type:    migrations.Bool,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "publicComment",
+				Type:    migrations.Text,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "privateComment",
+				Type:    migrations.Text,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "created",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.FreeForm{
+			// Reports are numbered, like notifications, so that
+			// moderators and the API can refer to them whether
+			// they were made on this server or received as Flag
+			// activities from others.
+			Identifier: "0044-create-reports-table",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec(`create table Reports (
+	id ` + tx.Dialect().AutoIncrement() + `,
+	activityId text not null unique,
+	reporterId text not null,
+	targetId text not null,
+	comment text not null,
+	forwarded boolean not null,
+	resolved boolean not null default ` + tx.Dialect().Literal(false) + `,
+	created text not null)`)
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("drop table Reports")
+			},
+		},
+		migrations.CreateTable(
+			"0045-create-report-posts-table",
+			"ReportPosts",
+			migrations.Column{
+				Name:    "reportId",
+				Type:    migrations.Int,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "postId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateIndex(
+			"0046-index-reports",
+			migrations.Index{
+				Name:    "ReportsByResolved",
+				Table:   "Reports",
+				Columns: []string{"resolved", "id"},
+			},
+			migrations.Index{
+				Name:    "ReportPostsByReport",
+				Table:   "ReportPosts",
+				Columns: []string{"reportId", "postId"},
+				Unique:  true,
+			},
+		),
+		migrations.CreateTable(
+			"0047-create-suspensions-table",
+			"Suspensions",
+			migrations.Column{
+				Name:       "actorId",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "created",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.FreeForm{
+			Identifier: "0048-create-moderation-log-table",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec(`create table ModerationLog (
+	id ` + tx.Dialect().AutoIncrement() + `,
+	moderatorId text not null,
+	action text not null,
+	targetId text not null,
+	reportId integer,
+	created text not null)`)
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("drop table ModerationLog")
+			},
+		},
+		migrations.AddColumn(
+			"0049-add-accounts-role",
+			"Accounts",
+			migrations.Column{
+				Name:    "role",
+				Type:    migrations.Text,
+				NotNull: true,
+				Default: &defaultRole,
+			},
+		),
+		migrations.CreateTable(
+			"0050-create-silences-table",
+			"Silences",
+			migrations.Column{
+				Name:       "actorId",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "created",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		migrations.CreateTable(
+			"0051-create-delivery-health-table",
+			"DeliveryHealth",
+			migrations.Column{
+				Name:       "host",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name: "lastSuccess",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name: "lastFailure",
+				Type: migrations.String,
+			},
+			migrations.Column{
+				Name:    "failures",
+				Type:    migrations.Int,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name: "lastError",
+				Type: migrations.Text,
+			},
+		),
+		migrations.FreeForm{
+			Identifier: "0052-create-deliveries-table",
+			Upward: func(tx db.MigrationTx) {
+				tx.Exec(`create table Deliveries (
+	id ` + tx.Dialect().AutoIncrement() + `,
+	activityId text not null,
+	actorId text not null,
+	inbox text not null,
+	body ` + tx.Dialect().TypeName(db.Blob) + ` not null,
+	attempts int not null default 0,
+	lastError text,
+	failed boolean not null default ` + tx.Dialect().Literal(false) + `,
+	created text not null)`)
+			},
+			Downward: func(tx db.MigrationTx) {
+				tx.Exec("drop table Deliveries")
+			},
+		},
+		migrations.CreateTable(
+			"0053-create-seeds-table",
+			"Seeds",
+			migrations.Column{
+				Name:       "name",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "objectId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "loaded",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+		),
+		// Follows of actors on other servers wait in the
+		// FollowRequests table until they are accepted, when
+		// they move to Follows with the ID of the Follow
+		// activity, so that it can be undone.
+		migrations.CreateTable(
+			"0054-create-follow-requests-table",
+			"FollowRequests",
+			migrations.Column{
+				Name:       "id",
+				Type:       migrations.String,
+				PrimaryKey: true,
+				NotNull:    true,
+			},
+			migrations.Column{
+				Name:    "followerId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "followeeId",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Column{
+				Name:    "published",
+				Type:    migrations.String,
+				NotNull: true,
+			},
+			migrations.Index{
+				Name:    "FollowRequestsByFollower",
+				Columns: []string{"followerId", "followeeId"},
+				Unique:  true,
+			},
+		),
+		migrations.AddColumn(
+			"0055-add-follows-activity-id",
+			"Follows",
+			migrations.Column{
+				Name: "activityId",
+				Type: migrations.String,
+			},
+		),
 	}
 }
@@ -0,0 +1,153 @@
+package migrations_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/db/dbtest"
+	"github.com/ekiru/kanna/migrations"
+)
+
+// apply applies migrations to a database in one run.
+func apply(t *testing.T, database *db.Database, ms []db.Migration) {
+	t.Helper()
+	run, err := db.StartMigrations(context.Background(), database, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Close()
+	for _, migration := range ms {
+		if _, err = run.Apply(migration); err != nil {
+			t.Fatalf("applying %s: %v", migration.ID(), err)
+		}
+	}
+}
+
+// undo undoes migrations in one run, in reverse order.
+func undo(t *testing.T, database *db.Database, ms []db.Migration) {
+	t.Helper()
+	run, err := db.StartMigrations(context.Background(), database, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.Close()
+	for i := len(ms) - 1; i >= 0; i-- {
+		if _, err = run.Undo(ms[i]); err != nil {
+			t.Fatalf("undoing %s: %v", ms[i].ID(), err)
+		}
+	}
+}
+
+// index returns the index of the migration with an ID.
+func index(t *testing.T, all []db.Migration, id string) int {
+	t.Helper()
+	for i, migration := range all {
+		if migration.ID() == id {
+			return i
+		}
+	}
+	t.Fatalf("no migration %s", id)
+	return -1
+}
+
+func exec(t *testing.T, database *db.Database, q string, args ...interface{}) {
+	t.Helper()
+	if _, err := database.Exec(q, args...); err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+}
+
+func queryString(t *testing.T, database *db.Database, q string, args ...interface{}) string {
+	t.Helper()
+	var s string
+	if err := database.QueryRow(q, args...).Scan(&s); err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	return s
+}
+
+// TestMigrations applies all of the migrations, undoes them and applies
+// them again, checking that the migrations that move data, which are
+// written separately for each dialect, keep it.
+func TestMigrations(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, database *db.Database) {
+		all := migrations.All()
+		// The data is stored just before the first of the
+		// migrations that move it.
+		first := index(t, all, "0021-move-posts-audience-to-addressing")
+		last := index(t, all, "0028-move-favourites-to-reactions")
+		const (
+			actor     = "https://example.com/actor/ann"
+			followers = actor + "/followers"
+			post      = "https://example.com/post/1"
+			audience  = "https://www.w3.org/ns/activitystreams#Public"
+			content   = "a <b> & c\nd\n\ne"
+			html      = "<p>a &lt;b&gt; &amp; c<br />d</p><p>e</p>"
+			// 2020-01-02T03:04:05Z
+			favourited = 1577934245
+		)
+		apply(t, database, all[:first])
+		exec(t, database, "insert into Actors (id, name, type, inbox, outbox, followers) values (?, ?, ?, ?, ?, ?)",
+			actor, "ann", "Person", actor+"/inbox", actor+"/outbox", followers)
+		exec(t, database, "insert into Posts (id, type, audience, authorId, content, published) values (?, ?, ?, ?, ?, ?)",
+			post, "Note", audience, actor, content, "2020-01-01T00:00:00Z")
+		exec(t, database, "insert into Favourites (actorId, postId, createdAt) values (?, ?, ?)",
+			actor, post, favourited)
+
+		apply(t, database, all[first:last+1])
+		if got := queryString(t, database,
+			"select targetId from Addressing where objectId = ? and field = 'to'", post); got != audience {
+			t.Errorf("to = %q, want %q", got, audience)
+		}
+		if got := queryString(t, database,
+			"select targetId from Addressing where objectId = ? and field = 'cc'", post); got != followers {
+			t.Errorf("cc = %q, want %q", got, followers)
+		}
+		if got := queryString(t, database, "select content from Posts where id = ?", post); got != html {
+			t.Errorf("content = %q, want %q", got, html)
+		}
+		var source struct {
+			Content, MediaType string
+		}
+		if err := json.Unmarshal([]byte(queryString(t, database, "select source from Posts where id = ?", post)), &source); err != nil {
+			t.Fatal(err)
+		}
+		if source.Content != content || source.MediaType != "text/plain" {
+			t.Errorf("source = %+v, want the content as text/plain", source)
+		}
+		if got, want := queryString(t, database,
+			"select published from Reactions where type = 'Like' and actorId = ? and objectId = ?", actor, post),
+			"2020-01-02T03:04:05.000Z"; got != want {
+			t.Errorf("published = %q, want %q", got, want)
+		}
+
+		apply(t, database, all[last+1:])
+		undo(t, database, all[first:])
+		var createdAt int64
+		if err := database.QueryRow("select createdAt from Favourites where postId = ?", post).Scan(&createdAt); err != nil {
+			t.Fatal(err)
+		} else if createdAt != favourited {
+			t.Errorf("createdAt = %d, want %d", createdAt, favourited)
+		}
+		if got := queryString(t, database, "select content from Posts where id = ?", post); got != content {
+			t.Errorf("content = %q, want %q", got, content)
+		}
+		if got := queryString(t, database, "select audience from Posts where id = ?", post); got != audience {
+			t.Errorf("audience = %q, want %q", got, audience)
+		}
+
+		undo(t, database, all[:first])
+		apply(t, database, all)
+		applied, err := db.AppliedMigrations(database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, migration := range all {
+			if applied[migration.ID()] == nil {
+				t.Errorf("%s wasn't applied", migration.ID())
+			}
+		}
+	})
+}
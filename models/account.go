@@ -5,9 +5,13 @@ import (
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
 
 	"golang.org/x/crypto/scrypt"
 
+	"github.com/ekiru/kanna/config"
 	"github.com/ekiru/kanna/db"
 )
 
@@ -26,46 +30,199 @@ type Account struct {
 	// other Actors or to author Activities as other Actors, but
 	// this Actor represents this account specifically.
 	Actor *Actor
+	// Role determines what the owner of the account may do on this
+	// server, such as moderating it.
+	Role string
 }
 
-// FromRow fills a Account with the data from a row returned by a
-// database query from the Accounts table joined with the Actors table.
-func (a *Account) FromRow(rows *sql.Rows) error {
-	a.Actor = &Actor{}
-	actor := a.Actor.Scanners()
-	return rows.Scan(
-		&a.Username,
-		&a.PasswordHash,
-		&a.PasswordHashVersion,
-		actor["id"],
-		actor["type"],
-		actor["name"],
-		actor["inbox"],
-		actor["outbox"],
-	)
+// The roles of accounts, from the least to the most privileged. Each
+// role may do everything that the roles before it may.
+const (
+	// UserRole may only use the server.
+	UserRole = "user"
+	// ModeratorRole may also handle reports and suspend or silence
+	// accounts.
+	ModeratorRole = "moderator"
+	// AdminRole may also block domains and manage accounts and the
+	// server.
+	AdminRole = "admin"
+)
+
+// Roles lists the roles of accounts, from the least to the most
+// privileged.
+var Roles = []string{UserRole, ModeratorRole, AdminRole}
+
+// roleRank returns the position of a role in Roles, or -1 if it isn't
+// a role.
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasRole reports whether an account has a role or a more privileged
+// one.
+func (a *Account) HasRole(role string) bool {
+	return roleRank(role) >= 0 && roleRank(a.Role) >= roleRank(role)
+}
+
+// accountMapping maps the columns of the Accounts table, and those of
+// the account's actor prefixed with actor, to the fields of an
+// Account.
+var accountMapping = db.Nest(db.NewMapping(map[string]func(a *Account) interface{}{
+	"username":            func(a *Account) interface{} { return &a.Username },
+	"passwordHash":        func(a *Account) interface{} { return &a.PasswordHash },
+	"passwordHashVersion": func(a *Account) interface{} { return &a.PasswordHashVersion },
+	"role":                func(a *Account) interface{} { return &a.Role },
+}), "actor", func(a *Account) *Actor {
+	if a.Actor == nil {
+		a.Actor = new(Actor)
+	}
+	return a.Actor
+}, actorMapping)
+
+// accountColumns selects the columns mapped by accountMapping from the
+// Accounts table, aliased acct, joined with the Actors table, aliased
+// act.
+var accountColumns = accountMapping.Columns("acct", "") + ", " + actorMapping.Columns("act", "actor") +
+	" from Accounts acct join Actors act on acct.actorId = act.id"
+
+// accountsWhere retrieves the accounts matching a condition on the
+// Accounts table, aliased acct, and the Actors table, aliased act.
+func accountsWhere(ctx context.Context, where string, args ...interface{}) ([]*Account, error) {
+	return db.All(ctx, accountMapping, "select "+accountColumns+" where "+where+" order by acct.username", args...)
 }
 
 // AccountByUsername retrieves a accounts.Account for the account with
-// the supplied username, as well as the account's actor.
+// the supplied username, as well as the account's actor. Accounts whose
+// actors are suspended aren't found, so that they can't be used.
 func AccountByUsername(ctx context.Context, username string) (*Account, error) {
-	var account Account
-	rows, err := db.DB(ctx).QueryContext(ctx,
-		"select acct.username, acct.passwordHash, acct.passwordHashVersion, "+
-			"acct.actorId, act.type, act.name, act.inbox, act.outbox "+
-			"from Accounts acct join Actors act on acct.actorId = act.id "+
-			"where username = ?",
-		username)
+	return accountWhere(ctx, "acct.username = ? and "+notSuspended("acct.actorId"), username)
+}
+
+// ManagedAccount retrieves an account by its username for the
+// moderators of this server, including it even if it is suspended.
+func ManagedAccount(ctx context.Context, username string) (*Account, error) {
+	return accountWhere(ctx, "acct.username = ?", username)
+}
+
+func accountWhere(ctx context.Context, where string, args ...interface{}) (*Account, error) {
+	accounts, err := accountsWhere(ctx, where, args...)
 	if err != nil {
 		return nil, err
-	}
-	defer rows.Close()
-	if !rows.Next() {
+	} else if len(accounts) == 0 {
 		return nil, sql.ErrNoRows
 	}
-	if err = account.FromRow(rows); err != nil {
+	return accounts[0], nil
+}
+
+// Accounts retrieves all of the accounts on this server, including
+// those that are suspended, in order of their usernames.
+func Accounts(ctx context.Context) ([]*Account, error) {
+	return accountsWhere(ctx, "true")
+}
+
+// ErrInvalidUsername is returned when creating an account with a
+// username that can't be used.
+var ErrInvalidUsername = errors.New("usernames may only contain letters, digits and underscores")
+
+// ErrUsernameTaken is returned when creating an account with the
+// username of an account that exists or existed.
+var ErrUsernameTaken = errors.New("the username is taken")
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// CreateAccount creates an account with a role, along with its actor,
+// whose ID is built from the username. The username of an account that
+// was deleted can't be used again, since its actor still exists. The
+// account and its actor are created together, or not at all.
+func CreateAccount(ctx context.Context, username, password, role string) (*Account, error) {
+	if !validUsername.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if roleRank(role) < 0 {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+	cfg := config.Get(ctx)
+	actor := NewActor(cfg.URL("actor", username), "Person")
+	if _, err := ActorById(ctx, actor.ID().String()); err == nil {
+		return nil, ErrUsernameTaken
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	actor.Name = username
+	actor.Inbox = cfg.URL("actor", username, "inbox")
+	actor.Outbox = cfg.URL("actor", username, "outbox")
+	actor.Followers = cfg.URL("actor", username, "followers")
+	account := &Account{
+		Username:            username,
+		PasswordHash:        HashScrypt.Hash(password, nil),
+		PasswordHashVersion: HashScrypt,
+		Actor:               actor,
+		Role:                role,
+	}
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.Exec(ctx,
+			"insert into Actors (id, type, name, inbox, outbox, followers) values (?, ?, ?, ?, ?, ?)",
+			actor.ID().String(), actor.typ, actor.Name, actor.Inbox.String(), actor.Outbox.String(), actor.Followers.String(),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(ctx,
+			"insert into Accounts (username, passwordHash, passwordHashVersion, actorId, role) values (?, ?, ?, ?, ?)",
+			username, account.PasswordHash, account.PasswordHashVersion, actor.ID().String(), role,
+		)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
-	return &account, nil
+	return account, nil
+}
+
+// DeleteAccount deletes an account and revokes its access tokens. Its
+// actor is kept, so that its posts can still be referred to, but is
+// suspended, which hides the posts and removes its follows.
+func DeleteAccount(ctx context.Context, account *Account) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		if err := SuspendActor(ctx, account.Actor); err != nil {
+			return err
+		}
+		if err := RevokeTokens(ctx, account); err != nil {
+			return err
+		}
+		_, err := db.Exec(ctx, "delete from Accounts where username = ?", account.Username)
+		return err
+	})
+}
+
+// SetRole changes the role of an account.
+func SetRole(ctx context.Context, account *Account, role string) error {
+	if roleRank(role) < 0 {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	_, err := db.Exec(ctx, "update Accounts set role = ? where username = ?", role, account.Username)
+	if err == nil {
+		account.Role = role
+	}
+	return err
+}
+
+// SetPassword changes the password of an account.
+func SetPassword(ctx context.Context, account *Account, password string) error {
+	hash := HashScrypt.Hash(password, nil)
+	_, err := db.Exec(ctx,
+		"update Accounts set passwordHash = ?, passwordHashVersion = ? where username = ?",
+		hash, HashScrypt, account.Username,
+	)
+	if err == nil {
+		account.PasswordHash, account.PasswordHashVersion = hash, HashScrypt
+	}
+	return err
 }
 
 // Authenticate attempts to authenticate as an account.
@@ -124,3 +281,10 @@ func (alg PasswordHashAlgorithm) Matches(password string, target []byte) bool {
 	// we could do a constant time compare but it doesn't matter here since we're comparing password hashes.
 	return bytes.Equal(hash, target)
 }
+
+// CountAccounts counts the accounts on this server.
+func CountAccounts(ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRow(ctx, "select count(*) from Accounts").Scan(&count)
+	return count, err
+}
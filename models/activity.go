@@ -0,0 +1,272 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/db"
+)
+
+// An Activity records an action taken by an actor, such as creating
+// or deleting a post, as it appears in the actor's outbox.
+type Activity struct {
+	id  *url.URL
+	typ string
+	// Actor is the actor that performed the activity.
+	Actor *Actor
+	// ObjectID is the ID of the object that the activity acted on.
+	ObjectID *url.URL
+	// Object is the current state of the object that the activity
+	// acted on, or nil if the object isn't known to this server.
+	Object activitystreams.Object
+	// Published is when the activity was performed.
+	Published string
+	// Recipient is the actor that an activity which isn't about a
+	// post, such as the Accept of a Follow, is addressed to.
+	Recipient *url.URL
+	// Flagged are the IDs of the posts that a Flag reports, besides
+	// their author, who is the Flag's object.
+	Flagged []*url.URL
+	// Content is the comment of a Flag.
+	Content string
+}
+
+func (a *Activity) ID() *url.URL {
+	return a.id
+}
+
+func (a *Activity) Types() []string {
+	return []string{a.typ}
+}
+
+func (a *Activity) HasType(t string) bool {
+	return t == a.typ
+}
+
+func (a *Activity) Props() []string {
+	return []string{"actor", "object", "content", "published", "to", "cc"}
+}
+
+func (a *Activity) GetProp(prop string) (interface{}, bool) {
+	switch prop {
+	case "actor":
+		return a.Actor.ID(), true
+	case "object":
+		// Likes and boosts only refer to the post, which
+		// belongs to another actor.
+		if a.Object != nil && a.typ != LikeType && a.typ != AnnounceType {
+			return a.Object, true
+		}
+		if a.typ == FlagType {
+			return append([]*url.URL{a.ObjectID}, a.Flagged...), true
+		}
+		return a.ObjectID, true
+	case "content":
+		if a.Content == "" {
+			return nil, true
+		}
+		return a.Content, true
+	case "published":
+		return a.Published, true
+	case "to", "cc":
+		return a.addressing(prop), true
+	default:
+		return nil, false
+	}
+}
+
+// addressing returns the to or cc field of an activity. Activities on
+// posts are addressed to the same audience as the post, except that
+// likes are only addressed to the post's author and boosts are public.
+// An Undo is addressed to the same audience as the activity it undoes,
+// and a Delete to the audience of the post it deleted.
+func (a *Activity) addressing(field string) []*url.URL {
+	switch object := a.Object.(type) {
+	case *Tombstone:
+		if object.post != nil {
+			return *object.post.addressingField(field)
+		}
+	case *Post:
+		switch {
+		case a.typ == LikeType && field == "to":
+			return []*url.URL{object.Author.ID()}
+		case a.typ == LikeType:
+			return nil
+		case a.typ == AnnounceType && field == "to":
+			return []*url.URL{publicCollection}
+		case a.typ == AnnounceType:
+			var cc []*url.URL
+			if a.Actor.Followers != nil {
+				cc = append(cc, a.Actor.Followers)
+			}
+			return append(cc, object.Author.ID())
+		}
+		return *object.addressingField(field)
+	case *Activity:
+		return object.addressing(field)
+	}
+	if a.Recipient != nil && field == "to" {
+		return []*url.URL{a.Recipient}
+	}
+	return nil
+}
+
+// recordActivity adds an activity performed by an actor to the actor's
+// outbox.
+func recordActivity(ctx context.Context, typ string, actor *Actor, object activitystreams.Object) (*Activity, error) {
+	activity := newActivity(ctx, typ, actor, object)
+	if err := saveActivity(ctx, activity); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// newActivity creates an activity performed by an actor at the current
+// time, giving it a new ID on this server.
+func newActivity(ctx context.Context, typ string, actor *Actor, object activitystreams.Object) *Activity {
+	return &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       typ,
+		Actor:     actor,
+		ObjectID:  object.ID(),
+		Object:    object,
+		Published: now(),
+	}
+}
+
+// saveActivity adds an activity to its actor's outbox.
+func saveActivity(ctx context.Context, activity *Activity) error {
+	_, err := db.Exec(ctx,
+		"insert into Activities (id, type, actorId, objectId, published) values (?, ?, ?, ?, ?)",
+		activity.id.String(), activity.typ, activity.Actor.ID().String(), activity.ObjectID.String(), activity.Published,
+	)
+	return err
+}
+
+// activityMapping maps the columns of the Activities table, and those
+// of the activity's actor prefixed with actor, to the fields of an
+// Activity.
+var activityMapping = db.Nest(db.NewMapping(map[string]func(a *Activity) interface{}{
+	"id":        func(a *Activity) interface{} { return db.URLScanner{&a.id} },
+	"type":      func(a *Activity) interface{} { return &a.typ },
+	"objectId":  func(a *Activity) interface{} { return db.URLScanner{&a.ObjectID} },
+	"published": func(a *Activity) interface{} { return &a.Published },
+}), "actor", func(a *Activity) *Actor {
+	if a.Actor == nil {
+		a.Actor = new(Actor)
+	}
+	return a.Actor
+}, actorMapping)
+
+// activityColumns selects the columns mapped by activityMapping from
+// the Activities table, aliased activity, joined with the Actors
+// table, aliased act.
+var activityColumns = activityMapping.Columns("activity", "") + ", " + actorMapping.Columns("act", "actor") +
+	" from Activities activity join Actors act on activity.actorId = act.id"
+
+// loadObject fills in the Object of an activity from the posts,
+// tombstones or activities stored on this server.
+func (a *Activity) loadObject(ctx context.Context) error {
+	id := a.ObjectID.String()
+	if a.typ == "Undo" {
+		if activity, err := ActivityById(ctx, id); err == nil {
+			a.Object = activity
+			return nil
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if post, err := PostById(ctx, id); err == nil {
+		a.Object = post
+		return nil
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	if tombstone, err := TombstoneById(ctx, id); err == nil {
+		a.Object = tombstone
+		return nil
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// ActivityById retrieves an activity along with its object.
+func ActivityById(ctx context.Context, id string) (*Activity, error) {
+	activity, err := db.One(ctx, activityMapping, "select "+activityColumns+" where activity.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if err = activity.loadObject(ctx); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// CanViewActivity reports whether an actor may see an activity. Only
+// those who may see a post may see the activities on it. The viewer is
+// nil for clients that aren't logged-in.
+func CanViewActivity(ctx context.Context, viewer *Actor, activity *Activity) (bool, error) {
+	switch object := activity.Object.(type) {
+	case *Post:
+		return CanView(ctx, viewer, object)
+	case *Activity:
+		return CanViewActivity(ctx, viewer, object)
+	}
+	return true, nil
+}
+
+// activityVisibleTo returns a condition restricting a query using the
+// alias activity for the Activities table to the activities that an
+// actor may see.
+func activityVisibleTo(viewer *Actor) (string, []interface{}) {
+	visible, args := visibleTo(viewer)
+	return "(not exists (select 1 from Posts post where post.id = activity.objectId) or " +
+		"exists (select 1 from Posts post join Actors act on post.authorId = act.id " +
+		"where post.id = activity.objectId and " + visible + "))", args
+}
+
+// OutboxActivities retrieves a page of the activities in an actor's
+// outbox that the viewer may see, along with their objects. The
+// cursors of the Page are activity IDs. The viewer is nil for clients
+// that aren't logged-in.
+func OutboxActivities(ctx context.Context, actor *Actor, viewer *Actor, page Page) ([]*Activity, error) {
+	visible, visibleArgs := activityVisibleTo(viewer)
+	conds, order, pageArgs := page.clauses("Activities", "activity")
+	conds = append([]string{"activity.actorId = ?", visible}, conds...)
+	q := fmt.Sprintf("select %s where %s order by activity.published %s, activity.id %s limit ?",
+		activityColumns, strings.Join(conds, " and "), order, order)
+	args := append([]interface{}{actor.ID().String()}, visibleArgs...)
+	args = append(append(args, pageArgs...), page.Limit)
+	activities, err := db.All(ctx, activityMapping, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if order == "asc" {
+		for i, j := 0, len(activities)-1; i < j; i, j = i+1, j-1 {
+			activities[i], activities[j] = activities[j], activities[i]
+		}
+	}
+	for _, activity := range activities {
+		if err = activity.loadObject(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return activities, nil
+}
+
+// CountOutboxActivities counts the activities in an actor's outbox
+// that the viewer may see.
+func CountOutboxActivities(ctx context.Context, actor *Actor, viewer *Actor) (int, error) {
+	var count int
+	visible, args := activityVisibleTo(viewer)
+	err := db.QueryRow(ctx,
+		"select count(*) from Activities activity where activity.actorId = ? and "+visible,
+		append([]interface{}{actor.ID().String()}, args...)...,
+	).Scan(&count)
+	return count, err
+}
@@ -1,17 +1,94 @@
 package models
 
 import (
+	"context"
+	"net/url"
+
 	"github.com/ekiru/kanna/db"
 )
 
-// Scanners returns a map of scanners that will scan database columns
-// into the fields of the Actor.
-func (a *Actor) Scanners() map[string]interface{} {
-	return map[string]interface{}{
-		"inbox":  db.URLScanner{&a.Inbox},
-		"outbox": db.URLScanner{&a.Outbox},
-		"name":   &a.Name,
-		"type":   &a.typ,
-		"id":     db.URLScanner{&a.id},
+// NewActor creates an Actor with an ID and type, such as one received
+// from another server. The actor isn't stored until SaveActor is
+// called.
+func NewActor(id *url.URL, typ string) *Actor {
+	return &Actor{id: id, typ: typ}
+}
+
+// SaveActor stores an actor received from another server, replacing
+// any copy of it that was stored before.
+func SaveActor(ctx context.Context, actor *Actor) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Actors (id, type, name, inbox, outbox, followers) values (?, ?, ?, ?, ?, ?)"+
+			conn.Dialect.Upsert([]string{"id"}, "type", "name", "inbox", "outbox", "followers"),
+		actor.ID().String(), actor.typ, actor.Name, urlString(actor.Inbox), urlString(actor.Outbox), urlString(actor.Followers),
+	)
+	return err
+}
+
+// urlString returns the string form of a URL that may be nil, for
+// storing in a nullable column.
+func urlString(u *url.URL) interface{} {
+	if u == nil {
+		return nil
+	}
+	return u.String()
+}
+
+// Handle returns the handle of an actor, in the form user@host.
+func (a *Actor) Handle() string {
+	return a.Name + "@" + a.ID().Host
+}
+
+// ActorByHandle retrieves a stored actor by their username and the
+// host of their ID.
+func ActorByHandle(ctx context.Context, name, host string) (*Actor, error) {
+	return db.One(ctx, actorMapping,
+		"select "+actorMapping.Columns("Actors", "")+" from Actors where name = ? and (id like ? or id like ?)",
+		name, "https://"+host+"/%", "http://"+host+"/%",
+	)
+}
+
+// ActorHosts returns the distinct hosts of all actors known to this
+// server.
+func ActorHosts(ctx context.Context) ([]string, error) {
+	rows, err := db.Query(ctx, "select id from Actors")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool)
+	var hosts []string
+	for rows.Next() {
+		var id *url.URL
+		if err := rows.Scan(db.URLScanner{&id}); err != nil {
+			return nil, err
+		}
+		if !seen[id.Host] {
+			seen[id.Host] = true
+			hosts = append(hosts, id.Host)
+		}
+	}
+	return hosts, rows.Err()
+}
+
+// ActorIds returns the IDs of all actors known to this server.
+func ActorIds(ctx context.Context) ([]*url.URL, error) {
+	rows, err := db.Query(ctx, "select id from Actors order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []*url.URL
+	for rows.Next() {
+		var id *url.URL
+		if err := rows.Scan(db.URLScanner{&id}); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
 }
@@ -3,7 +3,6 @@ package models
 import (
 	
 	"context"
-	"database/sql"
 	
 	"net/url"
 	
@@ -14,9 +13,11 @@ import (
 type Actor struct {
 	id *url.URL
 	typ string
+	Followers *url.URL
 	Inbox *url.URL
-	Name string
 	Outbox *url.URL
+	Name string
+	PublicKey *PublicKey
 }
 
 func (model *Actor) ID() *url.URL {
@@ -32,7 +33,7 @@ func (model *Actor) HasType(t string) bool {
 }
 
 func (model *Actor) Props() []string {
-	return []string{ "id", "type", "inbox","name","outbox", }
+	return []string{ "id", "type", "followers","inbox","outbox","preferredUsername","publicKey", }
 }
 
 func (model *Actor) GetProp(prop string) (interface{}, bool) {
@@ -41,38 +42,39 @@ func (model *Actor) GetProp(prop string) (interface{}, bool) {
 		return model.id, true
 	case "type":
 		return model.typ, true
+	case "followers":
+		return model.Followers, true
 	case "inbox":
 		return model.Inbox, true
-	case "name":
-		return model.Name, true
 	case "outbox":
 		return model.Outbox, true
+	case "preferredUsername":
+		return model.Name, true
+	case "publicKey":
+		return model.PublicKey, true
 	default:
 		return nil, false
 	}
 }
 
+var actorMapping = db.NewMapping(map[string]func(model *Actor) interface{}{
+	"id": func(model *Actor) interface{} { return db.URLScanner{ &model.id } },
+	"type": func(model *Actor) interface{} { return &model.typ },
+	"followers": func(model *Actor) interface{} { return db.URLScanner{ &model.Followers } },
+	"inbox": func(model *Actor) interface{} { return db.URLScanner{ &model.Inbox } },
+	"outbox": func(model *Actor) interface{} { return db.URLScanner{ &model.Outbox } },
+	"name": func(model *Actor) interface{} { return &model.Name },
+})
+
 func ActorById(ctx context.Context, id string) (*Actor, error) {
-	var model Actor
-	rows, err := db.DB(ctx).QueryContext(ctx, "select Actors.id, Actors.type, Actors.inbox, Actors.name, Actors.outbox from Actors where Actors.id = ?", id)
+	model, err := db.One(ctx, actorMapping, "select " + actorMapping.Columns("Actors", "") + " from Actors where Actors.id = ?", id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, sql.ErrNoRows
-	}
 
-	err = rows.Scan(
-		db.URLScanner{ &model.id },
-		&model.typ,
-		db.URLScanner{ &model.Inbox },
-		&model.Name,
-		db.URLScanner{ &model.Outbox },
-	)
-	if err != nil {
+	if err = model.loadExternal(ctx); err != nil {
 		return nil, err
 	}
 
-	return &model, nil
+	return model, nil
 }
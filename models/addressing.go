@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// PublicCollection is the special collection that addresses an object
+// to everyone.
+const PublicCollection = "https://www.w3.org/ns/activitystreams#Public"
+
+// A Visibility is one of the standard levels of visibility for posts,
+// each of which corresponds to a way of addressing the post. The
+// values are the names used by the Mastodon API.
+type Visibility string
+
+const (
+	// VisibilityPublic posts are addressed to the public and the
+	// author's followers and appear in public timelines.
+	VisibilityPublic Visibility = "public"
+	// VisibilityUnlisted posts are addressed to the author's
+	// followers with the public in cc, so anyone may see them but
+	// they don't appear in public timelines.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityFollowers posts are only addressed to the author's
+	// followers and any actors mentioned in the post.
+	VisibilityFollowers Visibility = "private"
+	// VisibilityDirect posts are only addressed to the actors
+	// mentioned in the post.
+	VisibilityDirect Visibility = "direct"
+)
+
+// Visibilities lists the visibility levels from most to least visible.
+var Visibilities = []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityFollowers, VisibilityDirect}
+
+// ParseVisibility converts the name of a visibility level to a
+// Visibility, reporting whether the name is valid.
+func ParseVisibility(name string) (Visibility, bool) {
+	for _, v := range Visibilities {
+		if string(v) == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+var publicCollection = mustParseURL(PublicCollection)
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// addressing returns the to and cc addressing for a post by the author
+// with this visibility that mentions the supplied actors.
+func (v Visibility) addressing(author *Actor, mentioned []*url.URL) (to, cc []*url.URL) {
+	var followers []*url.URL
+	if author.Followers != nil {
+		followers = []*url.URL{author.Followers}
+	}
+	switch v {
+	case VisibilityPublic:
+		return []*url.URL{publicCollection}, append(followers, mentioned...)
+	case VisibilityUnlisted:
+		return followers, append([]*url.URL{publicCollection}, mentioned...)
+	case VisibilityFollowers:
+		return followers, mentioned
+	default:
+		return mentioned, nil
+	}
+}
+
+func containsURL(urls []*url.URL, target *url.URL) bool {
+	if target == nil {
+		return false
+	}
+	for _, u := range urls {
+		if u.String() == target.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Visibility determines the visibility level of a post from its
+// addressing.
+func (post *Post) Visibility() Visibility {
+	switch {
+	case containsURL(post.To, publicCollection):
+		return VisibilityPublic
+	case containsURL(post.Cc, publicCollection):
+		return VisibilityUnlisted
+	case containsURL(post.To, post.Author.Followers) || containsURL(post.Cc, post.Author.Followers):
+		return VisibilityFollowers
+	default:
+		return VisibilityDirect
+	}
+}
+
+// Recipients returns the IDs of all of the actors and collections the
+// post is addressed to, including through bto and bcc.
+func (post *Post) Recipients() []*url.URL {
+	var recipients []*url.URL
+	for _, field := range [][]*url.URL{post.To, post.Cc, post.Bto, post.Bcc} {
+		recipients = append(recipients, field...)
+	}
+	return recipients
+}
+
+// CanView reports whether an actor may see a post. The viewer is nil
+// for clients that aren't logged-in.
+func CanView(ctx context.Context, viewer *Actor, post *Post) (bool, error) {
+	recipients := post.Recipients()
+	if containsURL(recipients, publicCollection) {
+		return true, nil
+	}
+	if viewer == nil {
+		return false, nil
+	}
+	if viewer.ID().String() == post.Author.ID().String() || containsURL(recipients, viewer.ID()) {
+		return true, nil
+	}
+	if containsURL(recipients, post.Author.Followers) {
+		return IsFollowing(ctx, viewer, post.Author)
+	}
+	return false, nil
+}
+
+// visibleTo returns a condition restricting a query to posts that an
+// actor may see. The query must use the aliases post and act for the
+// Posts table and the Actors table joined on the post's author. The
+// viewer is nil for clients that aren't logged-in.
+func visibleTo(viewer *Actor) (string, []interface{}) {
+	if viewer == nil {
+		return "exists (select 1 from Addressing a where a.objectId = post.id and a.targetId = ?)",
+			[]interface{}{PublicCollection}
+	}
+	id := viewer.ID().String()
+	return "(post.authorId = ? or exists (select 1 from Addressing a where a.objectId = post.id and " +
+			"(a.targetId in (?, ?) or (a.targetId = act.followers and exists " +
+			"(select 1 from Follows f where f.followeeId = act.id and f.followerId = ?)))))",
+		[]interface{}{id, PublicCollection, id, id}
+}
+
+var addressingFields = []string{"to", "cc", "bto", "bcc"}
+
+func (post *Post) addressingField(field string) *[]*url.URL {
+	switch field {
+	case "to":
+		return &post.To
+	case "cc":
+		return &post.Cc
+	case "bto":
+		return &post.Bto
+	case "bcc":
+		return &post.Bcc
+	default:
+		return nil
+	}
+}
+
+// loadAddressing loads the addressing of several posts at once.
+func loadAddressing(ctx context.Context, posts []*Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Post, len(posts))
+	args := make([]interface{}, 0, len(posts))
+	for _, post := range posts {
+		id := post.ID().String()
+		byID[id] = post
+		args = append(args, id)
+	}
+	rows, err := db.Query(ctx,
+		"select objectId, field, targetId from Addressing where objectId in (?"+
+			strings.Repeat(", ?", len(args)-1)+") order by rowid",
+		args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var objectId, field string
+		var target *url.URL
+		if err = rows.Scan(&objectId, &field, db.URLScanner{&target}); err != nil {
+			return err
+		}
+		if dst := byID[objectId].addressingField(field); dst != nil {
+			*dst = append(*dst, target)
+		}
+	}
+	return rows.Err()
+}
+
+// saveAddressing stores the addressing of a post.
+func (post *Post) saveAddressing(ctx context.Context) error {
+	for _, field := range addressingFields {
+		for _, target := range *post.addressingField(field) {
+			_, err := db.Exec(ctx,
+				"insert into Addressing (objectId, field, targetId) values (?, ?, ?)",
+				post.ID().String(), field, target.String(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deleteAddressing(ctx context.Context, objectId string) error {
+	_, err := db.Exec(ctx, "delete from Addressing where objectId = ?", objectId)
+	return err
+}
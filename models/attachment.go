@@ -0,0 +1,322 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// The types of Attachments that Kanna understands. Uploaded images are
+// Images, but other servers also send images as Documents.
+const (
+	ImageType    = "Image"
+	DocumentType = "Document"
+)
+
+// MaxAttachments is the largest number of attachments a post can have.
+const MaxAttachments = 4
+
+// ImageMediaTypes are the media types of the images that Kanna can
+// process, and so accepts as uploads and caches from other servers.
+var ImageMediaTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// ErrAttachmentUnavailable is returned when creating a post with an
+// attachment that its author didn't upload or that is already attached
+// to another post.
+var ErrAttachmentUnavailable = errors.New("attachment is not available")
+
+// An Attachment is an entry in the attachment property of a post: an
+// image or another file that is shown along with the post.
+type Attachment struct {
+	// ID is the URL at which the file is served by this server.
+	// The files of attachments of posts from other servers are
+	// cached the first time they are requested.
+	ID *url.URL
+	// Type is ImageType or DocumentType.
+	Type string
+	// MediaType is the MIME type of the file, if it is known.
+	MediaType string
+	// Name is the description of the attachment for those who
+	// can't see it.
+	Name string
+	// Width and Height are the dimensions of images in pixels,
+	// or zero if they aren't known.
+	Width, Height int
+	// RemoteURL is the URL of the file of an attachment of a post
+	// from another server, or nil for uploaded files.
+	RemoteURL *url.URL
+	// FileKey and PreviewKey identify the file and its thumbnail
+	// in the media storage. They are empty until the file of an
+	// attachment from another server is cached, and PreviewKey is
+	// empty for files that aren't images.
+	FileKey, PreviewKey string
+	// Owner is the ID of the actor that uploaded the file or wrote
+	// the post it is attached to.
+	Owner *url.URL
+	// PostID is the ID of the post the attachment belongs to, or
+	// nil if an uploaded file hasn't been attached to a post yet.
+	PostID *url.URL
+}
+
+// URL returns the canonical URL of the attachment's file, which is on
+// the server of the post it belongs to.
+func (a *Attachment) URL() *url.URL {
+	if a.RemoteURL != nil {
+		return a.RemoteURL
+	}
+	return a.ID
+}
+
+// PreviewURL returns the URL at which this server serves a thumbnail
+// of an image.
+func (a *Attachment) PreviewURL() *url.URL {
+	u := *a.ID
+	u.Path += "/preview"
+	return &u
+}
+
+// IsImage reports whether the attachment is an image that Kanna can
+// process. Images from other servers whose media type isn't known are
+// assumed to be processable until they are fetched.
+func (a *Attachment) IsImage() bool {
+	return ImageMediaTypes[a.MediaType] || a.MediaType == "" && a.Type == ImageType
+}
+
+// IsCached reports whether the attachment's file is in the media
+// storage.
+func (a *Attachment) IsCached() bool {
+	return a.FileKey != ""
+}
+
+// MarshalJSON serializes an Attachment as an Activity Streams object.
+func (a *Attachment) MarshalJSON() ([]byte, error) {
+	obj := map[string]interface{}{
+		"type": a.Type,
+		"url":  a.URL().String(),
+	}
+	if a.MediaType != "" {
+		obj["mediaType"] = a.MediaType
+	}
+	if a.Name != "" {
+		obj["name"] = a.Name
+	}
+	if a.Width > 0 && a.Height > 0 {
+		obj["width"] = a.Width
+		obj["height"] = a.Height
+	}
+	return json.Marshal(obj)
+}
+
+// NewAttachmentID generates the ID of a new attachment.
+func NewAttachmentID(ctx context.Context) *url.URL {
+	return newLocalID(ctx, "media")
+}
+
+// attachmentMapping maps the columns of the Attachments table to the
+// fields of an Attachment.
+var attachmentMapping = db.NewMapping(map[string]func(a *Attachment) interface{}{
+	"id":         func(a *Attachment) interface{} { return db.URLScanner{&a.ID} },
+	"type":       func(a *Attachment) interface{} { return &a.Type },
+	"mediaType":  func(a *Attachment) interface{} { return &a.MediaType },
+	"name":       func(a *Attachment) interface{} { return &a.Name },
+	"width":      func(a *Attachment) interface{} { return &a.Width },
+	"height":     func(a *Attachment) interface{} { return &a.Height },
+	"remoteUrl":  func(a *Attachment) interface{} { return db.URLScanner{&a.RemoteURL} },
+	"fileKey":    func(a *Attachment) interface{} { return (*nullString)(&a.FileKey) },
+	"previewKey": func(a *Attachment) interface{} { return (*nullString)(&a.PreviewKey) },
+	"ownerId":    func(a *Attachment) interface{} { return db.URLScanner{&a.Owner} },
+	"postId":     func(a *Attachment) interface{} { return db.URLScanner{&a.PostID} },
+})
+
+var attachmentColumns = attachmentMapping.Columns("Attachments", "")
+
+// nullString scans a nullable column into a string, treating null as
+// the empty string.
+type nullString string
+
+func (s *nullString) Scan(src interface{}) error {
+	var ns sql.NullString
+	if err := ns.Scan(src); err != nil {
+		return err
+	}
+	*s = nullString(ns.String)
+	return nil
+}
+
+// AttachmentById retrieves an attachment.
+func AttachmentById(ctx context.Context, id string) (*Attachment, error) {
+	return db.One(ctx, attachmentMapping,
+		"select "+attachmentColumns+" from Attachments where id = ?", id)
+}
+
+// CreateAttachment stores a file uploaded by an actor, which has
+// already been put in the media storage. It isn't attached to a post
+// until the post is created.
+func CreateAttachment(ctx context.Context, a *Attachment, owner *Actor) error {
+	a.Owner = owner.ID()
+	_, err := db.Exec(ctx,
+		"insert into Attachments (id, type, mediaType, name, width, height, fileKey, previewKey, ownerId, created) "+
+			"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.ID.String(), a.Type, a.MediaType, a.Name, a.Width, a.Height,
+		nullable(a.FileKey), nullable(a.PreviewKey), a.Owner.String(), now(),
+	)
+	return err
+}
+
+// SetAttachmentDescription changes the description of an attachment.
+func SetAttachmentDescription(ctx context.Context, a *Attachment, name string) error {
+	_, err := db.Exec(ctx,
+		"update Attachments set name = ? where id = ?", name, a.ID.String(),
+	)
+	if err == nil {
+		a.Name = name
+	}
+	return err
+}
+
+// CacheAttachment records that the file of an attachment from another
+// server has been put in the media storage, along with what was
+// learned about it when it was processed. If another request cached
+// the file first, CacheAttachment reports false, and the files stored
+// by the caller should be deleted.
+func CacheAttachment(ctx context.Context, a *Attachment, cached *Attachment) (bool, error) {
+	res, err := db.Exec(ctx,
+		"update Attachments set mediaType = ?, width = ?, height = ?, fileKey = ?, previewKey = ? "+
+			"where id = ? and fileKey is null",
+		cached.MediaType, cached.Width, cached.Height, nullable(cached.FileKey), nullable(cached.PreviewKey),
+		a.ID.String(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	a.MediaType, a.Width, a.Height = cached.MediaType, cached.Width, cached.Height
+	a.FileKey, a.PreviewKey = cached.FileKey, cached.PreviewKey
+	return true, nil
+}
+
+// attach attaches uploaded files to a new post, in order.
+func (post *Post) attach(ctx context.Context) error {
+	for i, a := range post.Attachment {
+		res, err := db.Exec(ctx,
+			"update Attachments set postId = ?, position = ? where id = ? and ownerId = ? and postId is null",
+			post.ID().String(), i, a.ID.String(), post.Author.ID().String(),
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrAttachmentUnavailable
+		}
+		a.PostID = post.ID()
+	}
+	return nil
+}
+
+// saveRemoteAttachments replaces the stored attachments of a post from
+// another server with its current attachments. Attachments whose files
+// are unchanged are kept, along with their cached files. The removed
+// attachments are returned so that their cached files can be deleted.
+func (post *Post) saveRemoteAttachments(ctx context.Context) ([]*Attachment, error) {
+	id := post.ID().String()
+	stored, err := attachmentsWhere(ctx, "postId = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	byURL := make(map[string]*Attachment)
+	for _, a := range stored {
+		byURL[a.RemoteURL.String()] = a
+	}
+	for i, a := range post.Attachment {
+		a.Owner, a.PostID = post.Author.ID(), post.ID()
+		if old := byURL[a.RemoteURL.String()]; old != nil {
+			delete(byURL, a.RemoteURL.String())
+			a.ID, a.FileKey, a.PreviewKey = old.ID, old.FileKey, old.PreviewKey
+			if a.IsCached() {
+				a.MediaType, a.Width, a.Height = old.MediaType, old.Width, old.Height
+			}
+			_, err = db.Exec(ctx,
+				"update Attachments set type = ?, name = ?, position = ? where id = ?",
+				a.Type, a.Name, i, a.ID.String(),
+			)
+		} else {
+			a.ID = NewAttachmentID(ctx)
+			_, err = db.Exec(ctx,
+				"insert into Attachments (id, type, mediaType, name, width, height, remoteUrl, ownerId, postId, position, created) "+
+					"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				a.ID.String(), a.Type, a.MediaType, a.Name, a.Width, a.Height,
+				a.RemoteURL.String(), a.Owner.String(), id, i, now(),
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var removed []*Attachment
+	for _, a := range stored {
+		if byURL[a.RemoteURL.String()] == nil {
+			continue
+		}
+		if _, err = db.Exec(ctx, "delete from Attachments where id = ?", a.ID.String()); err != nil {
+			return nil, err
+		}
+		removed = append(removed, a)
+	}
+	return removed, nil
+}
+
+// loadAttachments loads the attachments of several posts at once.
+func loadAttachments(ctx context.Context, posts []*Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Post, len(posts))
+	args := make([]interface{}, 0, len(posts))
+	for _, post := range posts {
+		id := post.ID().String()
+		byID[id] = post
+		args = append(args, id)
+	}
+	attachments, err := attachmentsWhere(ctx, "postId in (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		post := byID[a.PostID.String()]
+		post.Attachment = append(post.Attachment, a)
+	}
+	return nil
+}
+
+func attachmentsWhere(ctx context.Context, where string, args ...interface{}) ([]*Attachment, error) {
+	return db.All(ctx, attachmentMapping,
+		"select "+attachmentColumns+" from Attachments where "+where+" order by position", args...)
+}
+
+func deleteAttachments(ctx context.Context, postId string) error {
+	_, err := db.Exec(ctx, "delete from Attachments where postId = ?", postId)
+	return err
+}
+
+// nullable converts the empty string to null for storing in the
+// database.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// BlockType is the type of the activities by which actors block other
+// actors.
+const BlockType = "Block"
+
+// Block records that an actor on this server blocks another actor,
+// removing the follows between them and the notifications they have
+// given each other. It returns a Block activity to deliver to the
+// blocked actor, which isn't added to the actor's outbox since blocks
+// are private. Blocking an actor that is already blocked does nothing,
+// and the returned activity is nil.
+func Block(ctx context.Context, actor, target *Actor) (*Activity, error) {
+	activity := &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       BlockType,
+		Actor:     actor,
+		ObjectID:  target.ID(),
+		Published: now(),
+		Recipient: target.ID(),
+	}
+	if ok, err := saveBlock(ctx, activity.id, actor, target.ID(), activity.Published); err != nil || !ok {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// Unblock removes an actor's block of another actor, returning an Undo
+// activity for the Block to deliver to them. If the actor doesn't block
+// the target, nothing is done and the returned activity is nil.
+func Unblock(ctx context.Context, actor, target *Actor) (*Activity, error) {
+	undone := &Activity{typ: BlockType, Actor: actor, ObjectID: target.ID(), Recipient: target.ID()}
+	err := db.QueryRow(ctx,
+		"select id, published from Blocks where actorId = ? and targetId = ?",
+		actor.ID().String(), target.ID().String(),
+	).Scan(db.URLScanner{&undone.id}, &undone.Published)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = DeleteBlock(ctx, undone.id, actor); err != nil {
+		return nil, err
+	}
+	return &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       "Undo",
+		Actor:     actor,
+		ObjectID:  undone.id,
+		Object:    undone,
+		Published: now(),
+	}, nil
+}
+
+// SaveBlock stores a Block received from another server, by which one
+// of its actors blocks an actor on this server, as Block does for
+// local blocks.
+func SaveBlock(ctx context.Context, id *url.URL, actor *Actor, targetId *url.URL) error {
+	_, err := saveBlock(ctx, id, actor, targetId, now())
+	return err
+}
+
+// saveBlock stores a block, reporting whether it wasn't already stored.
+func saveBlock(ctx context.Context, id *url.URL, actor *Actor, targetId *url.URL, published string) (bool, error) {
+	actorId, blockedId := actor.ID().String(), targetId.String()
+	saved := false
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		conn, err := db.DB(ctx)
+		if err != nil {
+			return err
+		}
+		res, err := conn.ExecContext(ctx,
+			"insert into Blocks (id, actorId, targetId, published) values (?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+			id.String(), actorId, blockedId, published,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		for _, table := range []string{"Follows", "FollowRequests"} {
+			_, err = db.Exec(ctx,
+				"delete from "+table+" where (followerId = ? and followeeId = ?) or (followerId = ? and followeeId = ?)",
+				actorId, blockedId, blockedId, actorId,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = db.Exec(ctx,
+			"delete from Notifications where (recipientId = ? and actorId = ?) or (recipientId = ? and actorId = ?)",
+			actorId, blockedId, blockedId, actorId,
+		)
+		saved = err == nil
+		return err
+	})
+	return saved, err
+}
+
+// DeleteBlock deletes the block with an ID, if it was made by the
+// actor.
+func DeleteBlock(ctx context.Context, id *url.URL, actor *Actor) error {
+	_, err := db.Exec(ctx,
+		"delete from Blocks where id = ? and actorId = ?",
+		id.String(), actor.ID().String(),
+	)
+	return err
+}
+
+// IsBlocking reports whether one actor blocks another.
+func IsBlocking(ctx context.Context, actor, target *Actor) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Blocks where actorId = ? and targetId = ?",
+		actor.ID().String(), target.ID().String(),
+	).Scan(&count)
+	return count != 0, err
+}
+
+// BlockedActors retrieves the actors that an actor blocks, most
+// recently blocked first.
+func BlockedActors(ctx context.Context, actor *Actor) ([]*Actor, error) {
+	return relatedActors(ctx,
+		"select "+actorMapping.Columns("act", "")+
+			" from Blocks b join Actors act on b.targetId = act.id where b.actorId = ? order by b.published desc",
+		actor.ID().String(),
+	)
+}
+
+// relatedActors retrieves the actors selected by a query for the
+// columns of the Actors table.
+func relatedActors(ctx context.Context, q string, args ...interface{}) ([]*Actor, error) {
+	return db.All(ctx, actorMapping, q, args...)
+}
+
+// notHidden returns a condition restricting a query to the posts that
+// aren't hidden from an actor by blocks, mutes or the suspension of
+// their authors or their servers. Posts are hidden from actors who
+// block or mute their authors and from those their authors block, and
+// boosts by actors who are blocked or muted are hidden too. The query
+// must use the alias post for the Posts table; boosterColumn is the
+// column holding the ID of the actor who boosted the post, or "" if the
+// query doesn't select boosts. The viewer is nil for clients that
+// aren't logged-in.
+func notHidden(viewer *Actor, boosterColumn string) (string, []interface{}) {
+	cond := notSuspended("post.authorId") + " and not " + domainBlocked("post.authorId", SuspendSeverity)
+	if boosterColumn != "" {
+		cond += " and (" + boosterColumn + " is null or (" + notSuspended(boosterColumn) +
+			" and not " + domainBlocked(boosterColumn, SuspendSeverity) + "))"
+	}
+	if viewer == nil {
+		return cond, nil
+	}
+	id := viewer.ID().String()
+	cond += " and post.authorId not in (select targetId from Blocks where actorId = ?) " +
+		"and post.authorId not in (select actorId from Blocks where targetId = ?) " +
+		"and post.authorId not in (select targetId from Mutes where actorId = ?)"
+	args := []interface{}{id, id, id}
+	if boosterColumn != "" {
+		cond += " and (" + boosterColumn + " is null or (" +
+			boosterColumn + " not in (select targetId from Blocks where actorId = ?) and " +
+			boosterColumn + " not in (select targetId from Mutes where actorId = ?)))"
+		args = append(args, id, id)
+	}
+	return cond, args
+}
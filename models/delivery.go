@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// A Delivery is an activity that is being delivered to an inbox on
+// another server. Deliveries are stored until they succeed, so that
+// those that fail can be inspected and retried, and so that those
+// that are unfinished when the server stops can be resumed.
+type Delivery struct {
+	ID         int64
+	ActivityID *url.URL
+	// Actor is the actor on this server as whom the activity is
+	// signed.
+	Actor *Actor
+	Inbox *url.URL
+	// Body is the activity as it is sent.
+	Body []byte
+	// Attempts is the number of times delivery has been attempted,
+	// and LastError is why the last attempt failed.
+	Attempts  int
+	LastError string
+	// Failed is true once delivery has been given up on.
+	Failed bool
+	// Created is when the delivery was queued.
+	Created string
+}
+
+// QueueDelivery stores a delivery of an activity to an inbox, before
+// it is attempted.
+func QueueDelivery(ctx context.Context, activityId *url.URL, actor *Actor, inbox *url.URL, body []byte) (*Delivery, error) {
+	delivery := &Delivery{
+		ActivityID: activityId,
+		Actor:      actor,
+		Inbox:      inbox,
+		Body:       body,
+		Created:    now(),
+	}
+	err := db.QueryRow(ctx,
+		"insert into Deliveries (activityId, actorId, inbox, body, created) values (?, ?, ?, ?, ?) returning id",
+		activityId.String(), actor.ID().String(), inbox.String(), body, delivery.Created,
+	).Scan(&delivery.ID)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// RecordDeliveryAttempt records an attempt at a delivery, removing the
+// delivery if it succeeded. The error is nil if it did.
+func RecordDeliveryAttempt(ctx context.Context, delivery *Delivery, deliveryErr error) error {
+	delivery.Attempts++
+	if deliveryErr == nil {
+		_, err := db.Exec(ctx, "delete from Deliveries where id = ?", delivery.ID)
+		return err
+	}
+	delivery.LastError = deliveryErr.Error()
+	_, err := db.Exec(ctx,
+		"update Deliveries set attempts = ?, lastError = ? where id = ?",
+		delivery.Attempts, delivery.LastError, delivery.ID,
+	)
+	return err
+}
+
+// FailDelivery marks a delivery as given up on.
+func FailDelivery(ctx context.Context, delivery *Delivery) error {
+	_, err := db.Exec(ctx, "update Deliveries set failed = true where id = ?", delivery.ID)
+	if err == nil {
+		delivery.Failed = true
+	}
+	return err
+}
+
+// Deliveries retrieves the deliveries that haven't succeeded, with the
+// oldest first.
+func Deliveries(ctx context.Context) ([]*Delivery, error) {
+	return deliveriesWhere(ctx, "true")
+}
+
+// FailedDeliveries retrieves the deliveries that have been given up
+// on, with the oldest first.
+func FailedDeliveries(ctx context.Context) ([]*Delivery, error) {
+	return deliveriesWhere(ctx, "d.failed")
+}
+
+// PendingDeliveries retrieves the deliveries that haven't succeeded or
+// been given up on, with the oldest first.
+func PendingDeliveries(ctx context.Context) ([]*Delivery, error) {
+	return deliveriesWhere(ctx, "not d.failed")
+}
+
+// DeliveryById retrieves a delivery that hasn't succeeded.
+func DeliveryById(ctx context.Context, id int64) (*Delivery, error) {
+	deliveries, err := deliveriesWhere(ctx, "d.id = ?", id)
+	if err != nil {
+		return nil, err
+	} else if len(deliveries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return deliveries[0], nil
+}
+
+func deliveriesWhere(ctx context.Context, where string, args ...interface{}) ([]*Delivery, error) {
+	return db.All(ctx, deliveryMapping,
+		"select "+deliveryMapping.Columns("d", "")+", "+actorMapping.Columns("act", "actor")+
+			" from Deliveries d join Actors act on d.actorId = act.id "+
+			"where "+where+" order by d.id",
+		args...,
+	)
+}
+
+// deliveryMapping maps the columns of the Deliveries table, and those
+// of the actor prefixed with actor, to the fields of a Delivery.
+var deliveryMapping = db.Nest(db.NewMapping(map[string]func(delivery *Delivery) interface{}{
+	"id":         func(delivery *Delivery) interface{} { return &delivery.ID },
+	"activityId": func(delivery *Delivery) interface{} { return db.URLScanner{&delivery.ActivityID} },
+	"inbox":      func(delivery *Delivery) interface{} { return db.URLScanner{&delivery.Inbox} },
+	"body":       func(delivery *Delivery) interface{} { return &delivery.Body },
+	"attempts":   func(delivery *Delivery) interface{} { return &delivery.Attempts },
+	"lastError":  func(delivery *Delivery) interface{} { return (*nullString)(&delivery.LastError) },
+	"failed":     func(delivery *Delivery) interface{} { return &delivery.Failed },
+	"created":    func(delivery *Delivery) interface{} { return &delivery.Created },
+}), "actor", func(delivery *Delivery) *Actor {
+	if delivery.Actor == nil {
+		delivery.Actor = new(Actor)
+	}
+	return delivery.Actor
+}, actorMapping)
@@ -0,0 +1,294 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// The severities of DomainBlocks, named as in Mastodon's domain
+// blocklists.
+const (
+	// NoopSeverity only applies the block's other restrictions,
+	// such as rejecting media.
+	NoopSeverity = "noop"
+	// SilenceSeverity hides the posts of the domain's actors from
+	// public timelines, and their notifications from the users who
+	// don't follow them.
+	SilenceSeverity = "silence"
+	// SuspendSeverity cuts the domain off: activities from it are
+	// ignored, nothing is fetched from it or delivered to it, and
+	// the posts of its actors are hidden everywhere.
+	SuspendSeverity = "suspend"
+)
+
+// DomainBlockSeverities lists the severities of DomainBlocks, from the
+// least to the most severe.
+var DomainBlockSeverities = []string{NoopSeverity, SilenceSeverity, SuspendSeverity}
+
+// ErrInvalidDomain is returned when blocking something that isn't a
+// domain name.
+var ErrInvalidDomain = errors.New("invalid domain")
+
+// A DomainBlock restricts how this server interacts with another
+// server and its subdomains.
+type DomainBlock struct {
+	// Domain is the host name of the server, including its port if
+	// it isn't the default one.
+	Domain   string
+	Severity string
+	// RejectMedia, if true, stops the attachments of the posts of
+	// the domain's actors from being fetched. It is implied by
+	// SuspendSeverity.
+	RejectMedia bool
+	// PublicComment explains the block to everyone, while
+	// PrivateComment is only for the server's administrators.
+	PublicComment, PrivateComment string
+	// Created is when the block was made.
+	Created string
+}
+
+// Suspended reports whether a block cuts its domain off.
+func (block *DomainBlock) Suspended() bool {
+	return block != nil && block.Severity == SuspendSeverity
+}
+
+// Silenced reports whether a block hides its domain from public
+// timelines.
+func (block *DomainBlock) Silenced() bool {
+	return block != nil && block.Severity == SilenceSeverity
+}
+
+// RejectsMedia reports whether the attachments of posts from a block's
+// domain are rejected.
+func (block *DomainBlock) RejectsMedia() bool {
+	return block != nil && (block.RejectMedia || block.Severity == SuspendSeverity)
+}
+
+// NormalizeDomain converts the domain of a block, which may be given as
+// a URL, to the lower-case host name that is stored.
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if strings.Contains(domain, "://") {
+		u, err := url.Parse(domain)
+		if err != nil {
+			return "", ErrInvalidDomain
+		}
+		domain = u.Host
+	}
+	domain = strings.TrimSuffix(strings.TrimPrefix(domain, "*."), ".")
+	if domain == "" || strings.ContainsAny(domain, "/@%_*? \t") {
+		return "", ErrInvalidDomain
+	}
+	return domain, nil
+}
+
+func validSeverity(severity string) bool {
+	for _, s := range DomainBlockSeverities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveDomainBlock blocks a domain, replacing any earlier block of it.
+// Suspending a domain removes the follows between its actors and those
+// on this server.
+func SaveDomainBlock(ctx context.Context, block *DomainBlock) error {
+	domain, err := NormalizeDomain(block.Domain)
+	if err != nil {
+		return err
+	}
+	if !validSeverity(block.Severity) {
+		return fmt.Errorf("invalid severity %q", block.Severity)
+	}
+	block.Domain = domain
+	if block.Created == "" {
+		block.Created = now()
+	}
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into DomainBlocks (domain, severity, rejectMedia, publicComment, privateComment, created) "+
+			"values (?, ?, ?, ?, ?, ?)"+conn.Dialect.Upsert([]string{"domain"},
+			"severity", "rejectMedia", "publicComment", "privateComment", "created"),
+		block.Domain, block.Severity, block.RejectMedia, block.PublicComment, block.PrivateComment, block.Created,
+	)
+	if err != nil || !block.Suspended() {
+		return err
+	}
+	for _, table := range []string{"Follows", "FollowRequests"} {
+		_, err = db.Exec(ctx,
+			"delete from "+table+" where "+domainBlocked("followerId", SuspendSeverity)+" or "+domainBlocked("followeeId", SuspendSeverity),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDomainBlock lifts the block of a domain.
+func DeleteDomainBlock(ctx context.Context, domain string) error {
+	_, err := db.Exec(ctx, "delete from DomainBlocks where domain = ?", domain)
+	return err
+}
+
+// domainBlockMapping maps the columns of the DomainBlocks table to the
+// fields of a DomainBlock.
+var domainBlockMapping = db.NewMapping(map[string]func(block *DomainBlock) interface{}{
+	"domain":         func(block *DomainBlock) interface{} { return &block.Domain },
+	"severity":       func(block *DomainBlock) interface{} { return &block.Severity },
+	"rejectMedia":    func(block *DomainBlock) interface{} { return &block.RejectMedia },
+	"publicComment":  func(block *DomainBlock) interface{} { return &block.PublicComment },
+	"privateComment": func(block *DomainBlock) interface{} { return &block.PrivateComment },
+	"created":        func(block *DomainBlock) interface{} { return &block.Created },
+})
+
+var domainBlockColumns = domainBlockMapping.Columns("DomainBlocks", "") + " from DomainBlocks"
+
+// DomainBlocks retrieves all of the blocked domains, in alphabetical
+// order.
+func DomainBlocks(ctx context.Context) ([]*DomainBlock, error) {
+	return db.All(ctx, domainBlockMapping, "select "+domainBlockColumns+" order by domain")
+}
+
+// DomainBlockFor retrieves the block that applies to a host: that of
+// the host itself or of the closest of the domains it is a subdomain
+// of. If the host isn't blocked, it returns nil.
+func DomainBlockFor(ctx context.Context, host string) (*DomainBlock, error) {
+	host = strings.ToLower(host)
+	block, err := db.One(ctx, domainBlockMapping,
+		"select "+domainBlockColumns+" where domain = ? or ? like '%.' || domain order by length(domain) desc limit 1",
+		host, host,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// IsSuspended reports whether the server that a URL belongs to is
+// suspended.
+func IsSuspended(ctx context.Context, u *url.URL) (bool, error) {
+	block, err := DomainBlockFor(ctx, u.Host)
+	return block.Suspended(), err
+}
+
+// domainBlocked returns a condition matching the rows where column,
+// which holds the IDs of objects, contains the ID of an object on a
+// domain blocked with a severity, or on one of its subdomains.
+func domainBlocked(column, severity string) string {
+	return fmt.Sprintf("exists (select 1 from DomainBlocks d where d.severity = '%s' and "+
+		"(%s like '%%://' || d.domain || '/%%' or %s like '%%://%%.' || d.domain || '/%%'))",
+		severity, column, column)
+}
+
+// silenced returns a condition matching the rows where column holds
+// the ID of an actor who is silenced or on a silenced domain.
+func silenced(column string) string {
+	return "(" + column + " in (select actorId from Silences) or " + domainBlocked(column, SilenceSeverity) + ")"
+}
+
+// notSilenced returns a condition restricting a query to the posts
+// that may be shown in public timelines: those whose authors, whose IDs
+// are in authorColumn, aren't silenced or on silenced domains, or are
+// followed by the viewer. The viewer is nil for clients that aren't
+// logged-in.
+func notSilenced(authorColumn string, viewer *Actor) (string, []interface{}) {
+	cond := "not " + silenced(authorColumn)
+	if viewer == nil {
+		return cond, nil
+	}
+	return "(" + cond + " or " + authorColumn + " in (select followeeId from Follows where followerId = ?))",
+		[]interface{}{viewer.ID().String()}
+}
+
+// domainBlocksHeader is the header of domain blocklists, in the format
+// that Mastodon imports and exports them in.
+var domainBlocksHeader = []string{"#domain", "#severity", "#reject_media", "#reject_reports", "#public_comment", "#obfuscate"}
+
+// WriteDomainBlocksCSV writes a domain blocklist as CSV, in the format
+// that Mastodon imports. Private comments are left out.
+func WriteDomainBlocksCSV(w io.Writer, blocks []*DomainBlock) error {
+	out := csv.NewWriter(w)
+	out.Write(domainBlocksHeader)
+	for _, block := range blocks {
+		out.Write([]string{
+			block.Domain,
+			block.Severity,
+			strconv.FormatBool(block.RejectMedia),
+			"false",
+			block.PublicComment,
+			"false",
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// ReadDomainBlocksCSV reads a domain blocklist in the CSV format that
+// Mastodon exports, or a list of domains with one on each line. Domains
+// without a severity are suspended.
+func ReadDomainBlocksCSV(r io.Reader) ([]*DomainBlock, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	columns := map[string]int{"domain": 0}
+	var blocks []*DomainBlock
+	for line := 1; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if line == 1 && strings.TrimPrefix(strings.TrimSpace(record[0]), "#") == "domain" {
+			for i, name := range record {
+				columns[strings.TrimPrefix(strings.TrimSpace(name), "#")] = i
+			}
+			continue
+		}
+		if field("domain") == "" {
+			continue
+		}
+		block := &DomainBlock{Severity: field("severity"), PublicComment: field("public_comment")}
+		if block.Domain, err = NormalizeDomain(field("domain")); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch block.Severity {
+		case "":
+			block.Severity = SuspendSeverity
+		case "limit":
+			block.Severity = SilenceSeverity
+		}
+		if !validSeverity(block.Severity) {
+			return nil, fmt.Errorf("line %d: invalid severity %q", line, block.Severity)
+		}
+		if rejectMedia := field("reject_media"); rejectMedia != "" {
+			if block.RejectMedia, err = strconv.ParseBool(rejectMedia); err != nil {
+				return nil, fmt.Errorf("line %d: invalid reject_media %q", line, rejectMedia)
+			}
+		}
+		blocks = append(blocks, block)
+	}
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+)
+
+// ErrBlocked is returned when following an actor that blocks the
+// follower or is blocked by them.
+var ErrBlocked = errors.New("the actor is blocked")
+
+// Follow records that one actor follows another and notifies the
+// followee, if they are on this server. Following an actor that is
+// already followed does nothing, and actors can't follow those who
+// block them or whom they block.
+//
+// An actor on this server who follows an actor on another server only
+// asks to follow them: the returned Follow activity is to be delivered
+// to the followee, and the follow is pending until they send an Accept
+// of it, which FollowAccepted records. The Follow isn't added to the
+// follower's outbox. Otherwise, or if the follow was already asked
+// for, the returned activity is nil.
+func Follow(ctx context.Context, follower, followee *Actor) (*Activity, error) {
+	var activity *Activity
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var err error
+		activity, err = follow(ctx, follower, followee)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+func follow(ctx context.Context, follower, followee *Actor) (*Activity, error) {
+	var blocks int
+	err := db.QueryRow(ctx,
+		"select count(*) from Blocks where (actorId = ? and targetId = ?) or (actorId = ? and targetId = ?)",
+		follower.ID().String(), followee.ID().String(), followee.ID().String(), follower.ID().String(),
+	).Scan(&blocks)
+	if err != nil {
+		return nil, err
+	} else if blocks != 0 {
+		return nil, ErrBlocked
+	}
+	cfg := config.Get(ctx)
+	if cfg.IsLocal(followee.ID()) || !cfg.IsLocal(follower.ID()) {
+		return nil, saveFollow(ctx, follower.ID(), followee.ID(), nil)
+	}
+	if following, err := IsFollowing(ctx, follower, followee); err != nil || following {
+		return nil, err
+	}
+	activity := &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       "Follow",
+		Actor:     follower,
+		ObjectID:  followee.ID(),
+		Published: now(),
+		Recipient: followee.ID(),
+	}
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.ExecContext(ctx,
+		"insert into FollowRequests (id, followerId, followeeId, published) values (?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+		activity.id.String(), follower.ID().String(), followee.ID().String(), activity.Published,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// saveFollow records that one actor follows another, by the Follow
+// activity with an ID if it is known, and notifies the followee.
+func saveFollow(ctx context.Context, followerId, followeeId, activityId *url.URL) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := conn.ExecContext(ctx,
+		"insert into Follows (followerId, followeeId, createdAt, activityId) values (?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+		followerId.String(), followeeId.String(), time.Now().Unix(), urlString(activityId),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return notify(ctx, FollowNotification, followeeId, followerId, nil, nil)
+}
+
+// FollowAccepted records that an actor on another server has accepted
+// the Follow activity with an ID, by which an actor on this server asked
+// to follow them. If the ID isn't known, the Follow asked for by the
+// actor with the ID follower is accepted instead, for servers that
+// accept follows without giving their IDs. Accepts of follows that
+// weren't asked for are ignored.
+func FollowAccepted(ctx context.Context, followee *Actor, id, follower *url.URL) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		var request, followerId *url.URL
+		err := db.QueryRow(ctx,
+			"select id, followerId from FollowRequests where followeeId = ? and (id = ? or followerId = ?)",
+			followee.ID().String(), urlString(id), urlString(follower),
+		).Scan(db.URLScanner{&request}, db.URLScanner{&followerId})
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err = db.Exec(ctx, "delete from FollowRequests where id = ?", request.String()); err != nil {
+			return err
+		}
+		return saveFollow(ctx, followerId, followee.ID(), request)
+	})
+}
+
+// FollowRejected removes an actor on this server's request to follow an
+// actor on another server, or their follow of them if it had been
+// accepted, when the followee sends a Reject of the Follow activity
+// with an ID. The ID and follower are matched as by FollowAccepted.
+func FollowRejected(ctx context.Context, followee *Actor, id, follower *url.URL) error {
+	followeeId := followee.ID().String()
+	_, err := db.Exec(ctx,
+		"delete from FollowRequests where followeeId = ? and (id = ? or followerId = ?)",
+		followeeId, urlString(id), urlString(follower),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx,
+		"delete from Follows where followeeId = ? and (activityId = ? or followerId = ?)",
+		followeeId, urlString(id), urlString(follower),
+	)
+	return err
+}
+
+// Unfollow removes the record that one actor follows another, or that
+// they asked to, along with the followee's notification of it. If the
+// follower is on this server and the followee isn't, an Undo of the
+// Follow activity is returned to deliver to the followee; otherwise,
+// or if there was no Follow to undo, the returned activity is nil.
+func Unfollow(ctx context.Context, follower, followee *Actor) (*Activity, error) {
+	var activity *Activity
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		var err error
+		activity, err = unfollow(ctx, follower, followee)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+func unfollow(ctx context.Context, follower, followee *Actor) (*Activity, error) {
+	followerId, followeeId := follower.ID().String(), followee.ID().String()
+	undone := &Activity{typ: "Follow", Actor: follower, ObjectID: followee.ID(), Recipient: followee.ID()}
+	err := db.QueryRow(ctx,
+		"select activityId from Follows where followerId = ? and followeeId = ? and activityId is not null "+
+			"union select id from FollowRequests where followerId = ? and followeeId = ?",
+		followerId, followeeId, followerId, followeeId,
+	).Scan(db.URLScanner{&undone.id})
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if _, err = db.Exec(ctx, "delete from FollowRequests where followerId = ? and followeeId = ?", followerId, followeeId); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(ctx, "delete from Follows where followerId = ? and followeeId = ?", followerId, followeeId); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(ctx,
+		"delete from Notifications where type = ? and recipientId = ? and actorId = ?",
+		FollowNotification, followeeId, followerId,
+	)
+	if err != nil || undone.id == nil || config.Get(ctx).IsLocal(followee.ID()) {
+		return nil, err
+	}
+	return &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       "Undo",
+		Actor:     follower,
+		ObjectID:  undone.id,
+		Object:    undone,
+		Published: now(),
+	}, nil
+}
+
+// AcceptFollow creates an Accept activity telling a follower on
+// another server that the followee has accepted their Follow activity.
+// The Accept isn't added to the followee's outbox, since it is only of
+// interest to the follower.
+func AcceptFollow(ctx context.Context, followee, follower *Actor, followId *url.URL) *Activity {
+	return respondToFollow(ctx, "Accept", followee, follower, followId)
+}
+
+// RejectFollow creates a Reject activity telling a follower on another
+// server that the followee has refused their Follow activity, as
+// AcceptFollow does for accepted follows.
+func RejectFollow(ctx context.Context, followee, follower *Actor, followId *url.URL) *Activity {
+	return respondToFollow(ctx, "Reject", followee, follower, followId)
+}
+
+func respondToFollow(ctx context.Context, typ string, followee, follower *Actor, followId *url.URL) *Activity {
+	return &Activity{
+		id:        newLocalID(ctx, "activity"),
+		typ:       typ,
+		Actor:     followee,
+		ObjectID:  followId,
+		Published: now(),
+		Recipient: follower.ID(),
+	}
+}
+
+// IsFollowRequested reports whether one actor has asked to follow an
+// actor on another server, who hasn't yet accepted.
+func IsFollowRequested(ctx context.Context, follower, followee *Actor) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from FollowRequests where followerId = ? and followeeId = ?",
+		follower.ID().String(), followee.ID().String(),
+	).Scan(&count)
+	return count != 0, err
+}
+
+// IsFollowing reports whether one actor follows another.
+func IsFollowing(ctx context.Context, follower, followee *Actor) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Follows where followerId = ? and followeeId = ?",
+		follower.ID().String(), followee.ID().String(),
+	).Scan(&count)
+	return count != 0, err
+}
+
+// CountFollowers counts the actors following an actor.
+func CountFollowers(ctx context.Context, actor *Actor) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Follows where followeeId = ?",
+		actor.ID().String(),
+	).Scan(&count)
+	return count, err
+}
+
+// CountFollowing counts the actors an actor follows.
+func CountFollowing(ctx context.Context, actor *Actor) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Follows where followerId = ?",
+		actor.ID().String(),
+	).Scan(&count)
+	return count, err
+}
+
+// Followers retrieves the actors following an actor.
+func Followers(ctx context.Context, actor *Actor) ([]*Actor, error) {
+	return relatedActors(ctx,
+		"select "+actorMapping.Columns("act", "")+
+			" from Follows f join Actors act on f.followerId = act.id where f.followeeId = ?",
+		actor.ID().String(),
+	)
+}
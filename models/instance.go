@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"sort"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// An Instance is another server that this server knows of, along with
+// how well delivering activities to it has gone.
+type Instance struct {
+	// Host is the host of the IDs of the server's actors.
+	Host string
+	// Actors is the number of the server's actors that are known.
+	Actors int
+	// LastSuccess and LastFailure are when an activity was last
+	// delivered to the server and when a delivery last failed, or
+	// "" if none has.
+	LastSuccess, LastFailure string
+	// Failures is the number of deliveries that have failed since
+	// the last one that succeeded.
+	Failures int
+	// LastError is why the last failed delivery failed.
+	LastError string
+	// Block is how the server's domain is blocked, or nil if it
+	// isn't.
+	Block *DomainBlock
+}
+
+// RecordDelivery records whether an attempt to deliver an activity to
+// a server succeeded. The error is nil if it did.
+func RecordDelivery(ctx context.Context, host string, deliveryErr error) error {
+	var err error
+	if deliveryErr == nil {
+		_, err = db.Exec(ctx,
+			"insert into DeliveryHealth (host, lastSuccess, failures) values (?, ?, 0) "+
+				"on conflict (host) do update set lastSuccess = excluded.lastSuccess, failures = 0",
+			host, now(),
+		)
+	} else {
+		_, err = db.Exec(ctx,
+			"insert into DeliveryHealth (host, lastFailure, failures, lastError) values (?, ?, 1, ?) "+
+				"on conflict (host) do update set lastFailure = excluded.lastFailure, "+
+				"failures = DeliveryHealth.failures + 1, lastError = excluded.lastError",
+			host, now(), deliveryErr.Error(),
+		)
+	}
+	return err
+}
+
+// Instances retrieves the servers other than this one whose actors are
+// known, in order of their hosts.
+func Instances(ctx context.Context, ownHost string) ([]*Instance, error) {
+	var hosts []string
+	counts := make(map[string]int)
+	rows, err := db.Query(ctx, "select id from Actors")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id *url.URL
+		if err = rows.Scan(db.URLScanner{&id}); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if counts[id.Host] == 0 && id.Host != ownHost {
+			hosts = append(hosts, id.Host)
+		}
+		counts[id.Host]++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	var instances []*Instance
+	for _, host := range hosts {
+		instance, err := db.One(ctx, instanceMapping,
+			"select "+instanceMapping.Columns("DeliveryHealth", "")+" from DeliveryHealth where host = ?", host)
+		if err == sql.ErrNoRows {
+			instance = &Instance{Host: host}
+		} else if err != nil {
+			return nil, err
+		}
+		instance.Actors = counts[host]
+		if instance.Block, err = DomainBlockFor(ctx, host); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// instanceMapping maps the columns of the DeliveryHealth table to the
+// fields of an Instance.
+var instanceMapping = db.NewMapping(map[string]func(instance *Instance) interface{}{
+	"host":        func(instance *Instance) interface{} { return &instance.Host },
+	"lastSuccess": func(instance *Instance) interface{} { return (*nullString)(&instance.LastSuccess) },
+	"lastFailure": func(instance *Instance) interface{} { return (*nullString)(&instance.LastFailure) },
+	"failures":    func(instance *Instance) interface{} { return &instance.Failures },
+	"lastError":   func(instance *Instance) interface{} { return (*nullString)(&instance.LastError) },
+})
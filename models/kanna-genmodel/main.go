@@ -18,7 +18,6 @@ package {{.Package}}
 import (
 	{{ if .Table }}
 	"context"
-	"database/sql"
 	{{ end }}
 	"net/url"
 	{{ if .Table }}
@@ -68,61 +67,45 @@ func (model *{{.Name}}) GetProp(prop string) (interface{}, bool) {
 }
 
 {{ if .Table -}}
+var {{.MappingName}} = {{ range .Joins }}db.Nest({{ end }}db.NewMapping(map[string]func(model *{{.Name}}) interface{}{
+	"id": func(model *{{.Name}}) interface{} { return db.URLScanner{ &model.id } },
+	"type": func(model *{{.Name}}) interface{} { return &model.typ },
+{{- range .Properties -}}
+{{- if or .External .LinksTo -}}
+{{- else if eq .Type "*url.URL" }}
+	{{ printf "%q" .ColumnName }}: func(model *{{$model.Name}}) interface{} { return db.URLScanner{ &model.{{.FieldName}} } },
+{{- else }}
+	{{ printf "%q" .ColumnName }}: func(model *{{$model.Name}}) interface{} { return &model.{{.FieldName}} },
+{{- end -}}
+{{- end }}
+})
+{{- range .Joins -}}
+, {{ printf "%q" .Prefix }}, func(model *{{$model.Name}}) *{{.Model.Name}} {
+	if model.{{.LinkField}} == nil {
+		model.{{.LinkField}} = new({{.Model.Name}})
+	}
+	return model.{{.LinkField}}
+}, {{.Model.MappingName}})
+{{- end }}
+
 func {{.Name}}ById(ctx context.Context, id string) (*{{.Name}}, error) {
-	var model {{.Name}}
-	rows, err := db.DB(ctx).QueryContext(ctx, "select {{ $model.Table }}.id, {{ $model.Table }}.type {{- range .Properties -}}
-		, {{ $model.Table }}.{{ .ColumnName }}
-	{{- end -}}
-	{{- range $join := .Joins -}}
-		, {{ $join.Model.Table }}.type
-		{{- range $join.Model.Properties -}}
-			, {{ $join.Model.Table }}.{{ .ColumnName }}
-		{{- end -}}
-	{{- end }} from {{.Table}} {{- range .Joins -}}
+	model, err := db.One(ctx, {{.MappingName}}, "select " + {{.MappingName}}.Columns({{ printf "%q" .Table }}, "")
+	{{- range .Joins }} + ", " + {{.Model.MappingName}}.Columns({{ printf "%q" .Model.Table }}, {{ printf "%q" .Prefix }})
+	{{- end }} + " from {{.Table}}
+	{{- range .Joins -}}
 		{{- ""}} join {{ .Model.Table }} on {{ $model.Table }}.{{ .LinkColumn }} = {{ .Model.Table }}.id
 	{{- end }} where {{ .Table }}.id = ?", id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, sql.ErrNoRows
-	}
+{{- if .HasExternal }}
 
-{{- range .Joins }}
-	model.{{ .LinkField }} = new({{ .Model.Name }})
-{{- end }}
-
-	err = rows.Scan(
-		db.URLScanner{ &model.id },
-		&model.typ,
-
-{{- range .Properties -}}
-{{- if .LinksTo }}
-		db.URLScanner{ &model.{{.FieldName}}.id },
-{{- else if eq .Type "*url.URL" }}
-		db.URLScanner{ &model.{{.FieldName}} },
-{{- else }}
-		&model.{{.FieldName}},
-{{- end -}}
-{{- end -}}
-
-{{- range $join := .Joins }}
-		&model.{{$join.LinkField}}.typ,
-{{- range $join.Model.Properties -}}
-{{- if eq .Type "*url.URL" }}
-		db.URLScanner{ &model.{{$join.LinkField}}.{{.FieldName}} },
-{{- else }}
-		&model.{{$join.LinkField}}.{{.FieldName}},
-{{- end -}}
-{{- end -}}
-{{- end }}
-	)
-	if err != nil {
+	if err = model.loadExternal(ctx); err != nil {
 		return nil, err
 	}
+{{- end }}
 
-	return &model, nil
+	return model, nil
 }
 {{- end }}
 
@@ -165,12 +148,35 @@ type Model struct {
 	Joins      []ModelJoin
 }
 
+// MappingName is the name of the variable holding the db.Mapping of
+// the model's columns.
+func (m *Model) MappingName() string {
+	return lowerFirst(m.Name) + "Mapping"
+}
+
+// HasExternal reports whether any of the model's properties are
+// external.
+func (m *Model) HasExternal() bool {
+	for _, prop := range m.Properties {
+		if prop.External {
+			return true
+		}
+	}
+	return false
+}
+
 type Property struct {
+	// FieldName is the name of the struct field holding the
+	// property. It defaults to the capitalized property name.
 	FieldName  string
 	Name       string
 	ColumnName string
 	Type       string
 	LinksTo    string
+	// External properties are not stored in the model's table.
+	// Models with external properties must define a loadExternal
+	// method to fill them in after the rest of the model is loaded.
+	External bool
 }
 
 type ModelJoin struct {
@@ -179,6 +185,17 @@ type ModelJoin struct {
 	Model      *Model
 }
 
+// Prefix is the prefix of the names of the joined model's columns,
+// which is the uncapitalized name of the field holding it.
+func (j ModelJoin) Prefix() string {
+	return lowerFirst(j.LinkField)
+}
+
+// lowerFirst uncapitalizes a name.
+func lowerFirst(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
 func parseFile(filename string) []*Model {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -214,6 +231,12 @@ func processModel(raws rawModel) []*Model {
 				if linksTo, found := desc["links_to"]; found {
 					prop.LinksTo = linksTo.(string)
 				}
+				if field, found := desc["field_name"]; found {
+					prop.FieldName = field.(string)
+				}
+				if external, found := desc["external"]; found {
+					prop.External = external.(bool)
+				}
 				prop.Type = desc["type"].(string)
 			default:
 				panic("invalid property descriptor")
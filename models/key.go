@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/url"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+)
+
+// A PublicKey is the key with which other servers verify the
+// signatures on an actor's requests.
+type PublicKey struct {
+	ID *url.URL
+	// Owner is the ID of the actor that the key belongs to.
+	Owner *url.URL
+	// PublicKeyPem is the key in PEM format.
+	PublicKeyPem string
+}
+
+func (key *PublicKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	}{key.ID.String(), key.Owner.String(), key.PublicKeyPem})
+}
+
+// RSA parses the key, which must be an RSA key.
+func (key *PublicKey) RSA() (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key.PublicKeyPem))
+	if block == nil {
+		return nil, errors.New("public key is not in PEM format")
+	}
+	var parsed interface{}
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// keyBits is the size of the RSA keys generated for local actors.
+const keyBits = 2048
+
+// loadExternal loads the public key of an actor. Actors on this server
+// are given a key pair the first time one is needed.
+func (a *Actor) loadExternal(ctx context.Context) error {
+	key, err := publicKeyByOwner(ctx, a)
+	if err == sql.ErrNoRows && config.Get(ctx).IsLocal(a.ID()) {
+		_, _, err = SigningKey(ctx, a)
+		if err == nil {
+			key, err = publicKeyByOwner(ctx, a)
+		}
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	a.PublicKey = key
+	return nil
+}
+
+// publicKeyMapping maps the columns of the Keys table to the fields of
+// a PublicKey.
+var publicKeyMapping = db.NewMapping(map[string]func(key *PublicKey) interface{}{
+	"id":           func(key *PublicKey) interface{} { return db.URLScanner{&key.ID} },
+	"ownerId":      func(key *PublicKey) interface{} { return db.URLScanner{&key.Owner} },
+	"publicKeyPem": func(key *PublicKey) interface{} { return &key.PublicKeyPem },
+})
+
+func publicKeyByOwner(ctx context.Context, owner *Actor) (*PublicKey, error) {
+	return db.One(ctx, publicKeyMapping,
+		"select "+publicKeyMapping.Columns("Keys", "")+" from Keys where ownerId = ? order by id limit 1",
+		owner.ID().String(),
+	)
+}
+
+// PublicKeyById retrieves a stored public key.
+func PublicKeyById(ctx context.Context, id string) (*PublicKey, error) {
+	return db.One(ctx, publicKeyMapping,
+		"select "+publicKeyMapping.Columns("Keys", "")+" from Keys where id = ?", id)
+}
+
+// SavePublicKey stores the public key of an actor on another server,
+// replacing any copy of it that was stored before.
+func SavePublicKey(ctx context.Context, key *PublicKey) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Keys (id, ownerId, publicKeyPem) values (?, ?, ?)"+
+			conn.Dialect.Upsert([]string{"id"}, "ownerId", "publicKeyPem"),
+		key.ID.String(), key.Owner.String(), key.PublicKeyPem,
+	)
+	return err
+}
+
+// SigningKey returns the private key with which requests by an actor
+// on this server are signed, along with the ID of its public key. If
+// the actor doesn't have a key pair yet, one is generated.
+func SigningKey(ctx context.Context, actor *Actor) (*url.URL, *rsa.PrivateKey, error) {
+	keyId := *actor.ID()
+	keyId.Fragment = "main-key"
+	var privatePem sql.NullString
+	err := db.QueryRow(ctx,
+		"select privateKeyPem from Keys where id = ?", keyId.String(),
+	).Scan(&privatePem)
+	if err == sql.ErrNoRows {
+		return generateKey(ctx, &keyId, actor)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode([]byte(privatePem.String))
+	if block == nil {
+		return nil, nil, errors.New("no private key for " + keyId.String())
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &keyId, key, nil
+}
+
+func generateKey(ctx context.Context, keyId *url.URL, actor *Actor) (*url.URL, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := conn.ExecContext(ctx,
+		"insert into Keys (id, ownerId, publicKeyPem, privateKeyPem) values (?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+		keyId.String(), actor.ID().String(), string(publicPem), string(privatePem),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	// If another request generated a key at the same time, that key
+	// is used instead.
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		return SigningKey(ctx, actor)
+	}
+	return keyId, key, nil
+}
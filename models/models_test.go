@@ -0,0 +1,250 @@
+package models_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/db/dbtest"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/seeds"
+	"github.com/ekiru/kanna/streaming"
+)
+
+// seeded returns a context carrying a migrated database with the test
+// set of seeds loaded into it.
+func seeded(t *testing.T, database *db.Database) context.Context {
+	t.Helper()
+	dbtest.Migrate(t, database)
+	cfg := config.Default()
+	cfg.BaseURL = "https://kanna.example"
+	ctx := config.WithConfig(db.WithDB(context.Background(), database), cfg)
+	set, err := seeds.Read("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = seeds.Load(ctx, set); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func account(t *testing.T, ctx context.Context, username string) *models.Account {
+	t.Helper()
+	account, err := models.AccountByUsername(ctx, username)
+	if err != nil {
+		t.Fatalf("AccountByUsername(%s): %v", username, err)
+	}
+	return account
+}
+
+// TestQueries runs the queries of the models, which map their rows to
+// models by the names of the columns, against each dialect.
+func TestQueries(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, database *db.Database) {
+		ctx := seeded(t, database)
+		alice, bob := account(t, ctx, "alice"), account(t, ctx, "bob")
+		if alice.Role != "admin" || alice.Actor.Name != "alice" || alice.Actor.ID().String() != "https://kanna.example/actor/alice" {
+			t.Errorf("alice = %+v, actor %+v", alice, alice.Actor)
+		}
+
+		actor, err := models.ActorById(ctx, alice.Actor.ID().String())
+		if err != nil {
+			t.Fatal(err)
+		} else if actor.Name != "alice" || actor.Inbox == nil || actor.PublicKey == nil {
+			t.Errorf("ActorById = %+v", actor)
+		}
+		if actor, err = models.ActorByHandle(ctx, "bob", "kanna.example"); err != nil {
+			t.Fatal(err)
+		} else if actor.ID().String() != bob.Actor.ID().String() {
+			t.Errorf("ActorByHandle = %v, want %v", actor.ID(), bob.Actor.ID())
+		}
+		if followers, err := models.Followers(ctx, alice.Actor); err != nil {
+			t.Fatal(err)
+		} else if len(followers) != 2 {
+			t.Errorf("alice has %d followers, want 2", len(followers))
+		}
+
+		local, err := models.LocalTimeline(ctx, nil, models.Page{Limit: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var public *models.Post
+		for _, entry := range local {
+			if entry.Post.Author == nil || entry.Post.Author.Name == "" {
+				t.Errorf("%v has no author", entry.Post.ID())
+			}
+			if entry.Post.Source != nil && entry.Post.Source.Content == "A public post with a #hashtag." {
+				public = entry.Post
+			}
+		}
+		if public == nil {
+			t.Fatalf("the public post isn't in the local timeline: %d entries", len(local))
+		}
+		home, err := models.HomeTimeline(ctx, bob.Actor, models.Page{Limit: 20})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(home) <= len(local)-1 {
+			t.Errorf("bob's home timeline has %d entries, the local timeline %d", len(home), len(local))
+		}
+
+		post, err := models.PostById(ctx, public.ID().String())
+		if err != nil {
+			t.Fatal(err)
+		} else if post.Author.ID().String() != alice.Actor.ID().String() || len(post.Tag) != 1 {
+			t.Errorf("PostById = %+v", post)
+		}
+		if replies, err := models.Descendants(ctx, post, nil); err != nil {
+			t.Fatal(err)
+		} else if len(replies) != 1 || replies[0].Author.Name != "bob" {
+			t.Errorf("Descendants = %v", replies)
+		}
+		if tagged, err := models.PostsByHashtag(ctx, "HashTag", nil, models.Page{Limit: 20}); err != nil {
+			t.Fatal(err)
+		} else if len(tagged) != 1 {
+			t.Errorf("PostsByHashtag found %d posts, want 1", len(tagged))
+		}
+
+		activities, err := models.OutboxActivities(ctx, alice.Actor, alice.Actor, models.Page{Limit: 20})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(activities) == 0 {
+			t.Fatal("alice's outbox is empty")
+		}
+		if activity, err := models.ActivityById(ctx, activities[0].ID().String()); err != nil {
+			t.Fatal(err)
+		} else if activity.Actor.Name != "alice" || activity.Object == nil {
+			t.Errorf("ActivityById = %+v", activity)
+		}
+
+		if notifications, err := models.Notifications(ctx, bob.Actor, nil, models.Page{Limit: 20}); err != nil {
+			t.Fatal(err)
+		} else if len(notifications) == 0 || notifications[0].Actor == nil {
+			t.Errorf("Notifications = %v", notifications)
+		}
+
+		// Saving an actor again updates it.
+		id, _ := url.Parse("https://elsewhere.example/users/dan")
+		remote := models.NewActor(id, "Person")
+		remote.Name = "dan"
+		remote.Inbox, _ = url.Parse("https://elsewhere.example/users/dan/inbox")
+		remote.Outbox, _ = url.Parse("https://elsewhere.example/users/dan/outbox")
+		if err = models.SaveActor(ctx, remote); err != nil {
+			t.Fatal(err)
+		}
+		remote.Name = "daniel"
+		if err = models.SaveActor(ctx, remote); err != nil {
+			t.Fatal(err)
+		}
+		if actor, err = models.ActorById(ctx, id.String()); err != nil {
+			t.Fatal(err)
+		} else if actor.Name != "daniel" {
+			t.Errorf("name = %q, want daniel", actor.Name)
+		}
+
+		block := &models.DomainBlock{Domain: "Elsewhere.Example", Severity: models.SilenceSeverity}
+		if err = models.SaveDomainBlock(ctx, block); err != nil {
+			t.Fatal(err)
+		}
+		block.Severity = models.SuspendSeverity
+		if err = models.SaveDomainBlock(ctx, block); err != nil {
+			t.Fatal(err)
+		}
+		if found, err := models.DomainBlockFor(ctx, "sub.elsewhere.example"); err != nil {
+			t.Fatal(err)
+		} else if found == nil || found.Domain != "elsewhere.example" || found.Severity != models.SuspendSeverity {
+			t.Errorf("DomainBlockFor = %+v", found)
+		}
+
+		if found, err := models.SearchActors(ctx, models.ParseSearchQuery("carol"), 10); err != nil {
+			t.Fatal(err)
+		} else if len(found) != 1 || found[0].Name != "carol" {
+			t.Errorf("SearchActors = %v", found)
+		}
+	})
+}
+
+// TestStreamedDeletes checks that the deletes of posts and boosts are
+// only streamed to the timelines that they were in, although they are
+// no longer stored.
+func TestStreamedDeletes(t *testing.T) {
+	hub := streaming.NewHub()
+	defer hub.Close()
+	ctx := streaming.WithHub(seeded(t, dbtest.Open(t, db.SQLite)), hub)
+	alice, bob, carol := account(t, ctx, "alice"), account(t, ctx, "bob"), account(t, ctx, "carol")
+	dave, err := models.CreateAccount(ctx, "dave", "password", models.UserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := hub.Subscribe()
+	defer sub.Close()
+	deleted := func() *models.TimelineEntry {
+		t.Helper()
+		for event := range sub.C {
+			if event.Type == streaming.Delete {
+				return event.Object.(*models.TimelineEntry)
+			}
+		}
+		t.Fatal("the subscription was closed")
+		return nil
+	}
+	in := func(what string, in func() (bool, error), want bool) {
+		t.Helper()
+		if got, err := in(); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("%s: %v, want %v", what, got, want)
+		}
+	}
+
+	source := models.Source{Content: "For followers, about #kanna.", MediaType: markup.PlainText}
+	post, _, err := models.CreatePost(ctx, alice.Actor, source, models.ContentWarning{},
+		models.VisibilityFollowers, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.DeletePost(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+	entry := deleted()
+	in("in bob's home timeline", func() (bool, error) { return models.InHomeTimeline(ctx, bob.Actor, entry) }, true)
+	in("in dave's home timeline", func() (bool, error) { return models.InHomeTimeline(ctx, dave.Actor, entry) }, false)
+	in("in the local timeline", func() (bool, error) { return models.InLocalTimeline(ctx, nil, entry) }, false)
+	in("tagged for dave", func() (bool, error) { return models.InHashtagTimeline(ctx, "kanna", dave.Actor, entry) }, false)
+	in("tagged for bob", func() (bool, error) { return models.InHashtagTimeline(ctx, "kanna", bob.Actor, entry) }, true)
+
+	source.Content = "In public, about #kanna."
+	if post, _, err = models.CreatePost(ctx, alice.Actor, source, models.ContentWarning{},
+		models.VisibilityPublic, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.Announce(ctx, bob.Actor, post); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.Unannounce(ctx, bob.Actor, post); err != nil {
+		t.Fatal(err)
+	}
+	entry = deleted()
+	if entry.BoostedBy == nil || entry.BoostedBy.ID().String() != bob.Actor.ID().String() {
+		t.Fatalf("the deleted entry is %+v, want bob's boost", entry)
+	}
+	in("the boost in bob's home timeline", func() (bool, error) { return models.InHomeTimeline(ctx, bob.Actor, entry) }, true)
+	in("the boost in carol's home timeline", func() (bool, error) { return models.InHomeTimeline(ctx, carol.Actor, entry) }, false)
+	in("the boost in the federated timeline", func() (bool, error) { return models.InFederatedTimeline(ctx, nil, entry) }, false)
+
+	if _, err = models.Block(ctx, dave.Actor, alice.Actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.DeletePost(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+	entry = deleted()
+	in("in the local timeline", func() (bool, error) { return models.InLocalTimeline(ctx, nil, entry) }, true)
+	in("in the federated timeline for dave, who blocks alice", func() (bool, error) {
+		return models.InFederatedTimeline(ctx, dave.Actor, entry)
+	}, false)
+	in("tagged", func() (bool, error) { return models.InHashtagTimeline(ctx, "kanna", nil, entry) }, true)
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// The actions that moderators take, as they are recorded in the
+// moderation log.
+const (
+	// ResolveReportAction marks a report as dealt with.
+	ResolveReportAction = "resolve_report"
+	// SuspendActorAction suspends an actor.
+	SuspendActorAction = "suspend_actor"
+	// DeletePostAction deletes a post.
+	DeletePostAction = "delete_post"
+	// UnsuspendActorAction lifts the suspension of an actor.
+	UnsuspendActorAction = "unsuspend_actor"
+	// SilenceActorAction silences an actor.
+	SilenceActorAction = "silence_actor"
+	// UnsilenceActorAction lifts the silencing of an actor.
+	UnsilenceActorAction = "unsilence_actor"
+	// ResetPasswordAction gives an account a new password.
+	ResetPasswordAction = "reset_password"
+	// LogoutAction logs an account out everywhere.
+	LogoutAction = "logout"
+	// ChangeRoleAction changes the role of an account.
+	ChangeRoleAction = "change_role"
+)
+
+// SuspendActor cuts an actor off from this server: their posts are
+// hidden everywhere, activities from them are ignored, nothing is
+// delivered to them, and, if they are on this server, their account
+// can no longer be used. The follows between them and other actors,
+// and the requests to follow them, are removed.
+func SuspendActor(ctx context.Context, actor *Actor) error {
+	id := actor.ID().String()
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Suspensions (actorId, created) values (?, ?)"+conn.Dialect.Upsert(nil), id, now())
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"Follows", "FollowRequests"} {
+		_, err = conn.ExecContext(ctx, "delete from "+table+" where followerId = ? or followeeId = ?", id, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnsuspendActor lifts the suspension of an actor. The follows that
+// were removed when they were suspended aren't restored.
+func UnsuspendActor(ctx context.Context, actor *Actor) error {
+	_, err := db.Exec(ctx, "delete from Suspensions where actorId = ?", actor.ID().String())
+	return err
+}
+
+// IsActorSuspended reports whether an actor, identified by their ID,
+// has been suspended.
+func IsActorSuspended(ctx context.Context, id *url.URL) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Suspensions where actorId = ?", id.String(),
+	).Scan(&count)
+	return count != 0, err
+}
+
+// notSuspended returns a condition matching the rows where column
+// doesn't hold the ID of a suspended actor.
+func notSuspended(column string) string {
+	return column + " not in (select actorId from Suspensions)"
+}
+
+// SilenceActor hides an actor's posts from public timelines, and their
+// notifications from the users of this server who don't follow them.
+func SilenceActor(ctx context.Context, actor *Actor) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Silences (actorId, created) values (?, ?)"+conn.Dialect.Upsert(nil), actor.ID().String(), now())
+	return err
+}
+
+// UnsilenceActor lifts the silencing of an actor.
+func UnsilenceActor(ctx context.Context, actor *Actor) error {
+	_, err := db.Exec(ctx, "delete from Silences where actorId = ?", actor.ID().String())
+	return err
+}
+
+// IsActorSilenced reports whether an actor, identified by their ID,
+// has been silenced.
+func IsActorSilenced(ctx context.Context, id *url.URL) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Silences where actorId = ?", id.String(),
+	).Scan(&count)
+	return count != 0, err
+}
+
+// A ModerationAction is an entry in the moderation log, which records
+// what the moderators of this server have done.
+type ModerationAction struct {
+	ID        int64
+	Moderator *Actor
+	// Action is what was done, such as SuspendActorAction.
+	Action string
+	// TargetID is the ID of the actor or post that was acted on.
+	TargetID *url.URL
+	// ReportID is the ID of the report that the action was taken
+	// on, or 0 if it wasn't taken on a report.
+	ReportID int64
+	// Created is when the action was taken.
+	Created string
+}
+
+// LogModeration records an action taken by a moderator in the
+// moderation log. The report is nil for actions that weren't taken on
+// a report.
+func LogModeration(ctx context.Context, moderator *Actor, action string, targetId *url.URL, report *Report) error {
+	var reportId interface{}
+	if report != nil {
+		reportId = report.ID
+	}
+	_, err := db.Exec(ctx,
+		"insert into ModerationLog (moderatorId, action, targetId, reportId, created) values (?, ?, ?, ?, ?)",
+		moderator.ID().String(), action, targetId.String(), reportId, now(),
+	)
+	return err
+}
+
+// ModerationLog retrieves the most recent entries in the moderation
+// log, up to limit entries, with the most recent first.
+func ModerationLog(ctx context.Context, limit int) ([]*ModerationAction, error) {
+	return db.All(ctx, moderationActionMapping,
+		"select "+moderationActionMapping.Columns("log", "")+", "+actorMapping.Columns("act", "moderator")+
+			" from ModerationLog log join Actors act on log.moderatorId = act.id "+
+			"order by log.id desc limit ?",
+		limit,
+	)
+}
+
+// moderationActionMapping maps the columns of the ModerationLog table,
+// and those of the moderator prefixed with moderator, to the fields of
+// a ModerationAction.
+var moderationActionMapping = db.Nest(db.NewMapping(map[string]func(entry *ModerationAction) interface{}{
+	"id":       func(entry *ModerationAction) interface{} { return &entry.ID },
+	"action":   func(entry *ModerationAction) interface{} { return &entry.Action },
+	"targetId": func(entry *ModerationAction) interface{} { return db.URLScanner{&entry.TargetID} },
+	"reportId": func(entry *ModerationAction) interface{} { return (*nullInt64)(&entry.ReportID) },
+	"created":  func(entry *ModerationAction) interface{} { return &entry.Created },
+}), "moderator", func(entry *ModerationAction) *Actor {
+	if entry.Moderator == nil {
+		entry.Moderator = new(Actor)
+	}
+	return entry.Moderator
+}, actorMapping)
+
+// nullInt64 scans a nullable column into an int64, treating null as 0.
+type nullInt64 int64
+
+func (n *nullInt64) Scan(src interface{}) error {
+	var ni sql.NullInt64
+	if err := ni.Scan(src); err != nil {
+		return err
+	}
+	*n = nullInt64(ni.Int64)
+	return nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// Mute hides an actor's posts and boosts from the timelines of an
+// actor on this server and, if notifications is true, stops them from
+// notifying the actor. Unlike blocks, mutes aren't sent to other
+// servers. Muting an actor who is already muted updates whether their
+// notifications are muted.
+func Mute(ctx context.Context, actor, target *Actor, notifications bool) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Mutes (actorId, targetId, notifications, created) values (?, ?, ?, ?)"+
+			conn.Dialect.Upsert([]string{"actorId", "targetId"}, "notifications", "created"),
+		actor.ID().String(), target.ID().String(), notifications, now(),
+	)
+	return err
+}
+
+// Unmute removes an actor's mute of another actor.
+func Unmute(ctx context.Context, actor, target *Actor) error {
+	_, err := db.Exec(ctx,
+		"delete from Mutes where actorId = ? and targetId = ?",
+		actor.ID().String(), target.ID().String(),
+	)
+	return err
+}
+
+// IsMuting reports whether one actor mutes another, and if so, whether
+// their notifications are muted too.
+func IsMuting(ctx context.Context, actor, target *Actor) (muted, notifications bool, err error) {
+	err = db.QueryRow(ctx,
+		"select notifications from Mutes where actorId = ? and targetId = ?",
+		actor.ID().String(), target.ID().String(),
+	).Scan(&notifications)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	return err == nil, notifications, err
+}
+
+// MutedActors retrieves the actors that an actor mutes, most recently
+// muted first.
+func MutedActors(ctx context.Context, actor *Actor) ([]*Actor, error) {
+	return relatedActors(ctx,
+		"select "+actorMapping.Columns("act", "")+
+			" from Mutes m join Actors act on m.targetId = act.id where m.actorId = ? order by m.created desc",
+		actor.ID().String(),
+	)
+}
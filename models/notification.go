@@ -0,0 +1,398 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/streaming"
+)
+
+// The types of Notifications, named as in Mastodon's API.
+const (
+	MentionNotification   = "mention"
+	FollowNotification    = "follow"
+	FavouriteNotification = "favourite"
+	ReblogNotification    = "reblog"
+)
+
+// NotificationTypes lists the types of Notifications.
+var NotificationTypes = []string{MentionNotification, FollowNotification, FavouriteNotification, ReblogNotification}
+
+// reactionNotifications maps the types of reactions to the types of
+// the notifications about them.
+var reactionNotifications = map[string]string{
+	LikeType:     FavouriteNotification,
+	AnnounceType: ReblogNotification,
+}
+
+// A Notification tells a user on this server that another actor has
+// mentioned or followed them, or liked or boosted one of their posts.
+type Notification struct {
+	ID   int64
+	Type string
+	// Recipient is the actor that the notification is for.
+	Recipient *Actor
+	// Actor is the actor who did what the notification is about.
+	Actor *Actor
+	// Post is the post that mentions the user or that was liked or
+	// boosted. It is nil for follows.
+	Post *Post
+	// Created is when the notification was created.
+	Created string
+	Read    bool
+}
+
+// GroupKey identifies the group of similar notifications that a
+// notification belongs to: likes and boosts of the same post are
+// grouped, as are follows, while each mention is in a group of its own.
+func (n *Notification) GroupKey() string {
+	switch n.Type {
+	case FavouriteNotification, ReblogNotification:
+		return n.Type + "-" + n.Post.ID().String()
+	case FollowNotification:
+		return n.Type
+	default:
+		return "ungrouped-" + strconv.FormatInt(n.ID, 10)
+	}
+}
+
+// A NotificationGroup is a group of similar notifications, with the
+// most recent first.
+type NotificationGroup struct {
+	Key           string
+	Notifications []*Notification
+}
+
+// Latest returns the most recent notification in a group.
+func (g *NotificationGroup) Latest() *Notification {
+	return g.Notifications[0]
+}
+
+// Actors returns the distinct actors of the notifications in a group.
+func (g *NotificationGroup) Actors() []*Actor {
+	seen := make(map[string]bool)
+	var actors []*Actor
+	for _, n := range g.Notifications {
+		if !seen[n.Actor.ID().String()] {
+			seen[n.Actor.ID().String()] = true
+			actors = append(actors, n.Actor)
+		}
+	}
+	return actors
+}
+
+// Unread reports whether any of the notifications in a group are
+// unread.
+func (g *NotificationGroup) Unread() bool {
+	for _, n := range g.Notifications {
+		if !n.Read {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupNotifications groups similar notifications, which must be
+// ordered from the most recent. The groups are ordered by their most
+// recent notifications.
+func GroupNotifications(notifications []*Notification) []*NotificationGroup {
+	var groups []*NotificationGroup
+	byKey := make(map[string]*NotificationGroup)
+	for _, n := range notifications {
+		key := n.GroupKey()
+		group, ok := byKey[key]
+		if !ok {
+			group = &NotificationGroup{Key: key}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.Notifications = append(group.Notifications, n)
+	}
+	return groups
+}
+
+// notify creates a notification for an actor on this server, unless
+// notifications from the actor are filtered out as described by
+// notificationAllowed, or there is already a notification for the
+// activity.
+func notify(ctx context.Context, typ string, recipient, actor, object, activity *url.URL) error {
+	return insertNotification(ctx,
+		"insert into Notifications (type, recipientId, actorId, objectId, activityId, created) "+
+			"select * from (select ? as type, ? as recipientId, ? as actorId, ?, ?, ?) n where "+notificationAllowed,
+		typ, recipient.String(), actor.String(), urlString(object), urlString(activity), now(),
+	)
+}
+
+// notifyReaction notifies the author of a post about a like or boost
+// of it, as notify does.
+func notifyReaction(ctx context.Context, id *url.URL, typ string, actor *Actor, objectId *url.URL) error {
+	return insertNotification(ctx,
+		"insert into Notifications (type, recipientId, actorId, objectId, activityId, created) "+
+			"select * from (select ? as type, post.authorId as recipientId, ? as actorId, post.id, ?, ? "+
+			"from Posts post where post.id = ?) n where "+notificationAllowed,
+		reactionNotifications[typ], actor.ID().String(), id.String(), now(), objectId.String(),
+	)
+}
+
+// insertNotification executes an insert into the Notifications table,
+// leaving the notification out if there is already one for the
+// activity, and publishes the notification if it was created.
+func insertNotification(ctx context.Context, insert string, args ...interface{}) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	var id int64
+	err = conn.QueryRowContext(ctx,
+		insert+conn.Dialect.Upsert(nil)+" returning id", args...,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return publishNotification(ctx, id)
+}
+
+// notificationAllowed is a condition on a notification n that is about
+// to be created, selecting it only if the recipient is on this server
+// and isn't the actor themself, and the actor isn't blocked or muted by
+// the recipient. Notifications from suspended actors and those on
+// suspended domains are dropped, as are those from silenced actors and
+// those on silenced domains whom the recipient doesn't follow.
+var notificationAllowed = "n.recipientId != n.actorId " +
+	"and exists (select 1 from Accounts where actorId = n.recipientId) " +
+	"and not exists (select 1 from Blocks b where b.actorId = n.recipientId and b.targetId = n.actorId) " +
+	"and not exists (select 1 from Mutes m where m.actorId = n.recipientId and m.targetId = n.actorId and m.notifications) " +
+	"and " + notSuspended("n.actorId") + " " +
+	"and not " + domainBlocked("n.actorId", SuspendSeverity) + " " +
+	"and (not " + silenced("n.actorId") + " " +
+	"or exists (select 1 from Follows f where f.followerId = n.recipientId and f.followeeId = n.actorId))"
+
+// publishNotification tells the clients streaming notifications about
+// the notification with an ID, which has just been created.
+func publishNotification(ctx context.Context, id int64) error {
+	if streaming.Get(ctx) == nil {
+		return nil
+	}
+	var recipientId string
+	err := db.QueryRow(ctx,
+		"select recipientId from Notifications where id = ?", id,
+	).Scan(&recipientId)
+	if err != nil {
+		return err
+	}
+	recipient, err := ActorById(ctx, recipientId)
+	if err != nil {
+		return err
+	}
+	notification, err := NotificationById(ctx, recipient, strconv.FormatInt(id, 10))
+	if err != nil {
+		return err
+	}
+	streaming.Publish(ctx, streaming.Event{Type: streaming.Notification, Object: notification})
+	return nil
+}
+
+// NotifyMentions notifies the actors on this server who are mentioned
+// in a post and may see it. It is called for new posts, but not when
+// posts are updated, so that nobody is notified twice about a post.
+func NotifyMentions(ctx context.Context, post *Post) error {
+	for _, tag := range post.Tag {
+		if tag.Type != MentionType {
+			continue
+		}
+		recipient, err := ActorById(ctx, tag.Href.String())
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if visible, err := CanView(ctx, recipient, post); err != nil {
+			return err
+		} else if !visible {
+			continue
+		}
+		if err = notify(ctx, MentionNotification, recipient.ID(), post.Author.ID(), post.ID(), post.ID()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteNotifications deletes the notifications about an activity
+// that has been undone, such as a like.
+func deleteNotifications(ctx context.Context, activityId string, actor *Actor) error {
+	_, err := db.Exec(ctx,
+		"delete from Notifications where activityId = ? and actorId = ?",
+		activityId, actor.ID().String(),
+	)
+	return err
+}
+
+// Notifications retrieves a page of an actor's notifications, most
+// recent first, along with their actors and posts. The cursors of the
+// Page are notification IDs. If types isn't empty, only notifications
+// of those types are retrieved.
+func Notifications(ctx context.Context, recipient *Actor, types []string, page Page) ([]*Notification, error) {
+	conds := []string{"recipientId = ?"}
+	args := []interface{}{recipient.ID().String()}
+	if len(types) > 0 {
+		conds = append(conds, "type in (?"+strings.Repeat(", ?", len(types)-1)+")")
+		for _, typ := range types {
+			args = append(args, typ)
+		}
+	}
+	order := "desc"
+	for _, cursor := range []struct {
+		id, cond string
+	}{{page.MaxID, "id < ?"}, {page.SinceID, "id > ?"}, {page.MinID, "id > ?"}} {
+		if cursor.id != "" {
+			conds = append(conds, cursor.cond)
+			args = append(args, cursor.id)
+		}
+	}
+	if page.MinID != "" {
+		order = "asc"
+	}
+	rows, err := db.All(ctx, notificationMapping,
+		fmt.Sprintf("select %s from Notifications where %s order by id %s limit ?",
+			notificationMapping.Columns("Notifications", ""), strings.Join(conds, " and "), order),
+		append(args, page.Limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if order == "asc" {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	actors := make(map[string]*Actor)
+	posts := make(map[string]*Post)
+	var notifications []*Notification
+	for _, row := range rows {
+		n := &row.Notification
+		n.Recipient = recipient
+		actor, ok := actors[row.actorId]
+		if !ok {
+			if actor, err = ActorById(ctx, row.actorId); err != nil {
+				return nil, err
+			}
+			actors[row.actorId] = actor
+		}
+		n.Actor = actor
+		if row.objectId != "" {
+			post, ok := posts[row.objectId]
+			if !ok {
+				// Posts received from other servers may have
+				// been deleted without their notifications.
+				post, err = PostById(ctx, row.objectId)
+				if err != nil && err != sql.ErrNoRows {
+					return nil, err
+				}
+				posts[row.objectId] = post
+			}
+			if post == nil {
+				continue
+			}
+			n.Post = post
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+// A notificationRow is a notification along with the IDs of its actor
+// and post, which are loaded separately.
+type notificationRow struct {
+	Notification
+	actorId, objectId string
+}
+
+// notificationMapping maps the columns of the Notifications table,
+// other than its recipient's ID, to the fields of a notificationRow.
+var notificationMapping = db.NewMapping(map[string]func(n *notificationRow) interface{}{
+	"id":       func(n *notificationRow) interface{} { return &n.ID },
+	"type":     func(n *notificationRow) interface{} { return &n.Type },
+	"actorId":  func(n *notificationRow) interface{} { return &n.actorId },
+	"objectId": func(n *notificationRow) interface{} { return (*nullString)(&n.objectId) },
+	"created":  func(n *notificationRow) interface{} { return &n.Created },
+	"read":     func(n *notificationRow) interface{} { return &n.Read },
+})
+
+// NotificationById retrieves one of an actor's notifications.
+func NotificationById(ctx context.Context, recipient *Actor, id string) (*Notification, error) {
+	notifications, err := Notifications(ctx, recipient, nil, Page{MaxID: nextID(id), Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(notifications) == 0 || strconv.FormatInt(notifications[0].ID, 10) != id {
+		return nil, sql.ErrNoRows
+	}
+	return notifications[0], nil
+}
+
+// nextID returns the notification ID after id, so that a page ending
+// before it starts with id.
+func nextID(id string) string {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "0"
+	}
+	return strconv.FormatInt(n+1, 10)
+}
+
+// CountUnreadNotifications counts an actor's unread notifications.
+func CountUnreadNotifications(ctx context.Context, recipient *Actor) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Notifications where recipientId = ? and not read",
+		recipient.ID().String(),
+	).Scan(&count)
+	return count, err
+}
+
+// LastReadNotification returns the ID of an actor's most recent
+// notification that has been read, or 0 if none have been.
+func LastReadNotification(ctx context.Context, recipient *Actor) (int64, error) {
+	var id sql.NullInt64
+	err := db.QueryRow(ctx,
+		"select max(id) from Notifications where recipientId = ? and read",
+		recipient.ID().String(),
+	).Scan(&id)
+	return id.Int64, err
+}
+
+// MarkNotificationsRead marks an actor's notifications up to and
+// including the one with an ID as read.
+func MarkNotificationsRead(ctx context.Context, recipient *Actor, lastId int64) error {
+	_, err := db.Exec(ctx,
+		"update Notifications set read = true where recipientId = ? and id <= ? and not read",
+		recipient.ID().String(), lastId,
+	)
+	return err
+}
+
+// DismissNotification deletes one of an actor's notifications.
+func DismissNotification(ctx context.Context, recipient *Actor, id int64) error {
+	_, err := db.Exec(ctx,
+		"delete from Notifications where recipientId = ? and id = ?",
+		recipient.ID().String(), id,
+	)
+	return err
+}
+
+// ClearNotifications deletes all of an actor's notifications.
+func ClearNotifications(ctx context.Context, recipient *Actor) error {
+	_, err := db.Exec(ctx,
+		"delete from Notifications where recipientId = ?",
+		recipient.ID().String(),
+	)
+	return err
+}
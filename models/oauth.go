@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// An App is a client application registered to use the API through
+// OAuth.
+type App struct {
+	// ClientID identifies the application.
+	ClientID string
+	// ClientSecret authenticates the application when it requests
+	// tokens.
+	ClientSecret string
+	// Name is the name of the application shown to users.
+	Name string
+	// RedirectURIs holds the URIs, separated by newlines, to which
+	// the user may be redirected after authorizing the application.
+	RedirectURIs string
+	// Scopes holds the space-separated scopes the application may
+	// request.
+	Scopes string
+	// Website is the optional homepage of the application.
+	Website string
+}
+
+// AuthorizationCodeLifetime is how long an authorization code may be
+// exchanged for a token after it is issued.
+const AuthorizationCodeLifetime = 10 * time.Minute
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateApp registers a new application, generating its client ID and
+// secret.
+func CreateApp(ctx context.Context, name, redirectURIs, scopes, website string) (*App, error) {
+	app := &App{
+		ClientID:     randomToken(),
+		ClientSecret: randomToken(),
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		Website:      website,
+	}
+	_, err := db.Exec(ctx,
+		"insert into OAuthApps (clientId, clientSecret, name, redirectUris, scopes, website) values (?, ?, ?, ?, ?, ?)",
+		app.ClientID, app.ClientSecret, app.Name, app.RedirectURIs, app.Scopes, app.Website,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// appMapping maps the columns of the OAuthApps table to the fields of
+// an App.
+var appMapping = db.NewMapping(map[string]func(app *App) interface{}{
+	"clientId":     func(app *App) interface{} { return &app.ClientID },
+	"clientSecret": func(app *App) interface{} { return &app.ClientSecret },
+	"name":         func(app *App) interface{} { return &app.Name },
+	"redirectUris": func(app *App) interface{} { return &app.RedirectURIs },
+	"scopes":       func(app *App) interface{} { return &app.Scopes },
+	"website":      func(app *App) interface{} { return &app.Website },
+})
+
+// AppByClientID retrieves a registered application.
+func AppByClientID(ctx context.Context, clientID string) (*App, error) {
+	return db.One(ctx, appMapping,
+		"select "+appMapping.Columns("OAuthApps", "")+" from OAuthApps where clientId = ?",
+		clientID,
+	)
+}
+
+// CreateAuthorizationCode issues a code that the application can
+// exchange for a token acting as the account.
+func CreateAuthorizationCode(ctx context.Context, app *App, account *Account, redirectURI, scopes string) (string, error) {
+	code := randomToken()
+	_, err := db.Exec(ctx,
+		"insert into OAuthCodes (code, clientId, username, redirectUri, scopes, expiresAt) values (?, ?, ?, ?, ?, ?)",
+		hashToken(code), app.ClientID, account.Username, redirectURI, scopes,
+		time.Now().Add(AuthorizationCodeLifetime).Unix(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemAuthorizationCode exchanges an authorization code for the
+// account and scopes it was issued for. A code can only be redeemed
+// once, by the application it was issued to, with the same redirect
+// URI, and before it expires. Otherwise sql.ErrNoRows is returned.
+func RedeemAuthorizationCode(ctx context.Context, app *App, code, redirectURI string) (*Account, string, error) {
+	var username, scopes string
+	err := db.QueryRow(ctx,
+		"select username, scopes from OAuthCodes "+
+			"where code = ? and clientId = ? and redirectUri = ? and expiresAt > ?",
+		hashToken(code), app.ClientID, redirectURI, time.Now().Unix(),
+	).Scan(&username, &scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = db.Exec(ctx, "delete from OAuthCodes where code = ?", hashToken(code)); err != nil {
+		return nil, "", err
+	}
+	account, err := AccountByUsername(ctx, username)
+	return account, scopes, err
+}
+
+// CreateToken issues an access token allowing the application to act
+// as the account with the given scopes.
+func CreateToken(ctx context.Context, app *App, account *Account, scopes string) (string, error) {
+	token := randomToken()
+	_, err := db.Exec(ctx,
+		"insert into OAuthTokens (token, clientId, username, scopes, createdAt) values (?, ?, ?, ?, ?)",
+		hashToken(token), app.ClientID, account.Username, scopes, time.Now().Unix(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AccountByToken retrieves the account an access token acts as, along
+// with the scopes granted to the token.
+func AccountByToken(ctx context.Context, token string) (*Account, string, error) {
+	var username, scopes string
+	err := db.QueryRow(ctx,
+		"select username, scopes from OAuthTokens where token = ?",
+		hashToken(token),
+	).Scan(&username, &scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	account, err := AccountByUsername(ctx, username)
+	return account, scopes, err
+}
+
+// RevokeTokens invalidates all of the access tokens acting as an
+// account.
+func RevokeTokens(ctx context.Context, account *Account) error {
+	_, err := db.Exec(ctx, "delete from OAuthTokens where username = ?", account.Username)
+	return err
+}
+
+// RevokeToken invalidates an access token issued to an application.
+func RevokeToken(ctx context.Context, app *App, token string) error {
+	res, err := db.Exec(ctx,
+		"delete from OAuthTokens where token = ? and clientId = ?",
+		hashToken(token), app.ClientID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -2,45 +2,431 @@ package models
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/ekiru/kanna/config"
 	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/streaming"
 )
 
-func (post *Post) FromRow(rows *sql.Rows) error {
-	post.Author = &Actor{}
-	actor := post.Author.Scanners()
-	return rows.Scan(
-		db.URLScanner{&post.id},
-		&post.typ,
-		&post.Audience,
-		&post.Content,
-		&post.Published,
-		actor["id"],
-		actor["type"],
-		actor["name"],
-		actor["inbox"],
-		actor["outbox"],
-	)
-}
-
-func PostsByActor(ctx context.Context, actor *Actor) ([]*Post, error) {
-	var posts []*Post
-	rows, err := db.DB(ctx).QueryContext(ctx,
-		"select post.id, post.type, post.audience, post.content, post.published, "+
-			"post.authorId, act.type, act.name, act.inbox, act.outbox "+
-			"from Posts post join Actors act on post.authorId = act.id "+
-			"where act.id = ?",
-		actor.ID().String())
+// HTML returns the content of the post for inclusion in a page.
+// Content is sanitized before it is stored, but it is sanitized again
+// here so that stored content can never bypass the allowlist.
+func (post *Post) HTML() template.HTML {
+	return template.HTML(markup.Sanitize(post.Content))
+}
+
+// A ContentWarning hides a post, or just its attachments, until the
+// reader chooses to see it.
+type ContentWarning struct {
+	// Summary, if non-empty, is shown in place of the post.
+	Summary string
+	// Sensitive marks the post's attachments as unsuitable to be
+	// shown without warning.
+	Sensitive bool
+}
+
+// props returns the summary and sensitive properties of a local post
+// with the content warning. As on Mastodon, a post with a summary is
+// always sensitive.
+func (cw ContentWarning) props() (*string, bool) {
+	summary := strings.TrimSpace(cw.Summary)
+	if summary == "" {
+		return nil, cw.Sensitive
+	}
+	return &summary, true
+}
+
+// ContentWarning returns the content warning of a post.
+func (post *Post) ContentWarning() ContentWarning {
+	cw := ContentWarning{Sensitive: post.Sensitive}
+	if post.Summary != nil {
+		cw.Summary = *post.Summary
+	}
+	return cw
+}
+
+// SourceText returns the source from which the post's content was
+// rendered, or the content itself if the source isn't known.
+func (post *Post) SourceText() string {
+	if post.Source != nil {
+		return post.Source.Content
+	}
+	return post.Content
+}
+
+// loadExternal loads the addressing, tags and attachments of a post.
+func (post *Post) loadExternal(ctx context.Context) error {
+	return loadPostsExternal(ctx, []*Post{post})
+}
+
+// loadPostsExternal loads the addressing, tags and attachments of
+// several posts at once, and fills in the collections of local posts.
+func loadPostsExternal(ctx context.Context, posts []*Post) error {
+	cfg := config.Get(ctx)
+	for _, post := range posts {
+		if cfg.IsLocal(post.ID()) {
+			post.setCollections()
+		}
+	}
+	if err := loadAddressing(ctx, posts); err != nil {
+		return err
+	}
+	if err := loadTags(ctx, posts); err != nil {
+		return err
+	}
+	return loadAttachments(ctx, posts)
+}
+
+// postColumns selects the columns mapped by postMapping from the Posts
+// table, aliased post, joined with the Actors table, aliased act.
+var postColumns = postMapping.Columns("post", "") + ", " + actorMapping.Columns("act", "author") +
+	" from Posts post join Actors act on post.authorId = act.id"
+
+// A Page selects a window of a list of posts ordered from newest to
+// oldest. The cursors are the IDs of posts in the list, in the manner
+// of the Mastodon API's pagination parameters.
+type Page struct {
+	// MaxID, if non-empty, limits the page to posts older than
+	// the post with that ID.
+	MaxID string
+	// SinceID, if non-empty, limits the page to posts newer than
+	// the post with that ID.
+	SinceID string
+	// MinID, if non-empty, limits the page to posts newer than
+	// the post with that ID, and selects the oldest of those posts
+	// rather than the newest.
+	MinID string
+	// Limit is the maximum number of posts in the page.
+	Limit int
+}
+
+// postsPage retrieves a page of the posts matching a condition that
+// the viewer may see.
+func postsPage(ctx context.Context, where string, args []interface{}, viewer *Actor, page Page) ([]*Post, error) {
+	where, args = postsConditions(where, args, viewer)
+	conds, order, pageArgs := page.clauses("Posts", "post")
+	q := fmt.Sprintf("select %s where %s order by post.published %s, post.id %s limit ?",
+		postColumns, strings.Join(append([]string{where}, conds...), " and "), order, order)
+	args = append(append(args, pageArgs...), page.Limit)
+	posts, err := db.All(ctx, postMapping, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if order == "asc" {
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+		}
+	}
+	return posts, loadPostsExternal(ctx, posts)
+}
+
+// postsConditions adds the conditions restricting a query for posts to
+// those that the viewer may see to a condition on the Posts table
+// aliased post.
+func postsConditions(where string, args []interface{}, viewer *Actor) (string, []interface{}) {
+	visible, visibleArgs := visibleTo(viewer)
+	hidden, hiddenArgs := notHidden(viewer, "")
+	return where + " and " + visible + " and " + hidden, append(append(args, visibleArgs...), hiddenArgs...)
+}
+
+// inPosts reports whether a post matches a condition, as used by
+// postsPage, and may be seen by the viewer.
+func inPosts(ctx context.Context, where string, args []interface{}, viewer *Actor, post *Post) (bool, error) {
+	where, args = postsConditions("post.id = ? and "+where, append([]interface{}{post.ID().String()}, args...), viewer)
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Posts post join Actors act on post.authorId = act.id where "+where,
+		args...,
+	).Scan(&count)
+	return count != 0, err
+}
+
+// clauses returns the conditions selecting the rows of the page from
+// a table with id and published columns, the direction in which to
+// order the rows, and the arguments for the conditions. If the order
+// is "asc", the rows must be reversed after they are retrieved.
+func (page Page) clauses(table, alias string) (conds []string, order string, args []interface{}) {
+	key := fmt.Sprintf("(%s.published, %s.id)", alias, alias)
+	cursor := fmt.Sprintf("(select published, id from %s c where id = ?)", table)
+	if page.MaxID != "" {
+		conds = append(conds, key+" < "+cursor)
+		args = append(args, page.MaxID)
+	}
+	if page.SinceID != "" {
+		conds = append(conds, key+" > "+cursor)
+		args = append(args, page.SinceID)
+	}
+	order = "desc"
+	if page.MinID != "" {
+		conds = append(conds, key+" > "+cursor)
+		args = append(args, page.MinID)
+		order = "asc"
+	}
+	return
+}
+
+// CountPostsByActor counts the posts written by an actor.
+func CountPostsByActor(ctx context.Context, actor *Actor) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Posts where authorId = ?",
+		actor.ID().String(),
+	).Scan(&count)
+	return count, err
+}
+
+// CreatePost creates a new Note by an actor, giving it a new ID on
+// this server, addressing it according to its visibility, and marking
+// it as published at the current time. Its content is rendered from
+// the source, linking the mentions of the actors in the mentions map,
+// which is keyed by the handles used in the source, and the mentioned
+// actors are added to its addressing. If parent is non-nil, the post
+// is a reply to it and is also addressed to its author. The
+// attachments, which must have been uploaded by the author and not yet
+// attached to another post, are attached to the post in order. The
+// post is hidden behind the content warning, if any. A Create activity
+// for the post is added to the actor's outbox and returned, so that it
+// can be delivered. The post is stored along with everything else, or
+// not at all.
+func CreatePost(ctx context.Context, author *Actor, source Source, cw ContentWarning, visibility Visibility, mentions map[string]*Actor, parent *Post, attachments []*Attachment) (*Post, *Activity, error) {
+	post := &Post{
+		id:         newLocalID(ctx, "post"),
+		typ:        "Note",
+		Author:     author,
+		Content:    markup.Render(source.MediaType, source.Content, renderLinks(ctx, mentions)),
+		Source:     &source,
+		Published:  now(),
+		Tag:        postTags(ctx, source, mentions),
+		Attachment: attachments,
+	}
+	post.Summary, post.Sensitive = cw.props()
+	post.Context = post.id
+	mentioned := post.mentioned()
+	if parent != nil {
+		post.InReplyTo = parent.ID()
+		post.Context = parent.ID()
+		if parent.Context != nil {
+			post.Context = parent.Context
+		}
+		if !containsURL(mentioned, parent.Author.ID()) && parent.Author.ID().String() != author.ID().String() {
+			mentioned = append(mentioned, parent.Author.ID())
+		}
+	}
+	post.setCollections()
+	post.To, post.Cc = visibility.addressing(author, mentioned)
+	var activity *Activity
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.Exec(ctx,
+			"insert into Posts (id, type, authorId, content, plainText, summary, sensitive, source, published, inReplyTo, context) "+
+				"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			post.id.String(), post.typ, author.ID().String(), post.Content, markup.Text(post.Content), post.Summary, post.Sensitive,
+			post.Source, post.Published, urlString(post.InReplyTo), urlString(post.Context),
+		)
+		if err != nil {
+			return err
+		}
+		if err = post.saveAddressing(ctx); err != nil {
+			return err
+		}
+		if err = post.saveTags(ctx); err != nil {
+			return err
+		}
+		if err = post.attach(ctx); err != nil {
+			return err
+		}
+		if activity, err = recordActivity(ctx, "Create", author, post); err != nil {
+			return err
+		}
+		return NotifyMentions(ctx, post)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	streaming.Publish(ctx, streaming.Event{Type: streaming.Update, Object: &TimelineEntry{Post: post, Published: post.Published}})
+	return post, activity, nil
+}
+
+// UpdatePost replaces the source and content warning of a post,
+// re-rendering its content and tags as in CreatePost, and marks it as
+// updated at the current time. The addressing of the post is
+// unchanged. An Update activity for the post is added to the author's
+// outbox and returned.
+func UpdatePost(ctx context.Context, post *Post, source Source, cw ContentWarning, mentions map[string]*Actor) (*Activity, error) {
+	updated := now()
+	content := markup.Render(source.MediaType, source.Content, renderLinks(ctx, mentions))
+	summary, sensitive := cw.props()
+	var activity *Activity
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		_, err := db.Exec(ctx,
+			"update Posts set content = ?, plainText = ?, summary = ?, sensitive = ?, source = ?, updated = ? where id = ?",
+			content, markup.Text(content), summary, sensitive, &source, updated, post.ID().String(),
+		)
+		if err != nil {
+			return err
+		}
+		post.Content, post.Source, post.Updated = content, &source, &updated
+		post.Summary, post.Sensitive = summary, sensitive
+		post.Tag = postTags(ctx, source, mentions)
+		if err = post.saveTags(ctx); err != nil {
+			return err
+		}
+		activity, err = recordActivity(ctx, "Update", post.Author, post)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var post Post
-		if err = post.FromRow(rows); err != nil {
-			return posts, err
+	streaming.Publish(ctx, streaming.Event{Type: streaming.StatusUpdate, Object: &TimelineEntry{Post: post, Published: post.Published}})
+	return activity, nil
+}
+
+// NewPost creates a Post with an ID and type, such as one received
+// from another server. The post isn't stored until SavePost is called.
+func NewPost(id *url.URL, typ string) *Post {
+	return &Post{id: id, typ: typ}
+}
+
+// SavePost stores a post received from another server, along with its
+// addressing, tags and attachments, replacing any copy of it that was
+// stored before. The post's author must already be stored. The
+// attachments that the stored copy had and the post no longer has are
+// returned, so that their cached files can be deleted.
+func SavePost(ctx context.Context, post *Post) ([]*Attachment, error) {
+	id := post.ID().String()
+	var removed []*Attachment
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		conn, err := db.DB(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx,
+			"insert into Posts (id, type, authorId, content, plainText, summary, sensitive, source, published, updated, inReplyTo, context) "+
+				"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"+conn.Dialect.Upsert([]string{"id"},
+				"type", "authorId", "content", "plainText", "summary", "sensitive", "source", "published", "updated", "inReplyTo", "context"),
+			id, post.typ, post.Author.ID().String(), post.Content, markup.Text(post.Content), post.Summary, post.Sensitive, post.Source,
+			post.Published, post.Updated, urlString(post.InReplyTo), urlString(post.Context),
+		)
+		if err != nil {
+			return err
+		}
+		if err = deleteAddressing(ctx, id); err != nil {
+			return err
+		}
+		if err = post.saveAddressing(ctx); err != nil {
+			return err
+		}
+		if err = post.saveTags(ctx); err != nil {
+			return err
+		}
+		removed, err = post.saveRemoteAttachments(ctx)
+		return err
+	})
+	return removed, err
+}
+
+// DeletePost deletes a post along with any likes and boosts of it and
+// the notifications about it, leaving a Tombstone in its place. If the
+// author is on this server, a Delete activity for the post is added to
+// their outbox and returned, addressed to the post's audience;
+// otherwise the returned activity is nil. The files of the post's
+// attachments are left for the caller to delete from the media
+// storage.
+func DeletePost(ctx context.Context, post *Post) (*Activity, error) {
+	var activity *Activity
+	err := db.WithTx(ctx, func(ctx context.Context) error {
+		id := post.ID().String()
+		if _, err := db.Exec(ctx, "delete from Reactions where objectId = ?", id); err != nil {
+			return err
 		}
-		posts = append(posts, &post)
+		if _, err := db.Exec(ctx, "delete from Notifications where objectId = ?", id); err != nil {
+			return err
+		}
+		if _, err := db.Exec(ctx, "delete from Posts where id = ?", id); err != nil {
+			return err
+		}
+		if err := deleteAddressing(ctx, id); err != nil {
+			return err
+		}
+		if err := deleteTags(ctx, id); err != nil {
+			return err
+		}
+		if err := deleteAttachments(ctx, id); err != nil {
+			return err
+		}
+		tombstone, err := createTombstone(ctx, post)
+		if err != nil {
+			return err
+		}
+		if config.Get(ctx).IsLocal(post.Author.ID()) {
+			if activity, err = recordActivity(ctx, "Delete", post.Author, tombstone); err != nil {
+				return err
+			}
+		}
+		publishDelete(ctx, &TimelineEntry{Post: post, Published: post.Published})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// setCollections fills in the IDs of the collections of replies, likes
+// and shares of a post on this server.
+func (post *Post) setCollections() {
+	collection := func(name string) *url.URL {
+		u := *post.ID()
+		u.Path += "/" + name
+		return &u
+	}
+	post.Replies = collection("replies")
+	post.Likes = collection("likes")
+	post.Shares = collection("shares")
+}
+
+// newLocalID generates a new ID for an object on this server, in the
+// form BaseURL/kind/key for a random key.
+func newLocalID(ctx context.Context, kind string) *url.URL {
+	key := make([]byte, 12)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
 	}
-	return posts, rows.Err()
+	return config.Get(ctx).URL(kind, hex.EncodeToString(key))
+}
+
+// TimeFormat is the format of the published and updated properties
+// of objects stored on this server. Its fixed width allows the
+// database to order objects by comparing the formatted times.
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// now formats the current time in the format used for the published
+// and updated properties of objects.
+func now() string {
+	return time.Now().UTC().Format(TimeFormat)
+}
+
+// CountPostsByAccounts counts the posts written by the actors of
+// accounts on this server.
+func CountPostsByAccounts(ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Posts where authorId in (select actorId from Accounts)",
+	).Scan(&count)
+	return count, err
+}
+
+// CountPosts counts all of the posts stored on this server, including
+// those from other servers.
+func CountPosts(ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRow(ctx, "select count(*) from Posts").Scan(&count)
+	return count, err
 }
@@ -3,7 +3,6 @@ package models
 import (
 	
 	"context"
-	"database/sql"
 	
 	"net/url"
 	
@@ -14,10 +13,24 @@ import (
 type Post struct {
 	id *url.URL
 	typ string
-	Audience string
+	Attachment []*Attachment
 	Author *Actor
+	Bcc []*url.URL
+	Bto []*url.URL
+	Cc []*url.URL
 	Content string
+	Context *url.URL
+	InReplyTo *url.URL
+	Likes *url.URL
 	Published string
+	Replies *url.URL
+	Sensitive bool
+	Shares *url.URL
+	Source *Source
+	Summary *string
+	Tag []*Tag
+	To []*url.URL
+	Updated *string
 }
 
 func (model *Post) ID() *url.URL {
@@ -33,7 +46,7 @@ func (model *Post) HasType(t string) bool {
 }
 
 func (model *Post) Props() []string {
-	return []string{ "id", "type", "audience","author","content","published", }
+	return []string{ "id", "type", "attachment","attributedTo","bcc","bto","cc","content","context","inReplyTo","likes","published","replies","sensitive","shares","source","summary","tag","to","updated", }
 }
 
 func (model *Post) GetProp(prop string) (interface{}, bool) {
@@ -42,46 +55,74 @@ func (model *Post) GetProp(prop string) (interface{}, bool) {
 		return model.id, true
 	case "type":
 		return model.typ, true
-	case "audience":
-		return model.Audience, true
-	case "author":
+	case "attachment":
+		return model.Attachment, true
+	case "attributedTo":
 		return model.Author, true
+	case "bcc":
+		return model.Bcc, true
+	case "bto":
+		return model.Bto, true
+	case "cc":
+		return model.Cc, true
 	case "content":
 		return model.Content, true
+	case "context":
+		return model.Context, true
+	case "inReplyTo":
+		return model.InReplyTo, true
+	case "likes":
+		return model.Likes, true
 	case "published":
 		return model.Published, true
+	case "replies":
+		return model.Replies, true
+	case "sensitive":
+		return model.Sensitive, true
+	case "shares":
+		return model.Shares, true
+	case "source":
+		return model.Source, true
+	case "summary":
+		return model.Summary, true
+	case "tag":
+		return model.Tag, true
+	case "to":
+		return model.To, true
+	case "updated":
+		return model.Updated, true
 	default:
 		return nil, false
 	}
 }
 
+var postMapping = db.Nest(db.NewMapping(map[string]func(model *Post) interface{}{
+	"id": func(model *Post) interface{} { return db.URLScanner{ &model.id } },
+	"type": func(model *Post) interface{} { return &model.typ },
+	"content": func(model *Post) interface{} { return &model.Content },
+	"context": func(model *Post) interface{} { return db.URLScanner{ &model.Context } },
+	"inReplyTo": func(model *Post) interface{} { return db.URLScanner{ &model.InReplyTo } },
+	"published": func(model *Post) interface{} { return &model.Published },
+	"sensitive": func(model *Post) interface{} { return &model.Sensitive },
+	"source": func(model *Post) interface{} { return &model.Source },
+	"summary": func(model *Post) interface{} { return &model.Summary },
+	"updated": func(model *Post) interface{} { return &model.Updated },
+}), "author", func(model *Post) *Actor {
+	if model.Author == nil {
+		model.Author = new(Actor)
+	}
+	return model.Author
+}, actorMapping)
+
 func PostById(ctx context.Context, id string) (*Post, error) {
-	var model Post
-	rows, err := db.DB(ctx).QueryContext(ctx, "select Posts.id, Posts.type, Posts.audience, Posts.authorId, Posts.content, Posts.published, Actors.type, Actors.inbox, Actors.name, Actors.outbox from Posts join Actors on Posts.authorId = Actors.id where Posts.id = ?", id)
+	model, err := db.One(ctx, postMapping, "select " + postMapping.Columns("Posts", "") + ", " + actorMapping.Columns("Actors", "author") + " from Posts join Actors on Posts.authorId = Actors.id where Posts.id = ?", id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, sql.ErrNoRows
-	}
-	model.Author = new(Actor)
 
-	err = rows.Scan(
-		db.URLScanner{ &model.id },
-		&model.typ,
-		&model.Audience,
-		db.URLScanner{ &model.Author.id },
-		&model.Content,
-		&model.Published,
-		&model.Author.typ,
-		db.URLScanner{ &model.Author.Inbox },
-		&model.Author.Name,
-		db.URLScanner{ &model.Author.Outbox },
-	)
-	if err != nil {
+	if err = model.loadExternal(ctx); err != nil {
 		return nil, err
 	}
 
-	return &model, nil
+	return model, nil
 }
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/streaming"
+)
+
+// The types of reactions that actors can have to posts.
+const (
+	LikeType     = "Like"
+	AnnounceType = "Announce"
+)
+
+// ErrCannotAnnounce is returned when boosting a post that isn't
+// public or unlisted.
+var ErrCannotAnnounce = errors.New("only public and unlisted posts can be boosted")
+
+// Like records that an actor likes a post and adds a Like activity to
+// the actor's outbox. Liking a post that the actor already likes does
+// nothing, and the returned activity is nil.
+func Like(ctx context.Context, actor *Actor, post *Post) (*Activity, error) {
+	return react(ctx, LikeType, actor, post)
+}
+
+// Unlike removes an actor's like of a post and adds an Undo activity
+// for it to the actor's outbox. If the actor doesn't like the post,
+// nothing is done and the returned activity is nil.
+func Unlike(ctx context.Context, actor *Actor, post *Post) (*Activity, error) {
+	return unreact(ctx, LikeType, actor, post)
+}
+
+// Announce records that an actor has boosted a post and adds an
+// Announce activity to the actor's outbox, as Like does for likes.
+func Announce(ctx context.Context, actor *Actor, post *Post) (*Activity, error) {
+	if v := post.Visibility(); v != VisibilityPublic && v != VisibilityUnlisted {
+		return nil, ErrCannotAnnounce
+	}
+	return react(ctx, AnnounceType, actor, post)
+}
+
+// Unannounce removes an actor's boost of a post, as Unlike does for
+// likes.
+func Unannounce(ctx context.Context, actor *Actor, post *Post) (*Activity, error) {
+	return unreact(ctx, AnnounceType, actor, post)
+}
+
+func react(ctx context.Context, typ string, actor *Actor, post *Post) (*Activity, error) {
+	activity := newActivity(ctx, typ, actor, post)
+	// The reaction is stored first so that only one of several
+	// identical reactions results in an activity.
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.ExecContext(ctx,
+		"insert into Reactions (id, type, actorId, objectId, published) values (?, ?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+		activity.id.String(), typ, actor.ID().String(), post.ID().String(), activity.Published,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	if err = saveActivity(ctx, activity); err != nil {
+		return nil, err
+	}
+	if err = notifyReaction(ctx, activity.id, typ, actor, post.ID()); err != nil {
+		return nil, err
+	}
+	if typ == AnnounceType {
+		PublishBoost(ctx, activity.id, actor, post, activity.Published)
+	}
+	return activity, nil
+}
+
+func unreact(ctx context.Context, typ string, actor *Actor, post *Post) (*Activity, error) {
+	undone := &Activity{typ: typ, Actor: actor, ObjectID: post.ID(), Object: post}
+	err := db.QueryRow(ctx,
+		"select id, published from Reactions where actorId = ? and objectId = ? and type = ?",
+		actor.ID().String(), post.ID().String(), typ,
+	).Scan(db.URLScanner{&undone.id}, &undone.Published)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = DeleteReaction(ctx, undone.id, actor); err != nil {
+		return nil, err
+	}
+	return recordActivity(ctx, "Undo", actor, undone)
+}
+
+// PublishBoost tells the clients streaming timelines about a boost of a
+// post.
+func PublishBoost(ctx context.Context, id *url.URL, booster *Actor, post *Post, published string) {
+	streaming.Publish(ctx, streaming.Event{Type: streaming.Update, Object: &TimelineEntry{
+		Post:      post,
+		BoostedBy: booster,
+		BoostID:   id,
+		Published: published,
+	}})
+}
+
+// SaveReaction stores a Like or Announce of an object received from
+// another server. Storing a reaction that is already stored, or a
+// second reaction of the same type by the same actor to the same
+// object, does nothing.
+func SaveReaction(ctx context.Context, id *url.URL, typ string, actor *Actor, objectId *url.URL, published string) error {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"insert into Reactions (id, type, actorId, objectId, published) values (?, ?, ?, ?, ?)"+conn.Dialect.Upsert(nil),
+		id.String(), typ, actor.ID().String(), objectId.String(), published,
+	)
+	if err != nil {
+		return err
+	}
+	return notifyReaction(ctx, id, typ, actor, objectId)
+}
+
+// DeleteReaction deletes the reaction with an ID, if it was made by
+// the actor. Deleting a boost tells the clients streaming timelines
+// that it was deleted.
+func DeleteReaction(ctx context.Context, id *url.URL, actor *Actor) error {
+	var typ, published string
+	var objectId *url.URL
+	err := db.QueryRow(ctx,
+		"select type, objectId, published from Reactions where id = ? and actorId = ?",
+		id.String(), actor.ID().String(),
+	).Scan(&typ, db.URLScanner{&objectId}, &published)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec(ctx,
+		"delete from Reactions where id = ? and actorId = ?",
+		id.String(), actor.ID().String(),
+	)
+	if err != nil {
+		return err
+	}
+	if err = deleteNotifications(ctx, id.String(), actor); err != nil || typ != AnnounceType {
+		return err
+	}
+	post, err := PostById(ctx, objectId.String())
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	publishDelete(ctx, &TimelineEntry{Post: post, BoostedBy: actor, BoostID: id, Published: published})
+	return nil
+}
+
+// HasLiked reports whether an actor likes a post.
+func HasLiked(ctx context.Context, actor *Actor, post *Post) (bool, error) {
+	return hasReacted(ctx, LikeType, actor, post)
+}
+
+// HasAnnounced reports whether an actor has boosted a post.
+func HasAnnounced(ctx context.Context, actor *Actor, post *Post) (bool, error) {
+	return hasReacted(ctx, AnnounceType, actor, post)
+}
+
+func hasReacted(ctx context.Context, typ string, actor *Actor, post *Post) (bool, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Reactions where actorId = ? and objectId = ? and type = ?",
+		actor.ID().String(), post.ID().String(), typ,
+	).Scan(&count)
+	return count != 0, err
+}
+
+// CountLikes counts the likes of a post.
+func CountLikes(ctx context.Context, post *Post) (int, error) {
+	return countReactions(ctx, LikeType, post)
+}
+
+// CountAnnounces counts the boosts of a post.
+func CountAnnounces(ctx context.Context, post *Post) (int, error) {
+	return countReactions(ctx, AnnounceType, post)
+}
+
+func countReactions(ctx context.Context, typ string, post *Post) (int, error) {
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Reactions where objectId = ? and type = ?",
+		post.ID().String(), typ,
+	).Scan(&count)
+	return count, err
+}
+
+// LikedPosts retrieves a page of the posts an actor likes and may
+// still see.
+func LikedPosts(ctx context.Context, actor *Actor, page Page) ([]*Post, error) {
+	return postsPage(ctx,
+		"post.id in (select objectId from Reactions where actorId = ? and type = 'Like')",
+		[]interface{}{actor.ID().String()}, actor, page)
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+)
+
+// FlagType is the type of the activities by which actors report other
+// actors to the moderators of their servers.
+const FlagType = "Flag"
+
+// MaxReportComment is the greatest number of characters in the comment
+// of a report made on this server.
+const MaxReportComment = 1000
+
+// A Report asks the moderators of this server to look at an actor and
+// some of their posts. Reports are made by the users of this server or
+// received from other servers as Flag activities.
+type Report struct {
+	ID int64
+	// ActivityID is the ID of the Flag activity of the report.
+	ActivityID *url.URL
+	// Reporter is the actor who made the report. Reports received
+	// from Mastodon are made by the actor of the server rather than
+	// by one of its users.
+	Reporter *Actor
+	// Target is the actor who was reported.
+	Target *Actor
+	// Posts are the reported posts that haven't been deleted.
+	Posts   []*Post
+	Comment string
+	// Forwarded is true if the report was sent to the server of a
+	// Target on another server.
+	Forwarded bool
+	// Resolved is true once a moderator has dealt with the report.
+	Resolved bool
+	// Created is when the report was made.
+	Created string
+}
+
+// Flag returns the Flag activity of a report made on this server, to
+// deliver to the server of its target. This server has no actor of its
+// own, so the Flag is sent as the reporter.
+func (report *Report) Flag() *Activity {
+	activity := &Activity{
+		id:        report.ActivityID,
+		typ:       FlagType,
+		Actor:     report.Reporter,
+		ObjectID:  report.Target.ID(),
+		Published: report.Created,
+		Recipient: report.Target.ID(),
+		Content:   report.Comment,
+	}
+	for _, post := range report.Posts {
+		activity.Flagged = append(activity.Flagged, post.ID())
+	}
+	return activity
+}
+
+// CreateReport records a report by an actor on this server of another
+// actor and some of their posts. If forward is true and the target is
+// on another server, the report is marked as forwarded, and the caller
+// should deliver its Flag.
+func CreateReport(ctx context.Context, reporter, target *Actor, posts []*Post, comment string, forward bool) (*Report, error) {
+	report := &Report{
+		ActivityID: newLocalID(ctx, "activity"),
+		Reporter:   reporter,
+		Target:     target,
+		Posts:      posts,
+		Comment:    comment,
+		Forwarded:  forward && !config.Get(ctx).IsLocal(target.ID()),
+		Created:    now(),
+	}
+	if err := saveReport(ctx, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// SaveReport stores a report received from another server as a Flag
+// activity. A Flag that was already received is ignored.
+func SaveReport(ctx context.Context, id *url.URL, reporter, target *Actor, posts []*Post, comment string) error {
+	if _, err := ReportByActivityId(ctx, id.String()); err != sql.ErrNoRows {
+		return err
+	}
+	return saveReport(ctx, &Report{
+		ActivityID: id,
+		Reporter:   reporter,
+		Target:     target,
+		Posts:      posts,
+		Comment:    comment,
+		Created:    now(),
+	})
+}
+
+func saveReport(ctx context.Context, report *Report) error {
+	// The report's posts are stored along with it, or not at all.
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		conn, err := db.DB(ctx)
+		if err != nil {
+			return err
+		}
+		err = conn.QueryRowContext(ctx,
+			"insert into Reports (activityId, reporterId, targetId, comment, forwarded, created) values (?, ?, ?, ?, ?, ?) "+
+				"returning id",
+			report.ActivityID.String(), report.Reporter.ID().String(), report.Target.ID().String(),
+			report.Comment, report.Forwarded, report.Created,
+		).Scan(&report.ID)
+		if err != nil {
+			return err
+		}
+		for _, post := range report.Posts {
+			_, err = conn.ExecContext(ctx,
+				"insert into ReportPosts (reportId, postId) values (?, ?)"+conn.Dialect.Upsert(nil),
+				report.ID, post.ID().String(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reportMapping maps the columns of the Reports table, and those of
+// the reporter and target prefixed with their names, to the fields of
+// a Report.
+var reportMapping = db.Nest(db.Nest(db.NewMapping(map[string]func(report *Report) interface{}{
+	"id":         func(report *Report) interface{} { return &report.ID },
+	"activityId": func(report *Report) interface{} { return db.URLScanner{&report.ActivityID} },
+	"comment":    func(report *Report) interface{} { return &report.Comment },
+	"forwarded":  func(report *Report) interface{} { return &report.Forwarded },
+	"resolved":   func(report *Report) interface{} { return &report.Resolved },
+	"created":    func(report *Report) interface{} { return &report.Created },
+}), "reporter", func(report *Report) *Actor {
+	if report.Reporter == nil {
+		report.Reporter = new(Actor)
+	}
+	return report.Reporter
+}, actorMapping), "target", func(report *Report) *Actor {
+	if report.Target == nil {
+		report.Target = new(Actor)
+	}
+	return report.Target
+}, actorMapping)
+
+var reportColumns = reportMapping.Columns("report", "") + ", " +
+	actorMapping.Columns("reporter", "reporter") + ", " + actorMapping.Columns("target", "target") +
+	" from Reports report join Actors reporter on report.reporterId = reporter.id " +
+	"join Actors target on report.targetId = target.id"
+
+// loadPosts fills in the Posts of a report, leaving out those that
+// have been deleted.
+func (report *Report) loadPosts(ctx context.Context) error {
+	rows, err := db.Query(ctx, "select postId from ReportPosts where reportId = ?", report.ID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	report.Posts = nil
+	for _, id := range ids {
+		post, err := PostById(ctx, id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		report.Posts = append(report.Posts, post)
+	}
+	return nil
+}
+
+// ReportById retrieves a report along with the posts it reports.
+func ReportById(ctx context.Context, id int64) (*Report, error) {
+	return reportWhere(ctx, "report.id = ?", id)
+}
+
+// ReportByActivityId retrieves the report made by a Flag activity.
+func ReportByActivityId(ctx context.Context, id string) (*Report, error) {
+	return reportWhere(ctx, "report.activityId = ?", id)
+}
+
+func reportWhere(ctx context.Context, where string, arg interface{}) (*Report, error) {
+	report, err := db.One(ctx, reportMapping, "select "+reportColumns+" where "+where, arg)
+	if err != nil {
+		return nil, err
+	}
+	if err = report.loadPosts(ctx); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Reports retrieves the reports that are resolved or, if resolved is
+// false, those that are waiting for a moderator, with the most recent
+// first.
+func Reports(ctx context.Context, resolved bool) ([]*Report, error) {
+	reports, err := db.All(ctx, reportMapping,
+		"select "+reportColumns+" where report.resolved = ? order by report.id desc", resolved)
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		if err = report.loadPosts(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// ResolveReport marks a report as dealt with.
+func ResolveReport(ctx context.Context, report *Report) error {
+	_, err := db.Exec(ctx, "update Reports set resolved = true where id = ?", report.ID)
+	if err == nil {
+		report.Resolved = true
+	}
+	return err
+}
+
+// CountOpenReports counts the reports that are waiting for a
+// moderator.
+func CountOpenReports(ctx context.Context) (int, error) {
+	var count int
+	err := db.QueryRow(ctx, "select count(*) from Reports where not resolved").Scan(&count)
+	return count, err
+}
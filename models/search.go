@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+)
+
+// A SearchQuery is a parsed query for searching posts and actors.
+type SearchQuery struct {
+	// Terms are the words and phrases that results must contain.
+	Terms []SearchTerm
+	// From is the handle of the actor whose posts are searched, in
+	// the form user@host or just user for an account on this
+	// server. It is empty to search everyone's posts.
+	From string
+	// HasMedia restricts the results to posts with attachments.
+	HasMedia bool
+}
+
+// A SearchTerm is a word or phrase in a search query.
+type SearchTerm struct {
+	Text string
+	// Prefix is true if the term matches words that begin with
+	// its last word, rather than only that word.
+	Prefix bool
+}
+
+// ParseSearchQuery parses a search query. Words in the query are
+// searched for separately, while text in double quotes is searched for
+// as a phrase. A word or phrase followed by * matches any word
+// beginning with the last word. The operators from:user@host and
+// has:media restrict the results to an actor's posts and to posts with
+// attachments.
+func ParseSearchQuery(s string) SearchQuery {
+	var q SearchQuery
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var word string
+		phrase := s[0] == '"'
+		if phrase {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				word, s = s[1:], ""
+			} else {
+				word, s = s[1:end+1], s[end+2:]
+			}
+			if strings.HasPrefix(s, "*") {
+				word, s = word+"*", s[1:]
+			}
+		} else if end := strings.IndexAny(s, " \t\r\n"); end < 0 {
+			word, s = s, ""
+		} else {
+			word, s = s[:end], s[end:]
+		}
+		switch {
+		case !phrase && strings.HasPrefix(word, "from:") && len(word) > len("from:"):
+			q.From = strings.TrimPrefix(word[len("from:"):], "@")
+		case !phrase && word == "has:media":
+			q.HasMedia = true
+		default:
+			term := SearchTerm{Text: strings.TrimSuffix(word, "*"), Prefix: strings.HasSuffix(word, "*")}
+			if strings.TrimSpace(term.Text) != "" {
+				q.Terms = append(q.Terms, term)
+			}
+		}
+	}
+	return q
+}
+
+// IsEmpty returns whether a query has nothing to search for.
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Terms) == 0 && q.From == "" && !q.HasMedia
+}
+
+// match returns the full-text query matching the terms of a search
+// query, or "" if it has none. Each term is quoted so that characters
+// with special meanings in full-text queries are searched for as text.
+func (q SearchQuery) match() string {
+	terms := make([]string, len(q.Terms))
+	for i, term := range q.Terms {
+		terms[i] = `"` + strings.Replace(term.Text, `"`, `""`, -1) + `"`
+		if term.Prefix {
+			terms[i] += "*"
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// tsquery returns the PostgreSQL text search query matching the terms
+// of a search query, or "" if it has none. The words of each term are
+// quoted and must follow each other, and the last of them is a prefix
+// if the term is.
+func (q SearchQuery) tsquery() string {
+	quote := strings.NewReplacer(`\`, `\\`, "'", "''")
+	var terms []string
+	for _, term := range q.Terms {
+		words := strings.Fields(term.Text)
+		if len(words) == 0 {
+			continue
+		}
+		for i, word := range words {
+			words[i] = "'" + quote.Replace(word) + "'"
+		}
+		if term.Prefix {
+			words[len(words)-1] += ":*"
+		}
+		terms = append(terms, "("+strings.Join(words, " <-> ")+")")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// matchCondition returns a condition selecting the entries of the
+// SearchIndex table that match the terms of a search query in a
+// dialect, along with its argument, or "" if the query has none.
+func (q SearchQuery) matchCondition(d db.Dialect) (string, string) {
+	if d == db.PostgreSQL {
+		if query := q.tsquery(); query != "" {
+			return "document @@ to_tsquery('simple', ?)", query
+		}
+		return "", ""
+	}
+	if match := q.match(); match != "" {
+		return "SearchIndex match ?", match
+	}
+	return "", ""
+}
+
+// SearchPosts retrieves a page of the posts matching a search query
+// that the viewer may see, newest first. The viewer is nil for clients
+// that aren't logged-in.
+func SearchPosts(ctx context.Context, q SearchQuery, viewer *Actor, page Page) ([]*Post, error) {
+	if q.IsEmpty() {
+		return nil, nil
+	}
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var conds []string
+	var args []interface{}
+	if match, arg := q.matchCondition(conn.Dialect); match != "" {
+		conds = append(conds, "post.id in (select objectId from SearchIndex where "+match+" and kind = 'Post')")
+		args = append(args, arg)
+	}
+	if q.From != "" {
+		user, host := q.From, ""
+		if i := strings.IndexByte(q.From, '@'); i >= 0 {
+			user, host = q.From[:i], q.From[i+1:]
+		}
+		if host == "" || host == config.Get(ctx).Host() {
+			conds = append(conds, "post.authorId = (select actorId from Accounts where username = ?)")
+			args = append(args, user)
+		} else {
+			conds = append(conds, "act.name = ? and (act.id like ? or act.id like ?)")
+			args = append(args, user, "https://"+host+"/%", "http://"+host+"/%")
+		}
+	}
+	if q.HasMedia {
+		conds = append(conds, "exists (select 1 from Attachments m where m.postId = post.id)")
+	}
+	return postsPage(ctx, strings.Join(conds, " and "), args, viewer, page)
+}
+
+// SearchActors retrieves the actors matching the terms of a search
+// query, best matches first. Queries that are restricted to an actor's
+// posts or to posts with attachments match no actors.
+func SearchActors(ctx context.Context, q SearchQuery, limit int) ([]*Actor, error) {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := conn.Dialect
+	match, arg := q.matchCondition(d)
+	if match == "" || q.From != "" || q.HasMedia {
+		return nil, nil
+	}
+	// FTS5 ranks the best matches lowest, while PostgreSQL has to
+	// be asked to rank them.
+	order, args := "s.rank", []interface{}{arg}
+	if d == db.PostgreSQL {
+		order, args = "ts_rank(s.document, to_tsquery('simple', ?)) desc", append(args, arg)
+	}
+	return db.All(ctx, actorMapping,
+		"select "+actorMapping.Columns("act", "")+
+			" from SearchIndex s join Actors act on act.id = s.objectId "+
+			"where "+match+" and s.kind = 'Actor' order by "+order+" limit ?",
+		append(args, limit)...,
+	)
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// SeededObject retrieves the ID of the object that was created for a
+// named seed, returning sql.ErrNoRows if the seed hasn't been loaded.
+func SeededObject(ctx context.Context, name string) (*url.URL, error) {
+	var id *url.URL
+	err := db.QueryRow(ctx,
+		"select objectId from Seeds where name = ?", name,
+	).Scan(db.URLScanner{&id})
+	return id, err
+}
+
+// RecordSeed records that an object was created for a named seed, so
+// that it isn't created again.
+func RecordSeed(ctx context.Context, name string, id *url.URL) error {
+	_, err := db.Exec(ctx,
+		"insert into Seeds (name, objectId, loaded) values (?, ?, ?)",
+		name, id.String(), now(),
+	)
+	return err
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// A Source is the source from which the HTML content of a post was
+// rendered, along with the media type of the source, such as
+// text/markdown. Sources are stored as JSON.
+type Source struct {
+	Content   string
+	MediaType string
+}
+
+// MarshalJSON serializes a Source as in the ActivityPub source
+// property.
+func (source *Source) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"content":   source.Content,
+		"mediaType": source.MediaType,
+	})
+}
+
+// Scan implements the sql.Scanner interface.
+func (source *Source) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), source)
+	case []byte:
+		return json.Unmarshal(src, source)
+	default:
+		return errors.New("Source must be scanned from a string")
+	}
+}
+
+// Value implements the driver.Valuer interface.
+func (source *Source) Value() (driver.Value, error) {
+	if source == nil {
+		return nil, nil
+	}
+	buf, err := source.MarshalJSON()
+	return string(buf), err
+}
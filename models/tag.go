@@ -0,0 +1,229 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/markup"
+)
+
+// The types of Tags that Kanna understands.
+const (
+	MentionType = "Mention"
+	HashtagType = "Hashtag"
+)
+
+// A Tag is an entry in the tag property of a post, linking it to an
+// actor it mentions or to a hashtag.
+type Tag struct {
+	// Type is MentionType or HashtagType.
+	Type string
+	// Href is the ID of the mentioned actor, or the URL of the page
+	// for the hashtag.
+	Href *url.URL
+	// Name is the mention or hashtag as it appears in the post,
+	// such as @user@example.com or #kanna.
+	Name string
+}
+
+// MarshalJSON serializes a Tag as an Activity Streams Link.
+func (tag *Tag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"type": tag.Type,
+		"href": tag.Href.String(),
+		"name": tag.Name,
+	})
+}
+
+// HashtagURL returns the URL of the page on this server for a hashtag.
+// Hashtags are case-insensitive, so the name is lowercased.
+func HashtagURL(ctx context.Context, name string) *url.URL {
+	return config.Get(ctx).URL("tags", strings.ToLower(name))
+}
+
+// postTags builds the tags of a local post from its source. The
+// mentions map the handles used in the source to the actors they
+// refer to.
+func postTags(ctx context.Context, source Source, mentions map[string]*Actor) []*Tag {
+	var tags []*Tag
+	seen := make(map[string]bool)
+	handles, hashtags := markup.Tags(source.MediaType, source.Content)
+	for _, handle := range handles {
+		actor := mentions[handle]
+		if actor == nil || seen[actor.ID().String()] {
+			continue
+		}
+		seen[actor.ID().String()] = true
+		tags = append(tags, &Tag{MentionType, actor.ID(), "@" + actor.Handle()})
+	}
+	for _, name := range hashtags {
+		tags = append(tags, &Tag{HashtagType, HashtagURL(ctx, name), "#" + name})
+	}
+	return tags
+}
+
+// renderLinks returns the markup.Links for rendering a local post that
+// mentions the actors with the supplied handles.
+func renderLinks(ctx context.Context, mentions map[string]*Actor) *markup.Links {
+	return &markup.Links{
+		Mention: func(handle string) (string, bool) {
+			if actor := mentions[handle]; actor != nil {
+				return actor.ID().String(), true
+			}
+			return "", false
+		},
+		Hashtag: func(name string) string {
+			return HashtagURL(ctx, name).String()
+		},
+	}
+}
+
+// mentioned returns the IDs of the actors mentioned by a post.
+func (post *Post) mentioned() []*url.URL {
+	var ids []*url.URL
+	for _, tag := range post.Tag {
+		if tag.Type == MentionType {
+			ids = append(ids, tag.Href)
+		}
+	}
+	return ids
+}
+
+// loadTags loads the tags of several posts at once.
+func loadTags(ctx context.Context, posts []*Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Post, len(posts))
+	args := make([]interface{}, 0, len(posts))
+	for _, post := range posts {
+		id := post.ID().String()
+		byID[id] = post
+		args = append(args, id)
+	}
+	tags, err := db.All(ctx, tagMapping,
+		"select "+tagMapping.Columns("Tags", "")+" from Tags where objectId in (?"+
+			strings.Repeat(", ?", len(args)-1)+") order by rowid",
+		args...)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		post := byID[tag.objectId]
+		post.Tag = append(post.Tag, &tag.Tag)
+	}
+	return nil
+}
+
+// A tagRow is a tag along with the ID of the post that it belongs to.
+type tagRow struct {
+	Tag
+	objectId string
+}
+
+// tagMapping maps the columns of the Tags table to the fields of a
+// tagRow.
+var tagMapping = db.NewMapping(map[string]func(tag *tagRow) interface{}{
+	"objectId": func(tag *tagRow) interface{} { return &tag.objectId },
+	"type":     func(tag *tagRow) interface{} { return &tag.Type },
+	"href":     func(tag *tagRow) interface{} { return db.URLScanner{&tag.Href} },
+	"name":     func(tag *tagRow) interface{} { return &tag.Name },
+})
+
+// saveTags replaces the stored tags of a post with its current tags.
+func (post *Post) saveTags(ctx context.Context) error {
+	if err := deleteTags(ctx, post.ID().String()); err != nil {
+		return err
+	}
+	for _, tag := range post.Tag {
+		_, err := db.Exec(ctx,
+			"insert into Tags (objectId, type, href, name) values (?, ?, ?, ?)",
+			post.ID().String(), tag.Type, tag.Href.String(), tag.Name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteTags(ctx context.Context, objectId string) error {
+	_, err := db.Exec(ctx, "delete from Tags where objectId = ?", objectId)
+	return err
+}
+
+// HasHashtag reports whether a post is tagged with a hashtag, ignoring
+// case as hashtagCondition does.
+func (post *Post) HasHashtag(name string) bool {
+	for _, tag := range post.Tag {
+		if tag.Type == HashtagType && strings.EqualFold(tag.Name, "#"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashtagCondition returns a condition restricting a query on the
+// Posts table with the alias post to posts tagged with a hashtag. Posts
+// from silenced domains are left out, as they are from other public
+// timelines.
+func hashtagCondition(ctx context.Context, name string, viewer *Actor) (string, []interface{}, error) {
+	conn, err := db.DB(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	silenced, args := notSilenced("post.authorId", viewer)
+	d := conn.Dialect
+	return "exists (select 1 from Tags t where t.objectId = post.id and t.type = ? and " +
+			d.CaseInsensitive("t.name") + " = " + d.CaseInsensitive("?") + ") and " + silenced,
+		append([]interface{}{HashtagType, "#" + name}, args...), nil
+}
+
+// PostsByHashtag retrieves a page of the posts tagged with a hashtag
+// that the viewer may see. The viewer is nil for clients that aren't
+// logged-in.
+func PostsByHashtag(ctx context.Context, name string, viewer *Actor, page Page) ([]*Post, error) {
+	where, args, err := hashtagCondition(ctx, name, viewer)
+	if err != nil {
+		return nil, err
+	}
+	return postsPage(ctx, where, args, viewer, page)
+}
+
+// InHashtagTimeline reports whether an entry's post belongs in the
+// posts tagged with a hashtag as the viewer sees them, as selected by
+// PostsByHashtag. It is used to decide which new posts to stream.
+func InHashtagTimeline(ctx context.Context, name string, viewer *Actor, entry *TimelineEntry) (bool, error) {
+	post := entry.Post
+	if !post.HasHashtag(name) {
+		return false, nil
+	}
+	if entry.deleted {
+		return deletedVisible(ctx, viewer, entry)
+	}
+	where, args, err := hashtagCondition(ctx, name, viewer)
+	if err != nil {
+		return false, err
+	}
+	return inPosts(ctx, where, args, viewer, post)
+}
+
+// CountPostsByHashtag counts the posts tagged with a hashtag that the
+// viewer may see.
+func CountPostsByHashtag(ctx context.Context, name string, viewer *Actor) (int, error) {
+	where, args, err := hashtagCondition(ctx, name, viewer)
+	if err != nil {
+		return 0, err
+	}
+	where, args = postsConditions(where, args, viewer)
+	var count int
+	err = db.QueryRow(ctx,
+		"select count(*) from Posts post join Actors act on post.authorId = act.id where "+where,
+		args...,
+	).Scan(&count)
+	return count, err
+}
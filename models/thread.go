@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// MaxThreadDepth limits how far up or down a thread is followed, so
+// that very long threads and cycles of replies can't cause unbounded
+// work.
+const MaxThreadDepth = 50
+
+// Ancestors retrieves the stored posts that a post is a reply to,
+// starting from the beginning of the thread. The thread stops at the
+// first ancestor that isn't stored or that the viewer may not see.
+func Ancestors(ctx context.Context, post *Post, viewer *Actor) ([]*Post, error) {
+	var ancestors []*Post
+	seen := map[string]bool{post.ID().String(): true}
+	for parentId := post.InReplyTo; parentId != nil && len(ancestors) < MaxThreadDepth; {
+		if seen[parentId.String()] {
+			break
+		}
+		seen[parentId.String()] = true
+		parent, err := PostById(ctx, parentId.String())
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if visible, err := CanView(ctx, viewer, parent); err != nil {
+			return nil, err
+		} else if !visible {
+			break
+		}
+		ancestors = append(ancestors, parent)
+		parentId = parent.InReplyTo
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+	return ancestors, nil
+}
+
+// Descendants retrieves the replies to a post that the viewer may see,
+// along with the replies to those replies, and so on. The posts are
+// ordered as a depth-first walk of the thread, with the replies to
+// each post ordered from oldest to newest.
+func Descendants(ctx context.Context, post *Post, viewer *Actor) ([]*Post, error) {
+	visible, args := visibleTo(viewer)
+	replies, err := db.All(ctx, postMapping,
+		"with recursive thread (id, depth, path) as ("+
+			"select id, 1, published || id from Posts where inReplyTo = ? "+
+			"union all "+
+			"select p.id, t.depth + 1, t.path || '/' || p.published || p.id "+
+			"from Posts p join thread t on p.inReplyTo = t.id where t.depth < ?) "+
+			"select "+postColumns+" join thread t on t.id = post.id where "+visible+" order by t.path",
+		append([]interface{}{post.ID().String(), MaxThreadDepth}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var posts []*Post
+	seen := make(map[string]bool)
+	for _, reply := range replies {
+		// A post can be reached more than once if replies form a
+		// cycle.
+		if id := reply.ID().String(); !seen[id] {
+			seen[id] = true
+			posts = append(posts, reply)
+		}
+	}
+	return posts, loadPostsExternal(ctx, posts)
+}
+
+// RepliesPage retrieves a page of the direct replies to a post that
+// the viewer may see.
+func RepliesPage(ctx context.Context, post *Post, viewer *Actor, page Page) ([]*Post, error) {
+	return postsPage(ctx, "post.inReplyTo = ?", []interface{}{post.ID().String()}, viewer, page)
+}
+
+// CountReplies counts the direct replies to a post that the viewer may
+// see.
+func CountReplies(ctx context.Context, post *Post, viewer *Actor) (int, error) {
+	visible, args := visibleTo(viewer)
+	var count int
+	err := db.QueryRow(ctx,
+		"select count(*) from Posts post join Actors act on post.authorId = act.id where post.inReplyTo = ? and "+visible,
+		append([]interface{}{post.ID().String()}, args...)...,
+	).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,309 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/streaming"
+)
+
+// A TimelineEntry is a post as it appears in a list of posts: either
+// on its own, or boosted by an actor.
+type TimelineEntry struct {
+	Post *Post
+	// BoostedBy is the actor whose boost put the post in the list,
+	// or nil if the post is there on its own.
+	BoostedBy *Actor
+	// BoostID is the ID of the Announce activity of a boost.
+	BoostID *url.URL
+	// Published is when the post was published or boosted.
+	Published string
+	// deleted is true if the post or boost has been deleted, so that
+	// whether it was in a timeline has to be decided from the entry
+	// rather than from the database.
+	deleted bool
+}
+
+// ID returns the ID by which the entry is identified in the cursors of
+// a Page: the ID of the boost, or of the post if it isn't boosted.
+func (entry *TimelineEntry) ID() *url.URL {
+	if entry.BoostID != nil {
+		return entry.BoostID
+	}
+	return entry.Post.ID()
+}
+
+// HomeTimeline retrieves a page of an actor's home timeline: the posts
+// written or boosted by the actor and the actors they follow that the
+// actor may see.
+func HomeTimeline(ctx context.Context, actor *Actor, page Page) ([]*TimelineEntry, error) {
+	return timelinePage(ctx, homeTimeline(actor), actor, page)
+}
+
+// LocalTimeline retrieves a page of the public posts written by the
+// accounts on this server. Unlisted posts are not included.
+func LocalTimeline(ctx context.Context, viewer *Actor, page Page) ([]*TimelineEntry, error) {
+	return timelinePage(ctx, localTimeline, viewer, page)
+}
+
+// FederatedTimeline retrieves a page of the public posts known to the
+// server, from this server and others. Unlisted posts are not
+// included, nor are posts from silenced domains by actors the viewer
+// doesn't follow.
+func FederatedTimeline(ctx context.Context, viewer *Actor, page Page) ([]*TimelineEntry, error) {
+	return timelinePage(ctx, federatedTimeline(viewer), viewer, page)
+}
+
+// ProfileTimeline retrieves a page of the posts shown on an actor's
+// profile: the posts they wrote and the posts they boosted that the
+// viewer may see. The viewer is nil for clients that aren't logged-in.
+func ProfileTimeline(ctx context.Context, actor *Actor, viewer *Actor, page Page) ([]*TimelineEntry, error) {
+	id := actor.ID().String()
+	return timelinePage(ctx, timeline{"p.authorId = ?", []interface{}{id}, "r.actorId = ?", []interface{}{id}}, viewer, page)
+}
+
+// InHomeTimeline reports whether an entry belongs in an actor's home
+// timeline, as selected by HomeTimeline. It is used to decide which
+// new entries to stream.
+func InHomeTimeline(ctx context.Context, actor *Actor, entry *TimelineEntry) (bool, error) {
+	if entry.deleted {
+		sharer := entry.Post.Author
+		if entry.BoostedBy != nil {
+			sharer = entry.BoostedBy
+		}
+		if sharer.ID().String() != actor.ID().String() {
+			if following, err := IsFollowing(ctx, actor, sharer); err != nil || !following {
+				return false, err
+			}
+		}
+		return deletedVisible(ctx, actor, entry)
+	}
+	return inTimeline(ctx, homeTimeline(actor), actor, entry)
+}
+
+// InLocalTimeline reports whether an entry belongs in the local
+// timeline as the viewer sees it, as InHomeTimeline does for home
+// timelines.
+func InLocalTimeline(ctx context.Context, viewer *Actor, entry *TimelineEntry) (bool, error) {
+	if entry.deleted {
+		if !config.Get(ctx).IsLocal(entry.Post.Author.ID()) {
+			return false, nil
+		}
+		return InFederatedTimeline(ctx, viewer, entry)
+	}
+	return inTimeline(ctx, localTimeline, viewer, entry)
+}
+
+// InFederatedTimeline reports whether an entry belongs in the
+// federated timeline as the viewer sees it, as InHomeTimeline does for
+// home timelines.
+func InFederatedTimeline(ctx context.Context, viewer *Actor, entry *TimelineEntry) (bool, error) {
+	if entry.deleted {
+		if entry.BoostedBy != nil || entry.Post.Visibility() != VisibilityPublic {
+			return false, nil
+		}
+		return deletedVisible(ctx, viewer, entry)
+	}
+	return inTimeline(ctx, federatedTimeline(viewer), viewer, entry)
+}
+
+// deletedVisible reports whether the viewer could see an entry before
+// it was deleted, as timelineConditions decide for the entries that
+// are stored: whether they may see its post, and whether they block or
+// mute its author or booster or are blocked by its author. The viewer
+// is nil for clients that aren't logged-in.
+func deletedVisible(ctx context.Context, viewer *Actor, entry *TimelineEntry) (bool, error) {
+	if ok, err := CanView(ctx, viewer, entry.Post); err != nil || !ok || viewer == nil {
+		return ok, err
+	}
+	sharers := []*Actor{entry.Post.Author}
+	if entry.BoostedBy != nil {
+		sharers = append(sharers, entry.BoostedBy)
+	}
+	for _, sharer := range sharers {
+		if blocking, err := IsBlocking(ctx, viewer, sharer); err != nil || blocking {
+			return false, err
+		}
+		if muting, _, err := IsMuting(ctx, viewer, sharer); err != nil || muting {
+			return false, err
+		}
+	}
+	blocked, err := IsBlocking(ctx, entry.Post.Author, viewer)
+	return !blocked, err
+}
+
+// publishDelete tells the clients streaming timelines that an entry has
+// been deleted.
+func publishDelete(ctx context.Context, entry *TimelineEntry) {
+	entry.deleted = true
+	streaming.Publish(ctx, streaming.Event{Type: streaming.Delete, Object: entry})
+}
+
+// A timeline selects the entries of a timeline: the posts matching
+// postsWhere, a condition on the Posts table aliased p, and the boosts
+// matching boostsWhere, a condition on the Reactions table aliased r.
+// If boostsWhere is empty, the timeline doesn't include boosts.
+type timeline struct {
+	postsWhere  string
+	postsArgs   []interface{}
+	boostsWhere string
+	boostsArgs  []interface{}
+}
+
+func homeTimeline(actor *Actor) timeline {
+	id := actor.ID().String()
+	return timeline{
+		"(p.authorId = ? or p.authorId in (select followeeId from Follows where followerId = ?))",
+		[]interface{}{id, id},
+		"(r.actorId = ? or r.actorId in (select followeeId from Follows where followerId = ?))",
+		[]interface{}{id, id},
+	}
+}
+
+var localTimeline = timeline{
+	postsWhere: "p.authorId in (select actorId from Accounts) and " + publicCondition,
+	postsArgs:  []interface{}{PublicCollection},
+}
+
+func federatedTimeline(viewer *Actor) timeline {
+	silenced, args := notSilenced("p.authorId", viewer)
+	return timeline{
+		postsWhere: publicCondition + " and " + silenced,
+		postsArgs:  append([]interface{}{PublicCollection}, args...),
+	}
+}
+
+// publicCondition selects the posts, aliased p, that are addressed to
+// the public in their to field. Its argument is PublicCollection.
+const publicCondition = "exists (select 1 from Addressing a where a.objectId = p.id and a.field = 'to' and a.targetId = ?)"
+
+// timelineEntryIDs is a table of the IDs and publication times of all
+// posts and reactions, in which the cursors of timeline pages are
+// looked up.
+const timelineEntryIDs = "(select id, published from Posts union all select id, published from Reactions)"
+
+// entries returns a query selecting the IDs and publication times of
+// a timeline's entries, the IDs of the actors who boosted them and the
+// IDs of their posts, along with its arguments.
+func (t timeline) entries() (string, []interface{}) {
+	q := "select p.id, p.published, null as boosterId, p.id as postId from Posts p where " + t.postsWhere
+	args := append([]interface{}{}, t.postsArgs...)
+	if t.boostsWhere != "" {
+		q += " union all select r.id, r.published, r.actorId, r.objectId from Reactions r " +
+			"where r.type = 'Announce' and " + t.boostsWhere
+		args = append(args, t.boostsArgs...)
+	}
+	return q, args
+}
+
+// timelineConditions returns the conditions restricting a query for
+// the entries of a timeline, aliased e and joined with their posts, to
+// those that the viewer may see.
+func timelineConditions(viewer *Actor) ([]string, []interface{}) {
+	visible, args := visibleTo(viewer)
+	hidden, hiddenArgs := notHidden(viewer, "e.boosterId")
+	return []string{visible, hidden}, append(args, hiddenArgs...)
+}
+
+// A timelineRow is a row of a page of a timeline: an entry, along with
+// the IDs of the entry and of the actor who boosted its post, if any.
+type timelineRow struct {
+	TimelineEntry
+	id, boosterId *url.URL
+}
+
+// timelineMapping maps the columns of the rows of a page of a timeline:
+// those of the entries, prefixed with entry, and those of their posts,
+// prefixed with post.
+var timelineMapping = db.Nest(db.NewMapping(map[string]func(row *timelineRow) interface{}{
+	"entry.id":        func(row *timelineRow) interface{} { return db.URLScanner{&row.id} },
+	"entry.published": func(row *timelineRow) interface{} { return &row.Published },
+	"entry.boosterId": func(row *timelineRow) interface{} { return db.URLScanner{&row.boosterId} },
+}), "post", func(row *timelineRow) *Post {
+	if row.Post == nil {
+		row.Post = new(Post)
+	}
+	return row.Post
+}, postMapping)
+
+// timelineColumns selects the columns mapped by timelineMapping from a
+// timeline's entries, aliased e, joined with their posts as in
+// postColumns.
+var timelineColumns = `e.id as "entry.id", e.published as "entry.published", e.boosterId as "entry.boosterId", ` +
+	postMapping.Columns("post", "post") + ", " + actorMapping.Columns("act", "post.author") +
+	" from Posts post join Actors act on post.authorId = act.id"
+
+// timelinePage retrieves a page of a timeline, leaving out the posts
+// that the viewer may not see.
+func timelinePage(ctx context.Context, t timeline, viewer *Actor, page Page) ([]*TimelineEntry, error) {
+	entries, args := t.entries()
+	conds, condArgs := timelineConditions(viewer)
+	pageConds, order, pageArgs := page.clauses(timelineEntryIDs, "e")
+	q := fmt.Sprintf("select %s join (%s) e on e.postId = post.id "+
+		"where %s order by e.published %s, e.id %s limit ?",
+		timelineColumns, entries, strings.Join(append(conds, pageConds...), " and "), order, order)
+	args = append(append(append(args, condArgs...), pageArgs...), page.Limit)
+	rows, err := db.All(ctx, timelineMapping, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	var timeline []*TimelineEntry
+	var posts []*Post
+	var boosterIds []*url.URL
+	seen := make(map[string]*Post)
+	for _, row := range rows {
+		entry := &row.TimelineEntry
+		if row.boosterId != nil {
+			entry.BoostID = row.id
+		}
+		// A post can appear both on its own and boosted, and its
+		// external properties are loaded once for both.
+		if post, ok := seen[entry.Post.ID().String()]; ok {
+			entry.Post = post
+		} else {
+			seen[entry.Post.ID().String()] = entry.Post
+			posts = append(posts, entry.Post)
+		}
+		timeline = append(timeline, entry)
+		boosterIds = append(boosterIds, row.boosterId)
+	}
+	if order == "asc" {
+		for i, j := 0, len(timeline)-1; i < j; i, j = i+1, j-1 {
+			timeline[i], timeline[j] = timeline[j], timeline[i]
+			boosterIds[i], boosterIds[j] = boosterIds[j], boosterIds[i]
+		}
+	}
+	boosters := make(map[string]*Actor)
+	for i, id := range boosterIds {
+		if id == nil {
+			continue
+		}
+		booster, ok := boosters[id.String()]
+		if !ok {
+			if booster, err = ActorById(ctx, id.String()); err != nil {
+				return nil, err
+			}
+			boosters[id.String()] = booster
+		}
+		timeline[i].BoostedBy = booster
+	}
+	return timeline, loadPostsExternal(ctx, posts)
+}
+
+// inTimeline reports whether an entry is in a timeline as the viewer
+// sees it.
+func inTimeline(ctx context.Context, t timeline, viewer *Actor, entry *TimelineEntry) (bool, error) {
+	entries, args := t.entries()
+	conds, condArgs := timelineConditions(viewer)
+	var count int
+	err := db.QueryRow(ctx,
+		fmt.Sprintf("select count(*) from Posts post join Actors act on post.authorId = act.id "+
+			"join (%s) e on e.postId = post.id where e.id = ? and %s", entries, strings.Join(conds, " and ")),
+		append(append(args, entry.ID().String()), condArgs...)...,
+	).Scan(&count)
+	return count != 0, err
+}
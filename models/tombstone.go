@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// A Tombstone takes the place of an object that has been deleted.
+type Tombstone struct {
+	id *url.URL
+	// FormerType is the type of the deleted object.
+	FormerType string
+	// Deleted is when the object was deleted.
+	Deleted string
+	// post is the deleted post, if it was deleted by this process,
+	// so that the Delete activity can be addressed to its audience.
+	post *Post
+}
+
+func (t *Tombstone) ID() *url.URL {
+	return t.id
+}
+
+func (t *Tombstone) Types() []string {
+	return []string{"Tombstone"}
+}
+
+func (t *Tombstone) HasType(typ string) bool {
+	return typ == "Tombstone"
+}
+
+func (t *Tombstone) Props() []string {
+	return []string{"formerType", "deleted"}
+}
+
+func (t *Tombstone) GetProp(prop string) (interface{}, bool) {
+	switch prop {
+	case "formerType":
+		return t.FormerType, true
+	case "deleted":
+		return t.Deleted, true
+	default:
+		return nil, false
+	}
+}
+
+func createTombstone(ctx context.Context, post *Post) (*Tombstone, error) {
+	tombstone := &Tombstone{
+		id:         post.ID(),
+		FormerType: post.typ,
+		Deleted:    now(),
+		post:       post,
+	}
+	_, err := db.Exec(ctx,
+		"insert into Tombstones (id, formerType, deleted) values (?, ?, ?)",
+		tombstone.id.String(), tombstone.FormerType, tombstone.Deleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return tombstone, nil
+}
+
+// tombstoneMapping maps the columns of the Tombstones table to the
+// fields of a Tombstone.
+var tombstoneMapping = db.NewMapping(map[string]func(t *Tombstone) interface{}{
+	"id":         func(t *Tombstone) interface{} { return db.URLScanner{&t.id} },
+	"formerType": func(t *Tombstone) interface{} { return &t.FormerType },
+	"deleted":    func(t *Tombstone) interface{} { return &t.Deleted },
+})
+
+// TombstoneById retrieves the Tombstone left in place of a deleted
+// object.
+func TombstoneById(ctx context.Context, id string) (*Tombstone, error) {
+	return db.One(ctx, tombstoneMapping,
+		"select "+tombstoneMapping.Columns("Tombstones", "")+" from Tombstones where id = ?", id)
+}
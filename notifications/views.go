@@ -0,0 +1,109 @@
+// The notifications package serves the page listing a user's
+// notifications.
+package notifications
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the routes for notifications on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{routes.Method{"GET"}, "notifications"}, http.HandlerFunc(showNotifications))
+	router.Route([]interface{}{routes.Method{"POST"}, "notifications", "read"}, http.HandlerFunc(markRead))
+}
+
+// pageSize is the number of notifications in each page.
+const pageSize = 40
+
+var notificationsTemplate = views.HtmlTemplate("notifications/show.html")
+
+type notificationsData struct {
+	// Type is the type of notifications shown, or "" if all of
+	// them are.
+	Type   string
+	Types  []string
+	Groups []*models.NotificationGroup
+	// Last is the ID of the most recent notification shown, which
+	// marking notifications as read marks up to.
+	Last      int64
+	CSRFToken string
+	// Older links to the page of older notifications, if there are
+	// any.
+	Older string
+}
+
+// requireUser returns the logged-in user's actor, redirecting clients
+// that aren't logged-in to the login page.
+func requireUser(w http.ResponseWriter, r *http.Request) *models.Actor {
+	actor := sessions.Get(r.Context()).Actor()
+	if actor == nil {
+		http.Redirect(w, r, "/auth?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+	return actor
+}
+
+func showNotifications(w http.ResponseWriter, r *http.Request) {
+	actor := requireUser(w, r)
+	if actor == nil {
+		return
+	}
+	query := r.URL.Query()
+	d := notificationsData{Types: models.NotificationTypes, CSRFToken: sessions.CSRFToken(r.Context())}
+	var types []string
+	for _, typ := range models.NotificationTypes {
+		if query.Get("type") == typ {
+			d.Type, types = typ, []string{typ}
+		}
+	}
+	notifications, err := models.Notifications(r.Context(), actor, types, models.Page{
+		MaxID: query.Get("max_id"),
+		Limit: pageSize,
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	d.Groups = models.GroupNotifications(notifications)
+	if len(notifications) > 0 {
+		d.Last = notifications[0].ID
+	}
+	if len(notifications) == pageSize {
+		older := url.Values{"max_id": {strconv.FormatInt(notifications[len(notifications)-1].ID, 10)}}
+		if d.Type != "" {
+			older.Set("type", d.Type)
+		}
+		d.Older = "?" + older.Encode()
+	}
+	notificationsTemplate.Render(w, r, d)
+}
+
+func markRead(w http.ResponseWriter, r *http.Request) {
+	actor := requireUser(w, r)
+	if actor == nil {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		panic(routes.Error(err))
+	}
+	if !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid form submission"))
+		return
+	}
+	last, err := strconv.ParseInt(r.PostForm.Get("last"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid form submission"))
+		return
+	}
+	if err = models.MarkNotificationsRead(r.Context(), actor, last); err != nil {
+		panic(routes.Error(err))
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
@@ -10,12 +10,12 @@ import (
 	"github.com/ekiru/kanna/views"
 )
 
-// Home handles requests to the root path and currently doesn't really
-// do anything.
-var Home = views.HtmlTemplate("pages/home.html")
-
 // NotFound is displayed when a request does not match any Route.
-var NotFound = views.HtmlTemplate("pages/not_found.html")
+var NotFound = http.HandlerFunc(notFoundPage)
+
+func notFoundPage(w http.ResponseWriter, r *http.Request) {
+	views.HtmlTemplate("pages/not_found.html").RenderStatus(w, r, http.StatusNotFound, nil)
+}
 
 // Error is displayed when an error occurs while processing a request
 // handler.
@@ -23,5 +23,5 @@ var Error = http.HandlerFunc(errorPage)
 
 func errorPage(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Context().Value(routes.Param("error")))
-	views.HtmlTemplate("pages/error.html").ServeHTTP(w, r)
+	views.HtmlTemplate("pages/error.html").RenderStatus(w, r, http.StatusInternalServerError, nil)
 }
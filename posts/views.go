@@ -1,37 +1,511 @@
 package posts
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/media"
 	"github.com/ekiru/kanna/models"
 	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
 	"github.com/ekiru/kanna/views"
 )
 
 // AddRoutes registers the routes related to posts on the Router.
 func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{routes.Method{"GET"}, "post", "new"}, http.HandlerFunc(composePost))
+	router.Route([]interface{}{routes.Method{"POST"}, "post"}, http.HandlerFunc(createPost))
+	router.Route([]interface{}{routes.Method{"GET"}, "post", routes.Param("post"), "edit"}, http.HandlerFunc(editPost))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "edit"}, http.HandlerFunc(updatePost))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "delete"}, http.HandlerFunc(deletePost))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "like"}, reactionHandler(models.Like))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "unlike"}, reactionHandler(models.Unlike))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "boost"}, reactionHandler(models.Announce))
+	router.Route([]interface{}{routes.Method{"POST"}, "post", routes.Param("post"), "unboost"}, reactionHandler(models.Unannounce))
+	router.Route([]interface{}{"post", routes.Param("post"), "replies"}, http.HandlerFunc(showReplies))
+	router.Route([]interface{}{"post", routes.Param("post"), "likes"}, reactionsCollection(models.CountLikes))
+	router.Route([]interface{}{"post", routes.Param("post"), "shares"}, reactionsCollection(models.CountAnnounces))
 	router.Route([]interface{}{"post", routes.Param("post")}, http.HandlerFunc(showPost))
 }
 
+func postId(r *http.Request) string {
+	postKey := r.Context().Value(routes.Param("post")).(string)
+	return config.Get(r.Context()).URL("post", postKey).String()
+}
+
 func showPost(w http.ResponseWriter, r *http.Request) {
 	type data struct {
-		Post *models.Post
+		Post        *models.Post
+		Ancestors   []*models.Post
+		Descendants []*models.Post
+		CanEdit     bool
+		CanReply    bool
+		Likes       int
+		Shares      int
+		Liked       bool
+		Boosted     bool
+		CSRFToken   string
 	}
-	postKey := r.Context().Value(routes.Param("post")).(string)
-	postId := fmt.Sprintf("https://faew.ink/post/%s", postKey)
+	postId := postId(r)
 	if post, err := models.PostById(r.Context(), postId); err == nil {
+		viewer := sessions.Get(r.Context()).Actor()
+		if visible, err := models.CanView(r.Context(), viewer, post); err != nil {
+			panic(routes.Error(err))
+		} else if !visible {
+			panic(routes.NotFound)
+		}
 		switch r.Header.Get("Accept") {
 		case activitystreams.ContentType:
 			views.ActivityStream(post).ServeHTTP(w, r)
 		default:
-			views.HtmlTemplate("posts/show.html").Render(w, r, data{Post: post})
+			ancestors, err := models.Ancestors(r.Context(), post, viewer)
+			if err != nil {
+				panic(routes.Error(err))
+			}
+			descendants, err := models.Descendants(r.Context(), post, viewer)
+			if err != nil {
+				panic(routes.Error(err))
+			}
+			d := data{
+				Post:        post,
+				Ancestors:   ancestors,
+				Descendants: descendants,
+				CanEdit:     isAuthor(r, post),
+				CanReply:    viewer != nil,
+				CSRFToken:   sessions.CSRFToken(r.Context()),
+			}
+			if d.Likes, err = models.CountLikes(r.Context(), post); err != nil {
+				panic(routes.Error(err))
+			}
+			if d.Shares, err = models.CountAnnounces(r.Context(), post); err != nil {
+				panic(routes.Error(err))
+			}
+			if viewer != nil {
+				if d.Liked, err = models.HasLiked(r.Context(), viewer, post); err != nil {
+					panic(routes.Error(err))
+				}
+				if d.Boosted, err = models.HasAnnounced(r.Context(), viewer, post); err != nil {
+					panic(routes.Error(err))
+				}
+			}
+			views.HtmlTemplate("posts/show.html").Render(w, r, d)
 		}
 	} else if err == sql.ErrNoRows {
-		panic(routes.NotFound)
+		showTombstone(w, r, postId)
 	} else {
 		panic(routes.Error(err))
 	}
 }
+
+// repliesPageSize is the number of replies in each page of a replies
+// collection.
+const repliesPageSize = 20
+
+// showReplies serves the collection of direct replies to a post, paged
+// like an outbox.
+func showReplies(w http.ResponseWriter, r *http.Request) {
+	post := visiblePost(r)
+	viewer := sessions.Get(r.Context()).Actor()
+	query := r.URL.Query()
+	pageURL := func(param, id string) *url.URL {
+		u := *post.Replies
+		q := url.Values{"page": {"true"}}
+		if param != "" {
+			q.Set(param, id)
+		}
+		u.RawQuery = q.Encode()
+		return &u
+	}
+	if query.Get("page") == "" {
+		replies := activitystreams.NewOrderedCollection(post.Replies)
+		count, err := models.CountReplies(r.Context(), post, viewer)
+		if err != nil {
+			panic(routes.Error(err))
+		}
+		replies.TotalItems = count
+		replies.First = pageURL("", "")
+		views.ActivityStream(replies).ServeHTTP(w, r)
+		return
+	}
+	posts, err := models.RepliesPage(r.Context(), post, viewer, models.Page{
+		MaxID: query.Get("max_id"),
+		MinID: query.Get("min_id"),
+		Limit: repliesPageSize,
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	self := *post.Replies
+	self.RawQuery = r.URL.RawQuery
+	page := activitystreams.NewOrderedCollectionPage(&self, post.Replies)
+	page.Items = make([]interface{}, len(posts))
+	for i, reply := range posts {
+		page.Items[i] = reply.ID()
+	}
+	if len(posts) > 0 {
+		page.Prev = pageURL("min_id", posts[0].ID().String())
+		if len(posts) == repliesPageSize {
+			page.Next = pageURL("max_id", posts[len(posts)-1].ID().String())
+		}
+	}
+	views.ActivityStream(page).ServeHTTP(w, r)
+}
+
+// visiblePost retrieves the post in the request path, failing unless
+// the viewer may see it.
+func visiblePost(r *http.Request) *models.Post {
+	post, err := models.PostById(r.Context(), postId(r))
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	if visible, err := models.CanView(r.Context(), sessions.Get(r.Context()).Actor(), post); err != nil {
+		panic(routes.Error(err))
+	} else if !visible {
+		panic(routes.NotFound)
+	}
+	return post
+}
+
+// reactionsCollection serves the collection of likes or shares of a
+// post. Like a followers collection, it only says how many there are.
+func reactionsCollection(count func(context.Context, *models.Post) (int, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		post := visiblePost(r)
+		n, err := count(r.Context(), post)
+		if err != nil {
+			panic(routes.Error(err))
+		}
+		self := *post.ID()
+		self.Path = r.URL.Path
+		collection := activitystreams.NewOrderedCollection(&self)
+		collection.TotalItems = n
+		views.ActivityStream(collection).ServeHTTP(w, r)
+	})
+}
+
+// reactionHandler handles a form that likes or boosts the post in the
+// request path, or undoes that, using the function that does so. The
+// resulting activity is delivered to the other servers involved.
+func reactionHandler(react func(context.Context, *models.Actor, *models.Post) (*models.Activity, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := requireUser(w, r)
+		if user == nil {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			panic(routes.Error(err))
+		}
+		if !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid form submission"))
+			return
+		}
+		post := visiblePost(r)
+		activity, err := react(r.Context(), user.Actor, post)
+		if err == models.ErrCannotAnnounce {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
+			panic(routes.Error(err))
+		}
+		federation.Deliver(r.Context(), activity)
+		http.Redirect(w, r, post.ID().Path, http.StatusSeeOther)
+	})
+}
+
+// showTombstone responds with 410 Gone if the post has been deleted
+// and 404 Not Found if it never existed.
+func showTombstone(w http.ResponseWriter, r *http.Request, postId string) {
+	tombstone, err := models.TombstoneById(r.Context(), postId)
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	switch r.Header.Get("Accept") {
+	case activitystreams.ContentType:
+		views.ActivityStreamStatus(tombstone, http.StatusGone).ServeHTTP(w, r)
+	default:
+		goneTemplate.RenderStatus(w, r, http.StatusGone, tombstone)
+	}
+}
+
+var (
+	composeTemplate = views.HtmlTemplate("posts/compose.html")
+	goneTemplate    = views.HtmlTemplate("posts/gone.html")
+)
+
+type composeData struct {
+	Action    string
+	Content   string
+	Error     string
+	CSRFToken string
+	// InReplyTo is the post that a new post replies to, if any.
+	InReplyTo *models.Post
+	// Visibilities lists the visibility levels to choose from
+	// when composing a new post. It is nil when editing a post,
+	// since the audience of a post can't be changed.
+	Visibilities []models.Visibility
+	// AttachmentSlots numbers the fields for uploading attachments
+	// to a new post. It is nil when editing a post.
+	AttachmentSlots []int
+	// ContentWarning is the content warning of the post.
+	ContentWarning models.ContentWarning
+}
+
+// attachmentSlots numbers the attachment fields of the compose form.
+var attachmentSlots = func() []int {
+	slots := make([]int, models.MaxAttachments)
+	for i := range slots {
+		slots[i] = i + 1
+	}
+	return slots
+}()
+
+// multipartMemory is how much of a form with attachments is kept in
+// memory while it is parsed. The rest is stored in temporary files.
+const multipartMemory = 1 << 20
+
+// requireUser returns the logged-in user, redirecting to the login
+// form and returning nil if there isn't one.
+func requireUser(w http.ResponseWriter, r *http.Request) *models.Account {
+	user := sessions.Get(r.Context()).User
+	if user == nil {
+		http.Redirect(w, r, "/auth?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+	return user
+}
+
+// parsePostForm parses a form submitted to create or edit a post and
+// returns the Markdown source of the post and its content warning,
+// which are also filled in in the form data d. If the form is invalid,
+// it re-displays the form with an error and returns false.
+func parsePostForm(w http.ResponseWriter, r *http.Request, d *composeData) (models.Source, models.ContentWarning, bool) {
+	if err := r.ParseForm(); err != nil {
+		panic(routes.Error(err))
+	}
+	if !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid form submission"))
+		return models.Source{}, models.ContentWarning{}, false
+	}
+	d.Content = r.PostForm.Get("content")
+	d.ContentWarning = models.ContentWarning{
+		Summary:   r.PostForm.Get("summary"),
+		Sensitive: r.PostForm.Get("sensitive") != "",
+	}
+	if strings.TrimSpace(d.Content) == "" {
+		composeError(w, r, *d, "Posts can't be empty.")
+		return models.Source{}, models.ContentWarning{}, false
+	}
+	return models.Source{Content: d.Content, MediaType: markup.Markdown}, d.ContentWarning, true
+}
+
+// composeError re-displays the compose form with an error.
+func composeError(w http.ResponseWriter, r *http.Request, d composeData, message string) {
+	d.Error = message
+	d.CSRFToken = sessions.CSRFToken(r.Context())
+	if d.Visibilities != nil {
+		d.AttachmentSlots = attachmentSlots
+	}
+	composeTemplate.RenderStatus(w, r, http.StatusUnprocessableEntity, d)
+}
+
+// uploadAttachments stores the files uploaded with the compose form
+// as attachments, with the descriptions entered for them.
+func uploadAttachments(r *http.Request, owner *models.Actor) ([]*models.Attachment, error) {
+	var attachments []*models.Attachment
+	if r.MultipartForm == nil {
+		// The form was sent without any files.
+		return nil, nil
+	}
+	for _, slot := range attachmentSlots {
+		file, _, err := r.FormFile(fmt.Sprintf("attachment%d", slot))
+		if err == http.ErrMissingFile {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		description := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("description%d", slot)))
+		a, err := media.Upload(r.Context(), owner, file, description)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// replyParam retrieves the post named by the in_reply_to parameter, if
+// any, failing unless the user may see it.
+func replyParam(r *http.Request, values url.Values) *models.Post {
+	id := values.Get("in_reply_to")
+	if id == "" {
+		return nil
+	}
+	post, err := models.PostById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	if visible, err := models.CanView(r.Context(), sessions.Get(r.Context()).Actor(), post); err != nil {
+		panic(routes.Error(err))
+	} else if !visible {
+		panic(routes.NotFound)
+	}
+	return post
+}
+
+func composePost(w http.ResponseWriter, r *http.Request) {
+	if requireUser(w, r) == nil {
+		return
+	}
+	composeTemplate.Render(w, r, composeData{
+		Action:          "/post",
+		CSRFToken:       sessions.CSRFToken(r.Context()),
+		Visibilities:    models.Visibilities,
+		InReplyTo:       replyParam(r, r.URL.Query()),
+		AttachmentSlots: attachmentSlots,
+	})
+}
+
+func createPost(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	maxSize := int64(models.MaxAttachments)*config.Get(r.Context()).Media.MaxUploadSize + multipartMemory
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	if err := r.ParseMultipartForm(multipartMemory); err == http.ErrNotMultipart {
+		if err = r.ParseForm(); err != nil {
+			panic(routes.Error(err))
+		}
+	} else if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("the attachments are too large"))
+			return
+		}
+		panic(routes.Error(err))
+	}
+	d := composeData{Action: "/post", Visibilities: models.Visibilities, InReplyTo: replyParam(r, r.PostForm)}
+	source, cw, ok := parsePostForm(w, r, &d)
+	if !ok {
+		return
+	}
+	visibility, ok := models.ParseVisibility(r.PostForm.Get("visibility"))
+	if !ok {
+		visibility = models.VisibilityPublic
+	}
+	attachments, err := uploadAttachments(r, user.Actor)
+	switch err {
+	case nil:
+	case media.ErrUnsupported:
+		composeError(w, r, d, "Attachments must be JPEG, PNG or GIF images.")
+		return
+	case media.ErrTooLarge:
+		composeError(w, r, d, "An attachment is too large.")
+		return
+	default:
+		panic(routes.Error(err))
+	}
+	post, activity, err := models.CreatePost(r.Context(), user.Actor, source, cw, visibility,
+		federation.ResolveMentions(r.Context(), source), d.InReplyTo, attachments)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	federation.Deliver(r.Context(), activity)
+	http.Redirect(w, r, post.ID().Path, http.StatusSeeOther)
+}
+
+func isAuthor(r *http.Request, post *models.Post) bool {
+	user := sessions.Get(r.Context()).User
+	return user != nil && user.Actor.ID().String() == post.Author.ID().String()
+}
+
+// ownPost retrieves the post in the request path, failing unless the
+// logged-in user wrote it.
+func ownPost(w http.ResponseWriter, r *http.Request) *models.Post {
+	if requireUser(w, r) == nil {
+		return nil
+	}
+	post, err := models.PostById(r.Context(), postId(r))
+	if err == sql.ErrNoRows {
+		panic(routes.NotFound)
+	} else if err != nil {
+		panic(routes.Error(err))
+	}
+	if !isAuthor(r, post) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("you can only change your own posts"))
+		return nil
+	}
+	return post
+}
+
+func editPost(w http.ResponseWriter, r *http.Request) {
+	post := ownPost(w, r)
+	if post == nil {
+		return
+	}
+	composeTemplate.Render(w, r, composeData{
+		Action:         post.ID().Path + "/edit",
+		Content:        post.SourceText(),
+		CSRFToken:      sessions.CSRFToken(r.Context()),
+		ContentWarning: post.ContentWarning(),
+	})
+}
+
+func updatePost(w http.ResponseWriter, r *http.Request) {
+	post := ownPost(w, r)
+	if post == nil {
+		return
+	}
+	source, cw, ok := parsePostForm(w, r, &composeData{Action: post.ID().Path + "/edit"})
+	if !ok {
+		return
+	}
+	activity, err := models.UpdatePost(r.Context(), post, source, cw, federation.ResolveMentions(r.Context(), source))
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	federation.Deliver(r.Context(), activity)
+	http.Redirect(w, r, post.ID().Path, http.StatusSeeOther)
+}
+
+func deletePost(w http.ResponseWriter, r *http.Request) {
+	post := ownPost(w, r)
+	if post == nil {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		panic(routes.Error(err))
+	}
+	if !sessions.CheckCSRF(r.Context(), r.PostForm.Get("csrf")) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid form submission"))
+		return
+	}
+	activity, err := models.DeletePost(r.Context(), post)
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	federation.Deliver(r.Context(), activity)
+	media.DeleteFiles(r.Context(), post.Attachment)
+	http.Redirect(w, r, post.Author.ID().Path, http.StatusSeeOther)
+}
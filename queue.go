@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/models"
+)
+
+// queueInspect lists the deliveries that haven't succeeded, both those
+// that the server is still attempting and those it has given up on.
+func queueInspect(e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	deliveries, err := models.Deliveries(e.ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(e.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tATTEMPTS\tQUEUED\tINBOX\tACTIVITY\tLAST ERROR")
+	for _, d := range deliveries {
+		state := "pending"
+		if d.Failed {
+			state = "failed"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\n", d.ID, state, d.Attempts, d.Created, d.Inbox, d.ActivityID, d.LastError)
+	}
+	return w.Flush()
+}
+
+// queueRetry makes one more attempt at the deliveries with the IDs
+// given, or at all of the deliveries that have been given up on.
+func queueRetry(e *env, args []string) error {
+	var deliveries []*models.Delivery
+	if len(args) == 0 {
+		var err error
+		if deliveries, err = models.FailedDeliveries(e.ctx); err != nil {
+			return err
+		}
+	}
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		delivery, err := models.DeliveryById(e.ctx, id)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("there is no delivery %d waiting", id)
+		} else if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	failed := 0
+	for _, d := range deliveries {
+		if err := federation.Retry(e.ctx, d); err != nil {
+			fmt.Fprintf(e.out, "%d: %v\n", d.ID, err)
+			failed++
+		} else {
+			fmt.Fprintf(e.out, "%d: delivered\n", d.ID)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d deliveries failed again", failed, len(deliveries))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ekiru/kanna/db"
+)
+
+// schemaDump prints the statements that would create the tables,
+// indexes and triggers of the database as they are now.
+func schemaDump(e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	statements, err := db.Schema(e.db)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		fmt.Fprintf(e.out, "%s;\n\n", stmt)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// The search package serves the page for searching posts and actors,
+// which also finds actors and posts by their URLs and handles.
+package search
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the route for the search page on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{"search"}, http.HandlerFunc(showSearch))
+}
+
+// pageSize is the number of posts in each page of search results.
+const pageSize = 20
+
+// actorsLimit is the number of actors shown in the search results.
+const actorsLimit = 10
+
+// handleQuery matches queries for an actor's handle, with or without
+// the leading @.
+var handleQuery = regexp.MustCompile(`^@?[A-Za-z0-9_.-]+@[A-Za-z0-9.-]+(:[0-9]+)?$`)
+
+// hashtagQuery matches queries for a hashtag, capturing its name.
+var hashtagQuery = regexp.MustCompile(`^#([\pL\pN_]*[\pL_][\pL\pN_]*)$`)
+
+var searchTemplate = views.HtmlTemplate("search/show.html")
+
+// showSearch shows the results of a search. A query that is a URL or a
+// handle finds the actor or post it names, a query for a hashtag lists
+// the posts tagged with it, and any other query is parsed by
+// models.ParseSearchQuery and searched for in the posts and actors
+// known to this server.
+func showSearch(w http.ResponseWriter, r *http.Request) {
+	type data struct {
+		Query   string
+		Hashtag string
+		Actors  []*models.Actor
+		Posts   []*models.Post
+		Older   string
+	}
+	ctx := r.Context()
+	params := r.URL.Query()
+	session := sessions.Get(ctx)
+	viewer := session.Actor()
+	d := data{Query: strings.TrimSpace(params.Get("q"))}
+	page := models.Page{MaxID: params.Get("max_id"), Limit: pageSize}
+	var err error
+	if u, ok := parseURL(d.Query); ok || handleQuery.MatchString(d.Query) {
+		actor, post, err := resolve(ctx, d.Query, u, session.User != nil)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			// Failing to fetch something from another server
+			// just means that there are no results.
+			log.Printf("resolving %s: %v", d.Query, err)
+		case post != nil:
+			visible, err := models.CanView(ctx, viewer, post)
+			if err != nil {
+				panic(routes.Error(err))
+			}
+			if visible {
+				d.Posts = []*models.Post{post}
+			}
+		default:
+			d.Actors = []*models.Actor{actor}
+		}
+	} else if m := hashtagQuery.FindStringSubmatch(d.Query); m != nil {
+		d.Hashtag = strings.ToLower(m[1])
+		d.Posts, err = models.PostsByHashtag(ctx, d.Hashtag, viewer, page)
+	} else if q := models.ParseSearchQuery(d.Query); !q.IsEmpty() {
+		if page.MaxID == "" {
+			if d.Actors, err = models.SearchActors(ctx, q, actorsLimit); err != nil {
+				panic(routes.Error(err))
+			}
+		}
+		d.Posts, err = models.SearchPosts(ctx, q, viewer, page)
+	}
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	if len(d.Posts) == pageSize {
+		d.Older = "?" + url.Values{"q": {d.Query}, "max_id": {d.Posts[len(d.Posts)-1].ID().String()}}.Encode()
+	}
+	searchTemplate.Render(w, r, d)
+}
+
+// parseURL parses a query that is an http or https URL.
+func parseURL(query string) (*url.URL, bool) {
+	if !strings.HasPrefix(query, "https://") && !strings.HasPrefix(query, "http://") {
+		return nil, false
+	}
+	u, err := url.Parse(query)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// resolve finds the actor or post with a URL, or the actor with a
+// handle if u is nil. Actors and posts that aren't already known are
+// only fetched from other servers if remote is true, which it is only
+// for logged-in users, so that visitors can't make the server send
+// requests on their behalf. If nothing is found, resolve returns
+// sql.ErrNoRows.
+func resolve(ctx context.Context, query string, u *url.URL, remote bool) (*models.Actor, *models.Post, error) {
+	if u != nil {
+		if remote {
+			return federation.ResolveURL(ctx, u)
+		}
+		if actor, err := models.ActorById(ctx, u.String()); err != sql.ErrNoRows {
+			return actor, nil, err
+		}
+		post, err := models.PostById(ctx, u.String())
+		return nil, post, err
+	}
+	handle := strings.TrimPrefix(query, "@")
+	if remote {
+		actor, err := federation.Lookup(ctx, handle)
+		return actor, nil, err
+	}
+	i := strings.IndexByte(handle, '@')
+	user, host := handle[:i], handle[i+1:]
+	if host == config.Get(ctx).Host() {
+		account, err := models.AccountByUsername(ctx, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		return account.Actor, nil, nil
+	}
+	actor, err := models.ActorByHandle(ctx, user, host)
+	return actor, nil, err
+}
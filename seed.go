@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ekiru/kanna/seeds"
+)
+
+// seedLoad loads a set of seeds into the database, creating whatever
+// of it hasn't already been created.
+func seedLoad(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	set, err := seeds.Read(args[0])
+	if err != nil {
+		return err
+	}
+	created, err := seeds.Load(e.ctx, set)
+	fmt.Fprintf(e.out, "Created %d objects from the %s seeds\n", created, set.Name)
+	return err
+}
@@ -0,0 +1,259 @@
+// The seeds package loads sets of example accounts, follows and posts
+// into a database, such as for developing Kanna, testing it by hand or
+// demonstrating it. Unlike migrations, seeds are only loaded into the
+// databases that ask for them.
+//
+// A set of seeds is a JSON file, such as the dev, test and demo sets in
+// this directory, which are built into the binary. The accounts and
+// posts are created on the server that they are loaded into, so their
+// IDs are built from its base URL, and the content of each post is a
+// text/template executed with the server's configuration, so that it
+// can refer to {{.BaseURL}} or {{.Instance.Title}}. Loading a set again
+// only creates what hasn't been created yet.
+package seeds
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/markup"
+	"github.com/ekiru/kanna/models"
+)
+
+// A Set is a set of seeds.
+type Set struct {
+	// Name distinguishes the posts of the set from those of other
+	// sets. It is the name of the file without its extension.
+	Name     string    `json:"-"`
+	Accounts []Account `json:"accounts"`
+	Follows  []Follow  `json:"follows"`
+	Posts    []Post    `json:"posts"`
+}
+
+// An Account is created unless an account with its username exists.
+// Its role is user if it isn't given.
+type Account struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// A Follow makes the actor of one account follow that of another, by
+// their usernames.
+type Follow struct {
+	Follower string `json:"follower"`
+	Followee string `json:"followee"`
+}
+
+// A Post is written in Markdown by the account with the username
+// Author. Its key names it within the set, so that it is only created
+// once and so that replies can refer to it in InReplyTo. Its
+// visibility is public if it isn't given.
+type Post struct {
+	Key            string `json:"key"`
+	Author         string `json:"author"`
+	Content        string `json:"content"`
+	ContentWarning string `json:"contentWarning"`
+	Visibility     string `json:"visibility"`
+	InReplyTo      string `json:"inReplyTo"`
+}
+
+// builtin are the sets in this directory.
+//
+//go:embed *.json
+var builtin embed.FS
+
+// Read reads a set of seeds, which is either the name of one of the
+// sets built into the binary, such as dev, or the path of a .json
+// file.
+func Read(name string) (*Set, error) {
+	var f io.ReadCloser
+	var err error
+	if strings.HasSuffix(name, ".json") {
+		f, err = os.Open(name)
+	} else if f, err = builtin.Open(name + ".json"); err != nil {
+		return nil, fmt.Errorf("no set of seeds named %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	set := &Set{Name: strings.TrimSuffix(filepath.Base(name), ".json")}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(set); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return set, nil
+}
+
+// Load creates the accounts, follows and posts of a set that haven't
+// been created yet, returning how many it created.
+func Load(ctx context.Context, set *Set) (created int, err error) {
+	for _, seed := range set.Accounts {
+		ok, err := loadAccount(ctx, seed)
+		if err != nil {
+			return created, fmt.Errorf("account %s: %v", seed.Username, err)
+		} else if ok {
+			created++
+		}
+	}
+	for _, seed := range set.Follows {
+		ok, err := loadFollow(ctx, seed)
+		if err != nil {
+			return created, fmt.Errorf("follow of %s by %s: %v", seed.Followee, seed.Follower, err)
+		} else if ok {
+			created++
+		}
+	}
+	for i, seed := range set.Posts {
+		if seed.Key == "" {
+			return created, fmt.Errorf("post %d has no key", i+1)
+		}
+		ok, err := loadPost(ctx, set.Name, seed)
+		if err != nil {
+			return created, fmt.Errorf("post %s: %v", seed.Key, err)
+		} else if ok {
+			created++
+		}
+	}
+	return created, nil
+}
+
+func loadAccount(ctx context.Context, seed Account) (bool, error) {
+	if _, err := models.ManagedAccount(ctx, seed.Username); err == nil {
+		return false, nil
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+	role := seed.Role
+	if role == "" {
+		role = models.UserRole
+	}
+	_, err := models.CreateAccount(ctx, seed.Username, seed.Password, role)
+	return err == nil, err
+}
+
+func loadFollow(ctx context.Context, seed Follow) (bool, error) {
+	follower, err := account(ctx, seed.Follower)
+	if err != nil {
+		return false, err
+	}
+	followee, err := account(ctx, seed.Followee)
+	if err != nil {
+		return false, err
+	}
+	if following, err := models.IsFollowing(ctx, follower.Actor, followee.Actor); err != nil || following {
+		return false, err
+	}
+	_, err = models.Follow(ctx, follower.Actor, followee.Actor)
+	return true, err
+}
+
+func loadPost(ctx context.Context, setName string, seed Post) (bool, error) {
+	name := setName + "/" + seed.Key
+	if _, err := models.SeededObject(ctx, name); err == nil {
+		return false, nil
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+	author, err := account(ctx, seed.Author)
+	if err != nil {
+		return false, err
+	}
+	content, err := expand(ctx, seed.Content)
+	if err != nil {
+		return false, err
+	}
+	visibility := models.VisibilityPublic
+	if seed.Visibility != "" {
+		var ok bool
+		if visibility, ok = models.ParseVisibility(seed.Visibility); !ok {
+			return false, fmt.Errorf("invalid visibility %q", seed.Visibility)
+		}
+	}
+	var parent *models.Post
+	if seed.InReplyTo != "" {
+		id, err := models.SeededObject(ctx, setName+"/"+seed.InReplyTo)
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("the post %s that it replies to must come before it", seed.InReplyTo)
+		} else if err != nil {
+			return false, err
+		}
+		if parent, err = models.PostById(ctx, id.String()); err != nil {
+			return false, err
+		}
+	}
+	source := models.Source{Content: content, MediaType: markup.Markdown}
+	cw := models.ContentWarning{Summary: seed.ContentWarning, Sensitive: seed.ContentWarning != ""}
+	mentions, err := localMentions(ctx, source)
+	if err != nil {
+		return false, err
+	}
+	// The post is recorded as seeded along with creating it, so that
+	// loading the set again can't create it twice.
+	err = db.WithTx(ctx, func(ctx context.Context) error {
+		post, _, err := models.CreatePost(ctx, author.Actor, source, cw, visibility, mentions, parent, nil)
+		if err != nil {
+			return err
+		}
+		return models.RecordSeed(ctx, name, post.ID())
+	})
+	return err == nil, err
+}
+
+// account retrieves the account that a seed refers to by its username.
+func account(ctx context.Context, username string) (*models.Account, error) {
+	account, err := models.AccountByUsername(ctx, username)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no account named %s", username)
+	}
+	return account, err
+}
+
+// expand executes the content of a post as a template with the
+// configuration.
+func expand(ctx context.Context, content string) (string, error) {
+	tmpl, err := template.New("content").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err = tmpl.Execute(&b, config.Get(ctx)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// localMentions resolves the mentions in the source of a post, which
+// must all be of accounts on this server, so that loading seeds never
+// contacts other servers.
+func localMentions(ctx context.Context, source models.Source) (map[string]*models.Actor, error) {
+	mentions := make(map[string]*models.Actor)
+	handles, _ := markup.Tags(source.MediaType, source.Content)
+	for _, handle := range handles {
+		username := handle
+		if i := strings.IndexByte(handle, '@'); i >= 0 {
+			if handle[i+1:] != config.Get(ctx).Host() {
+				return nil, fmt.Errorf("@%s isn't on this server", handle)
+			}
+			username = handle[:i]
+		}
+		account, err := account(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		mentions[handle] = account.Actor
+	}
+	return mentions, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ekiru/kanna/accounts"
+	"github.com/ekiru/kanna/activities"
+	"github.com/ekiru/kanna/actors"
+	"github.com/ekiru/kanna/admin"
+	"github.com/ekiru/kanna/api"
+	"github.com/ekiru/kanna/config"
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/federation"
+	"github.com/ekiru/kanna/media"
+	"github.com/ekiru/kanna/middleware"
+	"github.com/ekiru/kanna/notifications"
+	"github.com/ekiru/kanna/pages"
+	"github.com/ekiru/kanna/posts"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/search"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/streaming"
+	"github.com/ekiru/kanna/tags"
+	"github.com/ekiru/kanna/timelines"
+	"github.com/ekiru/kanna/views"
+)
+
+// shutdownTimeout is how long the server waits for requests to finish
+// when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the server until it is interrupted, first resuming the
+// deliveries that were unfinished when it last stopped. It refuses to
+// start unless all of the migrations have been applied, which it does
+// itself if the -migrate flag is given.
+func serve(e *env, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	migrate := flags.Bool("migrate", false, "apply the migrations that haven't been applied")
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if err := checkSchema(e, *migrate); err != nil {
+		return err
+	}
+	views.LoadTemplates()
+	hub := streaming.NewHub()
+	handler, err := buildRoutes(e.cfg, e.db, hub)
+	if err != nil {
+		return err
+	}
+	if err = federation.ResumeDeliveries(e.ctx); err != nil {
+		return err
+	}
+	server := &http.Server{Addr: e.cfg.Listen, Handler: handler}
+	// Streaming connections stay open until the hub is closed, so
+	// it is closed first when shutting down.
+	server.RegisterOnShutdown(hub.Close)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err = server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+func buildRoutes(cfg *config.Config, conn *db.Database, hub *streaming.Hub) (http.Handler, error) {
+	var router routes.Router
+
+	config.InitParams(&router, cfg)
+	db.InitParams(&router, conn)
+	streaming.InitParams(&router, hub)
+	router.Middleware(sessions.Middleware())
+	router.Middleware(middleware.ContentTypeOverride())
+
+	if err := media.InitParams(&router, cfg); err != nil {
+		return nil, err
+	}
+
+	router.Route([]interface{}{}, timelines.Home)
+
+	accounts.AddRoutes(&router)
+	admin.AddRoutes(&router)
+	actors.AddRoutes(&router)
+	activities.AddRoutes(&router)
+	notifications.AddRoutes(&router)
+	posts.AddRoutes(&router)
+	search.AddRoutes(&router)
+	tags.AddRoutes(&router)
+	timelines.AddRoutes(&router)
+	federation.AddRoutes(&router)
+	media.AddRoutes(&router)
+	api.AddRoutes(&router)
+
+	router.NotFound(pages.NotFound)
+	router.Error(pages.Error)
+
+	return &router, nil
+}
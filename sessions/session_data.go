@@ -49,3 +49,12 @@ func (s *Session) Save() {
 		sd.username = ""
 	}
 }
+
+// Actor returns the main Actor of the logged-in user, or nil if the
+// client is not logged-in.
+func (s *Session) Actor() *models.Actor {
+	if s.User == nil {
+		return nil
+	}
+	return s.User.Actor
+}
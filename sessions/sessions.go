@@ -4,14 +4,20 @@ package sessions
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"net/http"
+	"sync"
 
 	"github.com/ekiru/kanna/routes"
 )
 
 type sessionMiddleware struct {
+	// mu guards sessions, which are shared by the requests being
+	// served concurrently.
+	mu       *sync.Mutex
 	sessions map[string]*sessionData
 }
 
@@ -19,6 +25,7 @@ type sessionMiddleware struct {
 // session ID and stores a Session in the request context.
 func Middleware() routes.Middleware {
 	return sessionMiddleware{
+		mu:       new(sync.Mutex),
 		sessions: make(map[string]*sessionData),
 	}
 }
@@ -35,6 +42,7 @@ type sessionIdContextKey struct{}
 func (mw sessionMiddleware) HandleMiddleware(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
 	var sessionId string
 	var session *sessionData
+	mw.mu.Lock()
 	if cookie, err := r.Cookie(cookieName); err == nil {
 		sessionId = cookie.Value
 		var ok bool
@@ -44,6 +52,7 @@ func (mw sessionMiddleware) HandleMiddleware(w http.ResponseWriter, r *http.Requ
 	} else {
 		sessionId, session = mw.createSession(w)
 	}
+	mw.mu.Unlock()
 	ctx := r.Context()
 	ctx = context.WithValue(ctx, mwContextKey{}, mw)
 	ctx = context.WithValue(ctx, sessionContextKey{}, session.load(ctx))
@@ -78,7 +87,22 @@ func newSessionId() string {
 func Close(ctx context.Context) {
 	mw := ctx.Value(mwContextKey{}).(sessionMiddleware)
 	id := ctx.Value(sessionIdContextKey{}).(string)
+	mw.mu.Lock()
 	delete(mw.sessions, id)
+	mw.mu.Unlock()
+}
+
+// CloseUser invalidates all of the Sessions in which a user is
+// logged-in, logging them out everywhere.
+func CloseUser(ctx context.Context, username string) {
+	mw := ctx.Value(mwContextKey{}).(sessionMiddleware)
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	for id, session := range mw.sessions {
+		if session.username == username {
+			delete(mw.sessions, id)
+		}
+	}
 }
 
 // Get retrieves the Session from the request context.
@@ -86,3 +110,18 @@ func Get(ctx context.Context) *Session {
 	// TODO maybe check this
 	return ctx.Value(sessionContextKey{}).(*Session)
 }
+
+// CSRFToken returns a token tied to the current session that forms
+// can include to show that they were submitted from one of Kanna's own
+// pages.
+func CSRFToken(ctx context.Context) string {
+	id := ctx.Value(sessionIdContextKey{}).(string)
+	sum := sha256.Sum256([]byte("csrf:" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckCSRF reports whether a token submitted with a form matches the
+// current session's CSRF token.
+func CheckCSRF(ctx context.Context, token string) bool {
+	return hmac.Equal([]byte(token), []byte(CSRFToken(ctx)))
+}
@@ -0,0 +1,153 @@
+// The streaming package provides an in-process hub through which the
+// code handling posts, deliveries and notifications publishes events
+// to the clients that are streaming them.
+package streaming
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ekiru/kanna/db"
+	"github.com/ekiru/kanna/routes"
+)
+
+// The types of Events, named as in Mastodon's streaming API.
+const (
+	// Update events are published for new posts and boosts. Their
+	// Object is a *models.TimelineEntry.
+	Update = "update"
+	// StatusUpdate events are published for edited posts. Their
+	// Object is a *models.TimelineEntry.
+	StatusUpdate = "status.update"
+	// Delete events are published for deleted posts and undone
+	// boosts. Their Object is the *models.TimelineEntry that was
+	// deleted.
+	Delete = "delete"
+	// Notification events are published for new notifications.
+	// Their Object is a *models.Notification.
+	Notification = "notification"
+)
+
+// An Event is something that happened which clients may want to be
+// told about. Subscribers decide which events each client may see.
+type Event struct {
+	Type   string
+	Object interface{}
+}
+
+// bufferSize is how many events each subscription can fall behind by
+// before it is closed.
+const bufferSize = 64
+
+// A Hub passes the events published to it on to its subscribers.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]bool
+	closed bool
+}
+
+// NewHub creates a Hub with no subscribers.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]bool)}
+}
+
+// A Subscription receives the events published to a Hub. Events are
+// buffered, and a subscription that falls too far behind is closed
+// rather than holding up the code publishing events, so that one slow
+// client can't slow down everyone else.
+type Subscription struct {
+	hub *Hub
+	// C receives the events published after the subscription was
+	// made. It is closed when the subscription is.
+	C  <-chan Event
+	ch chan Event
+	// Overflowed is true if the subscription was closed because it
+	// fell too far behind. It may only be read once C is closed.
+	Overflowed bool
+}
+
+// Subscribe creates a subscription to the events published to the hub.
+// If the hub has been closed, so is the subscription.
+func (hub *Hub) Subscribe() *Subscription {
+	ch := make(chan Event, bufferSize)
+	sub := &Subscription{hub: hub, C: ch, ch: ch}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		close(ch)
+	} else {
+		hub.subs[sub] = true
+	}
+	return sub
+}
+
+// Close stops a subscription. Closing a subscription more than once
+// does nothing.
+func (sub *Subscription) Close() {
+	sub.hub.mu.Lock()
+	defer sub.hub.mu.Unlock()
+	if sub.hub.subs[sub] {
+		delete(sub.hub.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish passes an event on to the hub's subscribers without waiting
+// for them to receive it. Subscriptions whose buffers are full are
+// closed.
+func (hub *Hub) Publish(event Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for sub := range hub.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			sub.Overflowed = true
+			delete(hub.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Close closes the hub's subscriptions, so that the clients streaming
+// events are disconnected when the server shuts down. Later
+// subscriptions are closed immediately.
+func (hub *Hub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for sub := range hub.subs {
+		delete(hub.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// InitParams configures a Router to pass a hub to request handlers via
+// the context.
+func InitParams(router *routes.Router, hub *Hub) {
+	router.BaseParam(hubKey{}, hub)
+}
+
+// WithHub returns a copy of the context carrying a hub, for use outside
+// of request handlers.
+func WithHub(ctx context.Context, hub *Hub) context.Context {
+	return context.WithValue(ctx, hubKey{}, hub)
+}
+
+type hubKey struct{}
+
+// Get retrieves the hub from the context, or returns nil if there
+// isn't one, as when running commands outside of the server.
+func Get(ctx context.Context) *Hub {
+	hub, _ := ctx.Value(hubKey{}).(*Hub)
+	return hub
+}
+
+// Publish publishes an event to the hub in the context, if there is
+// one, once the transaction that the context carries, if any, is
+// committed.
+func Publish(ctx context.Context, event Event) {
+	if hub := Get(ctx); hub != nil {
+		db.AfterCommit(ctx, func() { hub.Publish(event) })
+	}
+}
@@ -0,0 +1,90 @@
+// The tags package serves the pages listing the posts tagged with each
+// hashtag.
+package tags
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ekiru/kanna/activitystreams"
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the routes related to hashtags on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{"tags", routes.Param("tag")}, http.HandlerFunc(showTag))
+}
+
+// pageSize is the number of posts in each page of a hashtag's posts.
+const pageSize = 20
+
+var showTagTemplate = views.HtmlTemplate("tags/show.html")
+
+// showTag lists the posts tagged with a hashtag, either as an HTML page
+// or as an OrderedCollection paged like an outbox.
+func showTag(w http.ResponseWriter, r *http.Request) {
+	type data struct {
+		Name  string
+		Posts []*models.Post
+		Older string
+	}
+	name := strings.ToLower(r.Context().Value(routes.Param("tag")).(string))
+	viewer := sessions.Get(r.Context()).Actor()
+	id := models.HashtagURL(r.Context(), name)
+	query := r.URL.Query()
+	pageURL := func(param, postId string) *url.URL {
+		u := *id
+		q := url.Values{"page": {"true"}}
+		if param != "" {
+			q.Set(param, postId)
+		}
+		u.RawQuery = q.Encode()
+		return &u
+	}
+	asRequest := r.Header.Get("Accept") == activitystreams.ContentType
+	if asRequest && query.Get("page") == "" {
+		collection := activitystreams.NewOrderedCollection(id)
+		count, err := models.CountPostsByHashtag(r.Context(), name, viewer)
+		if err != nil {
+			panic(routes.Error(err))
+		}
+		collection.TotalItems = count
+		collection.First = pageURL("", "")
+		views.ActivityStream(collection).ServeHTTP(w, r)
+		return
+	}
+	posts, err := models.PostsByHashtag(r.Context(), name, viewer, models.Page{
+		MaxID: query.Get("max_id"),
+		MinID: query.Get("min_id"),
+		Limit: pageSize,
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	if !asRequest {
+		d := data{Name: name, Posts: posts}
+		if len(posts) == pageSize {
+			d.Older = "?" + url.Values{"max_id": {posts[len(posts)-1].ID().String()}}.Encode()
+		}
+		showTagTemplate.Render(w, r, d)
+		return
+	}
+	self := *id
+	self.RawQuery = r.URL.RawQuery
+	page := activitystreams.NewOrderedCollectionPage(&self, id)
+	page.Items = make([]interface{}, len(posts))
+	for i, post := range posts {
+		page.Items[i] = post
+	}
+	if len(posts) > 0 {
+		page.Prev = pageURL("min_id", posts[0].ID().String())
+		if len(posts) == pageSize {
+			page.Next = pageURL("max_id", posts[len(posts)-1].ID().String())
+		}
+	}
+	views.ActivityStream(page).ServeHTTP(w, r)
+}
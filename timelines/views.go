@@ -0,0 +1,97 @@
+// The timelines package serves the pages listing the posts on the
+// home, local and federated timelines.
+package timelines
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/routes"
+	"github.com/ekiru/kanna/sessions"
+	"github.com/ekiru/kanna/views"
+)
+
+// AddRoutes registers the routes for the timelines on the Router.
+func AddRoutes(router *routes.Router) {
+	router.Route([]interface{}{"timelines", "home"}, http.HandlerFunc(homeTimeline))
+	router.Route([]interface{}{"timelines", "local"}, timelineHandler("Local timeline", models.LocalTimeline))
+	router.Route([]interface{}{"timelines", "federated"}, timelineHandler("Federated timeline", models.FederatedTimeline))
+}
+
+// Home shows the home timeline to logged-in users and the local
+// timeline to everyone else.
+var Home = http.HandlerFunc(home)
+
+func home(w http.ResponseWriter, r *http.Request) {
+	if sessions.Get(r.Context()).User != nil {
+		homeTimeline(w, r)
+	} else {
+		timelineHandler("Local timeline", models.LocalTimeline).ServeHTTP(w, r)
+	}
+}
+
+// pageSize is the number of posts in each page of a timeline.
+const pageSize = 20
+
+var timelineTemplate = views.HtmlTemplate("timelines/show.html")
+
+type timelineData struct {
+	Title    string
+	Entries  []*models.TimelineEntry
+	LoggedIn bool
+	// Older and Newer link to the neighbouring pages of the
+	// timeline, if there are any.
+	Older, Newer string
+}
+
+func homeTimeline(w http.ResponseWriter, r *http.Request) {
+	user := sessions.Get(r.Context()).User
+	if user == nil {
+		http.Redirect(w, r, "/auth?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	renderTimeline(w, r, "Home", func(ctx context.Context, viewer *models.Actor, page models.Page) ([]*models.TimelineEntry, error) {
+		return models.HomeTimeline(ctx, viewer, page)
+	})
+}
+
+// timelineHandler serves a timeline that anyone may see.
+func timelineHandler(title string, timeline func(context.Context, *models.Actor, models.Page) ([]*models.TimelineEntry, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderTimeline(w, r, title, timeline)
+	})
+}
+
+func renderTimeline(w http.ResponseWriter, r *http.Request, title string, timeline func(context.Context, *models.Actor, models.Page) ([]*models.TimelineEntry, error)) {
+	query := r.URL.Query()
+	session := sessions.Get(r.Context())
+	entries, err := timeline(r.Context(), session.Actor(), models.Page{
+		MaxID: query.Get("max_id"),
+		MinID: query.Get("min_id"),
+		Limit: pageSize,
+	})
+	if err != nil {
+		panic(routes.Error(err))
+	}
+	d := timelineData{Title: title, Entries: entries, LoggedIn: session.User != nil}
+	d.Older, d.Newer = PageLinks(entries, pageSize, query.Get("max_id") != "" || query.Get("min_id") != "")
+	timelineTemplate.Render(w, r, d)
+}
+
+// PageLinks builds the query strings linking to the pages of older and
+// newer entries around a page of a timeline. There is only a link to
+// newer entries if the page isn't the first.
+func PageLinks(entries []*models.TimelineEntry, pageSize int, paged bool) (older, newer string) {
+	if len(entries) == 0 {
+		return "", ""
+	}
+	if len(entries) == pageSize {
+		older = "?" + url.Values{"max_id": {entries[len(entries)-1].ID().String()}}.Encode()
+	}
+	if paged {
+		newer = "?" + url.Values{"min_id": {entries[0].ID().String()}}.Encode()
+	}
+	return older, newer
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"github.com/ekiru/kanna/models"
+)
+
+// userCreate creates an account with a password read from the standard
+// input. The -role flag gives the account a role other than user, such
+// as to create the server's first administrator.
+func userCreate(e *env, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	role := flags.String("role", models.UserRole, "the role of the account")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	password, err := readPassword(e)
+	if err != nil {
+		return err
+	}
+	account, err := models.CreateAccount(e.ctx, flags.Arg(0), password, *role)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "Created %s with the actor %s\n", account.Username, account.Actor.ID())
+	return nil
+}
+
+// userPasswd changes the password of an account to one read from the
+// standard input.
+func userPasswd(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	account, err := findAccount(e, args[0])
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(e)
+	if err != nil {
+		return err
+	}
+	return models.SetPassword(e.ctx, account, password)
+}
+
+// userDelete deletes an account.
+func userDelete(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	account, err := findAccount(e, args[0])
+	if err != nil {
+		return err
+	}
+	return models.DeleteAccount(e.ctx, account)
+}
+
+// userPromote changes the role of an account, to admin unless another
+// role is given.
+func userPromote(e *env, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	role := models.AdminRole
+	if len(args) == 2 {
+		role = args[1]
+	}
+	account, err := findAccount(e, args[0])
+	if err != nil {
+		return err
+	}
+	return models.SetRole(e.ctx, account, role)
+}
+
+// findAccount retrieves an account by its username, including it even
+// if it is suspended.
+func findAccount(e *env, username string) (*models.Account, error) {
+	account, err := models.ManagedAccount(e.ctx, username)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no account named %s", username)
+	}
+	return account, err
+}
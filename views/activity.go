@@ -7,13 +7,20 @@ import (
 )
 
 type activityStreamsView struct {
-	obj activitystreams.Object
+	obj    activitystreams.Object
+	status int
 }
 
 // ActivityStream creates a handler that serializes an object as an
 // Activity Stream and serves it.
 func ActivityStream(obj activitystreams.Object) http.Handler {
-	return activityStreamsView{obj}
+	return activityStreamsView{obj, http.StatusOK}
+}
+
+// ActivityStreamStatus is like ActivityStream but responds with the
+// supplied HTTP status code.
+func ActivityStreamStatus(obj activitystreams.Object, status int) http.Handler {
+	return activityStreamsView{obj, status}
 }
 
 func (view activityStreamsView) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -22,5 +29,6 @@ func (view activityStreamsView) ServeHTTP(w http.ResponseWriter, r *http.Request
 		panic(err)
 	}
 	w.Header().Set("Content-Type", activitystreams.ContentType)
+	w.WriteHeader(view.status)
 	w.Write(buf)
 }
@@ -15,11 +15,12 @@ func Html(doc string) http.Handler {
 	}
 }
 
-func sendHtml(w http.ResponseWriter, buf []byte) {
+func sendHtml(w http.ResponseWriter, status int, buf []byte) {
 	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
 	w.Write(buf)
 }
 
 func (view *htmlView) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sendHtml(w, []byte(view.content))
+	sendHtml(w, http.StatusOK, []byte(view.content))
 }
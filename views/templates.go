@@ -7,11 +7,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/ekiru/kanna/models"
+	"github.com/ekiru/kanna/sessions"
 )
 
 var templates map[string]*template.Template
 
-func init() {
+// LoadTemplates reads the templates from the templates directory. It
+// must be called before any template is rendered, and panics if the
+// templates can't be read.
+func LoadTemplates() {
 	templates = make(map[string]*template.Template)
 	var partials []string
 	views := map[string]string{}
@@ -66,11 +72,41 @@ type HtmlTemplate string
 // Render renders the template to the response writer, passing the
 // supplied data to the template.
 func (template HtmlTemplate) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
+	template.RenderStatus(w, r, http.StatusOK, data)
+}
+
+// layoutData is passed to the layout, which passes the Page on to the
+// template's title and content.
+type layoutData struct {
+	Page interface{}
+	// LoggedIn is true if the client is logged-in, in which case
+	// the layout links to their notifications.
+	LoggedIn bool
+	// UnreadNotifications is the number of the user's unread
+	// notifications.
+	UnreadNotifications int
+	// Moderator is true if the user is a moderator, in which case
+	// the layout links to the administration pages.
+	Moderator bool
+}
+
+// RenderStatus is like Render but responds with the supplied HTTP
+// status code.
+func (template HtmlTemplate) RenderStatus(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	layout := layoutData{Page: data}
+	if user := sessions.Get(r.Context()).User; user != nil {
+		actor := user.Actor
+		layout.LoggedIn = true
+		layout.Moderator = user.HasRole(models.ModeratorRole)
+		// The count is only a hint, so the page is still shown
+		// if it can't be retrieved.
+		layout.UnreadNotifications, _ = models.CountUnreadNotifications(r.Context(), actor)
+	}
 	var output bytes.Buffer
-	if err := templates[string(template)].ExecuteTemplate(&output, "layout.html", data); err != nil {
+	if err := templates[string(template)].ExecuteTemplate(&output, "layout.html", layout); err != nil {
 		panic(err)
 	}
-	sendHtml(w, output.Bytes())
+	sendHtml(w, status, output.Bytes())
 }
 
 // ServeHTTP on an HtmlTemplate calls Render with nil data.